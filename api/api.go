@@ -1,60 +1,181 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"ss-agent/config"
+	"ss-agent/utils/logging"
+	"ss-agent/utils/metrics"
+	"time"
 )
 
+var logger = logging.For("api")
+
 func RegisterAgent() error {
-	log.Println("Registering agent...")
+	logger.Info("Registering agent")
 	// Implement registration logic
 	return nil
 }
 
 func UnregisterAgent() error {
-	log.Println("Unregistering agent...")
+	logger.Info("Unregistering agent")
 	// Implement unregistration logic
 	return nil
 }
 
+// Ping sends a heartbeat to the SIEM server. The body carries the sections of
+// all registered heartbeat sources.
 func Ping(client *http.Client) error {
+	return PingContext(context.Background(), client)
+}
+
+// PingContext sends a heartbeat like Ping, giving up when ctx is done.
+func PingContext(ctx context.Context, client *http.Client) error {
+	return sendHeartbeat(ctx, client, "online")
+}
+
+// PingOffline sends a final heartbeat telling the server the agent is going
+// offline on purpose, so it is not reported as lost. It carries whatever the
+// heartbeat sources still have queued.
+func PingOffline(ctx context.Context, client *http.Client) error {
+	return sendHeartbeat(ctx, client, "offline")
+}
+
+var (
+	heartbeatsTotal = metrics.NewCounter("ss_agent_heartbeats_total",
+		"Heartbeats sent to the SIEM server, by result.", "result")
+	heartbeatDuration = metrics.NewHistogram("ss_agent_heartbeat_duration_seconds",
+		"Time taken to send a heartbeat to the SIEM server.", nil)
+)
+
+// legacyRetry is how long the agent sends bare GET pings to a server that
+// refused a heartbeat payload before it offers one again
+const legacyRetry = time.Hour
+
+var (
+	// legacyServer is set while the server answers the heartbeat POST with
+	// 405. Servers from before heartbeat payloads only know a GET without
+	// body. Guarded by sendMu.
+	legacyServer  bool
+	legacyChecked time.Time
+)
+
+func sendHeartbeat(ctx context.Context, client *http.Client, status string) (err error) {
+	sendMu.Lock()
+	defer sendMu.Unlock()
+
+	start := time.Now()
+	defer func() {
+		heartbeatDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			heartbeatsTotal.Inc("failure")
+		} else {
+			heartbeatsTotal.Inc("success")
+		}
+	}()
+
 	conf := config.GetConfig()
 	if conf.APIUrl == "" {
 		return fmt.Errorf("APIUrl is not set in the configuration")
 	}
 
 	url := fmt.Sprintf("%s/agents/ping", conf.APIUrl)
-	log.Printf("ping %s", url)
+	if legacyServer && time.Since(legacyChecked) < legacyRetry {
+		return legacyPing(ctx, client, url, conf, status)
+	}
+	logger.Debug("Sending heartbeat", "url", url, "status", status)
 
-	req, err := http.NewRequest("GET", url, nil)
+	sections, sources := collectHeartbeat()
+	sections["sent_at"] = time.Now().UTC()
+	sections["status"] = status
+	payload, err := json.Marshal(sections)
+	if err != nil {
+		return fmt.Errorf("failed to encode heartbeat: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
 	if err != nil {
 		return fmt.Errorf("failed to create request: %v", err)
 	}
 
 	setHeaders(req, conf)
+	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("ping failed: %v", err)
 		return fmt.Errorf("request failed: %v", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("ping failed: %v", err)
 		return fmt.Errorf("failed to read response body: %v", err)
 	}
 
-	log.Printf("pong: %s", body)
+	// Only 405 marks a server from before heartbeat payloads; a 404 is more
+	// likely a wrong api_url and is reported like any other failure
+	if resp.StatusCode == http.StatusMethodNotAllowed {
+		if !legacyServer {
+			logger.Warn("Server does not accept heartbeat payloads, sending bare pings without service state",
+				"status", resp.Status)
+		}
+		legacyServer, legacyChecked = true, time.Now()
+		return legacyPing(ctx, client, url, conf, status)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("server returned %s: %s", resp.Status, body)
+	}
+	if legacyServer {
+		logger.Info("Server accepts heartbeat payloads again")
+		legacyServer = false
+	}
+
+	for _, src := range sources {
+		src.HeartbeatDelivered()
+	}
+
+	logger.Debug("Heartbeat accepted", "response", string(body))
+	return nil
+}
+
+// legacyPing sends the bare GET ping of servers that do not take a heartbeat
+// payload. The sections are kept for when the server does. Such servers have
+// no notion of going offline, so the final heartbeat is not sent.
+func legacyPing(ctx context.Context, client *http.Client, url string, conf config.Config, status string) error {
+	if status == "offline" {
+		logger.Debug("Server takes no heartbeat payload, not announcing going offline")
+		return nil
+	}
+	logger.Debug("Sending ping", "url", url)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	setHeaders(req, conf)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response body: %v", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("server returned %s: %s", resp.Status, body)
+	}
+	logger.Debug("Ping accepted", "response", string(body))
 	return nil
 }
 
 func Status() {
-	log.Println("Agent status: Registered")
+	logger.Info("Agent status: Registered")
 	// Implement status logic
 }
 
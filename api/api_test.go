@@ -0,0 +1,198 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"ss-agent/config"
+)
+
+// fakeServer records the heartbeats it receives. With legacy set it behaves
+// like a server from before heartbeat payloads and only accepts GET.
+type fakeServer struct {
+	legacy bool
+
+	mu       sync.Mutex
+	requests []string // method and status of the body, if any
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/agents/ping" || r.Header.Get("X-API-ACCESS-KEY") != "access" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	var body struct {
+		Status string `json:"status"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+	f.mu.Lock()
+	f.requests = append(f.requests, r.Method+" "+body.Status)
+	f.mu.Unlock()
+	if f.legacy && r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Write([]byte("pong"))
+}
+
+func (f *fakeServer) received() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	requests := f.requests
+	f.requests = nil
+	return requests
+}
+
+// deliveries counts the heartbeats its section was delivered in
+type deliveries struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (d *deliveries) HeartbeatSection() interface{} { return "section" }
+
+func (d *deliveries) HeartbeatDelivered() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.n++
+}
+
+func (d *deliveries) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.n
+}
+
+// useAPI serves the API with handler and loads a configuration pointing at it
+func useAPI(t *testing.T, handler http.Handler) {
+	t.Helper()
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	conf, _ := json.Marshal(map[string]string{
+		"api_url":          ts.URL + "/api",
+		"organization_key": "org",
+		"api_access_key":   "access",
+		"api_secret_key":   "secret",
+	})
+	if err := os.WriteFile(path, conf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.LoadConfigFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// useServer points the configuration at a fake server and registers a
+// heartbeat source
+func useServer(t *testing.T, legacy bool) (*fakeServer, *deliveries) {
+	t.Helper()
+	server := &fakeServer{legacy: legacy}
+	useAPI(t, server)
+
+	src := &deliveries{}
+	RegisterHeartbeatSource("test", src)
+	t.Cleanup(func() {
+		UnregisterHeartbeatSource("test")
+		legacyServer, legacyChecked = false, time.Time{}
+	})
+	return server, src
+}
+
+func TestPing(t *testing.T) {
+	server, src := useServer(t, false)
+	if err := Ping(http.DefaultClient); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if err := PingOffline(context.Background(), http.DefaultClient); err != nil {
+		t.Fatalf("PingOffline: %v", err)
+	}
+	if got := server.received(); len(got) != 2 || got[0] != "POST online" || got[1] != "POST offline" {
+		t.Errorf("server received %q, want an online and an offline POST", got)
+	}
+	if src.count() != 2 {
+		t.Errorf("section delivered %d times, want 2", src.count())
+	}
+}
+
+func TestPingLegacyServer(t *testing.T) {
+	server, src := useServer(t, true)
+	if err := Ping(http.DefaultClient); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	if got := server.received(); len(got) != 2 || got[0] != "POST online" || got[1] != "GET " {
+		t.Errorf("server received %q, want a POST refused and a GET", got)
+	}
+
+	// The server is remembered, until it is time to offer the payload again
+	if err := Ping(http.DefaultClient); err != nil {
+		t.Fatalf("second Ping: %v", err)
+	}
+	if err := PingOffline(context.Background(), http.DefaultClient); err != nil {
+		t.Fatalf("PingOffline: %v", err)
+	}
+	if got := server.received(); len(got) != 1 || got[0] != "GET " {
+		t.Errorf("server received %q, want only a GET", got)
+	}
+	if src.count() != 0 {
+		t.Errorf("section delivered %d times to a server that takes no payload", src.count())
+	}
+
+	server.legacy = false
+	legacyChecked = time.Now().Add(-legacyRetry)
+	if err := Ping(http.DefaultClient); err != nil {
+		t.Fatalf("Ping after the server was upgraded: %v", err)
+	}
+	if got := server.received(); len(got) != 1 || got[0] != "POST online" || src.count() != 1 {
+		t.Errorf("server received %q and section delivered %d times, want one POST delivered", got, src.count())
+	}
+}
+
+func TestPingRejected(t *testing.T) {
+	useServer(t, false)
+	conf := config.GetConfig()
+	conf.APIAccessKey = "wrong"
+	data, _ := json.Marshal(conf)
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.LoadConfigFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := Ping(http.DefaultClient); err == nil {
+		t.Error("Ping with wrong credentials succeeded")
+	}
+}
+
+func TestPingNotFound(t *testing.T) {
+	var mu sync.Mutex
+	var methods []string
+	useAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		methods = append(methods, r.Method)
+		mu.Unlock()
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(func() { legacyServer, legacyChecked = false, time.Time{} })
+
+	// A 404 is more likely a wrong api_url than a server without payloads
+	err := Ping(http.DefaultClient)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Ping = %v, want the 404", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(methods) != 1 || methods[0] != "POST" {
+		t.Errorf("server received %q, want only the POST", methods)
+	}
+}
@@ -0,0 +1,39 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"ss-agent/config"
+)
+
+// ReportCrash sends a crash report, as written by the crash package, to the
+// SIEM server
+func ReportCrash(ctx context.Context, client *http.Client, report []byte) error {
+	conf := config.GetConfig()
+	if conf.APIUrl == "" {
+		return fmt.Errorf("APIUrl is not set in the configuration")
+	}
+
+	url := fmt.Sprintf("%s/agents/crashes", conf.APIUrl)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(report))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	setHeaders(req, conf)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("server returned %s: %s", resp.Status, body)
+	}
+	return nil
+}
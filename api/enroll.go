@@ -0,0 +1,68 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// Enrollment holds the credentials the server issues in exchange for an
+// enrollment token.
+type Enrollment struct {
+	OrganizationKey string `json:"organization_key"`
+	APIAccessKey    string `json:"api_access_key"`
+	APISecretKey    string `json:"api_secret_key"`
+}
+
+// Enroll exchanges a one-time enrollment token for the agent credentials. It
+// does not use the configuration, since it runs before the agent has one.
+func Enroll(client *http.Client, apiURL, token string) (Enrollment, error) {
+	var enrollment Enrollment
+	if apiURL == "" {
+		return enrollment, fmt.Errorf("api_url is required to enroll")
+	}
+
+	hostname, _ := os.Hostname()
+	payload, err := json.Marshal(map[string]string{
+		"hostname": hostname,
+		"os":       runtime.GOOS,
+		"arch":     runtime.GOARCH,
+	})
+	if err != nil {
+		return enrollment, fmt.Errorf("failed to encode enrollment request: %v", err)
+	}
+
+	url := fmt.Sprintf("%s/agents/enroll", strings.TrimRight(apiURL, "/"))
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return enrollment, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return enrollment, fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return enrollment, fmt.Errorf("failed to read response body: %v", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return enrollment, fmt.Errorf("server returned %s: %s", resp.Status, body)
+	}
+	if err := json.Unmarshal(body, &enrollment); err != nil {
+		return enrollment, fmt.Errorf("invalid enrollment response: %v", err)
+	}
+	if enrollment.OrganizationKey == "" || enrollment.APIAccessKey == "" || enrollment.APISecretKey == "" {
+		return enrollment, fmt.Errorf("enrollment response is missing credentials")
+	}
+	return enrollment, nil
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"sort"
+	"sync"
+)
+
+// HeartbeatSource contributes a named section to every heartbeat sent by Ping.
+type HeartbeatSource interface {
+	// HeartbeatSection returns the payload for the next heartbeat. It must be
+	// safe to marshal as JSON.
+	HeartbeatSection() interface{}
+	// HeartbeatDelivered is called once the server accepted a heartbeat that
+	// contained the section last returned by HeartbeatSection.
+	HeartbeatDelivered()
+}
+
+var (
+	heartbeatMu      sync.Mutex
+	heartbeatSources = make(map[string]HeartbeatSource)
+
+	// sendMu serializes heartbeats, so a section is never collected for one
+	// heartbeat while the delivery of another is being acknowledged
+	sendMu sync.Mutex
+)
+
+// RegisterHeartbeatSource adds a section to the heartbeat under the given name,
+// replacing any source previously registered under it.
+func RegisterHeartbeatSource(name string, src HeartbeatSource) {
+	heartbeatMu.Lock()
+	defer heartbeatMu.Unlock()
+	heartbeatSources[name] = src
+}
+
+// UnregisterHeartbeatSource removes the named section from the heartbeat.
+func UnregisterHeartbeatSource(name string) {
+	heartbeatMu.Lock()
+	defer heartbeatMu.Unlock()
+	delete(heartbeatSources, name)
+}
+
+// collectHeartbeat gathers the sections of all registered sources and returns
+// the sources so they can be acknowledged after delivery.
+func collectHeartbeat() (map[string]interface{}, []HeartbeatSource) {
+	heartbeatMu.Lock()
+	names := make([]string, 0, len(heartbeatSources))
+	for name := range heartbeatSources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sources := make([]HeartbeatSource, 0, len(names))
+	for _, name := range names {
+		sources = append(sources, heartbeatSources[name])
+	}
+	heartbeatMu.Unlock()
+
+	sections := make(map[string]interface{}, len(names))
+	for i, src := range sources {
+		sections[names[i]] = src.HeartbeatSection()
+	}
+	return sections, sources
+}
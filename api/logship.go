@@ -0,0 +1,235 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"ss-agent/config"
+	"ss-agent/utils/guard"
+	"ss-agent/utils/logging"
+	"ss-agent/utils/metrics"
+)
+
+var (
+	logEventsShipped = metrics.NewCounter("ss_agent_log_events_shipped_total",
+		"Agent log events delivered to the SIEM server.")
+	logEventsDropped = metrics.NewCounter("ss_agent_log_events_dropped_total",
+		"Agent log events not shipped, by reason.", "reason")
+)
+
+// LogShipper forwards the agent's own warnings and errors to the SIEM server
+// in batches. Events over the rate limit, or that do not fit the queue while
+// the server is unreachable, are dropped and reported as counts with the next
+// batch. While the agent sheds load only errors are queued.
+type LogShipper struct {
+	client        *http.Client
+	batchSize     int
+	flushInterval time.Duration
+	rate          float64 // events per second
+	burst         float64
+
+	mu         sync.Mutex
+	queue      []logging.Entry
+	maxQueue   int
+	tokens     float64
+	lastRefill time.Time
+	suppressed int // over the rate limit since the last delivered batch
+	dropped    int // did not fit the queue or were shed since the last delivered batch
+	evicted    int // ever removed from the front of the queue to make room
+	shedding   guard.Level
+}
+
+// logBatch is the body of POST /agents/logs
+type logBatch struct {
+	SentAt     time.Time       `json:"sent_at"`
+	Events     []logging.Entry `json:"events"`
+	Suppressed int             `json:"suppressed,omitempty"`
+	Dropped    int             `json:"dropped,omitempty"`
+}
+
+// NewLogShipper creates a shipper with the defaults filled in for unset
+// settings
+func NewLogShipper(client *http.Client, conf config.LogShippingConfig) *LogShipper {
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = 100
+	}
+	if conf.FlushInterval <= 0 {
+		conf.FlushInterval = 10
+	}
+	if conf.RatePerMinute <= 0 {
+		conf.RatePerMinute = 120
+	}
+	return &LogShipper{
+		client:        client,
+		batchSize:     conf.BatchSize,
+		flushInterval: time.Duration(conf.FlushInterval) * time.Second,
+		rate:          float64(conf.RatePerMinute) / 60,
+		burst:         float64(conf.RatePerMinute),
+		maxQueue:      10 * conf.BatchSize,
+		tokens:        float64(conf.RatePerMinute),
+		lastRefill:    time.Now(),
+	}
+}
+
+// Add queues an event. It never blocks, so it can be called from a logging
+// subscriber.
+func (s *LogShipper) Add(e logging.Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.tokens += now.Sub(s.lastRefill).Seconds() * s.rate
+	if s.tokens > s.burst {
+		s.tokens = s.burst
+	}
+	s.lastRefill = now
+	if s.shedding > guard.Normal && e.Level != slog.LevelError.String() {
+		s.dropped++
+		logEventsDropped.Inc("shed")
+		return
+	}
+	if s.tokens < 1 {
+		s.suppressed++
+		logEventsDropped.Inc("rate_limit")
+		return
+	}
+	s.tokens--
+
+	if len(s.queue) >= s.queueLimit() {
+		s.queue = s.queue[1:]
+		s.dropped++
+		s.evicted++
+		logEventsDropped.Inc("queue_full")
+	}
+	s.queue = append(s.queue, e)
+}
+
+// queueLimit returns how many events may be queued. Callers hold mu.
+func (s *LogShipper) queueLimit() int {
+	if s.shedding == guard.Critical {
+		return s.batchSize
+	}
+	return s.maxQueue
+}
+
+// Shed implements guard.Shedder. Under pressure only errors are queued, and
+// when it is critical the queue is cut down to a single batch.
+func (s *LogShipper) Shed(level guard.Level) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shedding = level
+	if over := len(s.queue) - s.queueLimit(); over > 0 {
+		s.queue = s.queue[over:]
+		s.dropped += over
+		s.evicted += over
+		logEventsDropped.Add(float64(over), "shed")
+	}
+}
+
+// Pending returns the number of queued events
+func (s *LogShipper) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+// Run sends queued events every flush interval until ctx is done, then makes
+// a last attempt with reqCtx so errors logged during shutdown still arrive
+func (s *LogShipper) Run(ctx, reqCtx context.Context) {
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.Flush(reqCtx)
+			return
+		case <-ticker.C:
+			s.Flush(reqCtx)
+		}
+	}
+}
+
+// Flush sends all queued events in batches. Events of a batch that could not
+// be delivered stay queued for the next attempt.
+func (s *LogShipper) Flush(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 && s.suppressed == 0 && s.dropped == 0 {
+			s.mu.Unlock()
+			return nil
+		}
+		n := len(s.queue)
+		if n > s.batchSize {
+			n = s.batchSize
+		}
+		batch := logBatch{
+			SentAt:     time.Now().UTC(),
+			Events:     append(make([]logging.Entry, 0, n), s.queue[:n]...),
+			Suppressed: s.suppressed,
+			Dropped:    s.dropped,
+		}
+		evicted := s.evicted
+		s.mu.Unlock()
+
+		// Failures are only logged at debug level, a warning would be
+		// shipped again and keep the queue full while the server is down
+		if err := s.send(ctx, batch); err != nil {
+			logger.Debug("Failed to ship log events", "error", err)
+			return err
+		}
+		logEventsShipped.Add(float64(n))
+
+		s.mu.Lock()
+		// Add only appends or evicts from the front, so the sent events are
+		// still at the front unless some of them were evicted meanwhile.
+		// Events dropped without being queued do not move the queue.
+		sent := n - (s.evicted - evicted)
+		if sent < 0 {
+			sent = 0
+		}
+		if sent > len(s.queue) {
+			sent = len(s.queue)
+		}
+		s.queue = s.queue[sent:]
+		s.suppressed -= batch.Suppressed
+		s.dropped -= batch.Dropped
+		s.mu.Unlock()
+	}
+}
+
+func (s *LogShipper) send(ctx context.Context, batch logBatch) error {
+	conf := config.GetConfig()
+	if conf.APIUrl == "" {
+		return fmt.Errorf("APIUrl is not set in the configuration")
+	}
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed to encode log events: %v", err)
+	}
+
+	url := fmt.Sprintf("%s/agents/logs", conf.APIUrl)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	setHeaders(req, conf)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("server returned %s: %s", resp.Status, body)
+	}
+	return nil
+}
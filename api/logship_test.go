@@ -0,0 +1,116 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"ss-agent/config"
+	"ss-agent/utils/guard"
+	"ss-agent/utils/logging"
+)
+
+// logServer receives log batches. While a batch is being received, during
+// is called, e.g. to log more events.
+type logServer struct {
+	mu      sync.Mutex
+	batches []logBatch
+	during  func()
+}
+
+func (l *logServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var batch logBatch
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l.mu.Lock()
+	l.batches = append(l.batches, batch)
+	during := l.during
+	l.during = nil
+	l.mu.Unlock()
+	if during != nil {
+		during()
+	}
+}
+
+// messages returns the messages of each batch received, joined by spaces,
+// and the dropped counts reported
+func (l *logServer) messages() (batches []string, dropped []int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, b := range l.batches {
+		var msgs []string
+		for _, e := range b.Events {
+			msgs = append(msgs, e.Message)
+		}
+		batches = append(batches, strings.Join(msgs, " "))
+		dropped = append(dropped, b.Dropped)
+	}
+	return batches, dropped
+}
+
+func entry(level, msg string) logging.Entry {
+	return logging.Entry{Level: level, Message: msg}
+}
+
+func TestFlushWhileDropping(t *testing.T) {
+	tests := []struct {
+		name        string
+		during      func(s *LogShipper)
+		wantBatches []string
+		wantDropped []int
+	}{
+		{
+			// Shed events are counted as dropped but never queued, so the
+			// queue is as it was when the batch was taken
+			name: "shed events",
+			during: func(s *LogShipper) {
+				s.Shed(guard.Elevated)
+				s.Add(entry("WARN", "w1"))
+				s.Add(entry("ERROR", "e3"))
+			},
+			wantBatches: []string{"e1 e2", "e3"},
+			wantDropped: []int{0, 1},
+		},
+		{
+			// Under critical pressure the queue holds one batch, so queueing
+			// e3 evicts e1 from the front while the batch is in flight
+			name: "evicted events",
+			during: func(s *LogShipper) {
+				s.Shed(guard.Critical)
+				s.Add(entry("ERROR", "e3"))
+			},
+			wantBatches: []string{"e1 e2", "e3"},
+			wantDropped: []int{0, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &logServer{}
+			useAPI(t, server)
+			s := NewLogShipper(http.DefaultClient, config.LogShippingConfig{BatchSize: 2})
+			s.Add(entry("ERROR", "e1"))
+			s.Add(entry("ERROR", "e2"))
+			server.during = func() { tt.during(s) }
+
+			if err := s.Flush(context.Background()); err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+			batches, dropped := server.messages()
+			if strings.Join(batches, "|") != strings.Join(tt.wantBatches, "|") {
+				t.Errorf("batches = %q, want %q", batches, tt.wantBatches)
+			}
+			if fmt.Sprint(dropped) != fmt.Sprint(tt.wantDropped) {
+				t.Errorf("dropped = %v, want %v", dropped, tt.wantDropped)
+			}
+			if s.Pending() != 0 {
+				t.Errorf("%d events still queued after Flush", s.Pending())
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"ss-agent/config"
+)
+
+// UploadSupportBundle sends a support bundle to the SIEM server so support can
+// look at it without access to the host
+func UploadSupportBundle(ctx context.Context, client *http.Client, path string) error {
+	conf := config.GetConfig()
+	if conf.APIUrl == "" {
+		return fmt.Errorf("APIUrl is not set in the configuration")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/agents/support-bundles", conf.APIUrl)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, f)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.ContentLength = info.Size()
+	setHeaders(req, conf)
+	req.Header.Set("Content-Type", "application/gzip")
+	req.Header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(path)}))
+
+	logger.Info("Uploading support bundle", "file", path, "bytes", info.Size())
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("server returned %s: %s", resp.Status, body)
+	}
+	return nil
+}
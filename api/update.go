@@ -0,0 +1,68 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime"
+
+	"ss-agent/config"
+)
+
+// Release is an agent version offered by the SIEM server. Signature is the
+// base64 ed25519 signature of the version, platform and SHA-256, see
+// updater.SignedMessage.
+type Release struct {
+	Version   string `json:"version"`
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+// CheckForUpdate asks the server for the latest agent release on channel. It
+// returns nil when the server has nothing for this platform.
+func CheckForUpdate(ctx context.Context, client *http.Client, channel, current string) (*Release, error) {
+	conf := config.GetConfig()
+	if conf.APIUrl == "" {
+		return nil, fmt.Errorf("APIUrl is not set in the configuration")
+	}
+
+	query := url.Values{}
+	query.Set("channel", channel)
+	query.Set("os", runtime.GOOS)
+	query.Set("arch", runtime.GOARCH)
+	query.Set("version", current)
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/agents/updates?%s", conf.APIUrl, query.Encode()), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	setHeaders(req, conf)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %v", err)
+	}
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("server returned %s: %s", resp.Status, body)
+	}
+
+	var rel Release
+	if err := json.Unmarshal(body, &rel); err != nil {
+		return nil, fmt.Errorf("invalid update response: %v", err)
+	}
+	if rel.Version == "" {
+		return nil, nil
+	}
+	return &rel, nil
+}
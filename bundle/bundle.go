@@ -0,0 +1,234 @@
+// bundle/bundle.go
+
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"ss-agent/config"
+	"ss-agent/control"
+	"ss-agent/doctor"
+	"ss-agent/service"
+	"ss-agent/utils/logging"
+	"ss-agent/utils/osinfo"
+)
+
+var logger = logging.For("bundle")
+
+// Options controls what goes into a support bundle
+type Options struct {
+	Doctor       doctor.Env // also tells where the agent's files are
+	Version      string
+	JournalLines int   // lines of journal per unit, default 500
+	LogBytes     int64 // tail of the agent's log file, default 2 MiB
+}
+
+// File is a manifest entry
+type File struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Problem is something that could not be collected
+type Problem struct {
+	Item  string `json:"item"`
+	Error string `json:"error"`
+}
+
+// Manifest describes the bundle. It is the last file in the archive and
+// lists the SHA-256 of every other file.
+type Manifest struct {
+	CreatedAt    time.Time `json:"created_at"`
+	AgentVersion string    `json:"agent_version"`
+	Hostname     string    `json:"hostname"`
+	OS           string    `json:"os"`
+	Files        []File    `json:"files"`
+	Problems     []Problem `json:"problems,omitempty"`
+}
+
+// builder writes files into the archive and keeps the manifest
+type builder struct {
+	tw       *tar.Writer
+	now      time.Time
+	manifest Manifest
+	secrets  []string // values replaced in every collected file
+	err      error
+}
+
+// Create collects the support bundle and writes it to w as a gzipped tarball.
+// Items that cannot be collected are listed in the manifest instead of
+// failing the bundle; only write errors are returned.
+func Create(w io.Writer, opts Options) (Manifest, error) {
+	if opts.JournalLines <= 0 {
+		opts.JournalLines = 500
+	}
+	if opts.LogBytes <= 0 {
+		opts.LogBytes = 2 << 20
+	}
+
+	gz := gzip.NewWriter(w)
+	b := &builder{tw: tar.NewWriter(gz), now: time.Now()}
+	hostname, _ := os.Hostname()
+	b.manifest = Manifest{
+		CreatedAt:    b.now.UTC(),
+		AgentVersion: opts.Version,
+		Hostname:     hostname,
+		OS:           runtime.GOOS + "/" + runtime.GOARCH,
+	}
+
+	// The doctor loads the configuration, everything after it can use it
+	report := doctor.Run(opts.Doctor)
+	conf := config.GetConfig()
+	b.secrets = secretValues(conf)
+
+	b.addJSON("doctor.json", report)
+	var text bytes.Buffer
+	doctor.Print(&text, report)
+	b.add("doctor.txt", text.Bytes())
+
+	if config.ConfigFile() != "" {
+		b.addJSON("config.json", redactConfig(conf))
+	} else {
+		b.fail("config.json", fmt.Errorf("no configuration loaded"))
+	}
+
+	b.add("system.txt", systemInfo(opts.Version))
+	b.collectAgent(opts.Doctor.ControlPath)
+	b.collectLogFile(opts.Doctor.LogFilePath(conf), opts.LogBytes)
+	// Only a daemonized agent has one
+	if stderr := logging.StderrFile(opts.Doctor.LogFilePath(conf)); fileExists(stderr) {
+		b.collectLogFile(stderr, opts.LogBytes)
+	}
+	b.collectState(opts.Doctor.DataDirPath(conf))
+	b.collectJournal("journal/ss-agent.txt", "ss-agent", opts.JournalLines)
+
+	for _, name := range service.AllServices {
+		b.collectService(name, opts.JournalLines)
+	}
+
+	// The manifest is written last and does not list itself
+	data, err := marshal(b.manifest)
+	if err == nil {
+		b.write("manifest.json", data)
+	}
+	if err := b.tw.Close(); err != nil && b.err == nil {
+		b.err = err
+	}
+	if err := gz.Close(); err != nil && b.err == nil {
+		b.err = err
+	}
+	return b.manifest, b.err
+}
+
+// add redacts data and writes it to the archive
+func (b *builder) add(name string, data []byte) {
+	for _, secret := range b.secrets {
+		data = bytes.ReplaceAll(data, []byte(secret), []byte(redacted))
+	}
+	sum := sha256.Sum256(data)
+	if b.write(name, data) {
+		b.manifest.Files = append(b.manifest.Files, File{Name: name, Size: len(data), SHA256: hex.EncodeToString(sum[:])})
+	}
+}
+
+func (b *builder) addJSON(name string, v interface{}) {
+	data, err := marshal(v)
+	if err != nil {
+		b.fail(name, err)
+		return
+	}
+	b.add(name, data)
+}
+
+// marshal encodes v as indented JSON, leaving "<redacted>" readable
+func marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
+	return buf.Bytes(), err
+}
+
+func (b *builder) write(name string, data []byte) bool {
+	if b.err != nil {
+		return false
+	}
+	hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: b.now, Typeflag: tar.TypeReg}
+	if err := b.tw.WriteHeader(hdr); err != nil {
+		b.err = err
+		return false
+	}
+	if _, err := b.tw.Write(data); err != nil {
+		b.err = err
+		return false
+	}
+	return true
+}
+
+func (b *builder) fail(item string, err error) {
+	logger.Debug("Not collected", "item", item, "error", err)
+	b.manifest.Problems = append(b.manifest.Problems, Problem{Item: item, Error: err.Error()})
+}
+
+// collectAgent adds what the running agent reports about itself
+func (b *builder) collectAgent(controlPath string) {
+	var status json.RawMessage
+	if err := control.Call(controlPath, "status", nil, &status); err != nil {
+		b.fail("agent-status.json", err)
+		return
+	}
+	var indented bytes.Buffer
+	if json.Indent(&indented, status, "", "  ") == nil {
+		status = indented.Bytes()
+	}
+	b.add("agent-status.json", append(status, '\n'))
+
+	var entries []logging.Entry
+	if err := control.Call(controlPath, "logs", map[string]interface{}{"level": "debug"}, &entries); err != nil {
+		b.fail("logs/recent.json", err)
+		return
+	}
+	b.addJSON("logs/recent.json", entries)
+}
+
+func systemInfo(version string) []byte {
+	var buf bytes.Buffer
+	hostname, _ := os.Hostname()
+	fmt.Fprintf(&buf, "Agent version: %s\n", version)
+	fmt.Fprintf(&buf, "Hostname:      %s\n", hostname)
+	fmt.Fprintf(&buf, "OS:            %s (%s)\n", osinfo.GetOSType(), osinfo.GetOSDist())
+	fmt.Fprintf(&buf, "Platform:      %s/%s, %d CPUs, %s\n", runtime.GOOS, runtime.GOARCH, runtime.NumCPU(), runtime.Version())
+	fmt.Fprintf(&buf, "Collected at:  %s\n", time.Now().UTC().Format(time.RFC3339))
+
+	var env []string
+	for _, kv := range os.Environ() {
+		// Only the Go runtime settings, other variables may hold secrets
+		if strings.HasPrefix(kv, "GO") {
+			env = append(env, kv)
+		}
+	}
+	sort.Strings(env)
+	if len(env) > 0 {
+		fmt.Fprintf(&buf, "\nEnvironment:\n  %s\n", strings.Join(env, "\n  "))
+	}
+
+	for _, c := range systemCommands() {
+		fmt.Fprintf(&buf, "\n$ %s\n", strings.Join(c, " "))
+		buf.Write(query(c))
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,309 @@
+// bundle/collect.go
+
+package bundle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"ss-agent/config"
+	"ss-agent/service"
+	"ss-agent/service/servicectl"
+	"ss-agent/utils/runner"
+	"ss-agent/utils/store"
+	"ss-agent/utils/zeek"
+)
+
+const redacted = "<redacted>"
+
+// maxConfigFile caps the size of a collected service configuration file
+const maxConfigFile = 1 << 20
+
+// serviceConfigFiles are glob patterns for the configuration of each managed
+// service in its usual install locations
+var serviceConfigFiles = map[string][]string{
+	"fluent-bit": {
+		"/etc/fluent-bit/*.conf",
+		"/etc/fluent-bit/*.yaml",
+		"/opt/fluent-bit/etc/fluent-bit/*.conf",
+		"/usr/local/etc/fluent-bit/*.conf",
+		`C:\Program Files\fluent-bit\conf\*.conf`,
+	},
+	"zeek": {
+		"/opt/zeek/etc/*.cfg",
+		"/opt/zeek/share/zeek/site/local.zeek",
+		"/usr/local/zeek/etc/*.cfg",
+		"/usr/local/zeek/share/zeek/site/local.zeek",
+		"/usr/local/etc/*.cfg",
+	},
+	"osqueryd": {
+		"/etc/osquery/osquery.conf",
+		"/etc/osquery/osquery.flags",
+		"/var/osquery/osquery.conf",
+		"/var/osquery/osquery.flags",
+		`C:\Program Files\osquery\osquery.conf`,
+		`C:\Program Files\osquery\osquery.flags`,
+	},
+}
+
+// secretLine matches settings in service configuration files whose value is
+// a credential, e.g. "HTTP_Passwd secret" or "enroll_secret = secret"
+var secretLine = regexp.MustCompile(`(?im)^(\s*"?[\w.\-]*(?:passw|secret|token|api_?key)[\w.\-]*"?\s*[=:]?\s*)\S.*$`)
+
+// isSecretKey reports whether a configuration setting holds a credential
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range []string{"secret", "token", "passw", "access_key", "organization_key"} {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactConfig returns the configuration as generic JSON with credentials
+// replaced, so settings added later are covered without listing them here
+func redactConfig(conf config.Config) interface{} {
+	data, _ := json.Marshal(conf)
+	var v interface{}
+	json.Unmarshal(data, &v)
+	return redactValue(v)
+}
+
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			if s, ok := item.(string); ok && s != "" && isSecretKey(k) {
+				v[k] = redacted
+				continue
+			}
+			v[k] = redactValue(item)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = redactValue(v[i])
+		}
+	}
+	return v
+}
+
+// secretValues returns the credentials in the configuration. They are
+// removed from everything in the bundle, a debug log may contain them.
+func secretValues(conf config.Config) []string {
+	var values []string
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch v := v.(type) {
+		case map[string]interface{}:
+			for k, item := range v {
+				// Short values would replace unrelated text
+				if s, ok := item.(string); ok && len(s) >= 4 && isSecretKey(k) {
+					values = append(values, s)
+				}
+				walk(item)
+			}
+		case []interface{}:
+			for _, item := range v {
+				walk(item)
+			}
+		}
+	}
+	data, _ := json.Marshal(conf)
+	var v interface{}
+	json.Unmarshal(data, &v)
+	walk(v)
+	return values
+}
+
+// query runs a read-only command and returns its output, with the error
+// appended when it failed
+func query(args []string) []byte {
+	output, err := runner.Query(args[0], args[1:]...)
+	if err != nil {
+		output = append(output, fmt.Sprintf("\n(%v)\n", err)...)
+	}
+	return output
+}
+
+func available(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// systemCommands describe the host in system.txt
+func systemCommands() [][]string {
+	switch runtime.GOOS {
+	case "windows":
+		return [][]string{{"systeminfo"}}
+	case "darwin":
+		return [][]string{{"sw_vers"}, {"uname", "-a"}, {"uptime"}, {"df", "-h"}}
+	default:
+		commands := [][]string{{"uname", "-a"}, {"uptime"}, {"df", "-h"}, {"free", "-m"}, {"cat", "/etc/os-release"}}
+		if servicectl.DetectInitSystem() == servicectl.InitSystemd {
+			commands = append(commands, []string{"systemctl", "--failed", "--no-pager"})
+		}
+		return commands
+	}
+}
+
+// backendCommands return the commands whose raw output shows the state of a
+// managed service as the init system or service tool sees it
+func backendCommands(name string) [][]string {
+	if name == "zeek" && runtime.GOOS != "windows" {
+		zeekctl, err := zeek.FindZeekctl()
+		if err != nil {
+			return nil
+		}
+		return [][]string{{zeekctl, "status"}, {zeekctl, "diag"}}
+	}
+
+	switch runtime.GOOS {
+	case "windows":
+		if name == "zeek" {
+			name = "ss-network-analyzer"
+		}
+		return [][]string{{"sc", "query", name}, {"sc", "qc", name}}
+	case "darwin":
+		labels := map[string]string{"fluent-bit": "io.fluentbit.fluent-bit", "osqueryd": "io.osquery.agent"}
+		return [][]string{{"launchctl", "print", "system/" + labels[name]}}
+	}
+
+	switch servicectl.DetectInitSystem() {
+	case servicectl.InitSystemd:
+		return [][]string{
+			{"systemctl", "status", "--no-pager", "--full", servicectl.UnitName(name)},
+			{"systemctl", "show", "--no-pager", servicectl.UnitName(name)},
+		}
+	case servicectl.InitOpenRC:
+		return [][]string{{"rc-service", name, "status"}}
+	default:
+		return [][]string{{"service", name, "status"}}
+	}
+}
+
+// collectService adds the state, version, raw backend output, journal and
+// configuration files of a managed service
+func (b *builder) collectService(name string, journalLines int) {
+	dir := "services/" + name + "/"
+
+	var buf bytes.Buffer
+	state, err := service.ServiceState(name)
+	fmt.Fprintf(&buf, "State:   %s\n", state)
+	if err != nil {
+		fmt.Fprintf(&buf, "Error:   %v\n", err)
+	}
+	fmt.Fprintf(&buf, "Version: %s\n", service.CheckVersion(name))
+	for _, c := range backendCommands(name) {
+		fmt.Fprintf(&buf, "\n$ %s\n", strings.Join(c, " "))
+		buf.Write(query(c))
+	}
+	b.add(dir+"status.txt", buf.Bytes())
+
+	if name != "zeek" {
+		b.collectJournal(dir+"journal.txt", name, journalLines)
+	}
+
+	for _, pattern := range serviceConfigFiles[name] {
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			b.collectConfigFile(dir+"config", path)
+		}
+	}
+}
+
+// collectConfigFile adds a service configuration file under dir, keeping its
+// path so files with the same name from different locations do not clash
+func (b *builder) collectConfigFile(dir, path string) {
+	name := dir + "/" + strings.TrimLeft(filepath.ToSlash(strings.ReplaceAll(path, ":", "")), "/")
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return
+	}
+	if info.Size() > maxConfigFile {
+		b.fail(name, fmt.Errorf("%s is larger than %d bytes", path, maxConfigFile))
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		b.fail(name, err)
+		return
+	}
+	b.add(name, secretLine.ReplaceAll(data, []byte("${1}"+redacted)))
+}
+
+// collectJournal adds the last lines the systemd journal has for a unit
+func (b *builder) collectJournal(name, unit string, lines int) {
+	if runtime.GOOS != "linux" || !available("journalctl") {
+		return
+	}
+	output, err := runner.Query("journalctl", "--no-pager", "-o", "short-iso",
+		"-n", strconv.Itoa(lines), "-u", servicectl.UnitName(unit))
+	if err != nil {
+		b.fail(name, fmt.Errorf("journalctl failed: %v: %s", err, bytes.TrimSpace(output)))
+		return
+	}
+	b.add(name, output)
+}
+
+// collectState adds the state the agent keeps between runs, with anything
+// that looks like a credential replaced
+func (b *builder) collectState(dir string) {
+	f, err := store.Read(dir)
+	if err != nil {
+		b.fail("state.json", err)
+		return
+	}
+	data, _ := json.Marshal(f)
+	var v interface{}
+	json.Unmarshal(data, &v)
+	b.addJSON("state.json", redactValue(v))
+}
+
+// fileExists reports whether there is a file at path
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// collectLogFile adds the end of a log file of the agent
+func (b *builder) collectLogFile(path string, maxBytes int64) {
+	name := "logs/" + filepath.Base(path)
+	f, err := os.Open(path)
+	if err != nil {
+		b.fail(name, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		b.fail(name, err)
+		return
+	}
+	offset := info.Size() - maxBytes
+	if offset < 0 {
+		offset = 0
+	}
+	data, err := io.ReadAll(io.NewSectionReader(f, offset, info.Size()-offset))
+	if err != nil {
+		b.fail(name, err)
+		return
+	}
+	// Start at a whole line when the file was cut
+	if offset > 0 {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+	b.add(name, data)
+}
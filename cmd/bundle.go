@@ -0,0 +1,90 @@
+// cmd/bundle.go
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"ss-agent/api"
+	"ss-agent/bundle"
+	"ss-agent/config"
+	"ss-agent/control"
+	"ss-agent/doctor"
+)
+
+// supportBundleCommand returns the 'support-bundle' command, which collects
+// what support needs to look into a problem into one tarball
+func supportBundleCommand() *cobra.Command {
+	var output string
+	var upload bool
+	var journalLines int
+	cmd := &cobra.Command{
+		Use:   "support-bundle",
+		Short: "Collect configuration, logs and diagnostics into a tarball for support",
+		Long: `Collect a gzipped tarball with the redacted configuration, the doctor results,
+the agent's recent logs and saved state, OS information, the state and raw
+init system output of the managed services, their configuration files and
+journal excerpts. A manifest lists the SHA-256 of every file. Credentials
+from the configuration are removed from all files.
+
+Examples:
+  sudo ss-agent support-bundle
+  sudo ss-agent support-bundle -o /tmp/bundle.tar.gz --upload`,
+		Args: cobra.NoArgs,
+		// No loadConfig: the bundle is most needed when the configuration is broken
+		Run: func(cmd *cobra.Command, args []string) {
+			if output == "" {
+				hostname, _ := os.Hostname()
+				output = fmt.Sprintf("ss-agent-support-%s-%s.tar.gz", hostname, time.Now().Format("20060102-150405"))
+			}
+			f, err := os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				fatalf("Failed to create the support bundle: %v", err)
+			}
+
+			fmt.Println("Collecting support bundle...")
+			manifest, err := bundle.Create(f, bundle.Options{
+				Doctor: doctor.Env{
+					ConfigPath:     configPath,
+					PidFile:        pidFile,
+					LogFile:        logFile,
+					DefaultLogFile: getLogFilePath(),
+					DataDir:        getDataDirPath(),
+					ControlPath:    control.DefaultPath,
+					NewClient:      newHTTPClient,
+				},
+				Version:      agentVersion,
+				JournalLines: journalLines,
+			})
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(output)
+				fatalf("Failed to write the support bundle: %v", err)
+			}
+			fmt.Printf("Support bundle written to %s (%d files)\n", output, len(manifest.Files))
+			for _, p := range manifest.Problems {
+				fmt.Printf("  not collected: %s: %s\n", p.Item, p.Error)
+			}
+
+			if upload {
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+				defer cancel()
+				if err := api.UploadSupportBundle(ctx, newHTTPClient(config.GetConfig()), output); err != nil {
+					fatalf("Failed to upload the support bundle: %v", err)
+				}
+				fmt.Println("Support bundle uploaded")
+			}
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "Path of the tarball (default ss-agent-support-<host>-<time>.tar.gz)")
+	cmd.Flags().BoolVar(&upload, "upload", false, "Upload the bundle to the SIEM server")
+	cmd.Flags().IntVar(&journalLines, "journal-lines", 500, "Journal lines to include per service")
+	return cmd
+}
@@ -5,37 +5,58 @@ package cmd
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/spf13/cobra"
 	"ss-agent/api"
 	"ss-agent/config"
+	"ss-agent/control"
 	"ss-agent/service"
-	"ss-agent/utils"
+	"ss-agent/service/supervisor"
+	"ss-agent/utils/crash"
+	"ss-agent/utils/guard"
+	"ss-agent/utils/logging"
+	"ss-agent/utils/metrics"
 	"ss-agent/utils/osinfo"
+	"ss-agent/utils/pidfile"
+	"ss-agent/utils/scheduler"
+	"ss-agent/utils/sdnotify"
 )
 
 var (
 	client     *http.Client
 	configPath string // Holds the value of the --config flag
 	debugMode  bool   // Holds the value of the --debug flag
+	logLevel   string // Holds the value of the --log-level flag
+	logFile    string // Holds the value of the --log-file flag
 	daemonMode bool   // Holds the value of the --daemon flag
+
+	serviceTimeout time.Duration // Holds the value of the service --timeout flag
+	serviceWait    bool          // Holds the value of the service --wait flag
+	serviceDryRun  bool          // Holds the value of the service --dry-run flag
 )
 
-// const pidFile = "/tmp/ss-agent.pid" // Or use a directory within the user's home directory
+// logger is used by the running agent; CLI commands log through the
+// standard log package
+var logger = logging.For("agent")
 
 var (
-	pidFile string // Declared as a variable instead of a constant
+	pidFile string           // PID file path, from pid_file in the configuration or the OS default
+	pidLock *pidfile.PidFile // Held by the running agent until it exits
 )
 
 // Define valid services including 'all'
@@ -52,92 +73,145 @@ func contains(slice []string, item string) bool {
 	return false
 }
 
-// printConfig logs the current configuration in a readable format
+// printConfig logs the current configuration in a readable format at debug level
 func printConfig(cfg interface{}) {
+	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
 	v := reflect.ValueOf(cfg)
 	t := v.Type()
 	for i := 0; i < v.NumField(); i++ {
 		field := t.Field(i)
 		value := v.Field(i).Interface()
-		log.Printf("  %s: %v\n", field.Name, value)
+		slog.Debug(fmt.Sprintf("  %s: %v", field.Name, value))
+	}
+}
+
+// fatalf logs an error and exits. Unlike log.Fatalf it logs at error level.
+func fatalf(format string, args ...interface{}) {
+	slog.Error(fmt.Sprintf(format, args...))
+	logging.Close()
+	os.Exit(1)
+}
+
+// setupLogging configures logging from the configuration and the logging
+// flags. Only the running agent logs to a file; CLI commands use stderr.
+func setupLogging(toFile bool) {
+	conf := config.GetConfig().Logging
+	opts := logging.Options{
+		Level:      conf.Level,
+		Format:     conf.Format,
+		MaxSizeMB:  conf.MaxSizeMB,
+		MaxAgeDays: conf.MaxAgeDays,
+		MaxBackups: conf.MaxBackups,
+		Compress:   conf.Compress == nil || *conf.Compress,
+
+		BufferLines: conf.BufferLines,
+	}
+	if logLevel != "" {
+		opts.Level = logLevel
+	}
+	if debugMode {
+		opts.Level = "debug"
 	}
+	if toFile {
+		opts.File = agentLogFile()
+	}
+	if err := logging.Setup(opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid logging configuration: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// newHTTPClient returns the client for the SIEM API, honouring skip_ssl_verify
+func newHTTPClient(conf config.Config) *http.Client {
+	t := &apiTransport{}
+	t.current.Store(newTransport(conf))
+	return &http.Client{Transport: t}
+}
+
+func newTransport(conf config.Config) *http.Transport {
+	return &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: conf.SkipSSLVerify,
+		},
+	}
+}
+
+// apiTransport lets a reload change the TLS settings of the SIEM API client
+// while the heartbeat, the log shipper and the rest keep the same client
+type apiTransport struct {
+	current atomic.Pointer[http.Transport]
+}
+
+func (t *apiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.current.Load().RoundTrip(req)
+}
+
+// reloadHTTPClient applies the TLS settings of conf to client. Connections
+// made with the old settings are closed once idle.
+func reloadHTTPClient(conf config.Config) {
+	if t, ok := client.Transport.(*apiTransport); ok {
+		t.current.Swap(newTransport(conf)).CloseIdleConnections()
+	}
+}
+
+// agentLogFile returns the log file of the running agent, empty for stderr
+func agentLogFile() string {
+	if logFile != "" {
+		return logFile
+	}
+	return config.GetConfig().Logging.File
 }
 
 // Execute sets up and runs the Cobra command structure
 func Execute(version string, ctx context.Context, cancel context.CancelFunc) {
+	agentVersion = version
 	var rootCmd = &cobra.Command{
 		Use:   "agent",
 		Short: "SIEM Agent",
 	}
 
-	pidFile = getPidFilePath()
-	log.Printf("PID file will be created at: %s", pidFile)
-	// Ensure the PID directory exists before trying to write to it
-	err := utils.CreateDirectoryIfNotExists(filepath.Dir(pidFile))
-	if err != nil {
-		log.Fatalf("Failed to create directory for PID file: %v", err)
-	}
-
 	// Add global flags
 	rootCmd.PersistentFlags().StringVar(&configPath, "config", "", "Path to configuration file")
-	rootCmd.PersistentFlags().BoolVar(&debugMode, "debug", false, "Enable debug mode")
+	rootCmd.PersistentFlags().BoolVar(&debugMode, "debug", false, "Log at debug level, same as --log-level debug")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "", "Log level: debug, info, warn or error (overrides the configuration)")
+	rootCmd.PersistentFlags().StringVar(&logFile, "log-file", "", "Log file of the running agent (overrides the configuration)")
+	// Log at the requested level before any configuration is loaded
+	rootCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		setupLogging(false)
+	}
 
 	osinfo.DetectOS()
+	pidFile = getPidFilePath()
 
 	// loadConfig is a PreRun hook that loads the configuration based on the --config flag
 	loadConfig := func(cmd *cobra.Command, args []string) {
 		// Load the config file if the --config flag is provided
 		if configPath != "" {
-			log.Printf("Loading configuration from: %s\n", configPath)
+			slog.Debug("Loading configuration", "path", configPath)
 			if err := config.LoadConfigFromFile(configPath); err != nil {
-				log.Fatalf("Failed to load config from file: %v", err)
+				fatalf("Failed to load config from file: %v", err)
 			}
 		} else {
 			// If no config path is provided, try default config paths
 			if err := config.LoadConfig(); err != nil {
-				log.Fatalf("Failed to load config from default paths: %v", err)
+				fatalf("Failed to load config from default paths: %v", err)
 			}
 		}
 
-		// Setup TLS configuration with skip_ssl_verify option
 		conf := config.GetConfig()
-		tlsConfig := &tls.Config{
-			InsecureSkipVerify: conf.SkipSSLVerify,
-		}
-
-		client = &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: tlsConfig,
-			},
+		if conf.PidFile != "" {
+			pidFile = conf.PidFile
 		}
+		client = newHTTPClient(conf)
 
-		// If debug mode is enabled, set more verbose logging and display config
-		if debugMode {
-			log.SetFlags(log.LstdFlags | log.Lshortfile)
-			log.Println("Configuration loaded:")
-			printConfig(config.GetConfig())
-			log.Printf("OS Type: %s\n", osinfo.GetOSType())
-			log.Printf("OS Distribution: %s\n", osinfo.GetOSDist())
-			log.Printf("Program Version: %s\n", version)
-		}
-	}
-
-	// Check if an instance is already running
-	checkRunningInstance := func() bool {
-		data, err := os.ReadFile(pidFile)
-		if err == nil { // If PID file exists
-			pid, err := strconv.Atoi(string(data))
-			if err == nil {
-				process, err := os.FindProcess(pid)
-				if err == nil && process.Signal(syscall.Signal(0)) == nil {
-					// Process is running
-					log.Printf("An instance of the agent is already running with PID %d\n", pid)
-					return true
-				}
-			}
-		}
-		// No running instance found or PID file does not exist
-		return false
+		// Apply the logging configuration and show it at debug level
+		setupLogging(false)
+		slog.Debug("Configuration loaded:")
+		printConfig(config.GetConfig())
+		slog.Debug("Environment", "os_type", osinfo.GetOSType(), "os_dist", osinfo.GetOSDist(),
+			"version", version, "pid_file", pidFile)
 	}
 
 	// Start Command
@@ -146,9 +220,10 @@ func Execute(version string, ctx context.Context, cancel context.CancelFunc) {
 		Short:  "Start the agent service",
 		PreRun: loadConfig,
 		Run: func(cmd *cobra.Command, args []string) {
-			// Prevent starting a new instance if one is already running
-			if checkRunningInstance() {
-				log.Fatal("Failed to start: another instance of the agent is already running.")
+			// The lock on the PID file decides which agent runs, this only
+			// fails early with a clear message
+			if pid, running, _ := pidfile.Check(pidFile); running {
+				fatalf("Failed to start: another instance of the agent is already running with PID %d", pid)
 			}
 
 			if daemonMode {
@@ -158,9 +233,17 @@ func Execute(version string, ctx context.Context, cancel context.CancelFunc) {
 			} else {
 				// Otherwise, start normally
 				log.Println("Starting agent service...")
-				writePidFile()
-				go runPingInIntervals(ctx)
-				<-ctx.Done() // Wait for context to be done
+				lockPidFile()
+				setupLogging(true)
+				defer logging.Close()
+				handleSignals(cancel)
+				runAgent(ctx, cancel)
+				if restartInto != "" {
+					logging.Close()
+					if err := restartSelf(restartInto); err != nil {
+						fatalf("Failed to restart the agent: %v", err)
+					}
+				}
 			}
 		},
 	}
@@ -172,7 +255,46 @@ func Execute(version string, ctx context.Context, cancel context.CancelFunc) {
 		PreRun: loadConfig,
 		Run: func(cmd *cobra.Command, args []string) {
 			log.Println("Stopping agent service...")
-			stopService()
+			var pid int
+			err := control.Call(control.DefaultPath, "stop", nil, &pid)
+			if err == control.ErrNotRunning {
+				// Agents without a control socket only understand signals
+				stopService()
+				return
+			}
+			if err != nil {
+				fatalf("Failed to stop the agent: %v", err)
+			}
+			fmt.Printf("Asked agent with PID %d to stop\n", pid)
+			timeout := time.Duration(config.GetConfig().ShutdownTimeout)*time.Second + 10*time.Second
+			if !waitForAgentExit(timeout) {
+				fatalf("Agent with PID %d did not stop within %s", pid, timeout)
+			}
+			fmt.Println("Agent stopped")
+		},
+	}
+
+	// Reload Command
+	var reloadCmd = &cobra.Command{
+		Use:   "reload",
+		Short: "Make the running agent reload its configuration file",
+		Long: `Make the running agent load its configuration file again and apply it.
+
+Applied right away: the API credentials and api_url, skip_ssl_verify,
+ping_interval and the jobs overrides, logging.level (unless set with
+--log-level or --debug), the supervise policies and resource limits of the
+services, health.auth_token, shutdown_timeout and the update channel, interval
+and maintenance windows.
+
+Applied only by a restart: health.listen, metrics.listen, logging.file,
+format, rotation and buffer_lines, logging.shipping, self_limits,
+update.enabled, pid_file, crash_dir and data_dir.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			var path string
+			if err := control.Call(control.DefaultPath, "reload", nil, &path); err != nil {
+				fatalf("Failed to reload the agent configuration: %v", err)
+			}
+			fmt.Printf("Agent reloaded its configuration from %s\n", path)
 		},
 	}
 
@@ -181,14 +303,27 @@ func Execute(version string, ctx context.Context, cancel context.CancelFunc) {
 		Use:   "status",
 		Short: "Get the agent status",
 		Run: func(cmd *cobra.Command, args []string) {
-			if debugMode {
-				log.Println("Getting agent status in debug mode...")
-				log.SetFlags(log.LstdFlags | log.Lshortfile) // More verbose logging
-			} else {
-				log.Println("Getting agent status...")
-				log.SetFlags(log.LstdFlags)
+			log.Println("Getting agent status...")
+			var status AgentStatus
+			err := control.Call(control.DefaultPath, "status", nil, &status)
+			if err == control.ErrNotRunning {
+				// status works without a configuration, but a configured
+				// pid_file has to be honoured
+				if configPath != "" {
+					err = config.LoadConfigFromFile(configPath)
+				} else {
+					err = config.LoadConfig()
+				}
+				if err == nil && config.GetConfig().PidFile != "" {
+					pidFile = config.GetConfig().PidFile
+				}
+				statusService()
+				return
+			}
+			if err != nil {
+				fatalf("Failed to query the agent: %v", err)
 			}
-			statusService()
+			printAgentStatus(status)
 		},
 	}
 
@@ -198,15 +333,9 @@ func Execute(version string, ctx context.Context, cancel context.CancelFunc) {
 		Short:  "Register the agent",
 		PreRun: loadConfig,
 		Run: func(cmd *cobra.Command, args []string) {
-			if debugMode {
-				log.Println("Registering agent in debug mode...")
-				log.SetFlags(log.LstdFlags | log.Lshortfile) // More verbose logging
-			} else {
-				log.Println("Registering agent...")
-				log.SetFlags(log.LstdFlags)
-			}
+			log.Println("Registering agent...")
 			if err := api.RegisterAgent(); err != nil {
-				log.Fatalf("Failed to register agent: %v", err)
+				fatalf("Failed to register agent: %v", err)
 			}
 		},
 	}
@@ -217,15 +346,9 @@ func Execute(version string, ctx context.Context, cancel context.CancelFunc) {
 		Short:  "Unregister the agent",
 		PreRun: loadConfig,
 		Run: func(cmd *cobra.Command, args []string) {
-			if debugMode {
-				log.Println("Unregistering agent in debug mode...")
-				log.SetFlags(log.LstdFlags | log.Lshortfile) // More verbose logging
-			} else {
-				log.Println("Unregistering agent...")
-				log.SetFlags(log.LstdFlags)
-			}
+			log.Println("Unregistering agent...")
 			if err := api.UnregisterAgent(); err != nil {
-				log.Fatalf("Failed to unregister agent: %v", err)
+				fatalf("Failed to unregister agent: %v", err)
 			}
 		},
 	}
@@ -233,18 +356,18 @@ func Execute(version string, ctx context.Context, cancel context.CancelFunc) {
 	// Ping Command
 	var pingCmd = &cobra.Command{
 		Use:    "ping",
-		Short:  "Ping the SIEM server once",
+		Short:  "Ping the SIEM server once, through the running agent if there is one",
 		PreRun: loadConfig,
 		Run: func(cmd *cobra.Command, args []string) {
-			if debugMode {
-				log.Println("Pinging SIEM server in debug mode...")
-				log.SetFlags(log.LstdFlags | log.Lshortfile) // More verbose logging
-			} else {
-				log.Println("Pinging SIEM server...")
-				log.SetFlags(log.LstdFlags)
+			log.Println("Pinging SIEM server...")
+			err := control.Call(control.DefaultPath, "ping", nil, nil)
+			if err == control.ErrNotRunning {
+				err = api.Ping(client)
+			} else if err == nil {
+				log.Println("Heartbeat sent by the running agent")
 			}
-			if err := api.Ping(client); err != nil {
-				log.Fatalf("Failed to ping SIEM server: %v", err)
+			if err != nil {
+				fatalf("Failed to ping SIEM server: %v", err)
 			}
 		},
 	}
@@ -261,7 +384,7 @@ func Execute(version string, ctx context.Context, cancel context.CancelFunc) {
 	// Service Command
 	var serviceCmd = &cobra.Command{
 		Use:   "service",
-		Short: "Manage services (start, stop, restart, status)",
+		Short: "Manage services (start, stop, restart, status, install, upgrade, uninstall)",
 	}
 
 	// Start Service Command
@@ -272,22 +395,17 @@ func Execute(version string, ctx context.Context, cancel context.CancelFunc) {
 		Args:   cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			serviceName := strings.ToLower(args[0])
+			if serviceDryRun && contains(validServices, serviceName) {
+				planService(serviceName, "start")
+				return
+			}
 			if serviceName == "all" {
 				log.Println("Starting all services...")
-				for _, svc := range service.AllServices {
-					log.Printf("Attempting to start %s...", svc)
-					if err := service.ManageService(svc, "start"); err != nil {
-						log.Printf("Failed to start %s: %v", svc, err)
-						fmt.Printf("%-15s: [FAILED] %v\n", svc, err)
-					} else {
-						log.Printf("Successfully started %s", svc)
-						fmt.Printf("%-15s: [STARTED]\n", svc)
-					}
-				}
+				runAllServices("start")
 			} else if contains(service.AllServices, serviceName) {
 				log.Printf("Starting service %s...", serviceName)
-				if err := service.ManageService(serviceName, "start"); err != nil {
-					log.Fatalf("Failed to start service %s: %v", serviceName, err)
+				if err := manageService(serviceName, "start"); err != nil {
+					fatalf("Failed to start service %s: %v", serviceName, err)
 				} else {
 					log.Printf("Service %s started successfully", serviceName)
 					fmt.Println("Service started successfully")
@@ -308,22 +426,17 @@ func Execute(version string, ctx context.Context, cancel context.CancelFunc) {
 		Args:   cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			serviceName := strings.ToLower(args[0])
+			if serviceDryRun && contains(validServices, serviceName) {
+				planService(serviceName, "stop")
+				return
+			}
 			if serviceName == "all" {
 				log.Println("Stopping all services...")
-				for _, svc := range service.AllServices {
-					log.Printf("Attempting to stop %s...", svc)
-					if err := service.ManageService(svc, "stop"); err != nil {
-						log.Printf("Failed to stop %s: %v", svc, err)
-						fmt.Printf("%-15s: [FAILED] %v\n", svc, err)
-					} else {
-						log.Printf("Successfully stopped %s", svc)
-						fmt.Printf("%-15s: [STOPPED]\n", svc)
-					}
-				}
+				runAllServices("stop")
 			} else if contains(service.AllServices, serviceName) {
 				log.Printf("Stopping service %s...", serviceName)
-				if err := service.ManageService(serviceName, "stop"); err != nil {
-					log.Fatalf("Failed to stop service %s: %v", serviceName, err)
+				if err := manageService(serviceName, "stop"); err != nil {
+					fatalf("Failed to stop service %s: %v", serviceName, err)
 				} else {
 					log.Printf("Service %s stopped successfully", serviceName)
 					fmt.Println("Service stopped successfully")
@@ -344,22 +457,17 @@ func Execute(version string, ctx context.Context, cancel context.CancelFunc) {
 		Args:   cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			serviceName := strings.ToLower(args[0])
+			if serviceDryRun && contains(validServices, serviceName) {
+				planService(serviceName, "restart")
+				return
+			}
 			if serviceName == "all" {
 				log.Println("Restarting all services...")
-				for _, svc := range service.AllServices {
-					log.Printf("Attempting to restart %s...", svc)
-					if err := service.ManageService(svc, "restart"); err != nil {
-						log.Printf("Failed to restart %s: %v", svc, err)
-						fmt.Printf("%-15s: [FAILED] %v\n", svc, err)
-					} else {
-						log.Printf("Successfully restarted %s", svc)
-						fmt.Printf("%-15s: [RESTARTED]\n", svc)
-					}
-				}
+				runAllServices("restart")
 			} else if contains(service.AllServices, serviceName) {
 				log.Printf("Restarting service %s...", serviceName)
-				if err := service.ManageService(serviceName, "restart"); err != nil {
-					log.Fatalf("Failed to restart service %s: %v", serviceName, err)
+				if err := manageService(serviceName, "restart"); err != nil {
+					fatalf("Failed to restart service %s: %v", serviceName, err)
 				} else {
 					log.Printf("Service %s restarted successfully", serviceName)
 					fmt.Println("Service restarted successfully")
@@ -391,35 +499,84 @@ Examples:
 				fmt.Printf("Or use 'all' to manage all services.\n")
 				os.Exit(1)
 			}
-			if debugMode {
-				log.Printf("Checking status of service %s in debug mode...", serviceName)
-				log.SetFlags(log.LstdFlags | log.Lshortfile)
-			} else {
-				log.Printf("Checking status of service %s...", serviceName)
-				log.SetFlags(log.LstdFlags)
-			}
+			log.Printf("Checking status of service %s...", serviceName)
 			service.HealthCheck(serviceName)
 		},
 	}
 
+	serviceCmd.PersistentFlags().DurationVar(&serviceTimeout, "timeout", 5*time.Minute, "Overall timeout for the service operation")
+	serviceCmd.PersistentFlags().BoolVar(&serviceWait, "wait", true, "Wait for services to reach the expected state")
+	serviceCmd.PersistentFlags().BoolVar(&serviceDryRun, "dry-run", false, "Print the commands that would run without changing anything")
+
 	// Add subcommands to 'service' command
 	serviceCmd.AddCommand(serviceStartCmd, serviceStopCmd, serviceRestartCmd, serviceStatusCmd)
+	serviceCmd.AddCommand(packageCommands(loadConfig)...)
+	serviceCmd.AddCommand(limitsCommand(loadConfig))
 
 	// Add 'service' and other commands to root
-	rootCmd.AddCommand(startCmd, stopCmd, statusCmd, registerCmd, unregisterCmd, pingCmd, versionCmd, serviceCmd)
+	rootCmd.AddCommand(startCmd, stopCmd, reloadCmd, statusCmd, registerCmd, unregisterCmd, pingCmd, versionCmd, serviceCmd)
+	rootCmd.AddCommand(installCommands(version)...)
+	rootCmd.AddCommand(logsCommand())
+	rootCmd.AddCommand(doctorCommand())
+	rootCmd.AddCommand(supportBundleCommand())
+	rootCmd.AddCommand(jobsCommand())
+	rootCmd.AddCommand(stateCommand(loadConfig))
 
 	// Add daemon flag to start command
 	startCmd.Flags().BoolVarP(&daemonMode, "daemon", "d", false, "Run the agent service in the background")
 
 	// Execute the root command
 	if err := rootCmd.Execute(); err != nil {
-		log.Fatalf("Error executing command: %v", err)
+		fatalf("Error executing command: %v", err)
+	}
+}
+
+// manageService runs an action on a single service, waiting for it to reach
+// the expected state unless --wait=false was given. --timeout bounds either.
+func manageService(serviceName, action string) error {
+	if serviceWait {
+		return service.ManageServiceAndWait(serviceName, action, serviceTimeout)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), serviceTimeout)
+	defer cancel()
+	return service.ManageServiceContext(ctx, serviceName, action)
+}
+
+// planService prints what an action would do without executing it
+func planService(serviceName, action string) {
+	plan, err := service.Plan(serviceName, action, serviceWait, serviceTimeout)
+	if err != nil {
+		fatalf("Failed to plan %s of %s: %v", action, serviceName, err)
+	}
+	fmt.Println()
+	service.PrintPlan(os.Stdout, plan)
+}
+
+// runAllServices runs an action on all services in dependency order and
+// prints a summary table. Exits non-zero if any service did not succeed.
+func runAllServices(action string) {
+	results, err := service.RunAll(action, serviceTimeout, serviceWait)
+	if err != nil {
+		fatalf("Failed to %s all services: %v", action, err)
+	}
+
+	fmt.Println()
+	service.PrintBulkResults(os.Stdout, results)
+	failed := false
+	for _, r := range results {
+		if r.Err != nil {
+			log.Printf("%s %s: %v", r.Service, r.Outcome, r.Err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
 	}
 }
 
 // ensureLogDirectory ensures that the log directory exists and creates it if necessary
 func ensureLogDirectory(logFilePath string) error {
-	log.Println("Ensuring log directory exists: ", logFilePath)
+	slog.Debug("Ensuring log directory exists", "path", logFilePath)
 	logDir := filepath.Dir(logFilePath)
 	if _, err := os.Stat(logDir); os.IsNotExist(err) {
 		err := os.MkdirAll(logDir, 0755)
@@ -433,7 +590,6 @@ func ensureLogDirectory(logFilePath string) error {
 func getLogFilePath() string {
 	ostype := osinfo.GetOSType()
 
-	log.Printf("Detected OS: %s\n", ostype)
 	switch ostype {
 	case "linux":
 		return "/var/log/ss-agent/ss-agent.log"
@@ -447,40 +603,92 @@ func getLogFilePath() string {
 	}
 }
 
-// cmdDaemonize starts the agent as a background process
+// cmdDaemonize starts the agent as a background process detached from the
+// terminal session, and returns once the new agent holds the PID file
 func cmdDaemonize() {
-	// Prepare the command to rerun the current binary in "start" mode
-	cmd := exec.Command(os.Args[0], "start", "--config", configPath)
+	executable, err := os.Executable()
+	if err != nil {
+		fatalf("Failed to find the running executable: %v", err)
+	}
+	// Rerun the current binary in the foreground; the child must see the
+	// same configuration even though it runs from another directory
+	args := []string{"start"}
+	if configPath != "" {
+		absConfig, err := filepath.Abs(configPath)
+		if err != nil {
+			fatalf("Failed to resolve config path %s: %v", configPath, err)
+		}
+		args = append(args, "--config", absConfig)
+	}
+	if debugMode {
+		args = append(args, "--debug")
+	} else if logLevel != "" {
+		args = append(args, "--log-level", logLevel)
+	}
 
-	// Get the log file path
-	logFilePath := getLogFilePath()
+	// A daemon has no terminal, so it always logs to a file, rotated by the
+	// daemon itself
+	logFilePath := agentLogFile()
+	if logFilePath == "" {
+		logFilePath = getLogFilePath()
+	}
+	if logFilePath, err = filepath.Abs(logFilePath); err != nil {
+		fatalf("Failed to resolve log file path: %v", err)
+	}
+	args = append(args, "--log-file", logFilePath)
+	cmd := exec.Command(executable, args...)
+	detach(cmd)
 
 	// Ensure log directory exists
 	if err := ensureLogDirectory(logFilePath); err != nil {
-		log.Fatalf("Failed to ensure log directory: %v", err)
+		fatalf("Failed to ensure log directory: %v", err)
 	}
 
-	// Open or create the log file to write logs in daemon mode
-	logFile, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	// Anything written outside the logger, such as a panic, goes to a file
+	// of its own, as the log file is renamed away when it is rotated
+	stderrPath := logging.StderrFile(logFilePath)
+	out, err := os.OpenFile(stderrPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
 	if err != nil {
-		log.Fatalf("Failed to open log file: %v", err)
+		fatalf("Failed to open %s: %v", stderrPath, err)
 	}
-	defer logFile.Close()
+	defer out.Close()
 
-	// Redirect stdout and stderr to the log file in daemon mode
-	cmd.Stdout = logFile
-	cmd.Stderr = logFile
+	// Keep the daemon off the terminal entirely
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		fatalf("Failed to open %s: %v", os.DevNull, err)
+	}
+	defer devNull.Close()
+	cmd.Stdin = devNull
+	cmd.Stdout = out
+	cmd.Stderr = out
 
 	// Start the process in the background
 	if err := cmd.Start(); err != nil {
-		log.Fatalf("Failed to start daemon process: %v", err)
+		fatalf("Failed to start daemon process: %v", err)
 	}
 
-	// Output the PID to the log file instead of the console
-	log.Printf("Agent service started in the background with PID %d\n", cmd.Process.Pid)
-
-	// Exit the parent process to complete the daemonization
-	os.Exit(0)
+	// Wait until the daemon has locked the PID file, so a failed start is
+	// reported here instead of only in the log file
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-exited:
+			fatalf("Agent exited during startup (%v), see %s and %s", err, logFilePath, stderrPath)
+		default:
+		}
+		if pid, err := pidfile.Read(pidFile); err == nil && pid == cmd.Process.Pid {
+			log.Printf("Agent service started in the background with PID %d\n", pid)
+			// Exit the parent process to complete the daemonization
+			os.Exit(0)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	fatalf("Agent with PID %d did not lock %s within 10s, see %s and %s", cmd.Process.Pid, pidFile, logFilePath, stderrPath)
 }
 
 func getPidFilePath() string {
@@ -498,82 +706,354 @@ func getPidFilePath() string {
 	}
 }
 
-// writePidFile writes the current process PID to the pidFile
-func writePidFile() {
-	pid := os.Getpid()
-	err := os.WriteFile(pidFile, []byte(strconv.Itoa(pid)), 0644)
+// lockPidFile locks the PID file for the lifetime of this process. It exits
+// if another agent holds it.
+func lockPidFile() {
+	var err error
+	pidLock, err = pidfile.Acquire(pidFile)
+	var locked *pidfile.LockedError
+	if errors.As(err, &locked) {
+		fatalf("Failed to start: another instance of the agent is already running with PID %d", locked.PID)
+	}
 	if err != nil {
-		log.Fatalf("Failed to write PID file: %v", err)
+		fatalf("Failed to write PID file: %v", err)
 	}
 }
 
-// stopService sends a SIGTERM to the process whose PID is stored in pidFile
-func stopService() {
-	data, err := os.ReadFile(pidFile)
-	if err != nil {
-		log.Fatalf("Failed to read PID file: %v", err)
+// releasePidFile removes the PID file and drops its lock
+func releasePidFile() {
+	if pidLock == nil {
+		return
+	}
+	if err := pidLock.Release(); err != nil {
+		logger.Error("Failed to remove PID file", "error", err)
 	}
+	pidLock = nil
+}
 
-	pid, err := strconv.Atoi(string(data))
+// stopService sends a SIGTERM to the agent holding the PID file
+func stopService() {
+	pid, running, err := pidfile.Check(pidFile)
 	if err != nil {
-		log.Fatalf("Invalid PID in PID file: %v", err)
+		fatalf("Failed to read PID file: %v", err)
+	}
+	if !running {
+		fmt.Println("Agent is not running")
+		return
 	}
 
 	process, err := os.FindProcess(pid)
 	if err != nil {
-		log.Fatalf("Failed to find process with PID %d: %v", pid, err)
+		fatalf("Failed to find process with PID %d: %v", pid, err)
 	}
 
 	err = process.Signal(syscall.SIGTERM)
 	if err != nil {
-		log.Fatalf("Failed to send SIGTERM to process with PID %d: %v", pid, err)
+		fatalf("Failed to send SIGTERM to process with PID %d: %v", pid, err)
 	}
 
 	fmt.Printf("Sent SIGTERM to process with PID %d\n", pid)
+
+	// The agent drains for up to shutdown_timeout and then sends a final
+	// heartbeat, wait a little longer than that
+	timeout := time.Duration(config.GetConfig().ShutdownTimeout)*time.Second + 10*time.Second
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		_, running, err := pidfile.Check(pidFile)
+		if err != nil {
+			fatalf("Cannot check whether the agent stopped: %v", err)
+		}
+		if !running {
+			fmt.Println("Agent stopped")
+			return
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	fatalf("Agent with PID %d did not stop within %s", pid, timeout)
 }
 
-// statusService checks if the process with PID from pidFile is running
+// statusService checks whether an agent holds the PID file. It is the
+// fallback for agents that do not answer on the control socket.
 func statusService() {
-	data, err := os.ReadFile(pidFile)
-	if err != nil {
+	pid, running, err := pidfile.Check(pidFile)
+	switch {
+	case err != nil:
+		fmt.Printf("unknown (cannot check %s: %v)\n", pidFile, err)
+	case !running:
 		fmt.Println("stopped")
-		return
+	default:
+		fmt.Printf("running (PID %d, control socket %s not reachable)\n", pid, control.DefaultPath)
+	}
+	// A crash loop is why an agent is found stopped
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	printCrashStatus(w, crashStatus())
+	w.Flush()
+}
+
+// runAgent runs the agent in the foreground until ctx is cancelled, then
+// drains in-flight work for up to shutdown_timeout, sends a final offline
+// heartbeat and removes the PID file
+func runAgent(ctx context.Context, cancel context.CancelFunc) {
+	defer releasePidFile()
+	agentStarted = time.Now()
+	crash.Setup(crashDir(), agentVersion)
+	defer crash.Recover("agent")
+	// Apply the runtime limits before the agent gets going
+	selfGuard = guard.New(selfLimits(config.GetConfig().SelfLimits))
+
+	// Forward the agent's own warnings and errors to the SIEM, starting
+	// before anything that may log one
+	shipping := config.GetConfig().Logging.Shipping
+	shipper := api.NewLogShipper(client, shipping)
+	if !shipping.Disabled {
+		level := slog.LevelWarn
+		if shipping.Level != "" {
+			var err error
+			if level, err = logging.ParseLevel(shipping.Level); err != nil {
+				logger.Error("Invalid logging.shipping.level, shipping warnings and errors", "error", err)
+				level = slog.LevelWarn
+			}
+		}
+		defer logging.Subscribe(level, shipper.Add)()
 	}
 
-	pid, err := strconv.Atoi(string(data))
+	// A new version that keeps failing is rolled back before it does anything
+	exe, err := agentExecutable()
 	if err != nil {
-		fmt.Println("stopped")
+		logger.Error("Cannot find the agent binary, self-updates are off", "error", err)
+	}
+	restart := func() bool {
+		if err := prepareRestart(); err != nil {
+			logger.Warn("Cannot restart, the new version runs after the next start", "error", err)
+			return false
+		}
+		restartInto = exe
+		cancel()
+		return true
+	}
+	if exe != "" && checkUpdateOnStart(exe) && restart() {
 		return
 	}
 
-	process, err := os.FindProcess(pid)
-	if err != nil || process.Signal(syscall.Signal(0)) != nil {
-		fmt.Println("stopped")
-	} else {
-		fmt.Println("running")
+	// Remember who this agent is and that it is running
+	agentState = openState()
+	defer recordStop(agentState)
+
+	for svc, err := range service.ApplyAllResourceLimits() {
+		logger.Error("Failed to apply resource limits", "service", svc, "error", err)
 	}
+
+	// In-flight API calls use drainCtx, which outlives ctx until the
+	// shutdown deadline
+	drainCtx, cancelDrain := context.WithCancel(context.Background())
+	defer cancelDrain()
+
+	var wg sync.WaitGroup
+	sched := scheduler.New()
+	addJob(sched, heartbeatJob())
+
+	// Keep the managed services running and report their state in the heartbeat
+	sup := supervisor.New(config.GetConfig(), service.AllServices)
+	versions := service.NewVersionReporter()
+	api.RegisterHeartbeatSource("supervisor", sup)
+	api.RegisterHeartbeatSource("versions", versions)
+	api.RegisterHeartbeatSource("agent", agentIdentity{})
+	// Report and shed load when the agent itself runs short of resources
+	api.RegisterHeartbeatSource("resources", selfGuard)
+	selfGuard.Register("versions", versions)
+	selfGuard.Register("supervisor", sup)
+	selfGuard.Register("log shipping", shipper)
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		defer crash.Recover("supervisor")
+		sup.Run(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		defer crash.Recover("guard")
+		selfGuard.Run(ctx)
+	}()
+	// systemd is told the agent is ready once the configuration is loaded and
+	// the services are supervised, heartbeats only update the status, so a
+	// SIEM server that cannot be reached does not hold up the start
+	notify(sdnotify.Ready, sdnotify.Status("Running, waiting for the first heartbeat"))
+	// The control socket and the health and metrics endpoints stay up while
+	// draining, so the CLI and probes can tell when the agent is really gone
+	controlCtx, stopControl := context.WithCancel(context.Background())
+	metrics.Register(agentMetrics(sup, shipper))
+	metrics.Register(selfGuard)
+	var servers sync.WaitGroup
+	servers.Add(3)
+	go func() {
+		defer servers.Done()
+		defer crash.Recover("control")
+		serveControl(controlCtx, cancel, drainCtx, sup, sched)
+	}()
+	go func() {
+		defer servers.Done()
+		defer crash.Recover("health")
+		serveHealth(controlCtx, ctx, sup, sched)
+	}()
+	go func() {
+		defer servers.Done()
+		defer crash.Recover("metrics")
+		serveMetrics(controlCtx)
+	}()
+	defer func() {
+		stopControl()
+		servers.Wait()
+	}()
+	// Periodic work runs as jobs of the scheduler; runs in progress at
+	// shutdown use drainCtx
+	go func() {
+		defer wg.Done()
+		defer crash.Recover("scheduler")
+		sched.Run(ctx, drainCtx)
+	}()
+	if !shipping.Disabled {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer crash.Recover("log shipping")
+			shipper.Run(ctx, drainCtx)
+		}()
+	}
+	if exe != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer crash.Recover("update")
+			confirmUpdate(ctx, exe, restart)
+		}()
+		if config.GetConfig().Update.Enabled {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer crash.Recover("update")
+				runUpdater(ctx, drainCtx, exe, restart)
+			}()
+		}
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer crash.Recover("crash reports")
+		reportCrashes(ctx, drainCtx)
+	}()
+
+	// Wait for context to be done, keeping the systemd watchdog fed while the
+	// scheduled jobs make progress
+	runWatchdog(ctx, sched)
+
+	timeout := time.Duration(config.GetConfig().ShutdownTimeout) * time.Second
+	logger.Info("Shutting down, draining in-flight work", "timeout", timeout.String())
+	notify(sdnotify.Stopping, sdnotify.Status("Shutting down"))
+	deadline := time.AfterFunc(timeout, cancelDrain)
+	defer deadline.Stop()
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-drainCtx.Done():
+		logger.Warn("Shutdown deadline reached, abandoning in-flight work", "timeout", timeout.String())
+	}
+
+	// A restart into another version is not going offline
+	if restartInto != "" {
+		logger.Info("Agent stopped, restarting")
+		return
+	}
+
+	// Give the offline heartbeat a few seconds even if draining used up the
+	// whole deadline, otherwise the server only notices the agent is gone
+	// when heartbeats stop arriving
+	offlineCtx, cancelOffline := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelOffline()
+	if err := api.PingOffline(offlineCtx, client); err != nil {
+		logger.Error("Failed to send offline heartbeat", "error", err)
+	}
+	logger.Info("Agent stopped")
 }
 
-// runPingInIntervals continuously pings the SIEM server based on the PingInterval
-func runPingInIntervals(ctx context.Context) {
+// heartbeatJob sends a heartbeat every ping interval, starting right away,
+// and reports the result in the systemd status
+func heartbeatJob() scheduler.Job {
 	conf := config.GetConfig()
 	pingInterval := time.Duration(conf.PingInterval) * time.Second
 	if conf.PingInterval < 5 {
 		pingInterval = 5 * time.Second
 	}
+	timeout := 30 * time.Second
+	if pingInterval > timeout {
+		timeout = pingInterval
+	}
 
-	ticker := time.NewTicker(pingInterval)
-	defer ticker.Stop()
+	return scheduler.Job{
+		Name:      "heartbeat",
+		Schedule:  scheduler.Every(pingInterval),
+		Timeout:   timeout,
+		Immediate: true,
+		Run: func(ctx context.Context) error {
+			err := api.PingContext(ctx, client)
+			heartbeats.record(err)
+			if err != nil {
+				logger.Warn("Heartbeat failed", "error", err)
+				notify(sdnotify.Status("Last heartbeat failed at %s: %v", time.Now().Format(time.RFC3339), err))
+			} else {
+				notify(sdnotify.Status("Last heartbeat succeeded at %s", time.Now().Format(time.RFC3339)))
+			}
+			return err
+		},
+	}
+}
 
+// watchdogGrace is how long a job may be overdue or run past its timeout
+// before the agent counts as hung
+const watchdogGrace = time.Minute
+
+// runWatchdog blocks until ctx is done, sending WATCHDOG=1 to systemd at half
+// the interval it expects them when the unit has WatchdogSec set. The pings
+// stop while a scheduled job is stuck, so systemd restarts a hung agent.
+func runWatchdog(ctx context.Context, sched *scheduler.Scheduler) {
+	interval, ok := sdnotify.WatchdogInterval()
+	if !ok {
+		<-ctx.Done()
+		return
+	}
+	logger.Info("systemd watchdog enabled", "interval", interval.String())
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	hung := false
 	for {
+		stalled := sched.Stalled(watchdogGrace)
+		switch {
+		case len(stalled) == 0:
+			if hung {
+				logger.Info("Jobs are making progress again, pinging the systemd watchdog")
+				hung = false
+			}
+			notify(sdnotify.Watchdog)
+		case !hung:
+			logger.Error("Jobs are stuck, no longer pinging the systemd watchdog", "jobs", strings.Join(stalled, ", "))
+			notify(sdnotify.Status("Stuck jobs: %s", strings.Join(stalled, ", ")))
+			hung = true
+		}
 		select {
 		case <-ctx.Done():
-			log.Println("Stopping pinging due to service shutdown")
 			return
 		case <-ticker.C:
-			if err := api.Ping(client); err != nil {
-				log.Printf("ping failed: %v", err)
-			}
 		}
 	}
 }
+
+// notify sends states to systemd when running as a Type=notify unit
+func notify(states ...string) {
+	if _, err := sdnotify.Notify(states...); err != nil {
+		logger.Warn("sd_notify failed", "error", err)
+	}
+}
@@ -0,0 +1,248 @@
+// cmd/control.go
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"ss-agent/api"
+	"ss-agent/config"
+	"ss-agent/control"
+	"ss-agent/service"
+	"ss-agent/service/supervisor"
+	"ss-agent/utils/guard"
+	"ss-agent/utils/logging"
+	"ss-agent/utils/scheduler"
+)
+
+// AgentStatus is what the running agent reports for 'ss-agent status'
+type AgentStatus struct {
+	PID                int                        `json:"pid"`
+	AgentID            string                     `json:"agent_id,omitempty"`
+	Version            string                     `json:"version"`
+	StartedAt          time.Time                  `json:"started_at"`
+	Uptime             string                     `json:"uptime"`
+	ConfigFile         string                     `json:"config_file"`
+	LastHeartbeat      *time.Time                 `json:"last_heartbeat,omitempty"`
+	LastHeartbeatError string                     `json:"last_heartbeat_error,omitempty"`
+	Heartbeats         int                        `json:"heartbeats"`
+	HeartbeatFailures  int                        `json:"heartbeat_failures"`
+	QueueDepth         int                        `json:"queue_depth"` // supervisor transitions waiting for the next heartbeat
+	Services           []supervisor.ServiceStatus `json:"services"`
+	Crashes            *CrashStatus               `json:"crashes,omitempty"`
+	Resources          *guard.Status              `json:"resources,omitempty"` // the agent's own usage and limits
+}
+
+// heartbeatStats tracks the heartbeats of the running agent
+type heartbeatStats struct {
+	mu        sync.Mutex
+	last      time.Time
+	lastErr   error
+	lastOK    time.Time
+	succeeded int
+	failed    int
+}
+
+var (
+	agentVersion string
+	agentStarted time.Time
+	heartbeats   heartbeatStats
+	selfGuard    *guard.Guard // set while the agent runs
+)
+
+func (h *heartbeatStats) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = time.Now()
+	h.lastErr = err
+	if err != nil {
+		h.failed++
+	} else {
+		h.lastOK = h.last
+		h.succeeded++
+	}
+}
+
+// currentStatus collects the state of the running agent
+func currentStatus(sup *supervisor.Supervisor) AgentStatus {
+	status := AgentStatus{
+		PID:        os.Getpid(),
+		AgentID:    agentID(),
+		Version:    agentVersion,
+		StartedAt:  agentStarted,
+		Uptime:     time.Since(agentStarted).Round(time.Second).String(),
+		ConfigFile: config.ConfigFile(),
+		QueueDepth: sup.Pending(),
+		Services:   sup.Statuses(),
+		Crashes:    crashStatus(),
+	}
+	if selfGuard != nil {
+		resources := selfGuard.Status()
+		status.Resources = &resources
+	}
+	heartbeats.mu.Lock()
+	defer heartbeats.mu.Unlock()
+	if !heartbeats.last.IsZero() {
+		last := heartbeats.last
+		status.LastHeartbeat = &last
+	}
+	if heartbeats.lastErr != nil {
+		status.LastHeartbeatError = heartbeats.lastErr.Error()
+	}
+	status.Heartbeats = heartbeats.succeeded
+	status.HeartbeatFailures = heartbeats.failed
+	return status
+}
+
+// lastSuccess returns when a heartbeat last got through
+func (h *heartbeatStats) lastSuccess() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastOK
+}
+
+// serveControl answers CLI calls on the control socket until ctx is done.
+// stop cancels the agent's root context.
+func serveControl(ctx context.Context, stop context.CancelFunc, reqCtx context.Context, sup *supervisor.Supervisor, sched *scheduler.Scheduler) {
+	server := control.NewServer(control.DefaultPath)
+
+	server.Handle("status", func(json.RawMessage) (interface{}, error) {
+		return currentStatus(sup), nil
+	})
+
+	server.Handle("stop", func(json.RawMessage) (interface{}, error) {
+		logger.Info("Stop requested over the control socket")
+		stop()
+		return os.Getpid(), nil
+	})
+
+	server.Handle("reload", func(json.RawMessage) (interface{}, error) {
+		logger.Info("Reload requested over the control socket")
+		if err := config.Reload(); err != nil {
+			return nil, fmt.Errorf("failed to reload %s: %v", config.ConfigFile(), err)
+		}
+		if err := applyConfig(sup, sched); err != nil {
+			return nil, fmt.Errorf("reloaded %s, but %v", config.ConfigFile(), err)
+		}
+		return config.ConfigFile(), nil
+	})
+
+	server.Handle("logs", recentLogs)
+
+	server.Handle("jobs", func(json.RawMessage) (interface{}, error) {
+		return sched.Jobs(), nil
+	})
+
+	server.Handle("run-job", func(params json.RawMessage) (interface{}, error) {
+		var req runJobRequest
+		if err := json.Unmarshal(params, &req); err != nil {
+			return nil, err
+		}
+		return sched.RunNow(req.Name)
+	})
+
+	server.Handle("ping", func(json.RawMessage) (interface{}, error) {
+		err := api.PingContext(reqCtx, client)
+		heartbeats.record(err)
+		if err != nil {
+			return nil, err
+		}
+		return "pong", nil
+	})
+
+	if err := server.Serve(ctx); err != nil {
+		logger.Error("Control socket unavailable", "error", err)
+	}
+}
+
+// applyConfig applies a reloaded configuration to the running agent: the log
+// level, the TLS settings of the API client, the heartbeat schedule, the
+// supervise policies and the resource limits of the managed services. The
+// other settings are read as they are used or need a restart, see 'reload'.
+func applyConfig(sup *supervisor.Supervisor, sched *scheduler.Scheduler) error {
+	conf := config.GetConfig()
+	recordConfig(agentState)
+	// The log level follows the configuration unless set on the command line
+	if logLevel == "" && !debugMode {
+		if err := logging.SetLevel(conf.Logging.Level); err != nil {
+			return err
+		}
+	}
+	reloadHTTPClient(conf)
+	if err := rescheduleJob(sched, heartbeatJob()); err != nil {
+		return fmt.Errorf("failed to reschedule the heartbeat: %v", err)
+	}
+	sup.SetPolicies(conf)
+
+	var failed []string
+	for svc, err := range service.ApplyAllResourceLimits() {
+		logger.Error("Failed to apply resource limits", "service", svc, "error", err)
+		failed = append(failed, fmt.Sprintf("%s: %v", svc, err))
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("failed to apply resource limits: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// printAgentStatus prints the status reported by the running agent
+func printAgentStatus(status AgentStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Agent:\t[RUNNING] PID %d, version %s\n", status.PID, status.Version)
+	if status.AgentID != "" {
+		fmt.Fprintf(w, "Agent ID:\t%s\n", status.AgentID)
+	}
+	fmt.Fprintf(w, "Uptime:\t%s (since %s)\n", status.Uptime, status.StartedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "Config:\t%s\n", status.ConfigFile)
+	switch {
+	case status.LastHeartbeat == nil:
+		fmt.Fprintf(w, "Last heartbeat:\tnone yet\n")
+	case status.LastHeartbeatError != "":
+		fmt.Fprintf(w, "Last heartbeat:\t%s [FAILED] %s\n", status.LastHeartbeat.Format(time.RFC3339), status.LastHeartbeatError)
+	default:
+		fmt.Fprintf(w, "Last heartbeat:\t%s [OK]\n", status.LastHeartbeat.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "Heartbeats:\t%d sent, %d failed\n", status.Heartbeats, status.HeartbeatFailures)
+	fmt.Fprintf(w, "Queue depth:\t%d\n", status.QueueDepth)
+	printCrashStatus(w, status.Crashes)
+	printResourceStatus(w, status.Resources)
+	w.Flush()
+
+	if len(status.Services) == 0 {
+		return
+	}
+	fmt.Println("\nSupervised services:")
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tSTATE\tPOLICY\tRESTARTS\tNOTE")
+	for _, svc := range status.Services {
+		note := svc.LastError
+		if svc.CrashLoop {
+			note = "crash loop, not restarting: " + note
+		} else if svc.NextRestart != nil {
+			note = "restart at " + svc.NextRestart.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", svc.Name, svc.State, svc.Policy, svc.Restarts, note)
+	}
+	w.Flush()
+}
+
+// waitForAgentExit waits until the agent stops answering on the control socket
+func waitForAgentExit(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if err := control.Call(control.DefaultPath, "status", nil, nil); err == control.ErrNotRunning {
+			return true
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return false
+}
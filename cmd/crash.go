@@ -0,0 +1,123 @@
+// cmd/crash.go
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"ss-agent/api"
+	"ss-agent/config"
+	"ss-agent/utils/crash"
+)
+
+const (
+	// crashLoopCount crashes within crashLoopWindow are a crash loop
+	crashLoopCount  = 3
+	crashLoopWindow = time.Hour
+	// maxCrashReports bounds the reports kept while they cannot be sent
+	maxCrashReports = 20
+)
+
+// CrashStatus is the crash history of the agent shown by 'ss-agent status'
+type CrashStatus struct {
+	Recent    int        `json:"recent"` // crashes within Window
+	Window    string     `json:"window"`
+	Last      *time.Time `json:"last,omitempty"`
+	CrashLoop bool       `json:"crash_loop"`
+	Pending   int        `json:"pending"` // reports not sent to the SIEM yet
+}
+
+// crashDir returns where crash reports are kept
+func crashDir() string {
+	if dir := config.GetConfig().CrashDir; dir != "" {
+		return dir
+	}
+	return filepath.Join(filepath.Dir(getLogFilePath()), "crash")
+}
+
+// crashStatus returns the crash history, nil when the agent has not crashed
+// recently and no reports are waiting
+func crashStatus() *CrashStatus {
+	dir := crashDir()
+	count, last := crash.Recent(dir, crashLoopWindow)
+	pending, _ := crash.Pending(dir)
+	if count == 0 && len(pending) == 0 {
+		return nil
+	}
+	status := &CrashStatus{
+		Recent:    count,
+		Window:    crashLoopWindow.String(),
+		CrashLoop: count >= crashLoopCount,
+		Pending:   len(pending),
+	}
+	if !last.IsZero() {
+		status.Last = &last
+	}
+	return status
+}
+
+func printCrashStatus(w io.Writer, status *CrashStatus) {
+	if status == nil {
+		return
+	}
+	line := fmt.Sprintf("%d in the last %s", status.Recent, status.Window)
+	if status.Last != nil {
+		line += ", last at " + status.Last.Local().Format(time.RFC3339)
+	}
+	if status.CrashLoop {
+		line += " [CRASH LOOP]"
+	}
+	if status.Pending > 0 {
+		line += fmt.Sprintf(", %d report(s) not sent yet", status.Pending)
+	}
+	fmt.Fprintf(w, "Crashes:\t%s\n", line)
+}
+
+// reportCrashes sends the crash reports left by earlier runs to the SIEM and
+// removes them, retrying every minute until all are sent or ctx is done
+func reportCrashes(ctx, reqCtx context.Context) {
+	dir := crashDir()
+	if err := crash.Prune(dir, maxCrashReports); err != nil {
+		logger.Warn("Failed to prune crash reports", "dir", dir, "error", err)
+	}
+	if count, last := crash.Recent(dir, crashLoopWindow); count >= crashLoopCount {
+		logger.Warn("Agent is in a crash loop", "crashes", count, "window", crashLoopWindow.String(), "last", last)
+	}
+
+	for {
+		paths, err := crash.Pending(dir)
+		if err != nil {
+			logger.Warn("Failed to list crash reports", "dir", dir, "error", err)
+			return
+		}
+		done := 0
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				logger.Warn("Failed to read crash report", "file", path, "error", err)
+				done++
+				continue
+			}
+			if err := api.ReportCrash(reqCtx, client, data); err != nil {
+				logger.Debug("Failed to send crash report, retrying later", "file", path, "error", err)
+				break
+			}
+			os.Remove(path)
+			done++
+			logger.Info("Sent crash report", "file", path)
+		}
+		if done == len(paths) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Minute):
+		}
+	}
+}
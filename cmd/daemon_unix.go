@@ -0,0 +1,31 @@
+// cmd/daemon_unix.go
+
+//go:build !windows
+// +build !windows
+
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// detach starts the daemon in a new session, so it has no controlling
+// terminal and does not get the signals sent to the shell's process group
+func detach(cmd *exec.Cmd) {
+	cmd.Dir = "/"
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+// prepareRestart is called before the agent shuts down to restart. Nothing
+// is needed on Unix, restartSelf replaces the process once it has stopped.
+func prepareRestart() error {
+	return nil
+}
+
+// restartSelf replaces the stopped agent with exe, keeping the PID, the
+// arguments and the environment, so the service manager sees no restart
+func restartSelf(exe string) error {
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
@@ -0,0 +1,46 @@
+// cmd/daemon_windows.go
+
+//go:build windows
+// +build windows
+
+package cmd
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+
+	"ss-agent/installer"
+)
+
+// detach starts the daemon without a console and in its own process group,
+// so closing the console or pressing Ctrl+C does not stop it
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: windows.DETACHED_PROCESS | windows.CREATE_NEW_PROCESS_GROUP,
+		HideWindow:    true,
+	}
+}
+
+// prepareRestart has the service manager start the agent again a few seconds
+// after this process has stopped. Only the service can restart itself.
+func prepareRestart() error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	if !isService {
+		return errors.New("only the agent service can restart itself")
+	}
+	cmd := exec.Command("cmd.exe", "/c", "ping -n 6 127.0.0.1 >nul & net start "+installer.ServiceName)
+	detach(cmd)
+	return cmd.Start()
+}
+
+// restartSelf does nothing, prepareRestart already arranged the restart
+func restartSelf(exe string) error {
+	return nil
+}
@@ -0,0 +1,60 @@
+// cmd/doctor.go
+
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"ss-agent/control"
+	"ss-agent/doctor"
+)
+
+// doctorCommand returns the 'doctor' command, which checks the configuration,
+// the connection to the SIEM and the managed services and explains what to fix
+func doctorCommand() *cobra.Command {
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose the agent's configuration, connectivity and services",
+		Long: `Run a series of checks and print what is wrong with a hint on how to fix it:
+the configuration, the client certificates, DNS, TCP and TLS to api_url, an
+authenticated ping, the PID file, the log directory, the state store and the
+managed services.
+
+Exits with status 1 if any check failed.
+
+Examples:
+  ss-agent doctor
+  ss-agent doctor --config /etc/ss-agent/config.json --json`,
+		Args: cobra.NoArgs,
+		// No loadConfig: a broken configuration is one of the things to diagnose
+		Run: func(cmd *cobra.Command, args []string) {
+			report := doctor.Run(doctor.Env{
+				ConfigPath:     configPath,
+				PidFile:        pidFile,
+				LogFile:        logFile,
+				DefaultLogFile: getLogFilePath(),
+				DataDir:        getDataDirPath(),
+				ControlPath:    control.DefaultPath,
+				NewClient:      newHTTPClient,
+			})
+
+			if asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				enc.SetEscapeHTML(false)
+				enc.Encode(report)
+			} else {
+				doctor.Print(os.Stdout, report)
+			}
+			if report.Failed() {
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the results as JSON")
+	return cmd
+}
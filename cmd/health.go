@@ -0,0 +1,152 @@
+// cmd/health.go
+
+package cmd
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"ss-agent/config"
+	"ss-agent/service/supervisor"
+	"ss-agent/utils/metrics"
+	"ss-agent/utils/scheduler"
+)
+
+// readinessCheck is one line of the /readyz answer
+type readinessCheck struct {
+	name string
+	err  error
+}
+
+// serveHealth serves /healthz, /readyz and /status on the configured address
+// until ctx is done. The agent is reported as not ready once agentCtx is done,
+// so probes stop routing to it while it drains. It also serves /metrics when
+// the metrics endpoint is configured on the same address.
+func serveHealth(ctx, agentCtx context.Context, sup *supervisor.Supervisor, sched *scheduler.Scheduler) {
+	conf := config.GetConfig().Health
+	if conf.Listen == "" {
+		return
+	}
+	if host, _, err := net.SplitHostPort(conf.Listen); err == nil && !isLoopback(host) && conf.AuthToken == "" {
+		logger.Warn("Health endpoint is reachable from other hosts without an auth_token", "listen", conf.Listen)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		checks := readinessChecks(agentCtx, sched)
+		ready := true
+		for _, c := range checks {
+			if c.err != nil {
+				ready = false
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		for _, c := range checks {
+			if c.err != nil {
+				fmt.Fprintf(w, "[FAILED] %s: %v\n", c.name, c.err)
+			} else {
+				fmt.Fprintf(w, "[OK] %s\n", c.name)
+			}
+		}
+	})
+	if config.GetConfig().Metrics.Listen == conf.Listen {
+		mux.Handle("/metrics", metrics.Handler())
+	}
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(currentStatus(sup))
+	})
+
+	server := &http.Server{
+		Addr:              conf.Listen,
+		Handler:           requireToken(mux),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	listener, err := net.Listen("tcp", conf.Listen)
+	if err != nil {
+		logger.Error("Health endpoint unavailable", "error", err)
+		return
+	}
+	logger.Info("Health endpoint listening", "address", listener.Addr().String())
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		logger.Error("Health endpoint failed", "error", err)
+	}
+}
+
+// readinessChecks reports whether the agent is configured, enrolled and
+// getting its heartbeats through
+func readinessChecks(agentCtx context.Context, sched *scheduler.Scheduler) []readinessCheck {
+	conf := config.GetConfig()
+	checks := []readinessCheck{{name: "config"}, {name: "registered"}, {name: "heartbeat"}}
+
+	if config.ConfigFile() == "" {
+		checks[0].err = errors.New("no configuration loaded")
+	}
+	if conf.OrganizationKey == "" || conf.APIAccessKey == "" || conf.APISecretKey == "" {
+		checks[1].err = errors.New("organization_key and API keys are not set")
+	}
+	// Allow a couple of missed heartbeats before the agent is taken out. The
+	// runs are those of the heartbeat job, which may have its schedule
+	// overridden in the jobs section.
+	if last := heartbeats.lastSuccess(); last.IsZero() {
+		checks[2].err = errors.New("no heartbeat has got through yet")
+	} else if deadline := sched.Deadline("heartbeat", last, 3); !deadline.IsZero() && time.Now().After(deadline) {
+		checks[2].err = fmt.Errorf("last successful heartbeat was %s ago", time.Since(last).Round(time.Second))
+	}
+
+	if agentCtx.Err() != nil {
+		checks = append(checks, readinessCheck{name: "running", err: errors.New("shutting down")})
+	}
+	return checks
+}
+
+// requireToken rejects requests without the configured bearer token. The
+// token is read on every request, so a reload takes effect right away.
+func requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := config.GetConfig().Health.AuthToken
+		if token != "" {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,71 @@
+// cmd/install.go
+
+package cmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+
+	"github.com/spf13/cobra"
+
+	"ss-agent/installer"
+)
+
+// installCommands returns the 'install' and 'uninstall' commands, which set up
+// the agent itself as a service
+func installCommands(version string) []*cobra.Command {
+	var opts installer.Options
+	var insecure, noStart, keepConfig bool
+
+	var installCmd = &cobra.Command{
+		Use:   "install",
+		Short: "Install the agent as a service",
+		Long: `Copy this binary to its standard location, create the configuration, log and
+PID directories, install the configuration and register the agent with systemd,
+launchd or the Windows service manager. With --token the agent is enrolled and
+the issued credentials are written to the configuration.
+
+Running install again only repairs what is missing or out of date. An existing
+configuration is kept unless --force is given.
+
+Examples:
+  ss-agent install --api-url https://siem.example.com/api --token <enrollment-token>
+  ss-agent install --config ./config.json`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			opts.Layout = installer.DefaultLayout()
+			opts.Version = version
+			opts.ConfigFile = configPath
+			opts.Start = !noStart
+			opts.Client = &http.Client{
+				Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: insecure}},
+			}
+			if err := installer.Install(opts); err != nil {
+				fatalf("Installation failed: %v", err)
+			}
+			fmt.Printf("ss-agent %s installed to %s\n", version, opts.Layout.Binary)
+			fmt.Printf("Configuration: %s\n", opts.Layout.ConfigFile())
+		},
+	}
+	installCmd.Flags().StringVar(&opts.APIURL, "api-url", "", "API URL for the generated configuration and enrollment")
+	installCmd.Flags().StringVar(&opts.Token, "token", "", "Enrollment token")
+	installCmd.Flags().BoolVar(&opts.Force, "force", false, "Replace an existing configuration")
+	installCmd.Flags().BoolVar(&noStart, "no-start", false, "Install and enable the service without starting it")
+	installCmd.Flags().BoolVar(&insecure, "skip-ssl-verify", false, "Do not verify the server certificate when enrolling")
+
+	var uninstallCmd = &cobra.Command{
+		Use:   "uninstall",
+		Short: "Stop the agent service and remove everything install created",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := installer.Uninstall(installer.DefaultLayout(), keepConfig); err != nil {
+				fatalf("Uninstall failed: %v", err)
+			}
+			fmt.Println("ss-agent uninstalled")
+		},
+	}
+	uninstallCmd.Flags().BoolVar(&keepConfig, "keep-config", false, "Keep the configuration, certificates and agent state")
+
+	return []*cobra.Command{installCmd, uninstallCmd}
+}
@@ -0,0 +1,160 @@
+// cmd/jobs.go
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"ss-agent/config"
+	"ss-agent/control"
+	"ss-agent/utils/scheduler"
+)
+
+// addJob schedules a job with the overrides from the jobs section of the
+// configuration. An invalid override is logged and the default kept.
+func addJob(sched *scheduler.Scheduler, job scheduler.Job) {
+	if err := sched.Add(withOverrides(job)); err != nil {
+		logger.Error("Failed to schedule job", "job", job.Name, "error", err)
+	}
+}
+
+// rescheduleJob applies the schedule of job with the current overrides to the
+// scheduled job of the same name, e.g. after a reload
+func rescheduleJob(sched *scheduler.Scheduler, job scheduler.Job) error {
+	return sched.Reschedule(withOverrides(job))
+}
+
+// withOverrides applies the overrides from the jobs section of the
+// configuration to job
+func withOverrides(job scheduler.Job) scheduler.Job {
+	if override, ok := config.GetConfig().Jobs[job.Name]; ok {
+		if override.Schedule != "" {
+			schedule, err := scheduler.Parse(override.Schedule)
+			if err != nil {
+				logger.Error("Invalid job schedule, keeping the default", "job", job.Name, "default", job.Schedule.String(), "error", err)
+			} else {
+				job.Schedule = schedule
+			}
+		}
+		if override.Jitter > 0 {
+			job.Jitter = time.Duration(override.Jitter) * time.Second
+		}
+		if override.Timeout > 0 {
+			job.Timeout = time.Duration(override.Timeout) * time.Second
+		}
+	}
+	return job
+}
+
+// runJobRequest are the parameters of the "run-job" control method
+type runJobRequest struct {
+	Name string `json:"name"`
+}
+
+// jobsCommand returns the 'jobs' command with its subcommands
+func jobsCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "jobs",
+		Short: "List and run the periodic jobs of the running agent",
+	}
+	cmd.AddCommand(jobsListCommand(), jobsRunCommand())
+	return cmd
+}
+
+func jobsListCommand() *cobra.Command {
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the periodic jobs with their schedule, last and next run",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var jobs []scheduler.Status
+			err := control.Call(control.DefaultPath, "jobs", nil, &jobs)
+			if err == control.ErrNotRunning {
+				fatalf("The agent is not running")
+			}
+			if err != nil {
+				fatalf("Failed to list jobs: %v", err)
+			}
+			if asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				enc.Encode(jobs)
+				return
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "JOB\tSCHEDULE\tLAST RUN\tRESULT\tDURATION\tNEXT RUN\tRUNS\tFAILED\tSKIPPED")
+			for _, j := range jobs {
+				lastRun, result, nextRun := "never", "-", "-"
+				if j.LastRun != nil {
+					lastRun = j.LastRun.Local().Format(time.RFC3339)
+					result = j.LastResult
+				}
+				if j.Running {
+					result = "running"
+				}
+				if j.NextRun != nil {
+					nextRun = j.NextRun.Local().Format(time.RFC3339)
+				}
+				duration := j.LastDuration
+				if duration == "" {
+					duration = "-"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\t%d\n", j.Name, j.Schedule, lastRun, result,
+					duration, nextRun, j.Runs, j.Failures, j.Skipped)
+			}
+			w.Flush()
+
+			var failed []string
+			for _, j := range jobs {
+				if j.LastError != "" {
+					failed = append(failed, fmt.Sprintf("  %s: %s", j.Name, j.LastError))
+				}
+			}
+			if len(failed) > 0 {
+				fmt.Printf("\nLast errors:\n%s\n", strings.Join(failed, "\n"))
+			}
+		},
+	}
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the jobs as JSON")
+	return cmd
+}
+
+func jobsRunCommand() *cobra.Command {
+	var timeout time.Duration
+	cmd := &cobra.Command{
+		Use:   "run <job>",
+		Short: "Run a periodic job now and wait for its result",
+		Long: `Run a job of the running agent right away, outside its schedule, and
+print its result. A job that is already running is not started again.
+
+Examples:
+  ss-agent jobs run heartbeat`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			control.CallTimeout = timeout
+			var st scheduler.Status
+			err := control.Call(control.DefaultPath, "run-job", runJobRequest{Name: args[0]}, &st)
+			if err == control.ErrNotRunning {
+				fatalf("The agent is not running")
+			}
+			if err != nil {
+				fatalf("Failed to run job: %v", err)
+			}
+			if st.LastResult != scheduler.ResultOK {
+				fatalf("Job %s: [%s] after %s: %s", st.Name, strings.ToUpper(st.LastResult), st.LastDuration, st.LastError)
+			}
+			fmt.Printf("Job %s: [OK] in %s\n", st.Name, st.LastDuration)
+		},
+	}
+	cmd.Flags().DurationVar(&timeout, "timeout", 5*time.Minute, "How long to wait for the job to finish")
+	return cmd
+}
@@ -0,0 +1,77 @@
+// cmd/limits.go
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"ss-agent/service"
+)
+
+// limitsCommand returns the 'service limits' command, which applies the
+// configured resource limits as systemd drop-ins
+func limitsCommand(loadConfig func(cmd *cobra.Command, args []string)) *cobra.Command {
+	return &cobra.Command{
+		Use:   "limits [service|all]",
+		Short: "Apply and verify the resource limits of a service or all services",
+		Long: `Write the resource limits from services.<name>.resources (memory_max,
+cpu_quota, io_weight, nice) into a systemd drop-in under
+/etc/systemd/system/<unit>.d/, reload systemd and verify that the unit reports
+them. Services without limits have their drop-in removed. Zeek's limits go to
+zeek.service if that unit is installed, otherwise to ss-agent-zeek.slice, the
+slice zeekctl is run in; its nice level applies from the next start.
+
+Examples:
+  ss-agent service limits zeek
+  ss-agent service limits all --dry-run`,
+		PreRun: loadConfig,
+		Args:   cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			serviceName := strings.ToLower(args[0])
+			if !contains(validServices, serviceName) {
+				fmt.Printf("Invalid service name: %s\n", args[0])
+				fmt.Printf("Valid services are: %s\n", strings.Join(service.AllServices, ", "))
+				fmt.Printf("Or use 'all' to manage all services.\n")
+				os.Exit(1)
+			}
+			services := []string{serviceName}
+			if serviceName == "all" {
+				services = service.AllServices
+			}
+			if serviceDryRun {
+				for _, svc := range services {
+					svc := svc
+					runPlannedAction(svc, "apply limits", func() error {
+						return service.ApplyResourceLimits(svc)
+					})
+				}
+				return
+			}
+
+			failed := false
+			for _, svc := range services {
+				if err := service.ApplyResourceLimits(svc); err != nil {
+					fmt.Printf("%-15s: [ERROR] %v\n", svc, err)
+					failed = true
+					continue
+				}
+				status := service.ResourceLimitsStatus(svc)
+				if status.String() == "" {
+					fmt.Printf("%-15s: no limits configured\n", svc)
+				} else {
+					fmt.Printf("%-15s: %s\n", svc, status)
+				}
+				if status.Err != nil {
+					failed = true
+				}
+			}
+			if failed {
+				os.Exit(1)
+			}
+		},
+	}
+}
@@ -0,0 +1,114 @@
+// cmd/logs.go
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"ss-agent/control"
+	"ss-agent/utils/logging"
+)
+
+// logsRequest are the parameters of the "logs" control method
+type logsRequest struct {
+	Lines int    `json:"lines"`
+	Level string `json:"level"`
+}
+
+// recentLogs returns the agent's buffered log lines at or above the level,
+// keeping the last req.Lines of them
+func recentLogs(params json.RawMessage) (interface{}, error) {
+	var req logsRequest
+	if len(params) > 0 {
+		if err := json.Unmarshal(params, &req); err != nil {
+			return nil, err
+		}
+	}
+	min, err := logging.ParseLevel(req.Level)
+	if err != nil {
+		return nil, err
+	}
+	if req.Level == "" {
+		min = slog.LevelDebug
+	}
+
+	var entries []logging.Entry
+	for _, e := range logging.Recent(0) {
+		var lvl slog.Level
+		if lvl.UnmarshalText([]byte(e.Level)) == nil && lvl < min {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if req.Lines > 0 && len(entries) > req.Lines {
+		entries = entries[len(entries)-req.Lines:]
+	}
+	return entries, nil
+}
+
+// logsCommand returns the 'logs' command, which prints the recent log lines
+// the running agent keeps in memory
+func logsCommand() *cobra.Command {
+	var req logsRequest
+	var asJSON bool
+	cmd := &cobra.Command{
+		Use:   "logs",
+		Short: "Show the recent log lines of the running agent",
+		Long: `Print the most recent log lines the running agent keeps in memory
+(logging.buffer_lines), without reading its log file.
+
+Examples:
+  ss-agent logs -n 50
+  ss-agent logs --level warn --json`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			var entries []logging.Entry
+			err := control.Call(control.DefaultPath, "logs", req, &entries)
+			if err == control.ErrNotRunning {
+				fatalf("The agent is not running")
+			}
+			if err != nil {
+				fatalf("Failed to fetch logs from the agent: %v", err)
+			}
+			if asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				enc.Encode(entries)
+				return
+			}
+			for _, e := range entries {
+				fmt.Println(formatEntry(e))
+			}
+		},
+	}
+	cmd.Flags().IntVarP(&req.Lines, "lines", "n", 100, "Number of lines to show, 0 for all buffered lines")
+	cmd.Flags().StringVar(&req.Level, "level", "", "Only show lines at or above this level: debug, info, warn or error")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "Print the lines as JSON")
+	return cmd
+}
+
+func formatEntry(e logging.Entry) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s ", e.Time.Format(time.RFC3339), e.Level)
+	if e.Subsystem != "" {
+		fmt.Fprintf(&b, "[%s] ", e.Subsystem)
+	}
+	b.WriteString(e.Message)
+	keys := make([]string, 0, len(e.Attrs))
+	for k := range e.Attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%q", k, e.Attrs[k])
+	}
+	return b.String()
+}
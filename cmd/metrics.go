@@ -0,0 +1,100 @@
+// cmd/metrics.go
+
+package cmd
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"ss-agent/api"
+	"ss-agent/config"
+	"ss-agent/service/servicectl"
+	"ss-agent/service/supervisor"
+	"ss-agent/utils/metrics"
+)
+
+// agentMetrics reports the state of the managed services and the agent's
+// queues when metrics are scraped
+func agentMetrics(sup *supervisor.Supervisor, shipper *api.LogShipper) metrics.Collector {
+	return metrics.CollectorFunc(func() []metrics.Family {
+		state := metrics.Family{Name: "ss_agent_service_state", Type: metrics.TypeGauge,
+			Help: "State of a managed service, 1 for the current state and 0 for the others."}
+		restarts := metrics.Family{Name: "ss_agent_service_restarts_total", Type: metrics.TypeCounter,
+			Help: "Restarts of a managed service by the supervisor."}
+		crashLoop := metrics.Family{Name: "ss_agent_service_crash_loop", Type: metrics.TypeGauge,
+			Help: "Whether the supervisor gave up restarting a managed service."}
+
+		for _, svc := range sup.Statuses() {
+			name := metrics.Label{Name: "service", Value: svc.Name}
+			for st := servicectl.StateUnknown; st <= servicectl.StateNotInstalled; st++ {
+				value := 0.0
+				if st.String() == svc.State {
+					value = 1
+				}
+				state.Samples = append(state.Samples, metrics.Sample{
+					Labels: []metrics.Label{name, {Name: "state", Value: st.String()}},
+					Value:  value,
+				})
+			}
+			restarts.Samples = append(restarts.Samples, metrics.Sample{Labels: []metrics.Label{name}, Value: float64(svc.Restarts)})
+			value := 0.0
+			if svc.CrashLoop {
+				value = 1
+			}
+			crashLoop.Samples = append(crashLoop.Samples, metrics.Sample{Labels: []metrics.Label{name}, Value: value})
+		}
+
+		queue := metrics.Family{Name: "ss_agent_heartbeat_queue_depth", Type: metrics.TypeGauge,
+			Help:    "Supervisor transitions waiting to be sent with the next heartbeat.",
+			Samples: []metrics.Sample{{Value: float64(sup.Pending())}}}
+		logQueue := metrics.Family{Name: "ss_agent_log_queue_depth", Type: metrics.TypeGauge,
+			Help:    "Agent log events waiting to be shipped to the SIEM server.",
+			Samples: []metrics.Sample{{Value: float64(shipper.Pending())}}}
+		up := metrics.Family{Name: "ss_agent_info", Type: metrics.TypeGauge,
+			Help:    "Information about the running agent.",
+			Samples: []metrics.Sample{{Labels: []metrics.Label{{Name: "version", Value: agentVersion}}, Value: 1}}}
+		last := metrics.Family{Name: "ss_agent_last_successful_heartbeat_timestamp_seconds", Type: metrics.TypeGauge,
+			Help: "When a heartbeat last got through, 0 if none has yet."}
+		if t := heartbeats.lastSuccess(); !t.IsZero() {
+			last.Samples = []metrics.Sample{{Value: float64(t.UnixNano()) / 1e9}}
+		} else {
+			last.Samples = []metrics.Sample{{Value: 0}}
+		}
+		return []metrics.Family{state, restarts, crashLoop, queue, logQueue, up, last}
+	})
+}
+
+// serveMetrics serves /metrics on the configured address until ctx is done.
+// When it is the health address, the health listener serves /metrics instead.
+func serveMetrics(ctx context.Context) {
+	conf := config.GetConfig()
+	if conf.Metrics.Listen == "" || conf.Metrics.Listen == conf.Health.Listen {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	server := &http.Server{
+		Addr:              conf.Metrics.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	listener, err := net.Listen("tcp", conf.Metrics.Listen)
+	if err != nil {
+		logger.Error("Metrics endpoint unavailable", "error", err)
+		return
+	}
+	logger.Info("Metrics endpoint listening", "address", listener.Addr().String())
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		logger.Error("Metrics endpoint failed", "error", err)
+	}
+}
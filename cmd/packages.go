@@ -0,0 +1,118 @@
+// cmd/packages.go
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"ss-agent/service"
+	"ss-agent/utils/runner"
+)
+
+var (
+	packageVersion string
+	packageFile    string
+)
+
+// packageCommands returns the 'service install|upgrade|uninstall' commands,
+// which manage sensors through the host package manager
+func packageCommands(loadConfig func(cmd *cobra.Command, args []string)) []*cobra.Command {
+	var installCmd = &cobra.Command{
+		Use:   "install [service]",
+		Short: "Install a service with the host package manager",
+		Long: `Install a managed service with apt, dnf, yum or zypper, from the repository
+configured under services.<name>.package or from a local package file. The
+file must hold the package of the service, and its version is verified like a
+pinned one. If another version is installed, use upgrade to replace it.
+
+Examples:
+  ss-agent service install zeek
+  ss-agent service install fluent-bit --version 2.2.0
+  ss-agent service install osqueryd --file ./osquery_5.10.2-1.linux.amd64.deb`,
+		PreRun: loadConfig,
+		Args:   cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			serviceName := checkPackageService(args[0])
+			runPlannedAction(serviceName, "install", func() error {
+				return service.Install(serviceName, service.PackageOptions{Version: packageVersion, File: packageFile})
+			})
+		},
+	}
+
+	var upgradeCmd = &cobra.Command{
+		Use:    "upgrade [service]",
+		Short:  "Upgrade a service to the pinned or latest version",
+		PreRun: loadConfig,
+		Args:   cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			serviceName := checkPackageService(args[0])
+			runPlannedAction(serviceName, "upgrade", func() error {
+				return service.Upgrade(serviceName, service.PackageOptions{Version: packageVersion, File: packageFile})
+			})
+		},
+	}
+
+	var uninstallCmd = &cobra.Command{
+		Use:    "uninstall [service]",
+		Short:  "Stop a service and remove its package",
+		PreRun: loadConfig,
+		Args:   cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			serviceName := checkPackageService(args[0])
+			runPlannedAction(serviceName, "uninstall", func() error {
+				return service.Uninstall(serviceName)
+			})
+		},
+	}
+
+	for _, c := range []*cobra.Command{installCmd, upgradeCmd} {
+		c.Flags().StringVar(&packageVersion, "version", "", "Package version to install, overrides services.<name>.package.version")
+		c.Flags().StringVar(&packageFile, "file", "", "Install from a local package file instead of a repository")
+	}
+	return []*cobra.Command{installCmd, upgradeCmd, uninstallCmd}
+}
+
+// checkPackageService validates a service name for package operations,
+// which act on one service at a time
+func checkPackageService(name string) string {
+	serviceName := strings.ToLower(name)
+	if !contains(service.AllServices, serviceName) {
+		fmt.Printf("Invalid service name: %s\n", name)
+		fmt.Printf("Valid services are: %s\n", strings.Join(service.AllServices, ", "))
+		os.Exit(1)
+	}
+	return serviceName
+}
+
+// runPlannedAction runs an operation on a service, or prints the commands it would
+// run when --dry-run is given
+func runPlannedAction(serviceName, action string, fn func() error) {
+	if serviceDryRun {
+		state, stateErr := service.ServiceState(serviceName)
+		runner.SetDryRun(true)
+		err := fn()
+		steps := runner.TakePlan()
+		runner.SetDryRun(false)
+		fmt.Println()
+		service.PrintPlan(os.Stdout, []service.PlannedAction{{
+			Service:  serviceName,
+			Action:   action,
+			State:    state,
+			StateErr: stateErr,
+			Steps:    steps,
+			Err:      err,
+		}})
+		return
+	}
+	err := fn()
+	if err != nil {
+		fatalf("Failed to %s %s: %v", action, serviceName, err)
+	}
+	log.Printf("Service %s %s completed successfully", serviceName, action)
+	fmt.Printf("Service %s %s completed successfully\n", serviceName, action)
+}
@@ -0,0 +1,85 @@
+// cmd/resources.go
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"ss-agent/config"
+	"ss-agent/utils/guard"
+)
+
+// defaultMaxGoroutines is far above what the agent needs, reaching it means
+// goroutines are leaking
+const defaultMaxGoroutines = 10000
+
+// selfLimits applies the runtime limits from self_limits and returns the
+// limits the guard enforces. Invalid sizes are logged and not enforced.
+func selfLimits(conf config.SelfLimitsConfig) guard.Limits {
+	var memory int64
+	if conf.Memory != "" {
+		var err error
+		if memory, err = guard.ParseSize(conf.Memory); err != nil {
+			logger.Error("Invalid self_limits.memory, not limiting memory", "error", err)
+		}
+	}
+	limits := guard.Limits{
+		Memory:        guard.ApplyRuntimeLimits(memory, conf.MaxCPUs),
+		MaxGoroutines: conf.MaxGoroutines,
+		Interval:      time.Duration(conf.CheckInterval) * time.Second,
+	}
+	if limits.MaxGoroutines <= 0 {
+		limits.MaxGoroutines = defaultMaxGoroutines
+	}
+	if conf.Disk != "" {
+		disk, err := guard.ParseSize(conf.Disk)
+		if err != nil {
+			logger.Error("Invalid self_limits.disk, not limiting disk usage", "error", err)
+		}
+		limits.Disk = disk
+	}
+
+	// Only the agent's own files count, the log directory may be shared.
+	// The file being written is never deleted.
+	if path := agentLogFile(); path != "" {
+		ext := filepath.Ext(path)
+		limits.DiskFiles = append(limits.DiskFiles, strings.TrimSuffix(path, ext)+"*"+ext+"*")
+		limits.Keep = append(limits.Keep, path)
+	}
+	limits.DiskFiles = append(limits.DiskFiles, filepath.Join(crashDir(), "crash-*.json"))
+	return limits
+}
+
+// printResourceStatus prints the agent's own resource usage for
+// 'ss-agent status'
+func printResourceStatus(w io.Writer, status *guard.Status) {
+	if status == nil {
+		return
+	}
+	usage := func(used, limit int64) string {
+		if limit <= 0 {
+			return guard.FormatBytes(used)
+		}
+		return fmt.Sprintf("%s of %s", guard.FormatBytes(used), guard.FormatBytes(limit))
+	}
+	label := "[OK]"
+	if status.Level != guard.Normal.String() {
+		label = fmt.Sprintf("[%s since %s]", strings.ToUpper(status.Level), status.Since.Local().Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "Resources:\t%s memory %s, %d goroutines, %d CPUs, disk %s\n", label,
+		usage(int64(status.Memory), status.MemoryLimit), status.Goroutines, status.CPUs,
+		usage(status.Disk, status.DiskLimit))
+	if len(status.Reasons) > 0 {
+		fmt.Fprintf(w, "\t%s\n", strings.Join(status.Reasons, "; "))
+	}
+	if len(status.Shedding) > 0 {
+		fmt.Fprintf(w, "\tshedding load: %s\n", strings.Join(status.Shedding, ", "))
+	}
+	if status.DiskFreed > 0 {
+		fmt.Fprintf(w, "\tdeleted %s of old logs and crash reports to stay under the disk limit\n", guard.FormatBytes(status.DiskFreed))
+	}
+}
@@ -0,0 +1,27 @@
+// cmd/signals.go
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals cancels the root context on SIGINT or SIGTERM so the agent
+// shuts down gracefully. A second signal exits immediately. It is only
+// installed by 'start', other commands keep the default behaviour of exiting
+// on the first signal.
+func handleSignals(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Info("Received signal, shutting down", "signal", sig.String())
+		cancel()
+		sig = <-signals
+		logger.Warn("Received signal again, exiting immediately", "signal", sig.String())
+		os.Exit(1)
+	}()
+}
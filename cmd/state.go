@@ -0,0 +1,244 @@
+// cmd/state.go
+
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"ss-agent/config"
+	"ss-agent/utils/osinfo"
+	"ss-agent/utils/store"
+)
+
+// Keys of the state store
+const (
+	stateAgentID    = "agent/id"
+	stateAgentRuns  = "agent/runs"
+	stateConfigLast = "config/last"
+)
+
+// agentRuns is the run history of the agent, kept in the state store
+type agentRuns struct {
+	Starts       int        `json:"starts"`
+	FirstStarted time.Time  `json:"first_started"`
+	LastStarted  time.Time  `json:"last_started"`
+	LastStopped  *time.Time `json:"last_stopped,omitempty"`
+	// Running is set while the agent runs, finding it set on start means the
+	// previous run crashed or was killed
+	Running bool   `json:"running"`
+	Version string `json:"version"`
+}
+
+// loadedConfig is the configuration file the agent last loaded
+type loadedConfig struct {
+	Path     string    `json:"path"`
+	SHA256   string    `json:"sha256"`
+	LoadedAt time.Time `json:"loaded_at"`
+}
+
+// agentState is the state store of the running agent, nil when it could not
+// be opened. The agent then runs without remembering anything.
+var agentState *store.Store
+
+// getDataDirPath returns the default directory of the state the agent keeps
+// between runs
+func getDataDirPath() string {
+	switch osinfo.GetOSType() {
+	case "linux":
+		return "/var/lib/ss-agent"
+	case "windows":
+		return `C:\ProgramData\ss-agent\data`
+	case "darwin": // macOS
+		return "/Library/Application Support/ss-agent/data"
+	default:
+		return "./data"
+	}
+}
+
+// dataDir returns where the agent keeps its state
+func dataDir() string {
+	if dir := config.GetConfig().DataDir; dir != "" {
+		return dir
+	}
+	return getDataDirPath()
+}
+
+// openState opens the state store and records the start of this run
+func openState() *store.Store {
+	st, err := store.Open(dataDir())
+	if err != nil {
+		logger.Error("Cannot open the state store, nothing is kept between runs", "dir", dataDir(), "error", err)
+		return nil
+	}
+
+	var id string
+	if ok, err := st.Get(stateAgentID, &id); err != nil || !ok || id == "" {
+		id = newAgentID()
+		if err := st.Put(stateAgentID, id); err != nil {
+			logger.Error("Failed to save the agent ID", "error", err)
+		} else {
+			logger.Info("Generated agent ID", "agent_id", id)
+		}
+	}
+
+	var runs agentRuns
+	if _, err := st.Get(stateAgentRuns, &runs); err != nil {
+		logger.Warn("Discarding unreadable run history", "error", err)
+		runs = agentRuns{}
+	}
+	if runs.Running {
+		logger.Warn("The previous run did not shut down cleanly", "started", runs.LastStarted.Format(time.RFC3339),
+			"version", runs.Version)
+	}
+	now := time.Now().UTC()
+	if runs.FirstStarted.IsZero() {
+		runs.FirstStarted = now
+	}
+	runs.Starts++
+	runs.LastStarted = now
+	runs.Running = true
+	runs.Version = agentVersion
+	if err := st.Put(stateAgentRuns, runs); err != nil {
+		logger.Error("Failed to save the run history", "error", err)
+	}
+
+	recordConfig(st)
+	return st
+}
+
+// recordConfig remembers the configuration file that was loaded and logs
+// when it changed since it was last loaded
+func recordConfig(st *store.Store) {
+	if st == nil {
+		return
+	}
+	path := config.ConfigFile()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logger.Warn("Cannot read the configuration file to record its version", "path", path, "error", err)
+		return
+	}
+	sum := sha256.Sum256(data)
+	current := loadedConfig{Path: path, SHA256: hex.EncodeToString(sum[:]), LoadedAt: time.Now().UTC()}
+
+	var last loadedConfig
+	if ok, _ := st.Get(stateConfigLast, &last); ok && last.SHA256 != current.SHA256 {
+		logger.Info("Configuration changed since it was last loaded", "path", path,
+			"last_loaded", last.LoadedAt.Format(time.RFC3339))
+	}
+	if err := st.Put(stateConfigLast, current); err != nil {
+		logger.Error("Failed to save the configuration version", "error", err)
+	}
+}
+
+// recordStop marks the run as ended cleanly
+func recordStop(st *store.Store) {
+	if st == nil {
+		return
+	}
+	var runs agentRuns
+	if _, err := st.Get(stateAgentRuns, &runs); err != nil {
+		return
+	}
+	now := time.Now().UTC()
+	runs.LastStopped = &now
+	runs.Running = false
+	if err := st.Put(stateAgentRuns, runs); err != nil {
+		logger.Error("Failed to save the run history", "error", err)
+	}
+}
+
+// agentID returns the ID of this agent, empty when there is no state store
+func agentID() string {
+	var id string
+	if agentState != nil {
+		agentState.Get(stateAgentID, &id)
+	}
+	return id
+}
+
+// newAgentID returns a random version 4 UUID
+func newAgentID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// Not expected, and not worth failing the start over
+		now := time.Now().UnixNano()
+		for i := range b {
+			b[i] = byte(now >> (8 * (i % 8)))
+		}
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b[:])
+	return fmt.Sprintf("%s-%s-%s-%s-%s", h[0:8], h[8:12], h[12:16], h[16:20], h[20:32])
+}
+
+// agentIdentity is the "agent" section of the heartbeat, which identifies the
+// agent across restarts
+type agentIdentity struct{}
+
+// HeartbeatSection implements api.HeartbeatSource.
+func (agentIdentity) HeartbeatSection() interface{} {
+	section := map[string]interface{}{"id": agentID(), "version": agentVersion, "started_at": agentStarted.UTC()}
+	var runs agentRuns
+	if agentState != nil {
+		if ok, _ := agentState.Get(stateAgentRuns, &runs); ok {
+			section["starts"] = runs.Starts
+		}
+	}
+	return section
+}
+
+// HeartbeatDelivered implements api.HeartbeatSource.
+func (agentIdentity) HeartbeatDelivered() {}
+
+// stateCommand returns the 'state' command with its subcommands
+func stateCommand(loadConfig func(cmd *cobra.Command, args []string)) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "state",
+		Short: "Inspect the state the agent keeps between runs",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "dump [prefix]",
+		Short: "Print the state store as JSON",
+		Long: `Print the content of the agent's state store (agent ID, run history, last
+loaded configuration, ...) as JSON, optionally only the keys starting with
+prefix. The store is only read, so this is safe while the agent runs.
+
+Examples:
+  sudo ss-agent state dump
+  sudo ss-agent state dump agent/`,
+		Args:   cobra.MaximumNArgs(1),
+		PreRun: loadConfig,
+		Run: func(cmd *cobra.Command, args []string) {
+			f, err := store.Read(dataDir())
+			if os.IsNotExist(err) {
+				fatalf("No state in %s, the agent has not run yet", dataDir())
+			}
+			if err != nil {
+				fatalf("Failed to read the state: %v", err)
+			}
+			if len(args) > 0 {
+				for key := range f.Data {
+					if !strings.HasPrefix(key, args[0]) {
+						delete(f.Data, key)
+					}
+				}
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.SetEscapeHTML(false)
+			enc.Encode(f)
+		},
+	})
+	return cmd
+}
@@ -0,0 +1,234 @@
+// cmd/update.go
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"ss-agent/api"
+	"ss-agent/config"
+	"ss-agent/updater"
+	"ss-agent/utils/metrics"
+	"ss-agent/utils/version"
+)
+
+var updatesTotal = metrics.NewCounter("ss_agent_updates_total",
+	"Self-updates, by result.", "result")
+
+// restartInto is the binary to start once the agent has shut down, set when
+// an update or a rollback needs a restart
+var restartInto string
+
+// maxUpdateStarts is how often a new version may start without getting a
+// heartbeat through, e.g. because it crashes, before it is rolled back
+const maxUpdateStarts = 3
+
+// agentExecutable returns the path of the running binary, the one updates
+// replace
+func agentExecutable() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(exe)
+}
+
+// checkUpdateOnStart counts the starts of a newly installed version and rolls
+// it back when it keeps stopping before a heartbeat got through. It reports
+// whether the agent has to restart into the previous version.
+func checkUpdateOnStart(exe string) bool {
+	st, err := updater.LoadState(exe)
+	if err != nil {
+		logger.Error("Failed to read the update state", "error", err)
+		return false
+	}
+	if !st.Pending() {
+		return false
+	}
+	if st.Version != agentVersion {
+		logger.Warn("Update was replaced by another version, not waiting for it", "update", st.Version, "running", agentVersion)
+		st.Version, st.Starts = "", 0
+		if err := updater.SaveState(exe, st); err != nil {
+			logger.Error("Failed to save the update state", "error", err)
+		}
+		return false
+	}
+
+	st.Starts++
+	if st.Starts > maxUpdateStarts {
+		return rollbackUpdate(exe, st, "it did not get a heartbeat through in any of its starts") == nil
+	}
+	if err := updater.SaveState(exe, st); err != nil {
+		logger.Error("Failed to save the update state", "error", err)
+	}
+	return false
+}
+
+// confirmUpdate waits up to the grace period for a heartbeat of a newly
+// installed version and rolls it back if none gets through
+func confirmUpdate(ctx context.Context, exe string, restart func() bool) {
+	st, err := updater.LoadState(exe)
+	if err != nil || !st.Pending() || st.Version != agentVersion {
+		return
+	}
+	grace := time.Duration(config.GetConfig().Update.GracePeriod) * time.Second
+	if grace <= 0 {
+		grace = 5 * time.Minute
+	}
+	logger.Info("Waiting for a heartbeat to confirm the update", "version", st.Version, "grace_period", grace.String())
+
+	deadline := time.NewTimer(grace)
+	defer deadline.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// Stopped before it could prove itself, the next start continues
+			return
+		case <-ticker.C:
+			if heartbeats.lastSuccess().After(agentStarted) {
+				st.Version, st.Starts = "", 0
+				if err := updater.SaveState(exe, st); err != nil {
+					logger.Error("Failed to save the update state", "error", err)
+				}
+				updatesTotal.Inc("confirmed")
+				logger.Info("Update confirmed", "version", agentVersion, "previous", st.Previous)
+				return
+			}
+		case <-deadline.C:
+			if rollbackUpdate(exe, st, "no heartbeat got through within the grace period") == nil {
+				restart()
+			}
+			return
+		}
+	}
+}
+
+// rollbackUpdate puts back the previous binary and remembers the failed
+// version, so it is not installed again
+func rollbackUpdate(exe string, st updater.State, reason string) error {
+	if err := updater.Rollback(exe); err != nil {
+		logger.Error("Failed to roll back the update", "version", st.Version, "error", err)
+		updatesTotal.Inc("failed")
+		return err
+	}
+	st.Failed, st.Version, st.Starts = st.Version, "", 0
+	if err := updater.SaveState(exe, st); err != nil {
+		logger.Error("Failed to save the update state", "error", err)
+	}
+	updatesTotal.Inc("rolled_back")
+	logger.Error("Rolled back the update", "version", st.Failed, "to", st.Previous, "reason", reason)
+	return nil
+}
+
+// runUpdater checks for a new version every check interval, within the
+// maintenance windows, and installs it until ctx is done
+func runUpdater(ctx context.Context, reqCtx context.Context, exe string, restart func() bool) {
+	var next time.Time
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if now.Before(next) {
+				continue
+			}
+			conf := config.GetConfig().Update
+			open, err := updater.InWindow(conf.MaintenanceWindows, now)
+			if err != nil {
+				logger.Error("Not updating", "error", err)
+				continue
+			}
+			if !open {
+				continue
+			}
+
+			interval := time.Duration(conf.CheckInterval) * time.Second
+			if interval <= 0 {
+				interval = 6 * time.Hour
+			}
+			// Spread the checks of many agents over time
+			next = now.Add(interval - interval/10 + time.Duration(rand.Int63n(int64(interval/5)+1)))
+
+			installed, err := installUpdate(reqCtx, exe, conf.Channel)
+			if err != nil {
+				updatesTotal.Inc("failed")
+				logger.Error("Update failed", "error", err)
+				continue
+			}
+			if installed && restart() {
+				return
+			}
+		}
+	}
+}
+
+// installUpdate installs the newest release of channel when it is newer than
+// the running version. It reports whether it installed one.
+func installUpdate(ctx context.Context, exe, channel string) (bool, error) {
+	switch channel {
+	case "":
+		channel = "stable"
+	case "stable", "beta":
+	default:
+		return false, fmt.Errorf("unknown update channel %q, use stable or beta", channel)
+	}
+	st, err := updater.LoadState(exe)
+	if err != nil {
+		return false, err
+	}
+	if st.Pending() {
+		// Installed, but this process could not restart into it
+		return false, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Minute)
+	defer cancel()
+	rel, err := api.CheckForUpdate(ctx, client, channel, agentVersion)
+	if err != nil {
+		return false, err
+	}
+	if rel == nil {
+		logger.Debug("No update available", "channel", channel)
+		return false, nil
+	}
+	if cmp, err := version.Compare(rel.Version, agentVersion); err != nil || cmp <= 0 {
+		logger.Debug("No newer version available", "channel", channel, "offered", rel.Version)
+		return false, nil
+	}
+	if rel.Version == st.Failed {
+		logger.Debug("Skipping a version that was rolled back", "version", rel.Version)
+		return false, nil
+	}
+
+	// Check the signature before downloading anything
+	if err := updater.Verify(*rel); err != nil {
+		return false, err
+	}
+	logger.Info("Installing update", "version", rel.Version, "channel", channel)
+	downloaded, err := updater.Download(ctx, client, *rel, exe)
+	if err != nil {
+		return false, err
+	}
+	if err := updater.Install(exe, downloaded); err != nil {
+		os.Remove(downloaded)
+		return false, err
+	}
+	st = updater.State{Version: rel.Version, Previous: agentVersion, InstalledAt: time.Now().UTC(), Failed: st.Failed}
+	if err := updater.SaveState(exe, st); err != nil {
+		// Without the state the new version cannot be confirmed or rolled back
+		updater.Rollback(exe)
+		return false, err
+	}
+	updatesTotal.Inc("installed")
+	logger.Info("Update installed, restarting", "version", rel.Version)
+	return true, nil
+}
@@ -4,10 +4,15 @@ package config
 import (
 	"encoding/json"
 	"errors"
-	"log"
 	"os"
+	"sync"
+
+	"ss-agent/utils/logging"
+	"ss-agent/utils/metrics"
 )
 
+var logger = logging.For("config")
+
 type Config struct {
 	APIUrl          string `json:"api_url"`
 	OrganizationKey string `json:"organization_key"`
@@ -17,10 +22,171 @@ type Config struct {
 	KeyFile         string `json:"key_file"`
 	CAFile          string `json:"ca_file"`
 	PingInterval    int    `json:"ping_interval"`
+	ShutdownTimeout int    `json:"shutdown_timeout,omitempty"` // seconds to drain in-flight work on shutdown
+	PidFile         string `json:"pid_file,omitempty"`         // defaults to the usual location for the OS
+	CrashDir        string `json:"crash_dir,omitempty"`        // crash reports, defaults to "crash" next to the log file
+	DataDir         string `json:"data_dir,omitempty"`         // state kept between runs, defaults to the usual location for the OS
 	SkipSSLVerify   bool   `json:"skip_ssl_verify"`
+
+	// Health configures the local HTTP health and readiness endpoint
+	Health HealthConfig `json:"health"`
+	// Metrics configures the Prometheus metrics endpoint
+	Metrics MetricsConfig `json:"metrics"`
+	// Logging configures the agent's own logs
+	Logging LoggingConfig `json:"logging"`
+	// Update configures self-updates
+	Update UpdateConfig `json:"update"`
+	// SelfLimits caps the resources the agent itself uses
+	SelfLimits SelfLimitsConfig `json:"self_limits"`
+	// Jobs overrides how the agent's periodic jobs are scheduled, keyed by
+	// job name as listed by 'ss-agent jobs list'
+	Jobs map[string]JobConfig `json:"jobs,omitempty"`
+
+	// Services holds per-service settings keyed by service name (zeek, fluent-bit, osqueryd)
+	Services map[string]ServiceConfig `json:"services,omitempty"`
+}
+
+// HealthConfig controls the HTTP listener serving /healthz, /readyz and
+// /status for liveness and readiness probes
+type HealthConfig struct {
+	Listen    string `json:"listen"`     // e.g. "127.0.0.1:8787", empty disables the endpoint
+	AuthToken string `json:"auth_token"` // when set, requests need "Authorization: Bearer <token>"
+}
+
+// MetricsConfig controls the HTTP listener serving Prometheus metrics on
+// /metrics. It may share the health listener by using the same address.
+type MetricsConfig struct {
+	Listen string `json:"listen"` // e.g. "127.0.0.1:9469", empty disables the endpoint
+}
+
+// LoggingConfig controls the agent's own logs. The file is only written by
+// the running agent; CLI commands always log to stderr.
+type LoggingConfig struct {
+	Level      string `json:"level"`        // debug, info, warn or error, default info
+	Format     string `json:"format"`       // text or json, default text
+	File       string `json:"file"`         // empty logs to stderr, except in daemon mode
+	MaxSizeMB  int    `json:"max_size_mb"`  // rotate the file at this size, default 50
+	MaxAgeDays int    `json:"max_age_days"` // delete rotated files older than this, default 30
+	MaxBackups int    `json:"max_backups"`  // rotated files to keep, default 5
+	Compress   *bool  `json:"compress"`     // gzip rotated files, default true
+
+	// BufferLines is how many recent log lines are kept in memory for
+	// 'ss-agent logs', default 1000
+	BufferLines int               `json:"buffer_lines"`
+	Shipping    LogShippingConfig `json:"shipping"`
+}
+
+// LogShippingConfig controls forwarding the agent's own warnings and errors
+// to the SIEM as events
+type LogShippingConfig struct {
+	Disabled      bool   `json:"disabled"`
+	Level         string `json:"level"`           // lowest level shipped, default warn
+	BatchSize     int    `json:"batch_size"`      // events per request, default 100
+	FlushInterval int    `json:"flush_interval"`  // seconds between requests, default 10
+	RatePerMinute int    `json:"rate_per_minute"` // events accepted per minute, the rest are counted and dropped, default 120
+}
+
+// UpdateConfig controls how the agent updates itself. Durations are in
+// seconds.
+type UpdateConfig struct {
+	Enabled       bool   `json:"enabled"`
+	Channel       string `json:"channel"`        // stable or beta, default stable
+	CheckInterval int    `json:"check_interval"` // between checks for a new version, default 21600
+	GracePeriod   int    `json:"grace_period"`   // for the new version to get a heartbeat through before it is rolled back, default 300
+	// MaintenanceWindows limit when updates are applied, in local time, e.g.
+	// "Sat 02:00-04:00" or "Mon-Fri 22:00-02:00". Empty allows any time.
+	MaintenanceWindows []string `json:"maintenance_windows"`
+}
+
+// SelfLimitsConfig caps the agent's own resource use. Close to a limit the
+// agent sheds load: it pauses version detection, polls services less often
+// and ships only errors, and deletes its oldest logs and crash reports to stay
+// under the disk limit.
+type SelfLimitsConfig struct {
+	Memory        string `json:"memory"`         // soft limit of the Go runtime like GOMEMLIMIT, e.g. "256M"; empty for none
+	MaxCPUs       int    `json:"max_cpus"`       // CPUs the agent runs on at once (GOMAXPROCS), 0 for all
+	MaxGoroutines int    `json:"max_goroutines"` // default 10000
+	Disk          string `json:"disk"`           // logs and crash reports, e.g. "1G"; empty for none
+	CheckInterval int    `json:"check_interval"` // seconds between checks, default 15
+}
+
+// JobConfig overrides the schedule of a periodic job. Durations are in
+// seconds.
+type JobConfig struct {
+	Schedule string `json:"schedule"` // "@every 30s", "@hourly" or a cron expression like "*/5 * * * *"
+	Jitter   int    `json:"jitter"`   // random delay of each run, up to this
+	Timeout  int    `json:"timeout"`  // cancel a run taking longer
+}
+
+// ServiceConfig holds the settings for a single managed service
+type ServiceConfig struct {
+	// DependsOn overrides the services that must be running before this one.
+	// Leave unset to use the built-in dependencies, set to [] for none.
+	DependsOn []string `json:"depends_on"`
+	// MinVersion is the lowest supported version; older installs are flagged
+	MinVersion string          `json:"min_version"`
+	Package    PackageConfig   `json:"package"`
+	Supervise  SupervisePolicy `json:"supervise"`
+	Resources  ResourceLimits  `json:"resources"`
+}
+
+// ResourceLimits caps what a managed service may use. They are applied as a
+// systemd drop-in, so they only take effect on hosts running systemd.
+type ResourceLimits struct {
+	MemoryMax string `json:"memory_max"` // e.g. "2G", "512M" or "80%"
+	CPUQuota  string `json:"cpu_quota"`  // e.g. "50%", or "200%" for two CPUs
+	IOWeight  int    `json:"io_weight"`  // 1-10000, 0 leaves the default
+	Nice      *int   `json:"nice"`       // -20 to 19, unset leaves the default
+}
+
+// IsZero reports whether no limit is configured
+func (r ResourceLimits) IsZero() bool {
+	return r.MemoryMax == "" && r.CPUQuota == "" && r.IOWeight == 0 && r.Nice == nil
+}
+
+// PackageConfig controls how a managed service is installed and upgraded
+// through the host package manager
+type PackageConfig struct {
+	Name       string            `json:"name"`    // package name, defaults to the usual name for the service
+	Version    string            `json:"version"` // pinned version, empty for the latest
+	File       string            `json:"file"`    // local package file, installed instead of using a repository
+	Repository *RepositoryConfig `json:"repository"`
 }
 
-var config Config
+// RepositoryConfig describes a package repository added before installing
+type RepositoryConfig struct {
+	URL        string   `json:"url"`        // http(s):// or file:// base URL
+	Suite      string   `json:"suite"`      // apt only; empty for a flat repository
+	Components []string `json:"components"` // apt only
+	GPGKey     string   `json:"gpg_key"`    // path to the signing key, required for http(s) repositories
+	// AllowUnsigned accepts an http(s) repository without gpg_key, whose
+	// packages are then installed without signature checks
+	AllowUnsigned bool `json:"allow_unsigned"`
+}
+
+// Supervisor restart modes
+const (
+	RestartAlways    = "always"     // restart whenever the service is not running
+	RestartOnFailure = "on-failure" // restart only services that crashed or failed
+	RestartNever     = "never"      // only watch and report
+)
+
+// SupervisePolicy controls how the supervisor watches and restarts a service.
+// Durations are in seconds.
+type SupervisePolicy struct {
+	Restart         string `json:"restart"`
+	PollInterval    int    `json:"poll_interval"`
+	InitialBackoff  int    `json:"initial_backoff"`
+	MaxBackoff      int    `json:"max_backoff"`
+	MaxRestarts     int    `json:"max_restarts"`      // restarts allowed within CrashLoopWindow
+	CrashLoopWindow int    `json:"crash_loop_window"` // before the supervisor gives up
+}
+
+var (
+	mu         sync.RWMutex
+	config     Config
+	configFile string // file the configuration was loaded from
+)
 
 var defaultConfigPaths = []string{
 	"./config.json",
@@ -49,22 +215,56 @@ func LoadConfigFromFile(filePath string) error {
 	}
 	defer file.Close()
 
+	var loaded Config
 	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&config); err != nil {
+	if err := decoder.Decode(&loaded); err != nil {
 		return err
 	}
 
 	// Set default ping interval if not set or invalid
-	if config.PingInterval < 5 {
-		config.PingInterval = 5
+	if loaded.PingInterval < 5 {
+		loaded.PingInterval = 5
+	}
+	if loaded.ShutdownTimeout <= 0 {
+		loaded.ShutdownTimeout = 30
 	}
 
 	// No need to set SkipSSLVerify to false explicitly since it's already false by default
 
-	log.Println("Configuration loaded from:", filePath)
+	mu.Lock()
+	config = loaded
+	configFile = filePath
+	mu.Unlock()
+
+	logger.Debug("Configuration loaded", "path", filePath)
 	return nil
 }
 
+var reloadsTotal = metrics.NewCounter("ss_agent_config_reloads_total",
+	"Configuration reloads, by result.", "result")
+
+// Reload loads the configuration again from the file it was last loaded
+// from. The current configuration is kept if the file cannot be loaded.
+func Reload() error {
+	path := ConfigFile()
+	if path == "" {
+		return errors.New("no configuration has been loaded")
+	}
+	if err := LoadConfigFromFile(path); err != nil {
+		reloadsTotal.Inc("failure")
+		return err
+	}
+	reloadsTotal.Inc("success")
+	return nil
+}
+
+// ConfigFile returns the path the configuration was loaded from
+func ConfigFile() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return configFile
+}
+
 // LoadConfig attempts to load configuration from default paths
 func LoadConfig() error {
 	configPath, err := findConfigFile()
@@ -74,7 +274,39 @@ func LoadConfig() error {
 	return LoadConfigFromFile(configPath)
 }
 
+// SupervisePolicyFor returns the supervise policy for a service with defaults
+// filled in for any unset value
+func (c Config) SupervisePolicyFor(serviceName string) SupervisePolicy {
+	policy := c.Services[serviceName].Supervise
+	switch policy.Restart {
+	case RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		policy.Restart = RestartOnFailure
+	}
+	if policy.PollInterval < 5 {
+		policy.PollInterval = 30
+	}
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = 5
+	}
+	if policy.MaxBackoff <= 0 {
+		policy.MaxBackoff = 300
+	}
+	if policy.MaxBackoff < policy.InitialBackoff {
+		policy.MaxBackoff = policy.InitialBackoff
+	}
+	if policy.MaxRestarts <= 0 {
+		policy.MaxRestarts = 5
+	}
+	if policy.CrashLoopWindow <= 0 {
+		policy.CrashLoopWindow = 600
+	}
+	return policy
+}
+
 // GetConfig returns the current configuration
 func GetConfig() Config {
+	mu.RLock()
+	defer mu.RUnlock()
 	return config
 }
@@ -0,0 +1,190 @@
+// control/control.go
+
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"ss-agent/utils/logging"
+)
+
+var logger = logging.For("control")
+
+// CallTimeout bounds a single call from the CLI to the running agent
+var CallTimeout = 10 * time.Second
+
+// ErrNotRunning is returned by Call when no agent is listening on the socket.
+// Failing to connect for other reasons, such as missing permissions, is
+// reported as it is.
+var ErrNotRunning = errors.New("agent is not running")
+
+// Request is a single call on the control socket. Requests and responses are
+// JSON objects, one per line.
+type Request struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// Response is the answer to a Request. Error is set if the call failed.
+type Response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// HandlerFunc handles one method. The returned value is encoded as the result.
+type HandlerFunc func(params json.RawMessage) (interface{}, error)
+
+// Server answers calls from the CLI on a local socket that only the agent's
+// user (root or Administrators) can open.
+type Server struct {
+	path     string
+	mu       sync.RWMutex
+	handlers map[string]HandlerFunc
+}
+
+// NewServer creates a server for the socket or pipe at path.
+func NewServer(path string) *Server {
+	return &Server{path: path, handlers: make(map[string]HandlerFunc)}
+}
+
+// Handle registers the handler for a method.
+func (s *Server) Handle(method string, fn HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[method] = fn
+}
+
+// Serve listens until ctx is done. It fails if another agent is already
+// listening on the path.
+func (s *Server) Serve(ctx context.Context) error {
+	l, err := listen(s.path)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("control socket accept failed: %v", err)
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn io.ReadWriteCloser) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	encoder := json.NewEncoder(conn)
+	for scanner.Scan() {
+		var req Request
+		var resp Response
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			resp.Error = fmt.Sprintf("invalid request: %v", err)
+		} else {
+			resp = s.dispatch(req)
+		}
+		if err := encoder.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) dispatch(req Request) (resp Response) {
+	s.mu.RLock()
+	fn, ok := s.handlers[req.Method]
+	s.mu.RUnlock()
+	if !ok {
+		resp.Error = fmt.Sprintf("unknown method %q", req.Method)
+		return resp
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("Handler panicked", "method", req.Method, "panic", r)
+			resp = Response{Error: fmt.Sprintf("%s failed: %v", req.Method, r)}
+		}
+	}()
+	result, err := fn(req.Params)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	if resp.Result, err = json.Marshal(result); err != nil {
+		resp.Error = fmt.Sprintf("failed to encode result: %v", err)
+	}
+	return resp
+}
+
+// Call invokes a method on the agent listening at path and decodes the result
+// into result, which may be nil. It returns ErrNotRunning if nothing listens.
+func Call(path, method string, params, result interface{}) error {
+	req := Request{Method: method}
+	if params != nil {
+		raw, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req.Params = raw
+	}
+
+	conn, err := dial(path, CallTimeout)
+	if err != nil {
+		if notListening(err) {
+			return ErrNotRunning
+		}
+		if errors.Is(err, os.ErrPermission) {
+			return fmt.Errorf("cannot connect to the agent on %s, run as the agent's user (root or Administrator): %v", path, err)
+		}
+		return fmt.Errorf("cannot connect to the agent on %s: %v", path, err)
+	}
+	defer conn.Close()
+
+	done := make(chan error, 1)
+	var resp Response
+	go func() {
+		if err := json.NewEncoder(conn).Encode(req); err != nil {
+			done <- fmt.Errorf("failed to send %s: %v", method, err)
+			return
+		}
+		reader := bufio.NewReader(conn)
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			done <- fmt.Errorf("failed to read %s response: %v", method, err)
+			return
+		}
+		done <- json.Unmarshal(line, &resp)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+	case <-time.After(CallTimeout):
+		return fmt.Errorf("agent did not answer %s within %s", method, CallTimeout)
+	}
+
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if result != nil && len(resp.Result) > 0 {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
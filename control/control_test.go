@@ -0,0 +1,89 @@
+//go:build !windows
+// +build !windows
+
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCall(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ss-agent.sock")
+	server := NewServer(path)
+	server.Handle("echo", func(params json.RawMessage) (interface{}, error) {
+		var s string
+		err := json.Unmarshal(params, &s)
+		return s, err
+	})
+	server.Handle("fail", func(json.RawMessage) (interface{}, error) {
+		return nil, errors.New("it failed")
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(ctx) }()
+	defer func() {
+		cancel()
+		<-served
+	}()
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		if _, err := os.Stat(path); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var got string
+	if err := Call(path, "echo", "hello", &got); err != nil || got != "hello" {
+		t.Errorf("Call(echo) = %q, %v, want hello", got, err)
+	}
+	if err := Call(path, "fail", nil, nil); err == nil || err.Error() != "it failed" {
+		t.Errorf("Call(fail) = %v, want the handler error", err)
+	}
+	if err := Call(path, "missing", nil, nil); err == nil || err == ErrNotRunning {
+		t.Errorf("Call(missing) = %v, want an unknown method error", err)
+	}
+}
+
+func TestCallNotRunning(t *testing.T) {
+	dir := t.TempDir()
+	if err := Call(filepath.Join(dir, "missing.sock"), "status", nil, nil); err != ErrNotRunning {
+		t.Errorf("Call without a socket = %v, want ErrNotRunning", err)
+	}
+
+	// A socket left behind by an agent that died refuses connections
+	stale := filepath.Join(dir, "stale.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: stale, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.SetUnlinkOnClose(false)
+	l.Close()
+	if err := Call(stale, "status", nil, nil); err != ErrNotRunning {
+		t.Errorf("Call on a stale socket = %v, want ErrNotRunning", err)
+	}
+}
+
+func TestNotListening(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "dial", Net: "unix", Err: os.NewSyscallError("connect", syscall.ENOENT)}, true},
+		{&net.OpError{Op: "dial", Net: "unix", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, true},
+		{&net.OpError{Op: "dial", Net: "unix", Err: os.NewSyscallError("connect", syscall.EACCES)}, false},
+		{&net.OpError{Op: "dial", Net: "unix", Err: os.NewSyscallError("connect", syscall.EAGAIN)}, false},
+	}
+	for _, tt := range tests {
+		if got := notListening(tt.err); got != tt.want {
+			t.Errorf("notListening(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// control/listen_unix.go
+
+//go:build !windows
+// +build !windows
+
+package control
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// DefaultPath is where the agent listens for control calls
+const DefaultPath = "/var/run/ss-agent.sock"
+
+type unixListener struct {
+	*net.UnixListener
+}
+
+func (l unixListener) Accept() (io.ReadWriteCloser, error) {
+	return l.UnixListener.Accept()
+}
+
+// listen creates the socket with mode 0600, so only the agent's user can
+// connect. A socket left behind by an agent that died is replaced.
+func listen(path string) (listener, error) {
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("another agent is already listening on %s", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale control socket %s: %v", path, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for control socket: %v", err)
+	}
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket %s: %v", path, err)
+	}
+	// Connecting needs write permission on the socket, so 0600 limits the
+	// control API to the agent's user
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to restrict control socket %s: %v", path, err)
+	}
+	return unixListener{l}, nil
+}
+
+func dial(path string, timeout time.Duration) (io.ReadWriteCloser, error) {
+	return net.DialTimeout("unix", path, timeout)
+}
+
+// notListening reports whether a dial failed because no agent listens: the
+// socket does not exist, or was left behind by an agent that died
+func notListening(err error) bool {
+	return errors.Is(err, os.ErrNotExist) || errors.Is(err, syscall.ECONNREFUSED)
+}
@@ -0,0 +1,134 @@
+// control/listen_windows.go
+
+//go:build windows
+// +build windows
+
+package control
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// DefaultPath is where the agent listens for control calls
+const DefaultPath = `\\.\pipe\ss-agent`
+
+// pipeSDDL grants SYSTEM and the Administrators group access, nobody else
+const pipeSDDL = "D:P(A;;GA;;;SY)(A;;GA;;;BA)"
+
+var errListenerClosed = errors.New("control pipe closed")
+
+// pipeListener serves a named pipe. Each client gets its own pipe instance,
+// and a new instance is created for the next client once one connects.
+type pipeListener struct {
+	path   string
+	sa     *windows.SecurityAttributes
+	mu     sync.Mutex
+	next   windows.Handle
+	closed bool
+}
+
+func listen(path string) (listener, error) {
+	if conn, err := dial(path, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("another agent is already listening on %s", path)
+	}
+	sd, err := windows.SecurityDescriptorFromString(pipeSDDL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build control pipe security descriptor: %v", err)
+	}
+	sa := &windows.SecurityAttributes{
+		Length:             uint32(unsafe.Sizeof(windows.SecurityAttributes{})),
+		SecurityDescriptor: sd,
+	}
+	h, err := createPipe(path, sa, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create control pipe %s: %v", path, err)
+	}
+	return &pipeListener{path: path, sa: sa, next: h}, nil
+}
+
+func createPipe(path string, sa *windows.SecurityAttributes, first bool) (windows.Handle, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return windows.InvalidHandle, err
+	}
+	flags := uint32(windows.PIPE_ACCESS_DUPLEX)
+	if first {
+		flags |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+	mode := uint32(windows.PIPE_TYPE_BYTE | windows.PIPE_READMODE_BYTE | windows.PIPE_WAIT | windows.PIPE_REJECT_REMOTE_CLIENTS)
+	return windows.CreateNamedPipe(name, flags, mode, windows.PIPE_UNLIMITED_INSTANCES, 4096, 4096, 0, sa)
+}
+
+func (l *pipeListener) Accept() (io.ReadWriteCloser, error) {
+	l.mu.Lock()
+	h, closed := l.next, l.closed
+	l.mu.Unlock()
+	if closed {
+		return nil, errListenerClosed
+	}
+
+	if err := windows.ConnectNamedPipe(h, nil); err != nil && err != windows.ERROR_PIPE_CONNECTED {
+		windows.CloseHandle(h)
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		windows.CloseHandle(h)
+		return nil, errListenerClosed
+	}
+	next, err := createPipe(l.path, l.sa, false)
+	if err != nil {
+		windows.CloseHandle(h)
+		return nil, fmt.Errorf("failed to create control pipe instance: %v", err)
+	}
+	l.next = next
+	return os.NewFile(uintptr(h), l.path), nil
+}
+
+// Close stops accepting. A blocked Accept is released by connecting to the
+// waiting pipe instance.
+func (l *pipeListener) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+	if conn, err := dial(l.path, time.Second); err == nil {
+		conn.Close()
+	}
+	return nil
+}
+
+func dial(path string, timeout time.Duration) (io.ReadWriteCloser, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		h, err := windows.CreateFile(name, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.OPEN_EXISTING, 0, 0)
+		if err == nil {
+			return os.NewFile(uintptr(h), path), nil
+		}
+		// All instances are busy with other clients
+		if err != windows.ERROR_PIPE_BUSY || time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// notListening reports whether a dial failed because no agent listens, i.e.
+// the pipe does not exist
+func notListening(err error) bool {
+	return errors.Is(err, os.ErrNotExist)
+}
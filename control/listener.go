@@ -0,0 +1,11 @@
+// control/listener.go
+
+package control
+
+import "io"
+
+// listener accepts connections on a Unix socket or a Windows named pipe
+type listener interface {
+	Accept() (io.ReadWriteCloser, error)
+	Close() error
+}
@@ -0,0 +1,424 @@
+// doctor/checks.go
+
+package doctor
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+
+	"ss-agent/api"
+	"ss-agent/config"
+	"ss-agent/control"
+	"ss-agent/service"
+	"ss-agent/service/servicectl"
+	"ss-agent/utils/guard"
+	"ss-agent/utils/logging"
+	"ss-agent/utils/pidfile"
+	"ss-agent/utils/scheduler"
+	"ss-agent/utils/store"
+)
+
+// expiryWarning is how long before expiry a certificate is flagged
+const expiryWarning = 30 * 24 * time.Hour
+
+// networkTimeout bounds each network check
+const networkTimeout = 5 * time.Second
+
+func (s *state) checkConfig() []Result {
+	var err error
+	if s.env.ConfigPath != "" {
+		err = config.LoadConfigFromFile(s.env.ConfigPath)
+	} else {
+		err = config.LoadConfig()
+	}
+	if err != nil {
+		if os.IsNotExist(err) || s.env.ConfigPath == "" {
+			return []Result{result("config", Fail, "Pass --config <path> or run 'ss-agent install' to create one",
+				"No configuration found: %v", err)}
+		}
+		return []Result{result("config", Fail, "Fix the JSON syntax or the type of the reported setting",
+			"Cannot load %s: %v", s.env.ConfigPath, err)}
+	}
+	s.conf = config.GetConfig()
+	s.loaded = true
+	path := config.ConfigFile()
+
+	results := []Result{result("config", Pass, "", "Loaded %s", path)}
+
+	// Misspelled settings are silently ignored by the agent
+	if data, err := os.ReadFile(path); err == nil {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		var strict config.Config
+		if err := dec.Decode(&strict); err != nil {
+			results = append(results, result("config settings", Warn, "Check the spelling against config-template.json",
+				"%v", err))
+		}
+	}
+
+	u, err := url.Parse(s.conf.APIUrl)
+	switch {
+	case s.conf.APIUrl == "":
+		results = append(results, result("api_url", Fail, "Set api_url to the SIEM API base URL", "api_url is not set"))
+	case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "":
+		results = append(results, result("api_url", Fail, "Use a URL like https://siem.example.com/api",
+			"api_url %q is not a valid http(s) URL", s.conf.APIUrl))
+	default:
+		s.host = u.Hostname()
+		s.port = u.Port()
+		if s.port == "" {
+			s.port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+		}
+		if u.Scheme == "http" {
+			results = append(results, result("api_url", Warn, "Use https so credentials are not sent in clear text",
+				"%s does not use TLS", s.conf.APIUrl))
+		} else {
+			results = append(results, result("api_url", Pass, "", "%s", s.conf.APIUrl))
+		}
+	}
+
+	if s.conf.OrganizationKey == "" || s.conf.APIAccessKey == "" || s.conf.APISecretKey == "" {
+		results = append(results, result("credentials", Fail, "Enroll with 'ss-agent install --token <token>' or set organization_key, api_access_key and api_secret_key",
+			"The agent is not enrolled"))
+	} else {
+		results = append(results, result("credentials", Pass, "", "organization_key and API keys are set"))
+	}
+
+	if _, err := logging.ParseLevel(s.conf.Logging.Level); err != nil {
+		results = append(results, result("logging", Warn, "Use debug, info, warn or error", "logging.level: %v", err))
+	}
+	for _, size := range []struct{ key, value string }{
+		{"self_limits.memory", s.conf.SelfLimits.Memory},
+		{"self_limits.disk", s.conf.SelfLimits.Disk},
+	} {
+		if size.value == "" {
+			continue
+		}
+		if _, err := guard.ParseSize(size.value); err != nil {
+			results = append(results, result("self_limits", Warn, "Use a size like 512M or 1G, the limit is not enforced",
+				"%s: %v", size.key, err))
+		}
+	}
+	names := make([]string, 0, len(s.conf.Jobs))
+	for name := range s.conf.Jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if spec := s.conf.Jobs[name].Schedule; spec != "" {
+			if _, err := scheduler.Parse(spec); err != nil {
+				results = append(results, result("jobs", Warn, "Use \"@every 30s\", \"@hourly\" or a cron expression like \"*/5 * * * *\", the default schedule is used",
+					"jobs.%s.schedule: %v", name, err))
+			}
+		}
+	}
+	return results
+}
+
+func (s *state) checkCertificates() []Result {
+	if !s.loaded {
+		return []Result{result("certificates", Skip, "", "No configuration")}
+	}
+	c := s.conf
+	if c.CertFile == "" && c.KeyFile == "" && c.CAFile == "" {
+		return []Result{result("certificates", Skip, "", "No cert_file, key_file or ca_file configured")}
+	}
+
+	var results []Result
+	readable := true
+	for _, f := range []struct{ name, path string }{{"cert_file", c.CertFile}, {"key_file", c.KeyFile}, {"ca_file", c.CAFile}} {
+		if f.path == "" {
+			results = append(results, result(f.name, Warn, "Set "+f.name+" or remove the other certificate settings", "%s is not set", f.name))
+			readable = false
+			continue
+		}
+		if _, err := os.ReadFile(f.path); err != nil {
+			results = append(results, result(f.name, Fail, "Check that the file exists and is readable by the agent's user", "%v", err))
+			readable = false
+		}
+	}
+	if !readable {
+		return results
+	}
+
+	pair, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return append(results, result("certificates", Fail, "Use the key that was generated together with the certificate",
+			"Certificate and key do not match: %v", err))
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return append(results, result("certificates", Fail, "Replace the client certificate", "Cannot parse %s: %v", c.CertFile, err))
+	}
+
+	caData, _ := os.ReadFile(c.CAFile)
+	var cas []*x509.Certificate
+	for rest := caData; ; {
+		var block *pem.Block
+		if block, rest = pem.Decode(rest); block == nil {
+			break
+		}
+		if ca, err := x509.ParseCertificate(block.Bytes); err == nil {
+			cas = append(cas, ca)
+		}
+	}
+	if len(cas) == 0 {
+		return append(results, result("certificates", Fail, "ca_file must hold PEM encoded certificates", "No certificates found in %s", c.CAFile))
+	}
+	pool := x509.NewCertPool()
+	for _, ca := range cas {
+		pool.AddCert(ca)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: pool, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		results = append(results, result("certificates", Warn, "Check that ca_file holds the CA that issued cert_file",
+			"%s is not signed by %s: %v", c.CertFile, c.CAFile, err))
+	} else {
+		results = append(results, result("certificates", Pass, "", "Certificate and key match and chain to the CA"))
+	}
+
+	for _, cert := range append([]*x509.Certificate{leaf}, cas...) {
+		results = append(results, checkExpiry(cert))
+	}
+	return results
+}
+
+func checkExpiry(cert *x509.Certificate) Result {
+	name := "expiry " + cert.Subject.CommonName
+	now := time.Now()
+	switch {
+	case now.Before(cert.NotBefore):
+		return result(name, Fail, "Check the system clock", "Not valid before %s", cert.NotBefore.Format(time.RFC3339))
+	case now.After(cert.NotAfter):
+		return result(name, Fail, "Renew the certificate", "Expired on %s", cert.NotAfter.Format(time.RFC3339))
+	case cert.NotAfter.Sub(now) < expiryWarning:
+		return result(name, Warn, "Renew the certificate before it expires", "Expires in %d days (%s)",
+			int(cert.NotAfter.Sub(now).Hours()/24), cert.NotAfter.Format(time.RFC3339))
+	}
+	return result(name, Pass, "", "Valid until %s", cert.NotAfter.Format(time.RFC3339))
+}
+
+func (s *state) checkDNS() Result {
+	if s.host == "" {
+		return result("dns", Skip, "", "No valid api_url")
+	}
+	if net.ParseIP(s.host) != nil {
+		s.resolved = true
+		return result("dns", Skip, "", "%s is an IP address", s.host)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), networkTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, s.host)
+	if err != nil {
+		return result("dns", Fail, "Check /etc/resolv.conf and that the host name in api_url is correct",
+			"Cannot resolve %s: %v", s.host, err)
+	}
+	s.resolved = true
+	return result("dns", Pass, "", "%s resolves to %v", s.host, addrs)
+}
+
+func (s *state) checkTCP() Result {
+	if !s.resolved {
+		return result("tcp", Skip, "", "Host not resolved")
+	}
+	address := net.JoinHostPort(s.host, s.port)
+	conn, err := net.DialTimeout("tcp", address, networkTimeout)
+	if err != nil {
+		return result("tcp", Fail, "Check firewalls and proxies between this host and the SIEM",
+			"Cannot connect to %s: %v", address, err)
+	}
+	conn.Close()
+	s.reached = true
+	return result("tcp", Pass, "", "Connected to %s", address)
+}
+
+func (s *state) checkTLS() Result {
+	s.tlsOK = true
+	if !s.reached {
+		return result("tls", Skip, "", "Host not reachable")
+	}
+	if u, _ := url.Parse(s.conf.APIUrl); u.Scheme != "https" {
+		return result("tls", Skip, "", "api_url does not use https")
+	}
+
+	address := net.JoinHostPort(s.host, s.port)
+	dialer := &net.Dialer{Timeout: networkTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, &tls.Config{ServerName: s.host})
+	if err == nil {
+		conn.Close()
+		if s.conf.SkipSSLVerify {
+			return result("tls", Warn, "Set skip_ssl_verify to false, the server certificate verifies",
+				"TLS handshake with %s succeeded, but skip_ssl_verify is on", address)
+		}
+		return result("tls", Pass, "", "TLS handshake with %s succeeded and the certificate verifies", address)
+	}
+
+	var verifyErr *tls.CertificateVerificationError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	if !errors.As(err, &verifyErr) && !errors.As(err, &unknownAuthority) && !errors.As(err, &hostname) {
+		s.tlsOK = false
+		return result("tls", Fail, "Check that the port in api_url serves HTTPS", "TLS handshake with %s failed: %v", address, err)
+	}
+	if s.conf.SkipSSLVerify {
+		return result("tls", Warn, "Install the SIEM's CA in the system trust store and turn skip_ssl_verify off",
+			"Server certificate does not verify (%v), accepted because skip_ssl_verify is on", err)
+	}
+	s.tlsOK = false
+	return result("tls", Fail, "Install the SIEM's CA in the system trust store, or set skip_ssl_verify for testing only",
+		"Server certificate does not verify: %v", err)
+}
+
+func (s *state) checkPing() Result {
+	if !s.reached {
+		return result("ping", Skip, "", "Host not reachable")
+	}
+	if !s.tlsOK {
+		return result("ping", Skip, "", "TLS handshake failed")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*networkTimeout)
+	defer cancel()
+	if err := api.PingContext(ctx, s.env.NewClient(s.conf)); err != nil {
+		return result("ping", Fail, "Check the credentials in the configuration, or enroll again with 'ss-agent install --token <token> --force'",
+			"Authenticated ping failed: %v", err)
+	}
+	return result("ping", Pass, "", "The SIEM accepted an authenticated heartbeat")
+}
+
+func (s *state) checkPidFile() Result {
+	path := s.env.PidFile
+	if s.conf.PidFile != "" {
+		path = s.conf.PidFile
+	}
+	if dir := filepath.Dir(path); !isWritableDir(dir) {
+		return result("pid file", Fail, "Run the agent as root or make "+dir+" writable, or set pid_file",
+			"Cannot create files in %s", dir)
+	}
+	pid, running, err := pidfile.Check(path)
+	if os.IsPermission(err) {
+		return result("pid file", Warn, "Run 'ss-agent doctor' as root", "Cannot read %s: %v", path, err)
+	}
+	if err != nil {
+		return result("pid file", Fail, "Remove "+path+" if no agent is running", "Cannot check %s: %v", path, err)
+	}
+	if !running {
+		if _, err := os.Stat(path); err == nil {
+			return result("pid file", Warn, "It is ignored and replaced when the agent starts",
+				"Stale %s left by an agent that is no longer running", path)
+		}
+		return result("pid file", Warn, "Start it with 'ss-agent start' or through the init system", "The agent is not running")
+	}
+	if err := control.Call(s.env.ControlPath, "status", nil, nil); err != nil {
+		return result("pid file", Warn, "Restart the agent if the socket does not come back",
+			"Agent is running with PID %d, but its control socket %s does not answer: %v", pid, s.env.ControlPath, err)
+	}
+	return result("pid file", Pass, "", "Agent is running with PID %d", pid)
+}
+
+func (s *state) checkLogDir() Result {
+	dir := filepath.Dir(s.env.LogFilePath(s.conf))
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return result("log directory", Warn, "It is created when the agent starts, or run 'ss-agent install'", "%s does not exist", dir)
+	}
+	if err != nil {
+		return result("log directory", Fail, "", "Cannot access %s: %v", dir, err)
+	}
+	if !isWritableDir(dir) {
+		return result("log directory", Fail, "Run the agent as root or make "+dir+" writable by its user",
+			"Cannot write to %s", dir)
+	}
+	if info.Mode().Perm()&0002 != 0 {
+		return result("log directory", Warn, "Run 'chmod o-w "+dir+"'", "%s is world-writable", dir)
+	}
+	return result("log directory", Pass, "", "%s is writable", dir)
+}
+
+func (s *state) checkStateStore() Result {
+	dir := s.env.DataDirPath(s.conf)
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return result("state store", Warn, "It is created when the agent starts, or run 'ss-agent install'", "%s does not exist", dir)
+	}
+	if err != nil {
+		return result("state store", Fail, "", "Cannot access %s: %v", dir, err)
+	}
+	if !isWritableDir(dir) {
+		return result("state store", Fail, "Run the agent as root or set data_dir to a directory it can write",
+			"Cannot write to %s", dir)
+	}
+	f, err := store.Read(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return result("state store", Fail, "The agent moves it aside and starts with an empty state, losing its ID",
+			"Cannot read the state: %v", err)
+	}
+	if f.Schema > store.SchemaVersion {
+		return result("state store", Fail, "Install the newer agent again, or move the state file away to start afresh",
+			"The state has schema version %d, written by a newer agent that knows up to %d", f.Schema, store.SchemaVersion)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		return result("state store", Warn, "Run 'chmod 700 "+dir+"'", "%s is accessible to other users", dir)
+	}
+	if os.IsNotExist(err) {
+		return result("state store", Pass, "", "%s is writable, no state saved yet", dir)
+	}
+	return result("state store", Pass, "", "%s holds %d keys, last updated %s", filepath.Join(dir, store.FileName),
+		len(f.Data), f.UpdatedAt.Local().Format(time.RFC3339))
+}
+
+func (s *state) checkServices() []Result {
+	var results []Result
+	for _, name := range service.AllServices {
+		check := "service " + name
+		state, err := service.ServiceState(name)
+		if err != nil && state != servicectl.StateNotInstalled {
+			results = append(results, result(check, Fail, "", "Cannot get the state: %v", err))
+			continue
+		}
+		switch state {
+		case servicectl.StateNotInstalled:
+			results = append(results, result(check, Warn, "Install it with 'ss-agent service install "+name+"'", "Not installed"))
+			continue
+		case servicectl.StateRunning:
+		case servicectl.StateFailed:
+			results = append(results, result(check, Fail, "Check its logs, then run 'ss-agent service restart "+name+"'", "Failed"))
+			continue
+		default:
+			results = append(results, result(check, Warn, "Start it with 'ss-agent service start "+name+"'", "Installed but %s", state))
+			continue
+		}
+
+		vs := service.CheckVersion(name)
+		switch {
+		case vs.BelowMinimum:
+			results = append(results, result(check, Warn, "Upgrade it with 'ss-agent service upgrade "+name+"'", "Running, %s", vs))
+		case vs.Error != "":
+			results = append(results, result(check, Warn, "", "Running, but the version is unknown: %s", vs.Error))
+		default:
+			results = append(results, result(check, Pass, "", "Running, %s", vs))
+		}
+	}
+	return results
+}
+
+// isWritableDir reports whether a file can be created in dir
+func isWritableDir(dir string) bool {
+	f, err := os.CreateTemp(dir, ".ss-agent-doctor-*")
+	if err != nil {
+		return false
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return true
+}
@@ -0,0 +1,127 @@
+// doctor/doctor.go
+
+package doctor
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+
+	"ss-agent/config"
+)
+
+// Status is the outcome of a check
+type Status string
+
+const (
+	Pass Status = "pass"
+	Warn Status = "warn"
+	Fail Status = "fail"
+	Skip Status = "skip" // not run because an earlier check failed or it does not apply
+)
+
+// Result is the outcome of one check with a hint on how to fix it
+type Result struct {
+	Check   string `json:"check"`
+	Status  Status `json:"status"`
+	Message string `json:"message"`
+	Hint    string `json:"hint,omitempty"`
+}
+
+// Report holds the results of all checks
+type Report struct {
+	Results []Result       `json:"results"`
+	Summary map[Status]int `json:"summary"`
+}
+
+// Failed reports whether any check failed
+func (r Report) Failed() bool {
+	return r.Summary[Fail] > 0
+}
+
+// Env is what the checks need to know about the agent
+type Env struct {
+	ConfigPath     string // --config, empty searches the default paths
+	PidFile        string // default, pid_file in the configuration takes precedence
+	LogFile        string // --log-file, empty uses logging.file or DefaultLogFile
+	DefaultLogFile string
+	DataDir        string // default, data_dir in the configuration takes precedence
+	ControlPath    string
+	NewClient      func(config.Config) *http.Client // builds the client the agent uses for the API
+}
+
+// LogFilePath returns the log file of the agent running with conf
+func (e Env) LogFilePath(conf config.Config) string {
+	if e.LogFile != "" {
+		return e.LogFile
+	}
+	if conf.Logging.File != "" {
+		return conf.Logging.File
+	}
+	return e.DefaultLogFile
+}
+
+// DataDirPath returns the state directory of the agent running with conf
+func (e Env) DataDirPath(conf config.Config) string {
+	if conf.DataDir != "" {
+		return conf.DataDir
+	}
+	return e.DataDir
+}
+
+// state is shared between the checks of one run, so later checks can skip
+// when what they depend on failed
+type state struct {
+	env      Env
+	conf     config.Config
+	loaded   bool
+	host     string
+	port     string
+	resolved bool
+	reached  bool
+	tlsOK    bool // false only when a TLS handshake was tried and failed
+}
+
+// Run runs all checks in order
+func Run(env Env) Report {
+	s := &state{env: env}
+	report := Report{Summary: map[Status]int{}}
+	add := func(results ...Result) {
+		for _, r := range results {
+			report.Results = append(report.Results, r)
+			report.Summary[r.Status]++
+		}
+	}
+
+	add(s.checkConfig()...)
+	add(s.checkCertificates()...)
+	add(s.checkDNS())
+	add(s.checkTCP())
+	add(s.checkTLS())
+	add(s.checkPing())
+	add(s.checkPidFile())
+	add(s.checkLogDir())
+	add(s.checkStateStore())
+	add(s.checkServices()...)
+	return report
+}
+
+// Print writes the report as a table with hints below failed and warned checks
+func Print(w io.Writer, report Report) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, r := range report.Results {
+		fmt.Fprintf(tw, "[%s]\t%s\t%s\n", strings.ToUpper(string(r.Status)), r.Check, r.Message)
+		if r.Hint != "" && (r.Status == Warn || r.Status == Fail) {
+			fmt.Fprintf(tw, "\t\thint: %s\n", r.Hint)
+		}
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\n%d passed, %d warnings, %d failed, %d skipped\n",
+		report.Summary[Pass], report.Summary[Warn], report.Summary[Fail], report.Summary[Skip])
+}
+
+func result(check string, status Status, hint, format string, args ...interface{}) Result {
+	return Result{Check: check, Status: status, Message: fmt.Sprintf(format, args...), Hint: hint}
+}
@@ -3,6 +3,7 @@ module ss-agent
 go 1.22.4
 
 require (
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/spf13/cobra v1.2.1
 	golang.org/x/sys v0.0.0-20210510120138-977fb7262007
 )
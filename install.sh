@@ -1,22 +1,56 @@
 #!/bin/bash
+#
+# Installs ss-agent. The script only fetches the binary for this host; the
+# agent itself sets up directories, configuration, enrollment and the service
+# with `ss-agent install`, which is safe to run again.
+#
+# Usage:
+#   install.sh --url <binary-url> [ss-agent install flags]
+#   install.sh --binary <path> [ss-agent install flags]
+#
+# Example:
+#   curl -fsSL .../install.sh | sudo bash -s -- \
+#     --url https://downloads.example.com/ss-agent/ss-agent-linux-amd64 \
+#     --api-url https://siem.example.com/api --token <enrollment-token>
 
-# Variables
-AGENT_URL="https://example.com/agent"
-CONFIG_URL="https://example.com/config"
-INSTALL_DIR="/opt/siem-agent"
-CONFIG_FILE="$INSTALL_DIR/config.json"
+set -euo pipefail
 
-# Create installation directory
-sudo mkdir -p $INSTALL_DIR
+AGENT_URL="${SS_AGENT_URL:-}"
+AGENT_BINARY=""
+INSTALL_ARGS=()
 
-# Download the agent binary
-sudo curl -o $INSTALL_DIR/agent $AGENT_URL
-sudo chmod +x $INSTALL_DIR/agent
+while [ $# -gt 0 ]; do
+    case "$1" in
+        --url)
+            AGENT_URL="$2"
+            shift 2
+            ;;
+        --binary)
+            AGENT_BINARY="$2"
+            shift 2
+            ;;
+        *)
+            INSTALL_ARGS+=("$1")
+            shift
+            ;;
+    esac
+done
 
-# Download the configuration file
-curl -o $CONFIG_FILE $CONFIG_URL
+if [ "$(id -u)" -ne 0 ]; then
+    echo "install.sh must be run as root" >&2
+    exit 1
+fi
 
-# Register the agent
-sudo $INSTALL_DIR/agent register
+if [ -z "$AGENT_BINARY" ]; then
+    if [ -z "$AGENT_URL" ]; then
+        echo "Either --url <binary-url> or --binary <path> is required" >&2
+        exit 1
+    fi
+    TMP_DIR="$(mktemp -d)"
+    trap 'rm -rf "$TMP_DIR"' EXIT
+    AGENT_BINARY="$TMP_DIR/ss-agent"
+    curl -fsSL -o "$AGENT_BINARY" "$AGENT_URL"
+fi
 
-echo "SIEM agent installed and started."
+chmod +x "$AGENT_BINARY"
+"$AGENT_BINARY" install "${INSTALL_ARGS[@]+"${INSTALL_ARGS[@]}"}"
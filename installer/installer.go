@@ -0,0 +1,399 @@
+// installer/installer.go
+
+package installer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"ss-agent/api"
+	"ss-agent/config"
+)
+
+// ServiceName is the name the agent is registered under with the init system
+const ServiceName = "ss-agent"
+
+// manifestName is the file in BaseDir recording what the installer created
+const manifestName = "install-manifest.json"
+
+// Layout is where the agent and its files are installed
+type Layout struct {
+	Binary      string
+	BaseDir     string // holds the config and ssl directories and the manifest
+	ConfigDir   string
+	SSLDir      string
+	LogDir      string
+	PidDir      string
+	DataDir     string // state the agent keeps between runs
+	ServiceFile string // systemd unit or launchd plist, empty on Windows
+}
+
+// ConfigFile returns the path of the installed configuration
+func (l Layout) ConfigFile() string {
+	return filepath.Join(l.ConfigDir, "config.json")
+}
+
+// Options control an installation
+type Options struct {
+	Layout     Layout
+	Version    string
+	ConfigFile string // existing configuration to install instead of a generated one
+	APIURL     string // api_url for a generated configuration and for enrollment
+	Token      string // enrollment token, enrollment is skipped if empty
+	Force      bool   // replace an existing configuration
+	Start      bool   // start the agent service after installing it
+	Client     *http.Client
+}
+
+// Manifest records the paths the installer created, so uninstall removes
+// exactly those and leaves anything that was already there
+type Manifest struct {
+	Version     string    `json:"version"`
+	InstalledAt time.Time `json:"installed_at"`
+	Created     []string  `json:"created"`
+
+	changed bool // whether this run changed anything the running agent uses
+}
+
+func (m *Manifest) created(path string) {
+	for _, p := range m.Created {
+		if p == path {
+			return
+		}
+	}
+	m.Created = append(m.Created, path)
+}
+
+// Install installs the running binary as a service. Running it again on an
+// installed host only repairs what is missing or out of date.
+func Install(opts Options) (err error) {
+	if err := preflight(); err != nil {
+		return err
+	}
+	layout := opts.Layout
+	manifest := loadManifest(layout)
+	manifest.Version = opts.Version
+	manifest.InstalledAt = time.Now().UTC()
+
+	// The PID directory may be a shared system directory such as /var/run,
+	// so its mode and owner are only set when the installer creates it
+	dirs := []struct {
+		path string
+		perm os.FileMode
+		own  bool
+	}{
+		{layout.BaseDir, 0755, true},
+		{layout.ConfigDir, 0750, true},
+		{layout.SSLDir, 0700, true},
+		{layout.LogDir, 0755, true},
+		{layout.PidDir, 0755, false},
+		{layout.DataDir, 0700, true},
+	}
+	for _, d := range dirs {
+		if err := ensureDir(manifest, d.path, d.perm, d.own); err != nil {
+			return err
+		}
+	}
+	// Record what was created even if a later step fails, so a failed
+	// install can still be uninstalled
+	if err := saveManifest(layout, manifest); err != nil {
+		return err
+	}
+	defer func() {
+		if saveErr := saveManifest(layout, manifest); err == nil {
+			err = saveErr
+		}
+	}()
+
+	if err := installBinary(manifest, layout.Binary); err != nil {
+		return err
+	}
+	if err := installConfig(manifest, opts); err != nil {
+		return err
+	}
+	if opts.Token != "" {
+		if err := enroll(manifest, opts); err != nil {
+			return err
+		}
+	}
+	return installService(manifest, layout, opts.Start)
+}
+
+// Uninstall stops and removes the agent service and everything the installer
+// created. With keepConfig the configuration, the certificates and the state
+// with the agent's identity are kept.
+func Uninstall(layout Layout, keepConfig bool) error {
+	if err := requirePrivileges(); err != nil {
+		return err
+	}
+	if err := removeService(layout); err != nil {
+		return err
+	}
+
+	manifest := loadManifest(layout)
+	if len(manifest.Created) == 0 {
+		log.Printf("No install manifest found at %s, removing only the binary", manifestPath(layout))
+		manifest.Created = []string{layout.Binary}
+	}
+
+	kept := map[string]bool{}
+	if keepConfig {
+		for _, path := range []string{layout.BaseDir, layout.ConfigDir, layout.SSLDir, layout.ConfigFile(), layout.DataDir} {
+			kept[path] = true
+		}
+	}
+	for i := len(manifest.Created) - 1; i >= 0; i-- {
+		path := manifest.Created[i]
+		if _, err := os.Lstat(path); kept[path] || os.IsNotExist(err) {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", path, err)
+		}
+		log.Printf("Removed %s", path)
+	}
+	return nil
+}
+
+func manifestPath(layout Layout) string {
+	return filepath.Join(layout.BaseDir, manifestName)
+}
+
+func loadManifest(layout Layout) *Manifest {
+	manifest := &Manifest{}
+	data, err := os.ReadFile(manifestPath(layout))
+	if err != nil {
+		return manifest
+	}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		log.Printf("Ignoring unreadable install manifest: %v", err)
+	}
+	return manifest
+}
+
+func saveManifest(layout Layout, manifest *Manifest) error {
+	manifest.created(manifestPath(layout))
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(manifestPath(layout), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write install manifest: %v", err)
+	}
+	return nil
+}
+
+// ensureDir creates a directory if needed. The mode and owner are reset on
+// directories that belong to the agent, in case they were changed.
+func ensureDir(manifest *Manifest, path string, perm os.FileMode, own bool) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := os.MkdirAll(path, perm); err != nil {
+			return fmt.Errorf("failed to create directory %s: %v", path, err)
+		}
+		manifest.created(path)
+		log.Printf("Created %s", path)
+	} else if !own {
+		return nil
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		return fmt.Errorf("failed to set mode of %s: %v", path, err)
+	}
+	return setOwner(path)
+}
+
+// installBinary copies the running executable to its installed location,
+// unless it is already there
+func installBinary(manifest *Manifest, target string) error {
+	source, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the running executable: %v", err)
+	}
+	if source, err = filepath.EvalSymlinks(source); err != nil {
+		return fmt.Errorf("failed to resolve the running executable: %v", err)
+	}
+	if _, err := os.Stat(target); os.IsNotExist(err) {
+		manifest.created(target)
+	} else if same, err := sameFile(source, target); err == nil && same {
+		log.Printf("%s is up to date", target)
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", target, err)
+	}
+	// Copy next to the target and rename, so a running agent keeps its binary
+	tmp := target + ".new"
+	if err := copyFile(source, tmp, 0755); err != nil {
+		return fmt.Errorf("failed to copy binary to %s: %v", target, err)
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to install binary to %s: %v", target, err)
+	}
+	log.Printf("Installed %s", target)
+	manifest.changed = true
+	return setOwner(target)
+}
+
+// installConfig installs the given configuration or generates a minimal one.
+// An existing configuration is kept unless Force is set.
+func installConfig(manifest *Manifest, opts Options) error {
+	target := opts.Layout.ConfigFile()
+	if _, err := os.Stat(target); err == nil && !opts.Force {
+		log.Printf("Keeping existing configuration %s", target)
+		return nil
+	} else if os.IsNotExist(err) {
+		manifest.created(target)
+	}
+
+	var data []byte
+	if opts.ConfigFile != "" {
+		var err error
+		if data, err = os.ReadFile(opts.ConfigFile); err != nil {
+			return fmt.Errorf("failed to read configuration %s: %v", opts.ConfigFile, err)
+		}
+		var probe config.Config
+		if err := json.Unmarshal(data, &probe); err != nil {
+			return fmt.Errorf("invalid configuration %s: %v", opts.ConfigFile, err)
+		}
+	} else {
+		conf := config.Config{
+			APIUrl:       opts.APIURL,
+			CertFile:     filepath.Join(opts.Layout.SSLDir, "client.crt"),
+			KeyFile:      filepath.Join(opts.Layout.SSLDir, "client.key"),
+			CAFile:       filepath.Join(opts.Layout.SSLDir, "cacert.crt"),
+			PingInterval: 10,
+		}
+		var err error
+		if data, err = json.MarshalIndent(conf, "", "  "); err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	}
+
+	// The configuration holds the API credentials
+	if err := os.WriteFile(target, data, 0600); err != nil {
+		return fmt.Errorf("failed to write configuration %s: %v", target, err)
+	}
+	if err := os.Chmod(target, 0600); err != nil {
+		return err
+	}
+	log.Printf("Installed configuration %s", target)
+	manifest.changed = true
+	return setOwner(target)
+}
+
+// enroll exchanges the token for credentials and stores them in the installed
+// configuration, keeping all other settings as they are
+func enroll(manifest *Manifest, opts Options) error {
+	path := opts.Layout.ConfigFile()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration %s: %v", path, err)
+	}
+	settings := map[string]interface{}{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return fmt.Errorf("invalid configuration %s: %v", path, err)
+	}
+	// Enrollment tokens are single use, so a reinstall keeps the credentials
+	if key, _ := settings["api_access_key"].(string); key != "" && !opts.Force {
+		log.Println("Agent is already enrolled, use --force to enroll again")
+		return nil
+	}
+
+	apiURL := opts.APIURL
+	if apiURL == "" {
+		apiURL, _ = settings["api_url"].(string)
+	}
+	client := opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	log.Printf("Enrolling with %s...", apiURL)
+	enrollment, err := api.Enroll(client, apiURL, opts.Token)
+	if err != nil {
+		return fmt.Errorf("enrollment failed: %v", err)
+	}
+
+	settings["api_url"] = apiURL
+	settings["organization_key"] = enrollment.OrganizationKey
+	settings["api_access_key"] = enrollment.APIAccessKey
+	settings["api_secret_key"] = enrollment.APISecretKey
+	if data, err = json.MarshalIndent(settings, "", "  "); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write configuration %s: %v", path, err)
+	}
+	log.Println("Agent enrolled")
+	manifest.changed = true
+	return nil
+}
+
+// writeIfChanged writes a file unless it already has the given content and
+// reports whether it changed
+func writeIfChanged(manifest *Manifest, path string, content []byte, perm os.FileMode) (bool, error) {
+	existing, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(existing, content) {
+		return false, nil
+	}
+	if os.IsNotExist(err) {
+		manifest.created(path)
+	}
+	if err := os.WriteFile(path, content, perm); err != nil {
+		return false, fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	log.Printf("Wrote %s", path)
+	manifest.changed = true
+	return true, nil
+}
+
+func sameFile(a, b string) (bool, error) {
+	ha, err := fileHash(a)
+	if err != nil {
+		return false, err
+	}
+	hb, err := fileHash(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(ha, hb), nil
+}
+
+func fileHash(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,135 @@
+// installer/installer_darwin.go
+
+//go:build darwin
+// +build darwin
+
+package installer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+)
+
+// launchdLabel identifies the agent job to launchd
+const launchdLabel = "com.securityspectrum.ss-agent"
+
+// DefaultLayout returns the standard install locations. The config and log
+// paths match what the config loader and daemon mode look for.
+func DefaultLayout() Layout {
+	return Layout{
+		Binary:      "/usr/local/bin/ss-agent",
+		BaseDir:     "/Library/Application Support/ss-agent",
+		ConfigDir:   "/Library/Application Support/ss-agent/config",
+		SSLDir:      "/Library/Application Support/ss-agent/ssl",
+		LogDir:      "/Library/Logs/ss-agent",
+		PidDir:      "/Library/Logs/ss-agent",
+		DataDir:     "/Library/Application Support/ss-agent/data",
+		ServiceFile: "/Library/LaunchDaemons/" + launchdLabel + ".plist",
+	}
+}
+
+var plistTemplate = template.Must(template.New("plist").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{.Label}}</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>{{.Binary}}</string>
+		<string>start</string>
+		<string>--config</string>
+		<string>{{.Config}}</string>
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>StandardOutPath</key>
+	<string>{{.Log}}</string>
+	<key>StandardErrorPath</key>
+	<string>{{.Log}}</string>
+</dict>
+</plist>
+`))
+
+// preflight checks that the agent can be installed before anything changes
+func preflight() error {
+	return requirePrivileges()
+}
+
+func requirePrivileges() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("installing the agent requires root privileges")
+	}
+	return nil
+}
+
+func setOwner(path string) error {
+	// root:wheel
+	if err := os.Lchown(path, 0, 0); err != nil {
+		return fmt.Errorf("failed to set owner of %s: %v", path, err)
+	}
+	return nil
+}
+
+// installService writes the launchd plist and (re)loads the job. launchd
+// starts jobs with RunAtLoad as soon as they are loaded, so loading is
+// skipped unless start is set.
+func installService(manifest *Manifest, layout Layout, start bool) error {
+	var plist strings.Builder
+	err := plistTemplate.Execute(&plist, map[string]string{
+		"Label":  launchdLabel,
+		"Binary": layout.Binary,
+		"Config": layout.ConfigFile(),
+		"Log":    layout.LogDir + "/ss-agent.log",
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := writeIfChanged(manifest, layout.ServiceFile, []byte(plist.String()), 0644); err != nil {
+		return err
+	}
+	if err := setOwner(layout.ServiceFile); err != nil {
+		return err
+	}
+	if !start {
+		return nil
+	}
+
+	loaded := exec.Command("launchctl", "print", "system/"+launchdLabel).Run() == nil
+	if loaded && !manifest.changed {
+		return nil
+	}
+	// Unload first so a reinstall picks up the new plist and binary
+	if loaded {
+		exec.Command("launchctl", "bootout", "system/"+launchdLabel).Run()
+	}
+	output, err := exec.Command("launchctl", "bootstrap", "system", layout.ServiceFile).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("launchctl bootstrap failed: %v\nOutput: %s", err, string(output))
+	}
+	log.Printf("Loaded %s", launchdLabel)
+	return nil
+}
+
+// removeService unloads the job and removes the plist
+func removeService(layout Layout) error {
+	if _, err := os.Stat(layout.ServiceFile); os.IsNotExist(err) {
+		return nil
+	}
+	// bootout fails if the job is not loaded, which is fine
+	exec.Command("launchctl", "bootout", "system/"+launchdLabel).Run()
+	if err := os.Remove(layout.ServiceFile); err != nil {
+		return fmt.Errorf("failed to remove %s: %v", layout.ServiceFile, err)
+	}
+	log.Printf("Removed %s", layout.ServiceFile)
+	return nil
+}
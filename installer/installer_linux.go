@@ -0,0 +1,144 @@
+// installer/installer_linux.go
+
+//go:build linux
+// +build linux
+
+package installer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/template"
+
+	"ss-agent/service/servicectl"
+)
+
+// DefaultLayout returns the standard install locations. The config and log
+// paths match what the config loader and daemon mode look for.
+func DefaultLayout() Layout {
+	return Layout{
+		Binary:      "/usr/local/bin/ss-agent",
+		BaseDir:     "/etc/ss-agent",
+		ConfigDir:   "/etc/ss-agent/config",
+		SSLDir:      "/etc/ss-agent/ssl",
+		LogDir:      "/var/log/ss-agent",
+		PidDir:      "/var/run",
+		DataDir:     "/var/lib/ss-agent",
+		ServiceFile: "/etc/systemd/system/ss-agent.service",
+	}
+}
+
+var unitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description=Security Spectrum agent
+Documentation=https://github.com/securityspectrum/ss-agent
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+# The agent reports READY=1 once it supervises the services, the result of
+# its last heartbeat as its status, and pings the watchdog while its scheduled
+# jobs make progress.
+Type=notify
+NotifyAccess=main
+WatchdogSec=60
+ExecStart={{.Binary}} start --config {{.Config}}
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+func requirePrivileges() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("installing the agent requires root privileges")
+	}
+	return nil
+}
+
+// preflight checks that the agent can be installed before anything changes
+func preflight() error {
+	if err := requirePrivileges(); err != nil {
+		return err
+	}
+	if initSystem := servicectl.DetectInitSystem(); initSystem != servicectl.InitSystemd {
+		return fmt.Errorf("installing the agent service requires systemd, the host uses %s", initSystem)
+	}
+	return nil
+}
+
+func setOwner(path string) error {
+	if err := os.Lchown(path, 0, 0); err != nil {
+		return fmt.Errorf("failed to set owner of %s: %v", path, err)
+	}
+	return nil
+}
+
+// installService writes the systemd unit, reloads systemd if it changed and
+// enables the unit
+func installService(manifest *Manifest, layout Layout, start bool) error {
+	var unit strings.Builder
+	err := unitTemplate.Execute(&unit, map[string]string{
+		"Binary": layout.Binary,
+		"Config": layout.ConfigFile(),
+	})
+	if err != nil {
+		return err
+	}
+	changed, err := writeIfChanged(manifest, layout.ServiceFile, []byte(unit.String()), 0644)
+	if err != nil {
+		return err
+	}
+
+	backend := servicectl.Default()
+	if uc, ok := backend.(servicectl.UnitConfigurator); ok && changed {
+		if err := uc.DaemonReload(); err != nil {
+			return err
+		}
+	}
+	if err := backend.Enable(ServiceName); err != nil {
+		return fmt.Errorf("failed to enable %s: %v", ServiceName, err)
+	}
+	log.Printf("Enabled %s", servicectl.UnitName(ServiceName))
+	if !start {
+		return nil
+	}
+	// Restart if anything changed, so a reinstall picks up the new binary
+	// and configuration. Starting a running unit does nothing.
+	action, verb := backend.Start, "Started"
+	if manifest.changed {
+		action, verb = backend.Restart, "Restarted"
+	}
+	if err := action(context.Background(), ServiceName); err != nil {
+		return fmt.Errorf("failed to start %s: %v", ServiceName, err)
+	}
+	log.Printf("%s %s", verb, servicectl.UnitName(ServiceName))
+	return nil
+}
+
+// removeService stops and disables the unit and removes the unit file
+func removeService(layout Layout) error {
+	if _, err := os.Stat(layout.ServiceFile); os.IsNotExist(err) {
+		return nil
+	}
+	backend := servicectl.Default()
+	if status, err := backend.Status(ServiceName); err == nil && status.State == servicectl.StateRunning {
+		if err := backend.Stop(context.Background(), ServiceName); err != nil {
+			return fmt.Errorf("failed to stop %s: %v", ServiceName, err)
+		}
+	}
+	if err := backend.Disable(ServiceName); err != nil {
+		return fmt.Errorf("failed to disable %s: %v", ServiceName, err)
+	}
+	if err := os.Remove(layout.ServiceFile); err != nil {
+		return fmt.Errorf("failed to remove %s: %v", layout.ServiceFile, err)
+	}
+	log.Printf("Removed %s", layout.ServiceFile)
+	if uc, ok := backend.(servicectl.UnitConfigurator); ok {
+		return uc.DaemonReload()
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+// installer/installer_windows.go
+
+//go:build windows
+// +build windows
+
+package installer
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// DefaultLayout returns the standard install locations. The config and log
+// paths match what the config loader and daemon mode look for.
+func DefaultLayout() Layout {
+	return Layout{
+		Binary:    `C:\Program Files\ss-agent\ss-agent.exe`,
+		BaseDir:   `C:\ProgramData\ss-agent`,
+		ConfigDir: `C:\ProgramData\ss-agent\config`,
+		SSLDir:    `C:\ProgramData\ss-agent\ssl`,
+		LogDir:    `C:\ProgramData\ss-agent`,
+		PidDir:    `C:\ProgramData\ss-agent`,
+		DataDir:   `C:\ProgramData\ss-agent\data`,
+	}
+}
+
+// preflight checks that the agent can be installed before anything changes
+func preflight() error {
+	return requirePrivileges()
+}
+
+func requirePrivileges() error {
+	if !windows.GetCurrentProcessToken().IsElevated() {
+		return fmt.Errorf("installing the agent requires an elevated (administrator) prompt")
+	}
+	return nil
+}
+
+// setOwner is a no-op, files under Program Files and ProgramData inherit
+// their ACLs from the parent directory
+func setOwner(path string) error {
+	return nil
+}
+
+// installService registers the agent with the service control manager, or
+// updates the registration if it exists
+func installService(manifest *Manifest, layout Layout, start bool) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+
+	args := []string{"start", "--config", layout.ConfigFile()}
+	s, err := m.OpenService(ServiceName)
+	if err == nil {
+		conf, err := s.Config()
+		if err == nil {
+			conf.BinaryPathName = windows.EscapeArg(layout.Binary)
+			for _, arg := range args {
+				conf.BinaryPathName += " " + windows.EscapeArg(arg)
+			}
+			conf.StartType = mgr.StartAutomatic
+			err = s.UpdateConfig(conf)
+		}
+		if err != nil {
+			s.Close()
+			return fmt.Errorf("failed to update service %s: %v", ServiceName, err)
+		}
+		log.Printf("Updated service %s", ServiceName)
+	} else {
+		s, err = m.CreateService(ServiceName, layout.Binary, mgr.Config{
+			DisplayName: "Security Spectrum agent",
+			StartType:   mgr.StartAutomatic,
+		}, args...)
+		if err != nil {
+			return fmt.Errorf("failed to create service %s: %v", ServiceName, err)
+		}
+		log.Printf("Created service %s", ServiceName)
+	}
+	defer s.Close()
+
+	if !start {
+		return nil
+	}
+	if status, err := s.Query(); err == nil && status.State == svc.Running {
+		return nil
+	}
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("failed to start service %s: %v", ServiceName, err)
+	}
+	log.Printf("Started service %s", ServiceName)
+	return nil
+}
+
+// removeService stops the agent service and deletes its registration
+func removeService(layout Layout) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %v", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(ServiceName)
+	if err != nil {
+		// Not registered
+		return nil
+	}
+	defer s.Close()
+
+	if status, err := s.Control(svc.Stop); err == nil {
+		deadline := time.Now().Add(30 * time.Second)
+		for status.State != svc.Stopped && time.Now().Before(deadline) {
+			time.Sleep(500 * time.Millisecond)
+			if status, err = s.Query(); err != nil {
+				break
+			}
+		}
+	}
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("failed to delete service %s: %v", ServiceName, err)
+	}
+	log.Printf("Deleted service %s", ServiceName)
+	return nil
+}
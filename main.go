@@ -6,7 +6,6 @@ package main
 
 import (
 	"context"
-	"log"
 
 	"ss-agent/cmd"
 )
@@ -14,9 +13,6 @@ import (
 var version = "1.0.0"
 
 func main() {
-	// Configure logging to include timestamps
-	log.SetFlags(log.LstdFlags)
-
 	// Set up context for cancellation
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -16,8 +16,6 @@ import (
 var version = "1.0.0"
 
 func main() {
-	log.SetFlags(log.LstdFlags)
-
 	isService, err := svc.IsWindowsService()
 	if err != nil {
 		log.Fatalf("Failed to determine if running as a Windows service: %v", err)
@@ -0,0 +1,287 @@
+// service/bulk.go
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"ss-agent/config"
+)
+
+// defaultDependencies lists, for each managed service, the services that must
+// be running before it starts.
+var defaultDependencies = map[string][]string{
+	"fluent-bit": {"zeek"},       // tails the logs Zeek writes
+	"osqueryd":   {"fluent-bit"}, // ships its results through Fluent Bit
+}
+
+// Outcome labels for bulk operations
+const (
+	OutcomeStarted   = "[STARTED]"
+	OutcomeStopped   = "[STOPPED]"
+	OutcomeRestarted = "[RESTARTED]"
+	OutcomeFailed    = "[FAILED]"
+	OutcomeSkipped   = "[SKIPPED]"
+	OutcomeTimeout   = "[TIMEOUT]"
+)
+
+// BulkResult is the outcome of one service in a bulk operation.
+type BulkResult struct {
+	Service  string
+	Action   string
+	Outcome  string
+	Err      error
+	Duration time.Duration
+}
+
+// Dependencies returns the services the given service depends on, honouring
+// the depends_on override from the configuration.
+func Dependencies(serviceName string) []string {
+	if svcConf, ok := config.GetConfig().Services[serviceName]; ok && svcConf.DependsOn != nil {
+		return svcConf.DependsOn
+	}
+	return defaultDependencies[serviceName]
+}
+
+// DependencyLevels groups services so that every service only depends on
+// services in earlier levels. Services within a level are independent of each
+// other and can be handled concurrently. Dependencies outside of the given
+// services are ignored.
+func DependencyLevels(services []string) ([][]string, error) {
+	selected := make(map[string]bool, len(services))
+	for _, name := range services {
+		selected[name] = true
+	}
+
+	remaining := make(map[string][]string, len(services))
+	for _, name := range services {
+		var deps []string
+		for _, dep := range Dependencies(name) {
+			if selected[dep] {
+				deps = append(deps, dep)
+			}
+		}
+		remaining[name] = deps
+	}
+
+	var levels [][]string
+	done := make(map[string]bool, len(services))
+	for len(done) < len(services) {
+		var level []string
+		for _, name := range services {
+			if done[name] {
+				continue
+			}
+			ready := true
+			for _, dep := range remaining[name] {
+				if !done[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				level = append(level, name)
+			}
+		}
+		if len(level) == 0 {
+			var cycle []string
+			for _, name := range services {
+				if !done[name] {
+					cycle = append(cycle, name)
+				}
+			}
+			sort.Strings(cycle)
+			return nil, fmt.Errorf("dependency cycle between services: %s", strings.Join(cycle, ", "))
+		}
+		for _, name := range level {
+			done[name] = true
+		}
+		levels = append(levels, level)
+	}
+	return levels, nil
+}
+
+// RunAll performs start, stop or restart on all managed services. Starts run
+// in dependency order and stops in reverse order; a restart stops everything
+// before starting it again. Independent services are handled concurrently.
+// With wait, each service must reach its expected state before it counts as
+// done, so dependents only start once their dependencies are running.
+// Services still pending when the timeout expires are reported as timed out.
+func RunAll(action string, timeout time.Duration, wait bool) ([]BulkResult, error) {
+	levels, err := DependencyLevels(AllServices)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+
+	switch action {
+	case "start":
+		results := runLevels(levels, "start", deadline, wait, true, nil)
+		return orderedResults(levels, results), nil
+
+	case "stop":
+		reversed := reverseLevels(levels)
+		results := runLevels(reversed, "stop", deadline, wait, false, nil)
+		return orderedResults(reversed, results), nil
+
+	case "restart":
+		stopped := runLevels(reverseLevels(levels), "stop", deadline, wait, false, nil)
+		skip := make(map[string]string)
+		for name, r := range stopped {
+			if r.Err != nil {
+				skip[name] = fmt.Sprintf("stop failed: %v", r.Err)
+			}
+		}
+		started := runLevels(levels, "start", deadline, wait, true, skip)
+
+		results := make(map[string]BulkResult, len(started))
+		for name, r := range started {
+			r.Action = "restart"
+			if stop := stopped[name]; stop.Err != nil {
+				r = stop
+				r.Action = "restart"
+			} else {
+				r.Duration += stop.Duration
+				if r.Err == nil {
+					r.Outcome = OutcomeRestarted
+				}
+			}
+			results[name] = r
+		}
+		return orderedResults(levels, results), nil
+
+	default:
+		return nil, fmt.Errorf("unknown action: %s", action)
+	}
+}
+
+// runLevels runs the action on each level concurrently, waiting for a level
+// to finish before moving on. With blockOnFailure, services whose
+// dependencies failed are skipped. Services listed in skip are skipped with
+// the given reason.
+func runLevels(levels [][]string, action string, deadline time.Time, wait, blockOnFailure bool, skip map[string]string) map[string]BulkResult {
+	results := make(map[string]BulkResult)
+	failed := make(map[string]bool)
+
+	for _, level := range levels {
+		ch := make(chan BulkResult, len(level))
+		pending := make(map[string]bool)
+
+		for _, name := range level {
+			reason := skip[name]
+			if reason == "" && blockOnFailure {
+				for _, dep := range Dependencies(name) {
+					if failed[dep] {
+						reason = fmt.Sprintf("dependency %s did not %s", dep, action)
+						break
+					}
+				}
+			}
+			if reason != "" {
+				results[name] = BulkResult{Service: name, Action: action, Outcome: OutcomeSkipped, Err: fmt.Errorf("%s", reason)}
+				failed[name] = true
+				continue
+			}
+			if !time.Now().Before(deadline) {
+				results[name] = timedOut(name, action)
+				failed[name] = true
+				continue
+			}
+
+			pending[name] = true
+			go func(name string) {
+				start := time.Now()
+				var err error
+				if wait {
+					err = ManageServiceAndWait(name, action, time.Until(deadline))
+				} else {
+					ctx, cancel := context.WithDeadline(context.Background(), deadline)
+					err = ManageServiceContext(ctx, name, action)
+					cancel()
+				}
+				ch <- BulkResult{Service: name, Action: action, Err: err, Duration: time.Since(start)}
+			}(name)
+		}
+
+		// The service commands give up at the deadline; those still running
+		// then are reported as timed out without waiting for them.
+		timer := time.NewTimer(time.Until(deadline))
+		for len(pending) > 0 {
+			select {
+			case r := <-ch:
+				delete(pending, r.Service)
+				if r.Err != nil {
+					r.Outcome = OutcomeFailed
+					failed[r.Service] = true
+				} else {
+					r.Outcome = successOutcome(action)
+				}
+				results[r.Service] = r
+			case <-timer.C:
+				for name := range pending {
+					results[name] = timedOut(name, action)
+					failed[name] = true
+				}
+				pending = nil
+			}
+		}
+		timer.Stop()
+	}
+	return results
+}
+
+func timedOut(name, action string) BulkResult {
+	return BulkResult{Service: name, Action: action, Outcome: OutcomeTimeout, Err: fmt.Errorf("timed out")}
+}
+
+func successOutcome(action string) string {
+	switch action {
+	case "start":
+		return OutcomeStarted
+	case "stop":
+		return OutcomeStopped
+	default:
+		return OutcomeRestarted
+	}
+}
+
+func reverseLevels(levels [][]string) [][]string {
+	reversed := make([][]string, 0, len(levels))
+	for i := len(levels) - 1; i >= 0; i-- {
+		reversed = append(reversed, levels[i])
+	}
+	return reversed
+}
+
+func orderedResults(levels [][]string, results map[string]BulkResult) []BulkResult {
+	ordered := make([]BulkResult, 0, len(results))
+	for _, level := range levels {
+		for _, name := range level {
+			if r, ok := results[name]; ok {
+				ordered = append(ordered, r)
+			}
+		}
+	}
+	return ordered
+}
+
+// PrintBulkResults writes a summary table of a bulk operation.
+func PrintBulkResults(w io.Writer, results []BulkResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVICE\tACTION\tRESULT\tDURATION\tDETAIL")
+	for _, r := range results {
+		detail := ""
+		if r.Err != nil {
+			// Keep the table readable; command output follows on later lines
+			detail = strings.SplitN(r.Err.Error(), "\n", 2)[0]
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Service, r.Action, r.Outcome, r.Duration.Round(100*time.Millisecond), detail)
+	}
+	tw.Flush()
+}
@@ -1,94 +1,109 @@
 package fluentbit
 
 import (
+	"context"
 	"fmt"
-	"os/exec"
 	"runtime"
 	"strings"
-	"time"
+
+	"ss-agent/service/servicectl"
+	"ss-agent/utils/logging"
+	"ss-agent/utils/runner"
+	"ss-agent/utils/version"
 )
 
+var logger = logging.For("fluent-bit")
+
+// unitName is the Fluent Bit service name on Linux
+const unitName = "fluent-bit"
+
 // FluentBitStatus checks the status of Fluent Bit using platform-specific commands
 func FluentBitStatus() (string, error) {
-	fmt.Println("Checking Fluent Bit status...")
+	logger.Debug("Checking Fluent Bit status")
+
+	state, err := FluentBitState()
+	return state.Label(), err
+}
 
+// FluentBitState returns the normalized state of Fluent Bit
+func FluentBitState() (servicectl.State, error) {
 	switch runtime.GOOS {
 	case "linux":
-		cmd := exec.Command("systemctl", "is-active", "fluent-bit")
-		output, err := cmd.CombinedOutput()
-		status := strings.TrimSpace(string(output))
-
-		// Handle systemctl's inactive state without treating it as an error
-		if err != nil && strings.Contains(status, "inactive") {
-			return "[STOPPED]", nil
-		} else if err == nil && strings.Contains(status, "active") {
-			return "[RUNNING]", nil
-		} else if err != nil {
-			return "[FAILED]", fmt.Errorf("systemctl status failed: %v\nOutput: %s", err, string(output))
+		status, err := servicectl.Default().Status(unitName)
+		if err != nil {
+			return servicectl.StateFailed, err
 		}
-
-		return "[UNKNOWN]", nil
+		return status.State, nil
 
 	case "darwin":
-		cmd := exec.Command("launchctl", "print", "system")
-		output, err := cmd.CombinedOutput()
+		output, err := runner.Query("launchctl", "print", "system")
 
 		// Check if the error is specifically because the service is not found
 		if err != nil && strings.Contains(string(output), "could not find service") {
-			return "[NOT INSTALLED]", nil
+			return servicectl.StateNotInstalled, nil
 		}
 		if err != nil {
-			return "[FAILED]", fmt.Errorf("launchctl print failed: %v\nOutput: %s", err, string(output))
+			return servicectl.StateFailed, fmt.Errorf("launchctl print failed: %v\nOutput: %s", err, string(output))
 		}
 
 		if strings.Contains(string(output), "io.fluentbit.fluent-bit") {
-			return "[RUNNING]", nil
+			return servicectl.StateRunning, nil
 		}
-		return "[STOPPED]", nil
+		return servicectl.StateStopped, nil
 
 	case "windows":
-		cmd := exec.Command("sc", "query", "fluent-bit")
-		output, err := cmd.CombinedOutput()
+		output, err := runner.Query("sc", "query", "fluent-bit")
 		if err != nil {
-			return "[FAILED]", fmt.Errorf("sc query failed: %v\nOutput: %s", err, string(output))
+			return servicectl.StateFailed, fmt.Errorf("sc query failed: %v\nOutput: %s", err, string(output))
 		}
 
 		if strings.Contains(string(output), "RUNNING") {
-			return "[RUNNING]", nil
+			return servicectl.StateRunning, nil
 		}
-		return "[STOPPED]", nil
+		return servicectl.StateStopped, nil
 
 	default:
-		return "[UNKNOWN]", fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+		return servicectl.StateUnknown, fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
 	}
 }
 
+// fluentBitBinaryPaths are the known install locations of the fluent-bit binary
+var fluentBitBinaryPaths = []string{
+	"/opt/fluent-bit/bin/fluent-bit",
+	"/usr/bin/fluent-bit",
+	"/usr/local/bin/fluent-bit",
+	`C:\Program Files\fluent-bit\bin\fluent-bit.exe`,
+}
+
+// FluentBitVersion detects the installed Fluent Bit version using
+// `fluent-bit --version`, falling back to package metadata
+func FluentBitVersion() (version.Info, error) {
+	binary, _ := version.FindBinary("fluent-bit", fluentBitBinaryPaths...)
+	return version.Detect(binary, []string{"--version"}, "fluent-bit", "td-agent-bit")
+}
+
 // FluentBitStart starts Fluent Bit using platform-specific commands
-func FluentBitStart() error {
+func FluentBitStart(ctx context.Context) error {
 	switch runtime.GOOS {
 	case "linux":
-		cmd := exec.Command("systemctl", "start", "fluent-bit")
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("systemctl start failed: %v\nOutput: %s", err, string(output))
+		if err := servicectl.Default().Start(ctx, unitName); err != nil {
+			return err
 		}
-		fmt.Println("Fluent Bit started successfully.")
+		runner.LogUnlessDryRun(logger, "Fluent Bit started")
 
 	case "darwin":
-		cmd := exec.Command("sudo", "launchctl", "load", "/Library/LaunchDaemons/fluent-bit.plist")
-		output, err := cmd.CombinedOutput()
+		output, err := runner.RunContext(ctx, "sudo", "launchctl", "load", "/Library/LaunchDaemons/fluent-bit.plist")
 		if err != nil {
 			return fmt.Errorf("launchctl load failed: %v\nOutput: %s", err, string(output))
 		}
-		fmt.Println("Fluent Bit started successfully.")
+		runner.LogUnlessDryRun(logger, "Fluent Bit started")
 
 	case "windows":
-		cmd := exec.Command("sc", "start", "fluent-bit")
-		output, err := cmd.CombinedOutput()
+		output, err := runner.RunContext(ctx, "sc", "start", "fluent-bit")
 		if err != nil {
 			return fmt.Errorf("sc start failed: %v\nOutput: %s", err, string(output))
 		}
-		fmt.Println("Fluent Bit started successfully.")
+		runner.LogUnlessDryRun(logger, "Fluent Bit started")
 
 	default:
 		return fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
@@ -97,31 +112,27 @@ func FluentBitStart() error {
 }
 
 // FluentBitStop stops Fluent Bit using platform-specific commands
-func FluentBitStop() error {
+func FluentBitStop(ctx context.Context) error {
 	switch runtime.GOOS {
 	case "linux":
-		cmd := exec.Command("systemctl", "stop", "fluent-bit")
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("systemctl stop failed: %v\nOutput: %s", err, string(output))
+		if err := servicectl.Default().Stop(ctx, unitName); err != nil {
+			return err
 		}
-		fmt.Println("Fluent Bit stopped successfully.")
+		runner.LogUnlessDryRun(logger, "Fluent Bit stopped")
 
 	case "darwin":
-		cmd := exec.Command("sudo", "launchctl", "unload", "/Library/LaunchDaemons/fluent-bit.plist")
-		output, err := cmd.CombinedOutput()
+		output, err := runner.RunContext(ctx, "sudo", "launchctl", "unload", "/Library/LaunchDaemons/fluent-bit.plist")
 		if err != nil {
 			return fmt.Errorf("launchctl unload failed: %v\nOutput: %s", err, string(output))
 		}
-		fmt.Println("Fluent Bit stopped successfully.")
+		runner.LogUnlessDryRun(logger, "Fluent Bit stopped")
 
 	case "windows":
-		cmd := exec.Command("sc", "stop", "fluent-bit")
-		output, err := cmd.CombinedOutput()
+		output, err := runner.RunContext(ctx, "sc", "stop", "fluent-bit")
 		if err != nil {
 			return fmt.Errorf("sc stop failed: %v\nOutput: %s", err, string(output))
 		}
-		fmt.Println("Fluent Bit stopped successfully.")
+		runner.LogUnlessDryRun(logger, "Fluent Bit stopped")
 
 	default:
 		return fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
@@ -129,79 +140,22 @@ func FluentBitStop() error {
 	return nil
 }
 
-// isFluentBitStopped checks if Fluent Bit is no longer running
-func isFluentBitStopped() (bool, error) {
-	switch runtime.GOOS {
-	case "linux":
-		cmd := exec.Command("systemctl", "is-active", "fluent-bit")
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			// If the service is inactive, systemctl returns a non-zero exit code
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				if exitErr.ExitCode() == 3 { // inactive
-					return true, nil
-				}
-			}
-			return false, fmt.Errorf("error checking status: %v\nOutput: %s", err, string(output))
-		}
-		status := string(output)
-		return status == "inactive\n", nil
-
-	case "darwin":
-		cmd := exec.Command("launchctl", "list", "fluent-bit")
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			// If the service is not loaded, launchctl returns a non-zero exit code
-			if exitErr, ok := err.(*exec.ExitError); ok {
-				if exitErr.ExitCode() != 0 {
-					return true, nil
-				}
-			}
-			return false, fmt.Errorf("error checking status: %v\nOutput: %s", err, string(output))
-		}
-		// If the service is listed, it's still running
-		return false, nil
-
-	case "windows":
-		cmd := exec.Command("sc", "query", "fluent-bit")
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			return false, fmt.Errorf("error checking status: %v\nOutput: %s", err, string(output))
-		}
-		// Parse the output to check the state
-		outputStr := string(output)
-		if strings.Contains(outputStr, "STATE              : 1  STOPPED") {
-			return true, nil
-		}
-		return false, nil
-
-	default:
-		return false, fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
-	}
-}
-
 // FluentBitRestart stops and starts Fluent Bit, ensuring it fully stops before restarting
-func FluentBitRestart() error {
+func FluentBitRestart(ctx context.Context) error {
 	// Stop Fluent Bit
-	err := FluentBitStop()
+	err := FluentBitStop(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to stop Fluent Bit: %v", err)
 	}
 
-	// Wait for a short duration to ensure Fluent Bit has stopped
-	time.Sleep(2 * time.Second) // Adjust the duration as needed
-
-	// Optionally, verify that Fluent Bit has stopped
-	stopped, err := isFluentBitStopped()
+	// Wait until Fluent Bit has stopped before starting it again
+	_, err = servicectl.WaitForState(ctx, "Fluent Bit", FluentBitState, servicectl.StateStopped, servicectl.StateFailed)
 	if err != nil {
-		return fmt.Errorf("error checking Fluent Bit status: %v", err)
-	}
-	if !stopped {
-		return fmt.Errorf("Fluent Bit did not stop as expected")
+		return err
 	}
 
 	// Start Fluent Bit
-	err = FluentBitStart()
+	err = FluentBitStart(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to start Fluent Bit: %v", err)
 	}
@@ -0,0 +1,235 @@
+// service/install.go
+
+package service
+
+import (
+	"fmt"
+	"time"
+
+	"ss-agent/config"
+	"ss-agent/service/pkgmgr"
+	"ss-agent/service/servicectl"
+	"ss-agent/utils/runner"
+)
+
+// defaultPackages maps managed services to their usual package names
+var defaultPackages = map[string]string{
+	"zeek":       "zeek",
+	"fluent-bit": "fluent-bit",
+	"osqueryd":   "osquery",
+}
+
+// PackageOptions override the package settings from the configuration, e.g.
+// from command line flags.
+type PackageOptions struct {
+	Version string
+	File    string
+}
+
+// packageConfig returns the package settings of a service with defaults and
+// overrides applied.
+func packageConfig(serviceName string, opts PackageOptions) config.PackageConfig {
+	pkg := config.GetConfig().Services[serviceName].Package
+	if pkg.Name == "" {
+		pkg.Name = defaultPackages[serviceName]
+	}
+	if opts.Version != "" {
+		pkg.Version = opts.Version
+	}
+	if opts.File != "" {
+		pkg.File = opts.File
+	}
+	return pkg
+}
+
+// Install installs a managed service through the host package manager, from a
+// local package file or the configured repository, and verifies the result.
+// Installing a service that is already present at the wanted version, or at
+// the version in the package file, is a no-op.
+func Install(serviceName string, opts PackageOptions) error {
+	pm, err := pkgmgr.Detect()
+	if err != nil {
+		return err
+	}
+	pkg, err := resolvePackage(pm, serviceName, opts)
+	if err != nil {
+		return err
+	}
+
+	if installed, err := pm.InstalledVersion(pkg.Name); err == nil {
+		if pkg.Version == "" || pm.SameVersion(installed, pkg.Version) {
+			logger.Info("Already installed", "service", serviceName, "package", pkg.Name, "version", installed)
+			return nil
+		}
+		if pkg.File != "" {
+			return fmt.Errorf("%s is installed at version %s, use upgrade to replace it with %s %s from %s",
+				serviceName, installed, pkg.Name, pkg.Version, pkg.File)
+		}
+		return fmt.Errorf("%s is installed at version %s, use upgrade to change it to %s", serviceName, installed, pkg.Version)
+	}
+
+	logger.Info("Installing", "service", serviceName, "manager", pm.Kind, "package", pkg.Name)
+	if err := installPackage(pm, serviceName, pkg, false); err != nil {
+		return err
+	}
+	if err := verifyInstall(pm, serviceName, pkg); err != nil {
+		return err
+	}
+	if err := ApplyResourceLimits(serviceName); err != nil {
+		return fmt.Errorf("installed %s but failed to apply its resource limits: %v", serviceName, err)
+	}
+	return nil
+}
+
+// Upgrade upgrades an installed service to the pinned or latest version and
+// restarts it if it was running, so the new binary is used.
+func Upgrade(serviceName string, opts PackageOptions) error {
+	pm, err := pkgmgr.Detect()
+	if err != nil {
+		return err
+	}
+	pkg, err := resolvePackage(pm, serviceName, opts)
+	if err != nil {
+		return err
+	}
+
+	previous, err := pm.InstalledVersion(pkg.Name)
+	if err != nil {
+		return fmt.Errorf("%s is not installed, use install instead", serviceName)
+	}
+	state, _ := ServiceState(serviceName)
+
+	logger.Info("Upgrading", "service", serviceName, "from", previous, "manager", pm.Kind)
+	if err := installPackage(pm, serviceName, pkg, true); err != nil {
+		return err
+	}
+	if err := verifyInstall(pm, serviceName, pkg); err != nil {
+		return err
+	}
+
+	if state == servicectl.StateRunning {
+		logger.Info("Restarting to load the new version", "service", serviceName)
+		if err := ManageServiceAndWait(serviceName, "restart", servicectl.WaitTimeout); err != nil {
+			return fmt.Errorf("upgraded %s but failed to restart it: %v", serviceName, err)
+		}
+	}
+	return nil
+}
+
+// Uninstall stops a service, removes its package along with the repository
+// and resource limits that were added for it, and verifies that the package is
+// gone.
+func Uninstall(serviceName string) error {
+	pm, err := pkgmgr.Detect()
+	if err != nil {
+		return err
+	}
+	pkg := packageConfig(serviceName, PackageOptions{})
+
+	if _, err := pm.InstalledVersion(pkg.Name); err != nil {
+		logger.Info("Not installed", "service", serviceName, "package", pkg.Name)
+		if err := pm.RemoveRepository(serviceName); err != nil {
+			return err
+		}
+		return RemoveResourceLimits(serviceName)
+	}
+
+	if state, err := ServiceState(serviceName); err == nil && state == servicectl.StateRunning {
+		logger.Info("Stopping before removing it", "service", serviceName)
+		if err := ManageServiceAndWait(serviceName, "stop", servicectl.WaitTimeout); err != nil {
+			return fmt.Errorf("failed to stop %s: %v", serviceName, err)
+		}
+	}
+
+	logger.Info("Removing", "service", serviceName, "manager", pm.Kind, "package", pkg.Name)
+	if err := pm.Remove(pkg.Name); err != nil {
+		return err
+	}
+	if err := pm.RemoveRepository(serviceName); err != nil {
+		return err
+	}
+	if err := RemoveResourceLimits(serviceName); err != nil {
+		return err
+	}
+
+	if runner.DryRun() {
+		return nil
+	}
+	if installed, err := pm.InstalledVersion(pkg.Name); err == nil {
+		return fmt.Errorf("package %s is still installed at version %s", pkg.Name, installed)
+	}
+	return nil
+}
+
+// resolvePackage returns the package settings of a service. A local package
+// file pins the version to the one in the file, after checking that it holds
+// the package of the service and does not contradict a pinned version.
+func resolvePackage(pm *pkgmgr.Manager, serviceName string, opts PackageOptions) (config.PackageConfig, error) {
+	pkg := packageConfig(serviceName, opts)
+	if pkg.File == "" {
+		return pkg, nil
+	}
+	name, fileVersion, err := pm.PackageFile(pkg.File)
+	if err != nil {
+		return pkg, err
+	}
+	if name != pkg.Name {
+		return pkg, fmt.Errorf("%s contains package %s, not %s", pkg.File, name, pkg.Name)
+	}
+	if pkg.Version != "" && !pm.SameVersion(fileVersion, pkg.Version) {
+		return pkg, fmt.Errorf("%s contains %s %s, but version %s is pinned", pkg.File, name, fileVersion, pkg.Version)
+	}
+	pkg.Version = fileVersion
+	return pkg, nil
+}
+
+// installPackage installs from the local file if one is configured, and
+// otherwise from the repository, adding it first if configured.
+func installPackage(pm *pkgmgr.Manager, serviceName string, pkg config.PackageConfig, upgrade bool) error {
+	if pkg.File != "" {
+		return pm.InstallFile(pkg.File)
+	}
+	if pkg.Repository != nil {
+		if err := pm.AddRepository(serviceName, *pkg.Repository); err != nil {
+			return err
+		}
+	}
+	if upgrade {
+		return pm.Upgrade(pkg.Name, pkg.Version)
+	}
+	return pm.Install(pkg.Name, pkg.Version)
+}
+
+// verifyInstall checks that the package is installed at the pinned version
+// and that the service binary runs and meets the minimum version.
+func verifyInstall(pm *pkgmgr.Manager, serviceName string, pkg config.PackageConfig) error {
+	if runner.DryRun() {
+		runner.Record("verify %s is installed and reports its version", serviceName)
+		return nil
+	}
+
+	installed, err := pm.InstalledVersion(pkg.Name)
+	if err != nil {
+		return fmt.Errorf("verification failed: %v", err)
+	}
+	if pkg.Version != "" && !pm.SameVersion(installed, pkg.Version) {
+		return fmt.Errorf("verification failed: package %s is at version %s, expected %s", pkg.Name, installed, pkg.Version)
+	}
+
+	// Give the package scripts a moment to finish laying out the binaries
+	var vs VersionStatus
+	for attempt := 0; attempt < 3; attempt++ {
+		if vs = CheckVersion(serviceName); vs.Error == "" {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	if vs.Error != "" {
+		return fmt.Errorf("verification failed: package %s %s is installed but %s", pkg.Name, installed, vs.Error)
+	}
+	if vs.BelowMinimum {
+		return fmt.Errorf("verification failed: installed %s %s is below the minimum version %s", serviceName, vs.Version, vs.MinVersion)
+	}
+	logger.Info("Verified", "service", serviceName, "package", pkg.Name, "version", installed, "binary", vs.String())
+	return nil
+}
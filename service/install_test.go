@@ -0,0 +1,115 @@
+//go:build linux
+// +build linux
+
+package service
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"ss-agent/service/pkgmgr/pkgmgrtest"
+	"ss-agent/utils/runner"
+)
+
+// fakeApt puts the fake apt tools first on PATH, with the package versions
+// in installed already in their package database. Install runs in dry-run
+// mode, so only the queries reach the fakes.
+func fakeApt(t *testing.T, installed map[string]string) {
+	t.Helper()
+	pkgmgrtest.FakeApt(t, installed)
+	runner.SetDryRun(true)
+	runner.TakePlan()
+	t.Cleanup(func() {
+		runner.SetDryRun(false)
+		runner.TakePlan()
+	})
+}
+
+func TestInstallFile(t *testing.T) {
+	file := pkgmgrtest.Package(t, "fluent-bit_3.0.7_amd64.deb")
+	tests := []struct {
+		name      string
+		installed map[string]string
+		opts      PackageOptions
+		install   bool   // whether the file is installed
+		err       string // part of the expected error
+	}{
+		{"not installed", nil, PackageOptions{File: file}, true, ""},
+		{"same version installed", map[string]string{"fluent-bit": "3.0.7"}, PackageOptions{File: file}, false, ""},
+		{"other version installed", map[string]string{"fluent-bit": "3.0.4"}, PackageOptions{File: file}, false,
+			"fluent-bit is installed at version 3.0.4, use upgrade to replace it with fluent-bit 3.0.7"},
+		{"pinned version matches", nil, PackageOptions{File: file, Version: "3.0.7"}, true, ""},
+		{"pinned version differs", nil, PackageOptions{File: file, Version: "3.0.4"}, false, "but version 3.0.4 is pinned"},
+		{"other package", nil, PackageOptions{File: pkgmgrtest.Package(t, "zeek_6.0.3_amd64.deb")}, false, "contains package zeek, not fluent-bit"},
+		{"missing file", nil, PackageOptions{File: pkgmgrtest.Package(t, "missing.deb")}, false, "cannot read package file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeApt(t, tt.installed)
+			err := Install("fluent-bit", tt.opts)
+			if tt.err == "" && err != nil {
+				t.Fatalf("Install: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("Install = %v, want an error containing %q", err, tt.err)
+			}
+
+			plan := strings.Join(runner.TakePlan(), "\n")
+			installCmd := "apt-get -y -q --allow-downgrades install " + tt.opts.File
+			if got := strings.Contains(plan, installCmd); got != tt.install {
+				t.Errorf("file installed = %v, want %v, plan:\n%s", got, tt.install, plan)
+			}
+		})
+	}
+}
+
+func TestInstallFromRepository(t *testing.T) {
+	fakeApt(t, map[string]string{"zeek": "6.0.3"})
+
+	if err := Install("fluent-bit", PackageOptions{Version: "3.0.4"}); err != nil {
+		t.Fatalf("Install: %v", err)
+	}
+	plan := strings.Join(runner.TakePlan(), "\n")
+	if !strings.Contains(plan, "apt-get -y -q --allow-downgrades install fluent-bit=3.0.4") {
+		t.Errorf("plan does not install the pinned version:\n%s", plan)
+	}
+
+	if err := Install("zeek", PackageOptions{}); err != nil {
+		t.Fatalf("Install of an installed package: %v", err)
+	}
+	if plan := runner.TakePlan(); len(plan) != 0 {
+		t.Errorf("Install of an installed package planned %q", plan)
+	}
+}
+
+func TestInstallPinnedRevision(t *testing.T) {
+	if _, err := exec.LookPath("dpkg"); err != nil {
+		t.Skip("dpkg compares the versions and is not installed")
+	}
+	fakeApt(t, map[string]string{"zeek": "6.0.3-1"})
+
+	err := Install("zeek", PackageOptions{Version: "6.0.3-2"})
+	if err == nil || !strings.Contains(err.Error(), "zeek is installed at version 6.0.3-1, use upgrade") {
+		t.Errorf("Install of another revision = %v, want it refused", err)
+	}
+	if err := Install("zeek", PackageOptions{Version: "6.0.3-1"}); err != nil {
+		t.Errorf("Install of the installed revision: %v", err)
+	}
+	if plan := runner.TakePlan(); len(plan) != 0 {
+		t.Errorf("Install planned %q", plan)
+	}
+}
+
+func TestUpgradeFile(t *testing.T) {
+	fakeApt(t, map[string]string{"fluent-bit": "3.0.4"})
+	file := pkgmgrtest.Package(t, "fluent-bit_3.0.7_amd64.deb")
+
+	if err := Upgrade("fluent-bit", PackageOptions{File: file}); err != nil {
+		t.Fatalf("Upgrade: %v", err)
+	}
+	plan := strings.Join(runner.TakePlan(), "\n")
+	if !strings.Contains(plan, "apt-get -y -q --allow-downgrades install "+file) {
+		t.Errorf("plan does not install the file:\n%s", plan)
+	}
+}
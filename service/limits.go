@@ -0,0 +1,330 @@
+// service/limits.go
+
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"ss-agent/config"
+	"ss-agent/service/servicectl"
+	"ss-agent/service/zeek"
+	"ss-agent/utils/runner"
+)
+
+// resourceDropIn is the name of the drop-in holding the resource limits
+const resourceDropIn = "50-ss-agent-resources"
+
+// unlimited is how D-Bus reports an unset limit (UINT64_MAX)
+const unlimited = "18446744073709551615"
+
+var (
+	memoryPattern   = regexp.MustCompile(`^(\d+)([KMGTPE]?)$`)
+	percentPattern  = regexp.MustCompile(`^(\d+(?:\.\d+)?)%$`)
+	timespanPattern = regexp.MustCompile(`(\d+(?:\.\d+)?)(us|μs|ms|min|s|h|d)`)
+)
+
+var timespanUnits = map[string]float64{
+	"us": 1, "μs": 1, "ms": 1e3, "s": 1e6, "min": 60e6, "h": 3600e6, "d": 86400e6,
+}
+
+// LimitsStatus describes the configured resource limits of a service and
+// whether systemd is enforcing them.
+type LimitsStatus struct {
+	Service string
+	Limits  config.ResourceLimits
+	DropIn  string // path of the drop-in, empty if there is none
+	Err     error  // why the limits are not in effect
+}
+
+// String returns the limits for status output, e.g.
+// "limits: MemoryMax=2G CPUQuota=50% [APPLIED]". It is empty when no limits
+// are configured.
+func (s LimitsStatus) String() string {
+	if s.Limits.IsZero() && s.Err == nil {
+		return ""
+	}
+	settings := limitSettings(s.Limits)
+	if len(settings) == 0 {
+		settings = []string{"none"}
+	}
+	label := "[APPLIED]"
+	if s.Err != nil {
+		label = fmt.Sprintf("[NOT APPLIED: %v]", s.Err)
+	}
+	return "limits: " + strings.Join(settings, " ") + " " + label
+}
+
+// ApplyResourceLimits writes the configured resource limits of a service into
+// a systemd drop-in, reloads systemd if the drop-in changed and verifies that
+// the unit reports the new limits. A service without limits has its drop-in
+// removed, so limits taken out of the configuration are lifted again.
+func ApplyResourceLimits(serviceName string) error {
+	limits := config.GetConfig().Services[serviceName].Resources
+	uc, ok := servicectl.Configurator()
+	if !ok {
+		if limits.IsZero() {
+			return nil
+		}
+		return fmt.Errorf("resource limits for %s require systemd, the host uses %s", serviceName, servicectl.DetectInitSystem())
+	}
+	if limits.IsZero() {
+		return RemoveResourceLimits(serviceName)
+	}
+
+	unit := limitsUnit(serviceName)
+	content, err := renderResourceLimits(unit, limits)
+	if err != nil {
+		return fmt.Errorf("invalid resource limits for %s: %v", serviceName, err)
+	}
+	changed, err := servicectl.WriteDropIn(unit, resourceDropIn, content)
+	if err != nil {
+		return err
+	}
+	if changed {
+		logger.Info("Resource limits written", "service", serviceName, "path", servicectl.DropInPath(unit, resourceDropIn))
+		if err := uc.DaemonReload(); err != nil {
+			return err
+		}
+		if limits.Nice != nil {
+			if state, err := ServiceState(serviceName); err == nil && state == servicectl.StateRunning {
+				logger.Info("Nice applies from the next restart", "service", serviceName)
+			}
+		}
+	}
+	if runner.DryRun() {
+		runner.Record("verify %s reports %s", servicectl.UnitName(unit), strings.Join(unitSettings(unit, limits), " "))
+		return nil
+	}
+	return verifyResourceLimits(uc, serviceName, unit, limits)
+}
+
+// limitsUnit returns the unit the resource limits of a service are applied
+// to. Zeek is started by zeekctl, so unless a zeek.service unit is installed
+// its limits go to the slice zeekctl runs in.
+func limitsUnit(serviceName string) string {
+	if serviceName == "zeek" {
+		return zeek.LimitsUnit()
+	}
+	return serviceName
+}
+
+// ApplyAllResourceLimits applies the resource limits of every managed service
+// and returns the errors by service.
+func ApplyAllResourceLimits() map[string]error {
+	errs := make(map[string]error)
+	for _, svc := range AllServices {
+		if err := ApplyResourceLimits(svc); err != nil {
+			errs[svc] = err
+		}
+	}
+	return errs
+}
+
+// RemoveResourceLimits removes the resource limit drop-in of a service and
+// reloads systemd if there was one.
+func RemoveResourceLimits(serviceName string) error {
+	removed, err := servicectl.RemoveDropIn(limitsUnit(serviceName), resourceDropIn)
+	if err != nil || !removed {
+		return err
+	}
+	logger.Info("Resource limits removed", "service", serviceName)
+	if uc, ok := servicectl.Configurator(); ok {
+		return uc.DaemonReload()
+	}
+	return nil
+}
+
+// ResourceLimitsStatus checks whether the configured limits of a service are
+// written to its drop-in and reported by systemd, without changing anything.
+func ResourceLimitsStatus(serviceName string) LimitsStatus {
+	status := LimitsStatus{
+		Service: serviceName,
+		Limits:  config.GetConfig().Services[serviceName].Resources,
+	}
+	unit := limitsUnit(serviceName)
+	path := servicectl.DropInPath(unit, resourceDropIn)
+	existing, readErr := os.ReadFile(path)
+	if readErr == nil {
+		status.DropIn = path
+	}
+
+	if status.Limits.IsZero() {
+		if status.DropIn != "" {
+			status.Err = fmt.Errorf("%s is left over, run 'ss-agent service limits %s'", path, serviceName)
+		}
+		return status
+	}
+	uc, ok := servicectl.Configurator()
+	if !ok {
+		status.Err = fmt.Errorf("requires systemd")
+		return status
+	}
+	content, err := renderResourceLimits(unit, status.Limits)
+	if err != nil {
+		status.Err = err
+		return status
+	}
+	if status.DropIn == "" {
+		status.Err = fmt.Errorf("no drop-in")
+		return status
+	}
+	if !bytes.Equal(existing, content) {
+		status.Err = fmt.Errorf("drop-in is outdated")
+		return status
+	}
+	status.Err = verifyResourceLimits(uc, serviceName, unit, status.Limits)
+	return status
+}
+
+// renderResourceLimits validates the limits and renders the drop-in for unit.
+func renderResourceLimits(unit string, limits config.ResourceLimits) ([]byte, error) {
+	if limits.MemoryMax != "" && limits.MemoryMax != "infinity" &&
+		!memoryPattern.MatchString(limits.MemoryMax) && !percentPattern.MatchString(limits.MemoryMax) {
+		return nil, fmt.Errorf("memory_max %q is not a size (e.g. 2G) or percentage", limits.MemoryMax)
+	}
+	if limits.CPUQuota != "" && !percentPattern.MatchString(limits.CPUQuota) {
+		return nil, fmt.Errorf("cpu_quota %q is not a percentage (e.g. 50%%)", limits.CPUQuota)
+	}
+	if limits.IOWeight != 0 && (limits.IOWeight < 1 || limits.IOWeight > 10000) {
+		return nil, fmt.Errorf("io_weight %d is out of range 1-10000", limits.IOWeight)
+	}
+	if limits.Nice != nil && (*limits.Nice < -20 || *limits.Nice > 19) {
+		return nil, fmt.Errorf("nice %d is out of range -20 to 19", *limits.Nice)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "# Managed by ss-agent from the resources section of its configuration.")
+	fmt.Fprintln(&b, "# Changes to this file are overwritten.")
+	if isSlice(unit) {
+		fmt.Fprintln(&b, "[Slice]")
+	} else {
+		fmt.Fprintln(&b, "[Service]")
+	}
+	for _, setting := range unitSettings(unit, limits) {
+		fmt.Fprintln(&b, setting)
+	}
+	return b.Bytes(), nil
+}
+
+// isSlice reports whether a unit is a slice
+func isSlice(unit string) bool {
+	return strings.HasSuffix(unit, ".slice")
+}
+
+// unitSettings returns the limits that go into the drop-in of unit. A slice
+// has no nice level; zeekctl is started with it instead.
+func unitSettings(unit string, limits config.ResourceLimits) []string {
+	if isSlice(unit) {
+		limits.Nice = nil
+	}
+	return limitSettings(limits)
+}
+
+// limitSettings returns the configured limits as unit file settings.
+func limitSettings(limits config.ResourceLimits) []string {
+	var settings []string
+	if limits.MemoryMax != "" {
+		settings = append(settings, "MemoryMax="+limits.MemoryMax)
+	}
+	if limits.CPUQuota != "" {
+		settings = append(settings, "CPUQuota="+limits.CPUQuota)
+	}
+	if limits.IOWeight != 0 {
+		settings = append(settings, fmt.Sprintf("IOWeight=%d", limits.IOWeight))
+	}
+	if limits.Nice != nil {
+		settings = append(settings, fmt.Sprintf("Nice=%d", *limits.Nice))
+	}
+	return settings
+}
+
+// expectedProperties returns the unit properties the limits should show up
+// as, in the form normalizeProperty returns. Percentages of memory depend on
+// the host and are not checked.
+func expectedProperties(limits config.ResourceLimits) map[string]string {
+	expected := make(map[string]string)
+	if m := memoryPattern.FindStringSubmatch(limits.MemoryMax); m != nil {
+		n, _ := strconv.ParseUint(m[1], 10, 64)
+		shift := uint(strings.Index("KMGTPE", m[2])+1) * 10
+		if m[2] == "" {
+			shift = 0
+		}
+		expected["MemoryMax"] = strconv.FormatUint(n<<shift, 10)
+	} else if limits.MemoryMax == "infinity" {
+		expected["MemoryMax"] = "infinity"
+	}
+	if m := percentPattern.FindStringSubmatch(limits.CPUQuota); m != nil {
+		pct, _ := strconv.ParseFloat(m[1], 64)
+		expected["CPUQuotaPerSecUSec"] = strconv.FormatInt(int64(math.Round(pct*10000)), 10)
+	}
+	if limits.IOWeight != 0 {
+		expected["IOWeight"] = strconv.Itoa(limits.IOWeight)
+	}
+	if limits.Nice != nil {
+		expected["Nice"] = strconv.Itoa(*limits.Nice)
+	}
+	return expected
+}
+
+// normalizeProperty brings a property value reported over D-Bus or by
+// systemctl into one form: bytes, microseconds or "infinity".
+func normalizeProperty(name, value string) string {
+	value = strings.TrimSpace(value)
+	if value == unlimited || value == "infinity" {
+		return "infinity"
+	}
+	if value == "[not set]" {
+		return ""
+	}
+	if name == "CPUQuotaPerSecUSec" {
+		if _, err := strconv.ParseUint(value, 10, 64); err == nil {
+			return value
+		}
+		var usec float64
+		for _, m := range timespanPattern.FindAllStringSubmatch(value, -1) {
+			n, _ := strconv.ParseFloat(m[1], 64)
+			usec += n * timespanUnits[m[2]]
+		}
+		return strconv.FormatInt(int64(math.Round(usec)), 10)
+	}
+	return value
+}
+
+// verifyResourceLimits reads back the properties of the unit holding the
+// limits of a service and reports the first limit systemd does not enforce.
+func verifyResourceLimits(uc servicectl.UnitConfigurator, serviceName, unit string, limits config.ResourceLimits) error {
+	if isSlice(unit) {
+		limits.Nice = nil
+	}
+	expected := expectedProperties(limits)
+	if len(expected) == 0 {
+		return nil
+	}
+	if state, err := ServiceState(serviceName); err == nil && state == servicectl.StateNotInstalled {
+		// systemd picks up the drop-in once the unit is installed
+		return nil
+	}
+
+	names := make([]string, 0, len(expected))
+	for _, name := range []string{"MemoryMax", "CPUQuotaPerSecUSec", "IOWeight", "Nice"} {
+		if _, ok := expected[name]; ok {
+			names = append(names, name)
+		}
+	}
+	props, err := uc.Properties(unit, names...)
+	if err != nil {
+		return fmt.Errorf("failed to verify resource limits of %s: %v", serviceName, err)
+	}
+	for _, name := range names {
+		if got := normalizeProperty(name, props[name]); got != expected[name] {
+			return fmt.Errorf("%s of %s is %q, expected %q", name, servicectl.UnitName(unit), props[name], expected[name])
+		}
+	}
+	return nil
+}
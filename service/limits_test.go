@@ -0,0 +1,33 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"ss-agent/config"
+)
+
+func TestRenderResourceLimits(t *testing.T) {
+	nice := 5
+	limits := config.ResourceLimits{MemoryMax: "2G", CPUQuota: "150%", Nice: &nice}
+	tests := []struct {
+		unit, want string
+	}{
+		{"fluent-bit", "[Service]\nMemoryMax=2G\nCPUQuota=150%\nNice=5\n"},
+		// zeekctl is given the nice level, a slice has none
+		{"ss-agent-zeek.slice", "[Slice]\nMemoryMax=2G\nCPUQuota=150%\n"},
+	}
+	for _, tt := range tests {
+		content, err := renderResourceLimits(tt.unit, limits)
+		if err != nil {
+			t.Fatalf("%s: renderResourceLimits: %v", tt.unit, err)
+		}
+		if got := string(content); !strings.HasSuffix(got, "\n"+tt.want) {
+			t.Errorf("%s: drop-in =\n%s\nwant it to end in\n%s", tt.unit, got, tt.want)
+		}
+	}
+
+	if _, err := renderResourceLimits("fluent-bit", config.ResourceLimits{CPUQuota: "1.5"}); err == nil {
+		t.Error("renderResourceLimits accepted a cpu_quota without %")
+	}
+}
@@ -1,105 +1,122 @@
 package osquery
 
 import (
+	"context"
 	"fmt"
 	"os/exec"
 	"runtime"
 	"strings"
+
+	"ss-agent/service/servicectl"
+	"ss-agent/utils/logging"
+	"ss-agent/utils/runner"
+	"ss-agent/utils/version"
 )
 
+var logger = logging.For("osqueryd")
+
+// unitName is the osquery daemon service name on Linux
+const unitName = "osqueryd"
+
 // OsqueryStatus checks the status of Osquery using platform-specific commands
 func OsqueryStatus() (string, error) {
-	fmt.Println("Checking osqueryd status...")
+	logger.Debug("Checking osqueryd status")
+
+	state, err := OsqueryState()
+	return state.Label(), err
+}
 
+// OsqueryState returns the normalized state of osqueryd
+func OsqueryState() (servicectl.State, error) {
 	switch runtime.GOOS {
 	case "linux":
-		cmd := exec.Command("systemctl", "is-active", "osqueryd")
-		output, err := cmd.CombinedOutput()
-		status := strings.TrimSpace(string(output))
-
-		// If systemctl returns an error, but the output is "inactive", treat it as STOPPED
-		if err != nil && strings.Contains(status, "inactive") {
-			return "[STOPPED]", nil
-		} else if err == nil && strings.Contains(status, "active") {
-			return "[RUNNING]", nil
-		} else if err != nil {
-			return "[FAILED]", fmt.Errorf("systemctl status failed: %v\nOutput: %s", err, string(output))
+		status, err := servicectl.Default().Status(unitName)
+		if err != nil {
+			return servicectl.StateFailed, err
 		}
-
-		return "[UNKNOWN]", nil
+		return status.State, nil
 
 	case "darwin":
-		cmd := exec.Command("sudo", "launchctl", "list", "io.osquery.agent")
-		output, err := cmd.CombinedOutput()
+		output, err := runner.Query("sudo", "launchctl", "list", "io.osquery.agent")
 
 		// Handle the specific exit code for service not found
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			if exitErr.ExitCode() == 113 {
 				// Service not found or not installed
-				return "[NOT INSTALLED]", nil
+				return servicectl.StateNotInstalled, nil
 			}
 		}
 
 		// Handle other errors
 		if err != nil {
-			return "[FAILED]", fmt.Errorf("launchctl list failed: %v\nOutput: %s", err, string(output))
+			return servicectl.StateFailed, fmt.Errorf("launchctl list failed: %v\nOutput: %s", err, string(output))
 		}
 
 		if strings.Contains(string(output), "io.osquery.agent") {
-			return "[RUNNING]", nil
+			return servicectl.StateRunning, nil
 		}
-		return "[STOPPED]", nil
+		return servicectl.StateStopped, nil
 
 	case "windows":
-		cmd := exec.Command("sc", "query", "osqueryd")
-		output, err := cmd.CombinedOutput()
+		output, err := runner.Query("sc", "query", "osqueryd")
 		if err != nil {
-			return "[FAILED]", fmt.Errorf("sc query failed: %v\nOutput: %s", err, string(output))
+			return servicectl.StateFailed, fmt.Errorf("sc query failed: %v\nOutput: %s", err, string(output))
 		}
 
 		if strings.Contains(string(output), "RUNNING") {
-			return "[RUNNING]", nil
+			return servicectl.StateRunning, nil
 		}
-		return "[STOPPED]", nil
+		return servicectl.StateStopped, nil
 
 	default:
-		return "[UNKNOWN]", fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+		return servicectl.StateUnknown, fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
 	}
 }
 
+// osquerydBinaryPaths are the known install locations of the osqueryd binary
+var osquerydBinaryPaths = []string{
+	"/opt/osquery/bin/osqueryd",
+	"/usr/bin/osqueryd",
+	"/usr/local/bin/osqueryd",
+	"/opt/osquery/lib/osquery.app/Contents/MacOS/osqueryd",
+	`C:\Program Files\osquery\osqueryd\osqueryd.exe`,
+}
+
+// OsqueryVersion detects the installed osquery version using
+// `osqueryd --version`, falling back to package metadata
+func OsqueryVersion() (version.Info, error) {
+	binary, _ := version.FindBinary("osqueryd", osquerydBinaryPaths...)
+	return version.Detect(binary, []string{"--version"}, "osquery")
+}
+
 // OsqueryStart starts Osquery using platform-specific commands
-func OsqueryStart() error {
+func OsqueryStart(ctx context.Context) error {
 	switch runtime.GOOS {
 	case "linux":
-		cmdEnable := exec.Command("systemctl", "enable", "osqueryd")
-		if _, err := cmdEnable.CombinedOutput(); err != nil {
-			return fmt.Errorf("systemctl enable failed: %v", err)
+		backend := servicectl.Default()
+		if err := backend.Enable(unitName); err != nil {
+			return err
 		}
-
-		cmd := exec.Command("systemctl", "start", "osqueryd")
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("systemctl start failed: %v\nOutput: %s", err, string(output))
+		if err := backend.Start(ctx, unitName); err != nil {
+			return err
 		}
-		fmt.Println("osqueryd started successfully.")
+		runner.LogUnlessDryRun(logger, "osqueryd started")
 		return nil
 
 	case "darwin":
-		cmd := exec.Command("sudo", "launchctl", "load", "/Library/LaunchDaemons/io.osquery.agent.plist")
-		output, err := cmd.CombinedOutput()
+		output, err := runner.RunContext(ctx, "sudo", "launchctl", "load", "/Library/LaunchDaemons/io.osquery.agent.plist")
 		if err != nil {
 			return fmt.Errorf("launchctl load failed: %v\nOutput: %s", err, string(output))
 		}
-		fmt.Println("Osquery started successfully.")
+		runner.LogUnlessDryRun(logger, "Osquery started")
 		return nil
 
 	case "windows":
-		cmd := exec.Command("sc", "start", "osqueryd")
-		output, err := cmd.CombinedOutput()
+		output, err := runner.RunContext(ctx, "sc", "start", "osqueryd")
 		if err != nil {
 			return fmt.Errorf("sc start failed: %v\nOutput: %s", err, string(output))
 		}
-		fmt.Println("Osquery started successfully.")
+		runner.LogUnlessDryRun(logger, "Osquery started")
 		return nil
 
 	default:
@@ -108,38 +125,33 @@ func OsqueryStart() error {
 }
 
 // OsqueryStop stops Osquery using platform-specific commands
-func OsqueryStop() error {
+func OsqueryStop(ctx context.Context) error {
 	switch runtime.GOOS {
 	case "linux":
-		cmdEnable := exec.Command("systemctl", "disable", "osqueryd")
-		if _, err := cmdEnable.CombinedOutput(); err != nil {
-			return fmt.Errorf("systemctl enable failed: %v", err)
+		backend := servicectl.Default()
+		if err := backend.Disable(unitName); err != nil {
+			return err
 		}
-
-		cmd := exec.Command("systemctl", "stop", "osqueryd")
-		output, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("systemctl start failed: %v\nOutput: %s", err, string(output))
+		if err := backend.Stop(ctx, unitName); err != nil {
+			return err
 		}
-		fmt.Println("Osquery stopped successfully.")
+		runner.LogUnlessDryRun(logger, "Osquery stopped")
 		return nil
 
 	case "darwin":
-		cmd := exec.Command("sudo", "launchctl", "unload", "/Library/LaunchDaemons/io.osquery.agent.plist")
-		output, err := cmd.CombinedOutput()
+		output, err := runner.RunContext(ctx, "sudo", "launchctl", "unload", "/Library/LaunchDaemons/io.osquery.agent.plist")
 		if err != nil {
 			return fmt.Errorf("launchctl unload failed: %v\nOutput: %s", err, string(output))
 		}
-		fmt.Println("Osquery stopped successfully.")
+		runner.LogUnlessDryRun(logger, "Osquery stopped")
 		return nil
 
 	case "windows":
-		cmd := exec.Command("sc", "stop", "osqueryd")
-		output, err := cmd.CombinedOutput()
+		output, err := runner.RunContext(ctx, "sc", "stop", "osqueryd")
 		if err != nil {
 			return fmt.Errorf("sc stop failed: %v\nOutput: %s", err, string(output))
 		}
-		fmt.Println("Osquery stopped successfully.")
+		runner.LogUnlessDryRun(logger, "Osquery stopped")
 		return nil
 
 	default:
@@ -147,11 +159,15 @@ func OsqueryStop() error {
 	}
 }
 
-func OsqueryRestart() error {
-	// Stop and start Osquery
-	err := OsqueryStop()
+// OsqueryRestart stops osqueryd, waits for it to stop and starts it again
+func OsqueryRestart(ctx context.Context) error {
+	err := OsqueryStop(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = servicectl.WaitForState(ctx, "osqueryd", OsqueryState, servicectl.StateStopped, servicectl.StateFailed)
 	if err != nil {
 		return err
 	}
-	return OsqueryStart()
+	return OsqueryStart(ctx)
 }
@@ -0,0 +1,292 @@
+// service/pkgmgr/pkgmgr.go
+
+package pkgmgr
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"ss-agent/config"
+	"ss-agent/utils/logging"
+	"ss-agent/utils/runner"
+)
+
+var logger = logging.For("pkgmgr")
+
+// rpmEVR is the rpm query format of a package version, with the epoch only
+// if the package has one, e.g. "6.0.3-1.el9" or "1:6.0.3-1.el9"
+const rpmEVR = "%|EPOCH?{%{EPOCH}:}:{}|%{VERSION}-%{RELEASE}"
+
+// Kind identifies a supported package manager.
+type Kind string
+
+const (
+	Apt    Kind = "apt"
+	Dnf    Kind = "dnf"
+	Yum    Kind = "yum"
+	Zypper Kind = "zypper"
+)
+
+// detectOrder is the order package managers are looked up in. dnf comes
+// before yum because hosts with dnf often still ship a yum wrapper.
+var detectOrder = []struct {
+	kind   Kind
+	binary string
+}{
+	{Apt, "apt-get"},
+	{Dnf, "dnf"},
+	{Yum, "yum"},
+	{Zypper, "zypper"},
+}
+
+// Manager installs and removes packages with the host package manager.
+type Manager struct {
+	Kind Kind
+}
+
+// Detect finds the package manager of the host.
+func Detect() (*Manager, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("package management is not supported on %s", runtime.GOOS)
+	}
+	for _, pm := range detectOrder {
+		if _, err := exec.LookPath(pm.binary); err == nil {
+			return &Manager{Kind: pm.kind}, nil
+		}
+	}
+	return nil, fmt.Errorf("no supported package manager found (apt, dnf, yum or zypper)")
+}
+
+// AddRepository writes a repository definition named after the service and
+// refreshes the package metadata. Only file:// repositories, or ones with
+// allow_unsigned set, may go without a signing key.
+func (m *Manager) AddRepository(name string, repo config.RepositoryConfig) error {
+	if repo.URL == "" {
+		return fmt.Errorf("repository for %s has no url", name)
+	}
+	if repo.GPGKey == "" && !strings.HasPrefix(repo.URL, "file:") {
+		if !repo.AllowUnsigned {
+			return fmt.Errorf("repository %s for %s has no gpg_key, set allow_unsigned to install from it without signature checks", repo.URL, name)
+		}
+		logger.Warn("Repository has no gpg_key, package signatures will not be checked", "url", repo.URL)
+	}
+
+	path := m.RepositoryPath(name)
+	var content string
+	switch m.Kind {
+	case Apt:
+		content = aptSource(repo)
+	case Dnf, Yum:
+		content = rpmRepo(name, repo, false)
+	case Zypper:
+		content = rpmRepo(name, repo, true)
+	}
+	if err := runner.WriteFile(path, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write repository file %s: %v", path, err)
+	}
+	return m.refresh(name)
+}
+
+// RemoveRepository deletes the repository definition written by AddRepository.
+func (m *Manager) RemoveRepository(name string) error {
+	path := m.RepositoryPath(name)
+	if err := runner.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove repository file %s: %v", path, err)
+	}
+	return nil
+}
+
+// RepositoryPath returns where the repository definition for a service lives.
+func (m *Manager) RepositoryPath(name string) string {
+	file := "ss-agent-" + name
+	switch m.Kind {
+	case Apt:
+		return filepath.Join("/etc/apt/sources.list.d", file+".list")
+	case Zypper:
+		return filepath.Join("/etc/zypp/repos.d", file+".repo")
+	default:
+		return filepath.Join("/etc/yum.repos.d", file+".repo")
+	}
+}
+
+// refresh updates the metadata of the repository that was just added.
+func (m *Manager) refresh(name string) error {
+	switch m.Kind {
+	case Apt:
+		return m.run("apt-get", "-q", "update")
+	case Dnf, Yum:
+		return m.run(string(m.Kind), "-q", "makecache")
+	case Zypper:
+		return m.run("zypper", "--non-interactive", "refresh", "ss-agent-"+name)
+	}
+	return nil
+}
+
+// Install installs a package, pinned to version unless it is empty.
+func (m *Manager) Install(pkg, version string) error {
+	spec := m.packageSpec(pkg, version)
+	switch m.Kind {
+	case Apt:
+		return m.run("apt-get", "-y", "-q", "--allow-downgrades", "install", spec)
+	case Dnf, Yum:
+		return m.run(string(m.Kind), "-y", "-q", "install", spec)
+	case Zypper:
+		return m.run("zypper", "--non-interactive", "install", "--oldpackage", spec)
+	}
+	return fmt.Errorf("unsupported package manager: %s", m.Kind)
+}
+
+// InstallFile installs or upgrades from a local package file.
+func (m *Manager) InstallFile(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	switch m.Kind {
+	case Apt:
+		return m.run("apt-get", "-y", "-q", "--allow-downgrades", "install", abs)
+	case Dnf, Yum:
+		return m.run(string(m.Kind), "-y", "-q", "install", abs)
+	case Zypper:
+		return m.run("zypper", "--non-interactive", "install", "--oldpackage", abs)
+	}
+	return fmt.Errorf("unsupported package manager: %s", m.Kind)
+}
+
+// Upgrade upgrades an installed package to the pinned version, or to the
+// latest available one if version is empty.
+func (m *Manager) Upgrade(pkg, version string) error {
+	if version != "" {
+		return m.Install(pkg, version)
+	}
+	switch m.Kind {
+	case Apt:
+		return m.run("apt-get", "-y", "-q", "install", "--only-upgrade", pkg)
+	case Dnf, Yum:
+		return m.run(string(m.Kind), "-y", "-q", "upgrade", pkg)
+	case Zypper:
+		return m.run("zypper", "--non-interactive", "update", pkg)
+	}
+	return fmt.Errorf("unsupported package manager: %s", m.Kind)
+}
+
+// Remove uninstalls a package.
+func (m *Manager) Remove(pkg string) error {
+	switch m.Kind {
+	case Apt:
+		return m.run("apt-get", "-y", "-q", "remove", pkg)
+	case Dnf, Yum:
+		return m.run(string(m.Kind), "-y", "-q", "remove", pkg)
+	case Zypper:
+		return m.run("zypper", "--non-interactive", "remove", pkg)
+	}
+	return fmt.Errorf("unsupported package manager: %s", m.Kind)
+}
+
+// InstalledVersion returns the installed version of a package, or an error
+// if it is not installed.
+func (m *Manager) InstalledVersion(pkg string) (string, error) {
+	var output []byte
+	var err error
+	if m.Kind == Apt {
+		output, err = runner.Query("dpkg-query", "-W", "-f=${Status} ${Version}", pkg)
+		if err == nil && !strings.HasPrefix(string(output), "install ok installed") {
+			return "", fmt.Errorf("package %s is not installed", pkg)
+		}
+		if err == nil {
+			fields := strings.Fields(string(output))
+			return fields[len(fields)-1], nil
+		}
+	} else {
+		output, err = runner.Query("rpm", "-q", "--qf", rpmEVR, pkg)
+		if err == nil {
+			return strings.TrimSpace(string(output)), nil
+		}
+	}
+	return "", fmt.Errorf("package %s is not installed: %s", pkg, strings.TrimSpace(string(output)))
+}
+
+// PackageFile returns the name and version of the package in a local package
+// file, with the version in the format InstalledVersion reports.
+func (m *Manager) PackageFile(path string) (name, version string, err error) {
+	var output []byte
+	if m.Kind == Apt {
+		output, err = runner.Query("dpkg-deb", "--show", "--showformat=${Package} ${Version}", path)
+	} else {
+		output, err = runner.Query("rpm", "-q", "-p", "--qf", "%{NAME} "+rpmEVR, path)
+	}
+	// rpm prints signature warnings before the package, the last line is ours
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if err != nil || len(fields) != 2 {
+		return "", "", fmt.Errorf("cannot read package file %s: %s", path, strings.TrimSpace(string(output)))
+	}
+	return fields[0], fields[1], nil
+}
+
+// packageSpec renders a package name pinned to a version in the syntax of
+// the package manager.
+func (m *Manager) packageSpec(pkg, version string) string {
+	if version == "" {
+		return pkg
+	}
+	switch m.Kind {
+	case Dnf, Yum:
+		return pkg + "-" + version
+	default:
+		return pkg + "=" + version
+	}
+}
+
+func (m *Manager) run(name string, args ...string) error {
+	output, err := runner.Run(name, args...)
+	if err != nil {
+		return fmt.Errorf("%s failed: %v\nOutput: %s", runner.FormatCommand(name, args...), err, string(output))
+	}
+	return nil
+}
+
+// aptSource renders a sources.list entry. Without a suite the repository is
+// treated as a flat repository, which is what a local directory of .deb files
+// with a Packages index usually is.
+func aptSource(repo config.RepositoryConfig) string {
+	option := "[trusted=yes]"
+	if repo.GPGKey != "" {
+		option = "[signed-by=" + repo.GPGKey + "]"
+	}
+	url := repo.URL
+	if strings.HasPrefix(url, "file://") {
+		url = "file:" + strings.TrimPrefix(url, "file://")
+	}
+	if repo.Suite == "" {
+		return fmt.Sprintf("deb %s %s ./\n", option, url)
+	}
+	return fmt.Sprintf("deb %s %s %s %s\n", option, url, repo.Suite, strings.Join(repo.Components, " "))
+}
+
+// rpmRepo renders a .repo file for dnf, yum or zypper.
+func rpmRepo(name string, repo config.RepositoryConfig, zypper bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "[ss-agent-%s]\n", name)
+	fmt.Fprintf(&b, "name=ss-agent %s\n", name)
+	fmt.Fprintf(&b, "baseurl=%s\n", repo.URL)
+	fmt.Fprintln(&b, "enabled=1")
+	if zypper {
+		fmt.Fprintln(&b, "type=rpm-md")
+		fmt.Fprintln(&b, "autorefresh=1")
+	}
+	if repo.GPGKey != "" {
+		fmt.Fprintln(&b, "gpgcheck=1")
+		key := repo.GPGKey
+		if !strings.Contains(key, "://") {
+			key = "file://" + key
+		}
+		fmt.Fprintf(&b, "gpgkey=%s\n", key)
+	} else {
+		fmt.Fprintln(&b, "gpgcheck=0")
+	}
+	return b.String()
+}
@@ -0,0 +1,204 @@
+//go:build !windows
+// +build !windows
+
+package pkgmgr
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ss-agent/config"
+	"ss-agent/service/pkgmgr/pkgmgrtest"
+	"ss-agent/utils/runner"
+)
+
+// installed returns the installed version of pkg, "" if it is not installed
+func installed(t *testing.T, m *Manager, pkg string) string {
+	t.Helper()
+	v, err := m.InstalledVersion(pkg)
+	if err != nil {
+		if !strings.Contains(err.Error(), "is not installed") {
+			t.Fatalf("InstalledVersion(%s): %v", pkg, err)
+		}
+		return ""
+	}
+	return v
+}
+
+func TestInstallFromFileRepository(t *testing.T) {
+	pkgmgrtest.FakeApt(t, nil)
+	m := &Manager{Kind: Apt}
+
+	if v := installed(t, m, "fluent-bit"); v != "" {
+		t.Fatalf("fluent-bit is installed at %s before the test", v)
+	}
+	if err := m.Install("fluent-bit", "3.0.4"); err != nil {
+		t.Fatalf("Install pinned: %v", err)
+	}
+	if v := installed(t, m, "fluent-bit"); v != "3.0.4" {
+		t.Errorf("installed version = %q, want the pinned 3.0.4", v)
+	}
+	if err := m.Upgrade("fluent-bit", ""); err != nil {
+		t.Fatalf("Upgrade: %v", err)
+	}
+	if v := installed(t, m, "fluent-bit"); v != "3.0.7" {
+		t.Errorf("upgraded version = %q, want the latest 3.0.7", v)
+	}
+	if err := m.Install("fluent-bit", "3.0.4"); err != nil {
+		t.Fatalf("Install downgrade: %v", err)
+	}
+	if v := installed(t, m, "fluent-bit"); v != "3.0.4" {
+		t.Errorf("downgraded version = %q, want 3.0.4", v)
+	}
+	if err := m.Remove("fluent-bit"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if v := installed(t, m, "fluent-bit"); v != "" {
+		t.Errorf("fluent-bit is still installed at %s after Remove", v)
+	}
+
+	err := m.Install("zeek", "9.9.9")
+	if err == nil || !strings.Contains(err.Error(), "Unable to locate package zeek=9.9.9") {
+		t.Errorf("Install of a version missing from the repository = %v, want the apt-get error", err)
+	}
+	if v := installed(t, m, "zeek"); v != "" {
+		t.Errorf("zeek is installed at %s after a failed install", v)
+	}
+}
+
+func TestInstallFile(t *testing.T) {
+	pkgmgrtest.FakeApt(t, nil)
+	m := &Manager{Kind: Apt}
+	file := filepath.Join("testdata", "repo", "zeek_6.0.3_amd64.deb")
+
+	name, version, err := m.PackageFile(file)
+	if err != nil || name != "zeek" || version != "6.0.3" {
+		t.Fatalf("PackageFile = %q, %q, %v, want zeek 6.0.3", name, version, err)
+	}
+	// A relative path would be taken for a package name by apt-get
+	if err := m.InstallFile(file); err != nil {
+		t.Fatalf("InstallFile: %v", err)
+	}
+	if v := installed(t, m, "zeek"); v != "6.0.3" {
+		t.Errorf("installed version = %q, want 6.0.3", v)
+	}
+
+	if _, _, err := m.PackageFile(filepath.Join("testdata", "repo", "missing.deb")); err == nil {
+		t.Error("PackageFile of a missing file succeeded")
+	}
+}
+
+func TestAddRepositoryDryRun(t *testing.T) {
+	runner.SetDryRun(true)
+	defer runner.SetDryRun(false)
+	defer runner.TakePlan()
+
+	tests := []struct {
+		kind Kind
+		want []string
+	}{
+		{Apt, []string{"write /etc/apt/sources.list.d/ss-agent-zeek.list", "apt-get -q update"}},
+		{Dnf, []string{"write /etc/yum.repos.d/ss-agent-zeek.repo", "dnf -q makecache"}},
+		{Zypper, []string{"write /etc/zypp/repos.d/ss-agent-zeek.repo", "zypper --non-interactive refresh ss-agent-zeek"}},
+	}
+	for _, tt := range tests {
+		m := &Manager{Kind: tt.kind}
+		if err := m.AddRepository("zeek", config.RepositoryConfig{URL: "file:///srv/repo"}); err != nil {
+			t.Fatalf("%s: AddRepository: %v", tt.kind, err)
+		}
+		plan := runner.TakePlan()
+		if len(plan) != len(tt.want) || !strings.HasPrefix(plan[0], tt.want[0]+" ") || plan[1] != tt.want[1] {
+			t.Errorf("%s: plan = %q, want %q", tt.kind, plan, tt.want)
+		}
+	}
+
+	m := &Manager{Kind: Apt}
+	if err := m.AddRepository("zeek", config.RepositoryConfig{}); err == nil {
+		t.Error("AddRepository without url succeeded")
+	}
+	unsigned := config.RepositoryConfig{URL: "https://packages.example.com/zeek"}
+	if err := m.AddRepository("zeek", unsigned); err == nil || !strings.Contains(err.Error(), "has no gpg_key") {
+		t.Errorf("AddRepository of an unsigned https repository = %v, want it refused", err)
+	}
+	if plan := runner.TakePlan(); len(plan) != 0 {
+		t.Errorf("refused repository planned %q", plan)
+	}
+	unsigned.AllowUnsigned = true
+	if err := m.AddRepository("zeek", unsigned); err != nil {
+		t.Errorf("AddRepository with allow_unsigned: %v", err)
+	}
+}
+
+func TestRepositoryFiles(t *testing.T) {
+	flat := config.RepositoryConfig{URL: "file:///srv/repo"}
+	signed := config.RepositoryConfig{
+		URL:        "https://packages.example.com/zeek",
+		Suite:      "bookworm",
+		Components: []string{"main", "contrib"},
+		GPGKey:     "/etc/ss-agent/zeek.gpg",
+	}
+
+	if got, want := aptSource(flat), "deb [trusted=yes] file:/srv/repo ./\n"; got != want {
+		t.Errorf("aptSource(flat) = %q, want %q", got, want)
+	}
+	if got, want := aptSource(signed), "deb [signed-by=/etc/ss-agent/zeek.gpg] https://packages.example.com/zeek bookworm main contrib\n"; got != want {
+		t.Errorf("aptSource(signed) = %q, want %q", got, want)
+	}
+
+	want := "[ss-agent-zeek]\nname=ss-agent zeek\nbaseurl=file:///srv/repo\nenabled=1\ngpgcheck=0\n"
+	if got := rpmRepo("zeek", flat, false); got != want {
+		t.Errorf("rpmRepo(flat) = %q, want %q", got, want)
+	}
+	want = "[ss-agent-zeek]\nname=ss-agent zeek\nbaseurl=https://packages.example.com/zeek\nenabled=1\n" +
+		"type=rpm-md\nautorefresh=1\ngpgcheck=1\ngpgkey=file:///etc/ss-agent/zeek.gpg\n"
+	if got := rpmRepo("zeek", signed, true); got != want {
+		t.Errorf("rpmRepo(signed, zypper) = %q, want %q", got, want)
+	}
+}
+
+func TestPackageSpec(t *testing.T) {
+	tests := []struct {
+		kind          Kind
+		version, want string
+	}{
+		{Apt, "", "zeek"},
+		{Apt, "6.0.3", "zeek=6.0.3"},
+		{Dnf, "6.0.3-1", "zeek-6.0.3-1"},
+		{Yum, "6.0.3-1", "zeek-6.0.3-1"},
+		{Zypper, "6.0.3-1", "zeek=6.0.3-1"},
+	}
+	for _, tt := range tests {
+		m := &Manager{Kind: tt.kind}
+		if got := m.packageSpec("zeek", tt.version); got != tt.want {
+			t.Errorf("%s: packageSpec(zeek, %q) = %q, want %q", tt.kind, tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestCompareEVR(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"6.0.3-1.el9", "6.0.3-1.el9", 0},
+		{"6.0.3-1.el9", "6.0.3-2.el9", -1},
+		{"6.0.3-1.el9", "6.0.3", 0}, // no release matches any
+		{"6.0.10-1", "6.0.9-1", 1},
+		{"6.0.3-1", "1:6.0.2-1", -1},
+		{"6.0.3.1-1", "6.0.3.a-1", 1}, // numeric runs are newer
+		{"6.0.3-1", "6.0.3a-1", -1},
+		{"6.0.3~rc1-1", "6.0.3-1", -1},
+		{"6.0.3^git1-1", "6.0.3-1", 1},
+		{"6.0.03-1", "6.0.3-1", 0},
+		{"6.0.3_1-1", "6.0.3.1-1", 0},
+	}
+	for _, tt := range tests {
+		if got := compareEVR(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareEVR(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := compareEVR(tt.b, tt.a); got != -tt.want {
+			t.Errorf("compareEVR(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// service/pkgmgr/pkgmgrtest/pkgmgrtest.go
+
+// Package pkgmgrtest provides fake apt tools for tests of code that installs
+// packages.
+package pkgmgrtest
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// testdata returns the absolute path of the pkgmgr testdata directory
+func testdata(t *testing.T) string {
+	t.Helper()
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Fatal("cannot locate the pkgmgr testdata")
+	}
+	return filepath.Join(filepath.Dir(file), "..", "testdata")
+}
+
+// FakeApt puts the fake apt-get, dpkg-query and dpkg-deb from the pkgmgr
+// testdata first on PATH. They install from its file-based repository into a
+// package database in a temporary directory, which starts out with the
+// package versions in installed and is returned.
+func FakeApt(t *testing.T, installed map[string]string) string {
+	t.Helper()
+	dir := testdata(t)
+	db := t.TempDir()
+	for pkg, version := range installed {
+		if err := os.WriteFile(filepath.Join(db, pkg), []byte(version+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", filepath.Join(dir, "bin")+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("FAKE_APT_REPO", filepath.Join(dir, "repo"))
+	t.Setenv("FAKE_DPKG_DB", db)
+	return db
+}
+
+// Package returns the absolute path of a package file in the repository,
+// e.g. "zeek_6.0.3_amd64.deb"
+func Package(t *testing.T, name string) string {
+	t.Helper()
+	return filepath.Join(testdata(t), "repo", name)
+}
@@ -0,0 +1,152 @@
+// service/pkgmgr/version.go
+
+package pkgmgr
+
+import (
+	"strconv"
+	"strings"
+
+	"ss-agent/utils/runner"
+)
+
+// SameVersion reports whether two package versions are equal by the rules of
+// the package manager, including the Debian revision or rpm release. For rpm
+// a version given without release matches any release, as it does when
+// passed to dnf, yum or zypper.
+func (m *Manager) SameVersion(installed, wanted string) bool {
+	if installed == wanted {
+		return true
+	}
+	if m.Kind == Apt {
+		_, err := runner.Query("dpkg", "--compare-versions", installed, "eq", wanted)
+		return err == nil
+	}
+	return compareEVR(installed, wanted) == 0
+}
+
+// compareEVR compares two rpm [epoch:]version[-release] strings and returns
+// -1, 0 or 1. A missing epoch is 0; the release is only compared when both
+// have one.
+func compareEVR(a, b string) int {
+	ea, va, ra := splitEVR(a)
+	eb, vb, rb := splitEVR(b)
+	if ea != eb {
+		if ea < eb {
+			return -1
+		}
+		return 1
+	}
+	if cmp := rpmVerCmp(va, vb); cmp != 0 || ra == "" || rb == "" {
+		return cmp
+	}
+	return rpmVerCmp(ra, rb)
+}
+
+func splitEVR(evr string) (epoch int, version, release string) {
+	if i := strings.Index(evr, ":"); i >= 0 {
+		epoch, _ = strconv.Atoi(evr[:i])
+		evr = evr[i+1:]
+	}
+	if i := strings.LastIndex(evr, "-"); i >= 0 {
+		return epoch, evr[:i], evr[i+1:]
+	}
+	return epoch, evr, ""
+}
+
+// rpmVerCmp compares version or release strings like rpmvercmp: they are
+// split into runs of digits and of letters, numeric runs compare as numbers
+// and are newer than alphabetic ones, "~" sorts before anything, even the
+// end of the string, and "^" after the end of the string.
+func rpmVerCmp(a, b string) int {
+	if a == b {
+		return 0
+	}
+	for len(a) > 0 || len(b) > 0 {
+		a = strings.TrimLeftFunc(a, isVersionSeparator)
+		b = strings.TrimLeftFunc(b, isVersionSeparator)
+
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		if strings.HasPrefix(a, "^") || strings.HasPrefix(b, "^") {
+			switch {
+			case a == "":
+				return -1
+			case b == "":
+				return 1
+			case !strings.HasPrefix(a, "^"):
+				return 1
+			case !strings.HasPrefix(b, "^"):
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		if a == "" || b == "" {
+			break
+		}
+
+		isRun := isLetter
+		numeric := isDigit(rune(a[0]))
+		if numeric {
+			isRun = isDigit
+		}
+		runA, runB := leadingRun(a, isRun), leadingRun(b, isRun)
+		a, b = a[len(runA):], b[len(runB):]
+		if runB == "" {
+			// b has a run of the other kind here; numeric runs are newer
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+		if numeric {
+			runA, runB = strings.TrimLeft(runA, "0"), strings.TrimLeft(runB, "0")
+			if len(runA) != len(runB) {
+				if len(runA) < len(runB) {
+					return -1
+				}
+				return 1
+			}
+		}
+		if cmp := strings.Compare(runA, runB); cmp != 0 {
+			return cmp
+		}
+	}
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	default:
+		return 1
+	}
+}
+
+func leadingRun(s string, in func(rune) bool) string {
+	for i, r := range s {
+		if !in(r) {
+			return s[:i]
+		}
+	}
+	return s
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func isLetter(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+}
+
+func isVersionSeparator(r rune) bool {
+	return !isDigit(r) && !isLetter(r) && r != '~' && r != '^'
+}
@@ -0,0 +1,104 @@
+// service/plan.go
+
+package service
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"ss-agent/service/servicectl"
+	"ss-agent/utils/runner"
+)
+
+// PlannedAction is what a single service action would do in dry-run mode.
+type PlannedAction struct {
+	Service  string
+	Action   string
+	State    servicectl.State // detected before planning
+	StateErr error
+	Steps    []string
+	Err      error // the action would fail, e.g. because a tool is missing
+}
+
+// Plan records, without changing anything, the commands an action on a
+// service or on "all" would run. Services are planned in the same order
+// RunAll handles them.
+func Plan(serviceName, action string, wait bool, timeout time.Duration) ([]PlannedAction, error) {
+	type step struct{ name, action string }
+	var steps []step
+
+	if serviceName == "all" {
+		levels, err := DependencyLevels(AllServices)
+		if err != nil {
+			return nil, err
+		}
+		var forward, reverse []string
+		for _, level := range levels {
+			forward = append(forward, level...)
+		}
+		for _, level := range reverseLevels(levels) {
+			reverse = append(reverse, level...)
+		}
+
+		switch action {
+		case "start":
+			for _, name := range forward {
+				steps = append(steps, step{name, "start"})
+			}
+		case "stop":
+			for _, name := range reverse {
+				steps = append(steps, step{name, "stop"})
+			}
+		case "restart":
+			for _, name := range reverse {
+				steps = append(steps, step{name, "stop"})
+			}
+			for _, name := range forward {
+				steps = append(steps, step{name, "start"})
+			}
+		default:
+			return nil, fmt.Errorf("unknown action: %s", action)
+		}
+	} else {
+		steps = append(steps, step{serviceName, action})
+	}
+
+	runner.SetDryRun(true)
+	defer runner.SetDryRun(false)
+	runner.TakePlan()
+
+	planned := make([]PlannedAction, 0, len(steps))
+	for _, s := range steps {
+		p := PlannedAction{Service: s.name, Action: s.action}
+		p.State, p.StateErr = ServiceState(s.name)
+		if wait {
+			p.Err = ManageServiceAndWait(s.name, s.action, timeout)
+		} else {
+			p.Err = ManageService(s.name, s.action)
+		}
+		p.Steps = runner.TakePlan()
+		planned = append(planned, p)
+	}
+	return planned, nil
+}
+
+// PrintPlan writes a plan in execution order.
+func PrintPlan(w io.Writer, plan []PlannedAction) {
+	fmt.Fprintln(w, "Plan (dry run, nothing was changed):")
+	for i, p := range plan {
+		state := p.State.String()
+		if p.StateErr != nil {
+			state = fmt.Sprintf("%s (%v)", state, p.StateErr)
+		}
+		fmt.Fprintf(w, "\n%d. %s %s (current state: %s)\n", i+1, p.Action, p.Service, state)
+		for _, step := range p.Steps {
+			fmt.Fprintf(w, "     %s\n", step)
+		}
+		if p.Err != nil {
+			fmt.Fprintf(w, "     would fail: %v\n", p.Err)
+		} else if len(p.Steps) == 0 {
+			fmt.Fprintln(w, "     nothing to do")
+		}
+	}
+}
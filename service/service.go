@@ -3,37 +3,48 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"ss-agent/service/fluentbit"
 	"ss-agent/service/osquery"
+	"ss-agent/service/servicectl"
 	"ss-agent/service/zeek"
+	"ss-agent/utils/logging"
 	"strings"
+	"sync"
 )
 
+var logger = logging.For("service")
+
 var AllServices = []string{"fluent-bit", "zeek", "osqueryd"}
 
 // ManageService manages the specified service based on the action.
 func ManageService(serviceName, action string) error {
+	return ManageServiceContext(context.Background(), serviceName, action)
+}
+
+// ManageServiceContext is ManageService with a context that bounds the action.
+func ManageServiceContext(ctx context.Context, serviceName, action string) error {
 	switch strings.ToLower(serviceName) {
 	case "zeek":
-		return handleZeekService(action)
+		return handleZeekService(ctx, action)
 	case "fluent-bit":
-		return handleFluentBitService(action)
+		return handleFluentBitService(ctx, action)
 	case "osqueryd":
-		return handleOsqueryService(action) // Add this line
+		return handleOsqueryService(ctx, action) // Add this line
 	default:
 		return fmt.Errorf("unknown service: %s", serviceName)
 	}
 }
 
-func handleOsqueryService(action string) error {
+func handleOsqueryService(ctx context.Context, action string) error {
 	switch action {
 	case "start":
-		return osquery.OsqueryStart()
+		return osquery.OsqueryStart(ctx)
 	case "stop":
-		return osquery.OsqueryStop()
+		return osquery.OsqueryStop(ctx)
 	case "restart":
-		return osquery.OsqueryRestart()
+		return osquery.OsqueryRestart(ctx)
 	case "status":
 		status, err := osquery.OsqueryStatus()
 		if err != nil {
@@ -47,14 +58,14 @@ func handleOsqueryService(action string) error {
 }
 
 // handleZeekService handles the actions for the Zeek service
-func handleZeekService(action string) error {
+func handleZeekService(ctx context.Context, action string) error {
 	switch action {
 	case "start":
-		return zeek.ZeekStart()
+		return zeek.ZeekStart(ctx)
 	case "stop":
-		return zeek.ZeekStop()
+		return zeek.ZeekStop(ctx)
 	case "restart":
-		return zeek.ZeekRestart() // Restart calls both stop and start
+		return zeek.ZeekRestart(ctx) // Restart calls both stop and start
 	case "status":
 		status, err := zeek.ZeekStatus()
 		if err != nil {
@@ -68,14 +79,14 @@ func handleZeekService(action string) error {
 }
 
 // handleFluentBitService handles the actions for the Fluent Bit service
-func handleFluentBitService(action string) error {
+func handleFluentBitService(ctx context.Context, action string) error {
 	switch action {
 	case "start":
-		return fluentbit.FluentBitStart()
+		return fluentbit.FluentBitStart(ctx)
 	case "stop":
-		return fluentbit.FluentBitStop()
+		return fluentbit.FluentBitStop(ctx)
 	case "restart":
-		return fluentbit.FluentBitRestart() // Restart calls both stop and start
+		return fluentbit.FluentBitRestart(ctx) // Restart calls both stop and start
 	case "status":
 		status, err := fluentbit.FluentBitStatus()
 		if err != nil {
@@ -89,24 +100,37 @@ func handleFluentBitService(action string) error {
 }
 
 func HealthCheck(serviceName string) {
+	services := []string{serviceName}
 	if strings.ToLower(serviceName) == "all" {
-		// List all services' statuses
+		// List all services' statuses, checking them concurrently
 		fmt.Println("Listing all service statuses...")
-		for _, svc := range AllServices {
-			status, err := checkServiceStatus(svc)
-			if err != nil {
-				fmt.Printf("%-15s: [ERROR] %v\n", svc, err)
-			} else {
-				fmt.Printf("%-15s: %s\n", svc, status)
-			}
-		}
-	} else {
-		// Check the status of a specific service
-		status, err := checkServiceStatus(serviceName)
-		if err != nil {
-			fmt.Printf("%-15s: [ERROR] %v\n", serviceName, err)
+		services = AllServices
+	}
+
+	statuses := make([]string, len(services))
+	errs := make([]error, len(services))
+	versions := make([]VersionStatus, len(services))
+	limits := make([]LimitsStatus, len(services))
+	var wg sync.WaitGroup
+	for i, svc := range services {
+		wg.Add(1)
+		go func(i int, svc string) {
+			defer wg.Done()
+			statuses[i], errs[i] = checkServiceStatus(svc)
+			versions[i] = CheckVersion(svc)
+			limits[i] = ResourceLimitsStatus(svc)
+		}(i, svc)
+	}
+	wg.Wait()
+
+	for i, svc := range services {
+		if errs[i] != nil {
+			fmt.Printf("%-15s: [ERROR] %v\n", svc, errs[i])
 		} else {
-			fmt.Printf("%-15s: %s\n", serviceName, status)
+			fmt.Printf("%-15s: %s\n", svc, strings.TrimSpace(statuses[i]+" "+versions[i].String()))
+		}
+		if l := limits[i].String(); l != "" {
+			fmt.Printf("%-15s  %s\n", "", l)
 		}
 	}
 }
@@ -135,3 +159,18 @@ func checkServiceStatus(serviceName string) (string, error) {
 		return "[UNKNOWN]", fmt.Errorf("unknown service: %s", serviceName)
 	}
 }
+
+// ServiceState returns the normalized state of a managed service without
+// printing anything, for callers that poll it.
+func ServiceState(serviceName string) (servicectl.State, error) {
+	switch strings.ToLower(serviceName) {
+	case "zeek":
+		return zeek.ZeekState()
+	case "fluent-bit":
+		return fluentbit.FluentBitState()
+	case "osqueryd":
+		return osquery.OsqueryState()
+	default:
+		return servicectl.StateUnknown, fmt.Errorf("unknown service: %s", serviceName)
+	}
+}
@@ -0,0 +1,95 @@
+// service/servicectl/detect.go
+
+package servicectl
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"ss-agent/utils/logging"
+)
+
+var logger = logging.For("servicectl")
+
+// InitSystem identifies the init system managing services on the host.
+type InitSystem string
+
+const (
+	InitSystemd InitSystem = "systemd"
+	InitOpenRC  InitSystem = "openrc"
+	InitSysV    InitSystem = "sysv"
+	InitUnknown InitSystem = "unknown"
+)
+
+// DetectInitSystem inspects the host to find out which init system is in
+// charge. The checks mirror the ones the init systems document themselves:
+// sd_booted() for systemd and the softlevel file for OpenRC.
+func DetectInitSystem() InitSystem {
+	if isDir("/run/systemd/system") {
+		return InitSystemd
+	}
+	if fileExists("/run/openrc/softlevel") {
+		return InitOpenRC
+	}
+	if _, err := exec.LookPath("openrc-run"); err == nil {
+		if _, err := exec.LookPath("rc-service"); err == nil {
+			return InitOpenRC
+		}
+	}
+	if isDir("/etc/init.d") {
+		return InitSysV
+	}
+	return InitUnknown
+}
+
+func detectBackend() Backend {
+	initSystem := DetectInitSystem()
+	switch initSystem {
+	case InitSystemd:
+		b, err := NewSystemdDBus()
+		if err != nil {
+			logger.Warn("systemd D-Bus backend unavailable, falling back to systemctl", "error", err)
+			return Systemctl{}
+		}
+		return b
+	case InitOpenRC:
+		return OpenRC{}
+	case InitSysV:
+		return SysV{}
+	default:
+		logger.Warn("Could not detect a supported init system")
+		return unsupported{}
+	}
+}
+
+// unsupported is used when no init system could be detected. Every operation
+// fails with the same error.
+type unsupported struct{}
+
+func (unsupported) Name() string { return string(InitUnknown) }
+
+func (unsupported) Start(ctx context.Context, unit string) error   { return errUnsupported() }
+func (unsupported) Stop(ctx context.Context, unit string) error    { return errUnsupported() }
+func (unsupported) Restart(ctx context.Context, unit string) error { return errUnsupported() }
+func (unsupported) Enable(unit string) error                       { return errUnsupported() }
+func (unsupported) Disable(unit string) error                      { return errUnsupported() }
+
+func (unsupported) Status(unit string) (Status, error) {
+	return Status{Unit: unit}, errUnsupported()
+}
+
+func errUnsupported() error {
+	return fmt.Errorf("no supported init system detected (systemd, OpenRC or SysV)")
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,75 @@
+// service/servicectl/dropin.go
+
+package servicectl
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"ss-agent/utils/runner"
+)
+
+// DropInDir is where unit drop-in directories are created.
+var DropInDir = "/etc/systemd/system"
+
+// UnitConfigurator is implemented by the systemd backends. It reloads unit
+// files after drop-ins changed and reads back unit properties to check that
+// the new settings are in effect.
+type UnitConfigurator interface {
+	DaemonReload() error
+	// Properties reads properties of the Service interface, or of the Slice
+	// interface for a slice. Values are returned as reported by the backend;
+	// systemctl formats some of them, e.g. "500ms" where D-Bus reports 500000.
+	Properties(unit string, names ...string) (map[string]string, error)
+}
+
+// Configurator returns the default backend as a UnitConfigurator, or false
+// if the host is not managed by systemd.
+func Configurator() (UnitConfigurator, bool) {
+	c, ok := Default().(UnitConfigurator)
+	return c, ok
+}
+
+// DropInPath returns the path of a drop-in, e.g.
+// /etc/systemd/system/zeek.service.d/50-ss-agent-resources.conf.
+func DropInPath(unit, name string) string {
+	return filepath.Join(DropInDir, UnitName(unit)+".d", name+".conf")
+}
+
+// WriteDropIn writes a drop-in unless it already has the given content and
+// reports whether it changed. The caller reloads systemd if it did.
+func WriteDropIn(unit, name string, content []byte) (bool, error) {
+	path := DropInPath(unit, name)
+	if existing, err := os.ReadFile(path); err == nil && bytes.Equal(existing, content) {
+		return false, nil
+	}
+	if err := runner.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return false, fmt.Errorf("failed to create drop-in directory for %s: %v", unit, err)
+	}
+	if err := runner.WriteFile(path, content, 0644); err != nil {
+		return false, fmt.Errorf("failed to write drop-in %s: %v", path, err)
+	}
+	return true, nil
+}
+
+// RemoveDropIn removes a drop-in, and its directory if nothing else is left
+// in it, and reports whether anything was removed.
+func RemoveDropIn(unit, name string) (bool, error) {
+	path := DropInPath(unit, name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return false, nil
+	}
+	if err := runner.Remove(path); err != nil {
+		return false, fmt.Errorf("failed to remove drop-in %s: %v", path, err)
+	}
+	dir := filepath.Dir(path)
+	// In dry-run mode the drop-in is still there, so it is not counted
+	if entries, err := os.ReadDir(dir); err == nil && (len(entries) == 0 || len(entries) == 1 && entries[0].Name() == filepath.Base(path)) {
+		if err := runner.Remove(dir); err != nil {
+			return true, fmt.Errorf("failed to remove drop-in directory %s: %v", dir, err)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,108 @@
+// service/servicectl/openrc.go
+
+package servicectl
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"ss-agent/utils/runner"
+)
+
+// openrcRunlevel is the runlevel services are enabled in.
+const openrcRunlevel = "default"
+
+// OpenRC controls services with rc-service and rc-update (Alpine, Gentoo).
+type OpenRC struct{}
+
+func (OpenRC) Name() string {
+	return string(InitOpenRC)
+}
+
+func (OpenRC) Start(ctx context.Context, unit string) error {
+	return runRCService(ctx, unit, "start")
+}
+
+func (OpenRC) Stop(ctx context.Context, unit string) error {
+	return runRCService(ctx, unit, "stop")
+}
+
+func (OpenRC) Restart(ctx context.Context, unit string) error {
+	return runRCService(ctx, unit, "restart")
+}
+
+func (OpenRC) Enable(unit string) error {
+	return runRCUpdate("add", unit)
+}
+
+func (OpenRC) Disable(unit string) error {
+	return runRCUpdate("del", unit)
+}
+
+// Status reports StateNotInstalled when there is no init script, and otherwise
+// maps the " * status: <state>" line of `rc-service <name> status`.
+func (OpenRC) Status(unit string) (Status, error) {
+	name := serviceName(unit)
+	st := Status{Unit: name}
+	if !fileExists(filepath.Join("/etc/init.d", name)) {
+		st.LoadState = "not-found"
+		st.State = StateNotInstalled
+		return st, nil
+	}
+
+	st.LoadState = "loaded"
+	st.UnitFileState = "disabled"
+	if fileExists(filepath.Join("/etc/runlevels", openrcRunlevel, name)) {
+		st.UnitFileState = "enabled"
+	}
+
+	// rc-service exits non-zero for every state but "started", so the output
+	// is what tells the states apart
+	output, err := runner.Query("rc-service", name, "status")
+	st.ActiveState = parseOpenRCStatus(string(output))
+	switch st.ActiveState {
+	case "started":
+		st.State = StateRunning
+	case "stopped", "inactive":
+		st.State = StateStopped
+	case "crashed":
+		st.State = StateFailed
+	case "starting":
+		st.State = StateStarting
+	case "stopping":
+		st.State = StateStopping
+	default:
+		st.State = StateUnknown
+		if err != nil {
+			return st, fmt.Errorf("rc-service status failed: %v\nOutput: %s", err, string(output))
+		}
+	}
+	return st, nil
+}
+
+func parseOpenRCStatus(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		if idx := strings.Index(line, "status:"); idx >= 0 {
+			return strings.TrimSpace(line[idx+len("status:"):])
+		}
+	}
+	return ""
+}
+
+func runRCService(ctx context.Context, unit, action string) error {
+	output, err := runner.RunContext(ctx, "rc-service", serviceName(unit), action)
+	if err != nil {
+		return fmt.Errorf("rc-service %s failed: %v\nOutput: %s", action, err, string(output))
+	}
+	return nil
+}
+
+func runRCUpdate(action, unit string) error {
+	output, err := runner.Run("rc-update", action, serviceName(unit), openrcRunlevel)
+	if err != nil {
+		return fmt.Errorf("rc-update %s failed: %v\nOutput: %s", action, err, string(output))
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+// service/servicectl/servicectl.go
+
+package servicectl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// State is the normalized state of a managed service, independent of the
+// init system or tool that reported it.
+type State int
+
+const (
+	StateUnknown State = iota
+	StateRunning
+	StateStopped
+	StateFailed
+	StateStarting
+	StateStopping
+	StateNotInstalled
+)
+
+var stateNames = map[State]string{
+	StateUnknown:      "unknown",
+	StateRunning:      "running",
+	StateStopped:      "stopped",
+	StateFailed:       "failed",
+	StateStarting:     "starting",
+	StateStopping:     "stopping",
+	StateNotInstalled: "not installed",
+}
+
+func (s State) String() string {
+	if name, ok := stateNames[s]; ok {
+		return name
+	}
+	return stateNames[StateUnknown]
+}
+
+// Label returns the bracketed form used in CLI output, e.g. "[RUNNING]".
+func (s State) Label() string {
+	return "[" + strings.ToUpper(s.String()) + "]"
+}
+
+// Status is the state of a single unit as reported by a Backend. Fields other
+// than Unit and State are only filled in when the backend can provide them.
+type Status struct {
+	Unit          string
+	State         State
+	LoadState     string
+	ActiveState   string
+	SubState      string
+	Result        string
+	UnitFileState string
+	MainPID       uint32
+	NRestarts     uint32
+}
+
+// Detail returns a short human readable description of the raw unit state,
+// e.g. "failed/failed, result: exit-code, restarts: 3".
+func (s Status) Detail() string {
+	var parts []string
+	if s.ActiveState != "" {
+		if s.SubState != "" {
+			parts = append(parts, s.ActiveState+"/"+s.SubState)
+		} else {
+			parts = append(parts, s.ActiveState)
+		}
+	}
+	if s.Result != "" && s.Result != "success" {
+		parts = append(parts, "result: "+s.Result)
+	}
+	if s.NRestarts > 0 {
+		parts = append(parts, fmt.Sprintf("restarts: %d", s.NRestarts))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Backend controls services through the host init system. Start, Stop and
+// Restart give up when the context is done.
+type Backend interface {
+	// Name identifies the backend in logs, e.g. "systemd-dbus".
+	Name() string
+	Start(ctx context.Context, unit string) error
+	Stop(ctx context.Context, unit string) error
+	Restart(ctx context.Context, unit string) error
+	Enable(unit string) error
+	Disable(unit string) error
+	Status(unit string) (Status, error)
+}
+
+var (
+	defaultOnce    sync.Once
+	defaultBackend Backend
+)
+
+// Default returns the backend for the running host's init system. On systemd
+// hosts the D-Bus backend is preferred, falling back to systemctl when the
+// system bus is not reachable.
+func Default() Backend {
+	defaultOnce.Do(func() {
+		defaultBackend = detectBackend()
+	})
+	return defaultBackend
+}
+
+// SetDefault overrides the backend returned by Default.
+func SetDefault(b Backend) {
+	defaultOnce.Do(func() {})
+	defaultBackend = b
+}
+
+// UnitName appends the ".service" suffix when the name has no unit type.
+func UnitName(name string) string {
+	if strings.Contains(name, ".") {
+		return name
+	}
+	return name + ".service"
+}
+
+// serviceName strips the systemd ".service" suffix for init systems that
+// address services by bare name.
+func serviceName(unit string) string {
+	return strings.TrimSuffix(unit, ".service")
+}
+
+// exitCode returns the exit status of a finished command, or -1 if the
+// command could not be run at all.
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// statusFromProperties builds a Status from systemd unit properties, as
+// returned by either D-Bus or `systemctl show`.
+func statusFromProperties(unit string, props map[string]string) Status {
+	st := Status{
+		Unit:          unit,
+		LoadState:     props["LoadState"],
+		ActiveState:   props["ActiveState"],
+		SubState:      props["SubState"],
+		Result:        props["Result"],
+		UnitFileState: props["UnitFileState"],
+	}
+	fmt.Sscan(props["MainPID"], &st.MainPID)
+	fmt.Sscan(props["NRestarts"], &st.NRestarts)
+
+	if st.LoadState == "not-found" {
+		st.State = StateNotInstalled
+		return st
+	}
+	switch st.ActiveState {
+	case "active", "reloading":
+		st.State = StateRunning
+	case "inactive":
+		st.State = StateStopped
+	case "failed":
+		st.State = StateFailed
+	case "activating":
+		st.State = StateStarting
+	case "deactivating":
+		st.State = StateStopping
+	default:
+		st.State = StateUnknown
+	}
+	return st
+}
@@ -0,0 +1,94 @@
+// service/servicectl/systemctl.go
+
+package servicectl
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"ss-agent/utils/runner"
+)
+
+// systemctlProperties are the unit properties read by Systemctl.Status.
+var systemctlProperties = []string{
+	"LoadState", "ActiveState", "SubState", "Result", "UnitFileState", "MainPID", "NRestarts",
+}
+
+// Systemctl controls systemd units by running the systemctl CLI. It is the
+// fallback for hosts where the system bus is not reachable.
+type Systemctl struct{}
+
+func (Systemctl) Name() string {
+	return "systemctl"
+}
+
+func (Systemctl) Start(ctx context.Context, unit string) error {
+	return runSystemctl(ctx, "start", unit)
+}
+
+func (Systemctl) Stop(ctx context.Context, unit string) error {
+	return runSystemctl(ctx, "stop", unit)
+}
+
+func (Systemctl) Restart(ctx context.Context, unit string) error {
+	return runSystemctl(ctx, "restart", unit)
+}
+
+func (Systemctl) Enable(unit string) error {
+	return runSystemctl(context.Background(), "enable", unit)
+}
+
+func (Systemctl) Disable(unit string) error {
+	return runSystemctl(context.Background(), "disable", unit)
+}
+
+// DaemonReload reloads all unit files, e.g. after a drop-in changed.
+func (Systemctl) DaemonReload() error {
+	output, err := runner.Run("systemctl", "daemon-reload")
+	if err != nil {
+		return fmt.Errorf("systemctl daemon-reload failed: %v\nOutput: %s", err, string(output))
+	}
+	return nil
+}
+
+// Properties reads unit properties with `systemctl show`.
+func (Systemctl) Properties(unit string, names ...string) (map[string]string, error) {
+	unit = UnitName(unit)
+	output, err := runner.Query("systemctl", "show", unit, "--property="+strings.Join(names, ","))
+	if err != nil {
+		return nil, fmt.Errorf("systemctl show failed: %v\nOutput: %s", err, string(output))
+	}
+	return parseShowOutput(output), nil
+}
+
+// Status parses `systemctl show` rather than `is-active`, which only reports
+// the ActiveState.
+func (Systemctl) Status(unit string) (Status, error) {
+	unit = UnitName(unit)
+	output, err := runner.Query("systemctl", "show", unit, "--property="+strings.Join(systemctlProperties, ","))
+	if err != nil {
+		return Status{Unit: unit}, fmt.Errorf("systemctl show failed: %v\nOutput: %s", err, string(output))
+	}
+	return statusFromProperties(unit, parseShowOutput(output)), nil
+}
+
+// parseShowOutput parses the Name=value lines printed by `systemctl show`.
+func parseShowOutput(output []byte) map[string]string {
+	props := make(map[string]string)
+	for _, line := range strings.Split(string(output), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) == 2 {
+			props[parts[0]] = parts[1]
+		}
+	}
+	return props
+}
+
+func runSystemctl(ctx context.Context, action, unit string) error {
+	output, err := runner.RunContext(ctx, "systemctl", action, UnitName(unit))
+	if err != nil {
+		return fmt.Errorf("systemctl %s failed: %v\nOutput: %s", action, err, string(output))
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+// service/servicectl/systemd.go
+
+package servicectl
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"ss-agent/utils/runner"
+)
+
+const (
+	systemdBusName      = "org.freedesktop.systemd1"
+	systemdObjectPath   = dbus.ObjectPath("/org/freedesktop/systemd1")
+	systemdManagerIface = "org.freedesktop.systemd1.Manager"
+	systemdUnitIface    = "org.freedesktop.systemd1.Unit"
+	systemdServiceIface = "org.freedesktop.systemd1.Service"
+	systemdSliceIface   = "org.freedesktop.systemd1.Slice"
+	dbusPropertiesIface = "org.freedesktop.DBus.Properties"
+)
+
+// JobTimeout bounds how long a start, stop or restart waits for systemd to
+// finish the queued job.
+var JobTimeout = 90 * time.Second
+
+// SystemdDBus talks to systemd over the system bus (org.freedesktop.systemd1).
+// The bus address can be overridden with DBUS_SYSTEM_BUS_ADDRESS, which is how
+// it is pointed at a local fake systemd service.
+type SystemdDBus struct {
+	conn *dbus.Conn
+}
+
+// NewSystemdDBus connects to the system bus and verifies that systemd is on it.
+func NewSystemdDBus() (*SystemdDBus, error) {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to system bus: %v", err)
+	}
+	s, err := NewSystemdDBusConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// NewSystemdDBusConn uses an already established bus connection.
+func NewSystemdDBusConn(conn *dbus.Conn) (*SystemdDBus, error) {
+	var owner string
+	err := conn.BusObject().Call("org.freedesktop.DBus.GetNameOwner", 0, systemdBusName).Store(&owner)
+	if err != nil {
+		return nil, fmt.Errorf("systemd is not available on the bus: %v", err)
+	}
+	return &SystemdDBus{conn: conn}, nil
+}
+
+func (s *SystemdDBus) Name() string {
+	return "systemd-dbus"
+}
+
+// Close closes the underlying bus connection.
+func (s *SystemdDBus) Close() error {
+	return s.conn.Close()
+}
+
+func (s *SystemdDBus) manager() dbus.BusObject {
+	return s.conn.Object(systemdBusName, systemdObjectPath)
+}
+
+func (s *SystemdDBus) Start(ctx context.Context, unit string) error {
+	return s.runJob(ctx, "StartUnit", unit)
+}
+
+func (s *SystemdDBus) Stop(ctx context.Context, unit string) error {
+	return s.runJob(ctx, "StopUnit", unit)
+}
+
+func (s *SystemdDBus) Restart(ctx context.Context, unit string) error {
+	return s.runJob(ctx, "RestartUnit", unit)
+}
+
+// Enable enables the unit file and reloads the manager configuration.
+func (s *SystemdDBus) Enable(unit string) error {
+	unit = UnitName(unit)
+	if runner.DryRun() {
+		runner.Record("dbus %s.EnableUnitFiles [%s]", systemdManagerIface, unit)
+		return s.reload()
+	}
+	var carriesInstallInfo bool
+	var changes [][]interface{}
+	err := s.manager().Call(systemdManagerIface+".EnableUnitFiles", 0, []string{unit}, false, true).
+		Store(&carriesInstallInfo, &changes)
+	if err != nil {
+		return fmt.Errorf("systemd EnableUnitFiles %s failed: %v", unit, err)
+	}
+	return s.reload()
+}
+
+// Disable disables the unit file and reloads the manager configuration.
+func (s *SystemdDBus) Disable(unit string) error {
+	unit = UnitName(unit)
+	if runner.DryRun() {
+		runner.Record("dbus %s.DisableUnitFiles [%s]", systemdManagerIface, unit)
+		return s.reload()
+	}
+	var changes [][]interface{}
+	err := s.manager().Call(systemdManagerIface+".DisableUnitFiles", 0, []string{unit}, false).Store(&changes)
+	if err != nil {
+		return fmt.Errorf("systemd DisableUnitFiles %s failed: %v", unit, err)
+	}
+	return s.reload()
+}
+
+// DaemonReload reloads all unit files, e.g. after a drop-in changed.
+func (s *SystemdDBus) DaemonReload() error {
+	return s.reload()
+}
+
+// Properties reads properties of the Service interface of a unit, or of the
+// Slice interface for a slice.
+func (s *SystemdDBus) Properties(unit string, names ...string) (map[string]string, error) {
+	unit = UnitName(unit)
+	iface := systemdServiceIface
+	if strings.HasSuffix(unit, ".slice") {
+		iface = systemdSliceIface
+	}
+	var path dbus.ObjectPath
+	if err := s.manager().Call(systemdManagerIface+".LoadUnit", 0, unit).Store(&path); err != nil {
+		return nil, fmt.Errorf("systemd LoadUnit %s failed: %v", unit, err)
+	}
+
+	obj := s.conn.Object(systemdBusName, path)
+	props := make(map[string]string, len(names))
+	for _, name := range names {
+		var v dbus.Variant
+		if err := obj.Call(dbusPropertiesIface+".Get", 0, iface, name).Store(&v); err != nil {
+			return nil, fmt.Errorf("failed to read %s of %s: %v", name, unit, err)
+		}
+		props[name] = fmt.Sprint(v.Value())
+	}
+	return props, nil
+}
+
+func (s *SystemdDBus) reload() error {
+	if runner.DryRun() {
+		runner.Record("dbus %s.Reload", systemdManagerIface)
+		return nil
+	}
+	if err := s.manager().Call(systemdManagerIface+".Reload", 0).Err; err != nil {
+		return fmt.Errorf("systemd Reload failed: %v", err)
+	}
+	return nil
+}
+
+// Status loads the unit and reads its Unit and Service properties.
+func (s *SystemdDBus) Status(unit string) (Status, error) {
+	unit = UnitName(unit)
+	var path dbus.ObjectPath
+	if err := s.manager().Call(systemdManagerIface+".LoadUnit", 0, unit).Store(&path); err != nil {
+		return Status{Unit: unit}, fmt.Errorf("systemd LoadUnit %s failed: %v", unit, err)
+	}
+
+	obj := s.conn.Object(systemdBusName, path)
+	props := make(map[string]string)
+	for _, iface := range []string{systemdUnitIface, systemdServiceIface} {
+		var values map[string]dbus.Variant
+		if err := obj.Call(dbusPropertiesIface+".GetAll", 0, iface).Store(&values); err != nil {
+			if iface == systemdServiceIface {
+				// Units that failed to load do not expose the Service interface
+				break
+			}
+			return Status{Unit: unit}, fmt.Errorf("failed to read properties of %s: %v", unit, err)
+		}
+		for name, v := range values {
+			props[name] = fmt.Sprint(v.Value())
+		}
+	}
+	return statusFromProperties(unit, props), nil
+}
+
+// runJob queues a unit job and waits for systemd to report its result, at
+// most JobTimeout or until ctx is done. The job itself is left to systemd. Jobs
+// of different units run concurrently: each has its own signal channel and
+// picks its JobRemoved out by the job path, and the bus counts the match
+// rules each of them adds.
+func (s *SystemdDBus) runJob(ctx context.Context, method, unit string) error {
+	unit = UnitName(unit)
+	if runner.DryRun() {
+		runner.Record("dbus %s.%s %s replace", systemdManagerIface, method, unit)
+		return nil
+	}
+
+	signals := make(chan *dbus.Signal, 16)
+	s.conn.Signal(signals)
+	defer s.conn.RemoveSignal(signals)
+
+	match := []dbus.MatchOption{
+		dbus.WithMatchObjectPath(systemdObjectPath),
+		dbus.WithMatchInterface(systemdManagerIface),
+		dbus.WithMatchMember("JobRemoved"),
+	}
+	if err := s.conn.AddMatchSignal(match...); err != nil {
+		return fmt.Errorf("failed to subscribe to systemd job signals: %v", err)
+	}
+	defer s.conn.RemoveMatchSignal(match...)
+
+	// systemd only broadcasts job signals to subscribed clients. Subscribing
+	// twice returns an error that is safe to ignore.
+	s.manager().Call(systemdManagerIface+".Subscribe", 0)
+
+	var job dbus.ObjectPath
+	if err := s.manager().CallWithContext(ctx, systemdManagerIface+"."+method, 0, unit, "replace").Store(&job); err != nil {
+		return fmt.Errorf("systemd %s %s failed: %v", method, unit, err)
+	}
+
+	timeout := time.NewTimer(JobTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case sig, ok := <-signals:
+			if !ok {
+				return fmt.Errorf("system bus connection closed while waiting for %s %s", method, unit)
+			}
+			if sig.Name != systemdManagerIface+".JobRemoved" || len(sig.Body) < 4 {
+				continue
+			}
+			if path, _ := sig.Body[1].(dbus.ObjectPath); path != job {
+				continue
+			}
+			result, _ := sig.Body[3].(string)
+			if result != "done" {
+				return fmt.Errorf("systemd %s %s finished with result %q", method, unit, result)
+			}
+			return nil
+		case <-timeout.C:
+			return fmt.Errorf("timed out after %s waiting for systemd %s %s", JobTimeout, method, unit)
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for systemd %s %s: %v", method, unit, ctx.Err())
+		}
+	}
+}
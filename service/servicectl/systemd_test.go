@@ -0,0 +1,361 @@
+//go:build !windows
+// +build !windows
+
+package servicectl
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// busConfig runs dbus-daemon as a private bus anyone may own names on
+const busConfig = `<!DOCTYPE busconfig PUBLIC "-//freedesktop//DTD D-BUS Bus Configuration 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/busconfig.dtd">
+<busconfig>
+  <type>session</type>
+  <listen>unix:path=%s</listen>
+  <auth>EXTERNAL</auth>
+  <policy context="default">
+    <allow send_destination="*" eavesdrop="true"/>
+    <allow eavesdrop="true"/>
+    <allow own="*"/>
+  </policy>
+</busconfig>
+`
+
+// privateBus starts a dbus-daemon for the test and returns its address
+func privateBus(t *testing.T) string {
+	t.Helper()
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon is not installed")
+	}
+	dir := t.TempDir()
+	config := filepath.Join(dir, "bus.conf")
+	if err := os.WriteFile(config, []byte(fmt.Sprintf(busConfig, filepath.Join(dir, "bus"))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(daemon, "--config-file="+config, "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start dbus-daemon: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("dbus-daemon did not print its address: %v", err)
+	}
+	return strings.TrimSpace(address)
+}
+
+// fakeSystemd is the part of systemd's Manager and unit objects the backend
+// uses. Jobs finish with the result set for their unit, "done" by default.
+type fakeSystemd struct {
+	conn *dbus.Conn
+
+	mu      sync.Mutex
+	calls   []string
+	results map[string]string            // unit -> job result, "" never finishes
+	units   map[string]map[string]string // unit -> properties
+	jobs    uint32
+}
+
+func newFakeSystemd(t *testing.T, address string) *fakeSystemd {
+	t.Helper()
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatalf("fake systemd cannot connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	f := &fakeSystemd{conn: conn, results: map[string]string{}, units: map[string]map[string]string{}}
+	if err := conn.Export(f, systemdObjectPath, systemdManagerIface); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := conn.RequestName(systemdBusName, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		t.Fatalf("fake systemd cannot own %s: %v", systemdBusName, err)
+	}
+	return f
+}
+
+// setResult sets how jobs of unit end, "" for never
+func (f *fakeSystemd) setResult(unit, result string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.results[unit] = result
+}
+
+// addUnit makes a unit loadable with the given properties
+func (f *fakeSystemd) addUnit(t *testing.T, unit string, props map[string]string) {
+	t.Helper()
+	f.mu.Lock()
+	f.units[unit] = props
+	f.mu.Unlock()
+	if err := f.conn.Export(&fakeUnit{props: props}, unitPath(unit), dbusPropertiesIface); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (f *fakeSystemd) record(call string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+func (f *fakeSystemd) recorded() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func unitPath(unit string) dbus.ObjectPath {
+	return dbus.ObjectPath("/org/freedesktop/systemd1/unit/" + strings.NewReplacer(".", "_2e", "-", "_2d").Replace(unit))
+}
+
+func (f *fakeSystemd) Subscribe() *dbus.Error {
+	return nil
+}
+
+func (f *fakeSystemd) Reload() *dbus.Error {
+	f.record("Reload")
+	return nil
+}
+
+func (f *fakeSystemd) LoadUnit(unit string) (dbus.ObjectPath, *dbus.Error) {
+	f.mu.Lock()
+	_, ok := f.units[unit]
+	f.mu.Unlock()
+	if !ok {
+		return "", dbus.NewError("org.freedesktop.systemd1.NoSuchUnit", []interface{}{"Unit " + unit + " not found."})
+	}
+	return unitPath(unit), nil
+}
+
+func (f *fakeSystemd) StartUnit(unit, mode string) (dbus.ObjectPath, *dbus.Error) {
+	return f.queue("StartUnit", unit, mode)
+}
+
+func (f *fakeSystemd) StopUnit(unit, mode string) (dbus.ObjectPath, *dbus.Error) {
+	return f.queue("StopUnit", unit, mode)
+}
+
+func (f *fakeSystemd) RestartUnit(unit, mode string) (dbus.ObjectPath, *dbus.Error) {
+	return f.queue("RestartUnit", unit, mode)
+}
+
+// queue creates a job and announces its end with JobRemoved, as systemd does
+// once the job has run
+func (f *fakeSystemd) queue(method, unit, mode string) (dbus.ObjectPath, *dbus.Error) {
+	f.record(method + " " + unit + " " + mode)
+	f.mu.Lock()
+	f.jobs++
+	id := f.jobs
+	result, ok := f.results[unit]
+	f.mu.Unlock()
+	if !ok {
+		result = "done"
+	}
+	job := dbus.ObjectPath(fmt.Sprintf("/org/freedesktop/systemd1/job/%d", id))
+	if result != "" {
+		go func() {
+			// An unrelated job ending first must not be taken for this one
+			f.conn.Emit(systemdObjectPath, systemdManagerIface+".JobRemoved",
+				id+1000, dbus.ObjectPath("/org/freedesktop/systemd1/job/other"), "other.service", "failed")
+			f.conn.Emit(systemdObjectPath, systemdManagerIface+".JobRemoved", id, job, unit, result)
+		}()
+	}
+	return job, nil
+}
+
+// fakeUnit serves the properties of a unit for both the Unit and the Service
+// interface
+type fakeUnit struct {
+	props map[string]string
+}
+
+func (u *fakeUnit) Get(iface, name string) (dbus.Variant, *dbus.Error) {
+	v, ok := u.props[name]
+	if !ok {
+		return dbus.Variant{}, dbus.NewError("org.freedesktop.DBus.Error.UnknownProperty", []interface{}{"Unknown property " + name})
+	}
+	return dbus.MakeVariant(v), nil
+}
+
+func (u *fakeUnit) GetAll(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	all := make(map[string]dbus.Variant, len(u.props))
+	for name, v := range u.props {
+		all[name] = dbus.MakeVariant(v)
+	}
+	return all, nil
+}
+
+// connectBackend starts a private bus with a fake systemd on it and connects
+// the backend through DBUS_SYSTEM_BUS_ADDRESS, as on a real host
+func connectBackend(t *testing.T) (*SystemdDBus, *fakeSystemd) {
+	t.Helper()
+	address := privateBus(t)
+	fake := newFakeSystemd(t, address)
+	t.Setenv("DBUS_SYSTEM_BUS_ADDRESS", address)
+	s, err := NewSystemdDBus()
+	if err != nil {
+		t.Fatalf("NewSystemdDBus: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, fake
+}
+
+func TestSystemdDBusNotOnBus(t *testing.T) {
+	address := privateBus(t)
+	t.Setenv("DBUS_SYSTEM_BUS_ADDRESS", address)
+	if s, err := NewSystemdDBus(); err == nil {
+		s.Close()
+		t.Fatal("NewSystemdDBus succeeded without systemd on the bus")
+	}
+}
+
+func TestSystemdDBusJobs(t *testing.T) {
+	s, fake := connectBackend(t)
+	fake.setResult("broken.service", "failed")
+
+	if err := s.Start(context.Background(), "fluent-bit"); err != nil {
+		t.Errorf("Start: %v", err)
+	}
+	if err := s.Stop(context.Background(), "fluent-bit.service"); err != nil {
+		t.Errorf("Stop: %v", err)
+	}
+	if err := s.Restart(context.Background(), "fluent-bit"); err != nil {
+		t.Errorf("Restart: %v", err)
+	}
+	err := s.Start(context.Background(), "broken")
+	if err == nil || !strings.Contains(err.Error(), `result "failed"`) {
+		t.Errorf("Start of a failing unit = %v, want the job result", err)
+	}
+
+	want := []string{
+		"StartUnit fluent-bit.service replace",
+		"StopUnit fluent-bit.service replace",
+		"RestartUnit fluent-bit.service replace",
+		"StartUnit broken.service replace",
+	}
+	if got := fake.recorded(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("calls = %q, want %q", got, want)
+	}
+}
+
+func TestSystemdDBusConcurrentJobs(t *testing.T) {
+	s, fake := connectBackend(t)
+	fake.setResult("hung.service", "")
+	defer func(timeout time.Duration) { JobTimeout = timeout }(JobTimeout)
+	JobTimeout = 2 * time.Second
+
+	hung := make(chan error, 1)
+	go func() { hung <- s.Start(context.Background(), "hung") }()
+	for !strings.Contains(strings.Join(fake.recorded(), "\n"), "hung.service") {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A job stuck in systemd must not hold up the jobs of other units
+	started := time.Now()
+	if err := s.Start(context.Background(), "fluent-bit"); err != nil {
+		t.Errorf("Start: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Start waited %s for the hung job", elapsed)
+	}
+	if err := <-hung; err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Start of the hung unit = %v, want a timeout", err)
+	}
+}
+
+func TestSystemdDBusJobTimeout(t *testing.T) {
+	s, fake := connectBackend(t)
+	fake.setResult("hung.service", "")
+	defer func(timeout time.Duration) { JobTimeout = timeout }(JobTimeout)
+	JobTimeout = 200 * time.Millisecond
+
+	err := s.Start(context.Background(), "hung")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Start = %v, want a timeout", err)
+	}
+
+	// A caller's deadline ends the wait before JobTimeout does
+	JobTimeout = time.Minute
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = s.Start(ctx, "hung")
+	if err == nil || !strings.Contains(err.Error(), "gave up") {
+		t.Errorf("Start with a deadline = %v, want it to give up", err)
+	}
+}
+
+func TestSystemdDBusProperties(t *testing.T) {
+	s, fake := connectBackend(t)
+	fake.addUnit(t, "osqueryd.service", map[string]string{
+		"MemoryMax":          "2147483648",
+		"CPUQuotaPerSecUSec": "500000",
+	})
+
+	props, err := s.Properties("osqueryd", "MemoryMax", "CPUQuotaPerSecUSec")
+	if err != nil {
+		t.Fatalf("Properties: %v", err)
+	}
+	if props["MemoryMax"] != "2147483648" || props["CPUQuotaPerSecUSec"] != "500000" {
+		t.Errorf("Properties = %v", props)
+	}
+	if _, err := s.Properties("osqueryd", "IOWeight"); err == nil {
+		t.Error("Properties of an unknown property succeeded")
+	}
+	if _, err := s.Properties("missing", "MemoryMax"); err == nil {
+		t.Error("Properties of a unit that does not exist succeeded")
+	}
+}
+
+func TestSystemdDBusStatus(t *testing.T) {
+	s, fake := connectBackend(t)
+	fake.addUnit(t, "zeek.service", map[string]string{
+		"LoadState":   "loaded",
+		"ActiveState": "failed",
+		"SubState":    "failed",
+		"Result":      "exit-code",
+		"MainPID":     "0",
+		"NRestarts":   "3",
+	})
+	fake.addUnit(t, "gone.service", map[string]string{"LoadState": "not-found", "ActiveState": "inactive"})
+
+	st, err := s.Status("zeek")
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if st.State != StateFailed || st.NRestarts != 3 || st.Detail() != "failed/failed, result: exit-code, restarts: 3" {
+		t.Errorf("Status = %+v (%s)", st, st.Detail())
+	}
+	if st, err := s.Status("gone"); err != nil || st.State != StateNotInstalled {
+		t.Errorf("Status of a unit without unit file = %v, %v, want not installed", st.State, err)
+	}
+}
+
+func TestSystemdDBusReload(t *testing.T) {
+	s, fake := connectBackend(t)
+	if err := s.DaemonReload(); err != nil {
+		t.Fatalf("DaemonReload: %v", err)
+	}
+	if got := fake.recorded(); len(got) != 1 || got[0] != "Reload" {
+		t.Errorf("calls = %q, want Reload", got)
+	}
+}
@@ -0,0 +1,119 @@
+// service/servicectl/sysv.go
+
+package servicectl
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+
+	"ss-agent/utils/runner"
+)
+
+// SysV controls services through LSB init scripts in /etc/init.d.
+type SysV struct{}
+
+func (SysV) Name() string {
+	return string(InitSysV)
+}
+
+func (SysV) Start(ctx context.Context, unit string) error {
+	return runInitScript(ctx, unit, "start")
+}
+
+func (SysV) Stop(ctx context.Context, unit string) error {
+	return runInitScript(ctx, unit, "stop")
+}
+
+func (SysV) Restart(ctx context.Context, unit string) error {
+	return runInitScript(ctx, unit, "restart")
+}
+
+// Enable links the script into the runlevels with update-rc.d (Debian) or
+// chkconfig (Red Hat), whichever the host has.
+func (SysV) Enable(unit string) error {
+	return runRunlevelTool(unit, true)
+}
+
+func (SysV) Disable(unit string) error {
+	return runRunlevelTool(unit, false)
+}
+
+// Status interprets the exit code of `<script> status` as defined by the LSB
+// init script specification.
+func (SysV) Status(unit string) (Status, error) {
+	name := serviceName(unit)
+	st := Status{Unit: name}
+	script := initScriptPath(name)
+	if !fileExists(script) {
+		st.LoadState = "not-found"
+		st.State = StateNotInstalled
+		return st, nil
+	}
+	st.LoadState = "loaded"
+
+	output, err := runner.Query(script, "status")
+	switch code := exitCode(err); {
+	case err == nil:
+		st.ActiveState = "running"
+		st.State = StateRunning
+	case code == 1:
+		st.ActiveState = "dead"
+		st.Result = "pid file exists"
+		st.State = StateFailed
+	case code == 2:
+		st.ActiveState = "dead"
+		st.Result = "lock file exists"
+		st.State = StateFailed
+	case code == 3:
+		st.ActiveState = "stopped"
+		st.State = StateStopped
+	default:
+		st.State = StateUnknown
+		return st, fmt.Errorf("%s status failed: %v\nOutput: %s", script, err, string(output))
+	}
+	return st, nil
+}
+
+func initScriptPath(name string) string {
+	return filepath.Join("/etc/init.d", name)
+}
+
+func runInitScript(ctx context.Context, unit, action string) error {
+	script := initScriptPath(serviceName(unit))
+	if !fileExists(script) {
+		return fmt.Errorf("init script %s not found", script)
+	}
+	output, err := runner.RunContext(ctx, script, action)
+	if err != nil {
+		return fmt.Errorf("%s %s failed: %v\nOutput: %s", script, action, err, string(output))
+	}
+	return nil
+}
+
+func runRunlevelTool(unit string, enable bool) error {
+	name := serviceName(unit)
+	var args []string
+	if _, err := exec.LookPath("update-rc.d"); err == nil {
+		if enable {
+			args = []string{"update-rc.d", name, "defaults"}
+		} else {
+			args = []string{"update-rc.d", name, "disable"}
+		}
+	} else if _, err := exec.LookPath("chkconfig"); err == nil {
+		if enable {
+			args = []string{"chkconfig", name, "on"}
+		} else {
+			args = []string{"chkconfig", name, "off"}
+		}
+	} else {
+		return fmt.Errorf("neither update-rc.d nor chkconfig found to change the runlevels of %s", name)
+	}
+
+	output, err := runner.Run(args[0], args[1:]...)
+	if err != nil {
+		return fmt.Errorf("%s failed: %v\nOutput: %s", args[0], err, string(output))
+	}
+	return nil
+}
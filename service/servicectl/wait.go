@@ -0,0 +1,73 @@
+// service/servicectl/wait.go
+
+package servicectl
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"ss-agent/utils/runner"
+)
+
+// WaitTimeout bounds waits that have no deadline of their own, such as the
+// stop phase of a restart.
+var WaitTimeout = 60 * time.Second
+
+// WaitPollInterval is the time between state checks while waiting.
+var WaitPollInterval = time.Second
+
+// WaitForState polls stateFunc until it reports one of the wanted states or
+// ctx is done, and waits at most WaitTimeout if ctx has no deadline. Errors
+// from stateFunc are retried, as a service that is still coming up may not
+// answer status queries yet. A service that is not installed ends the wait
+// right away, as does one that failed unless failed is a wanted state. The
+// last observed state is returned in either case.
+func WaitForState(ctx context.Context, name string, stateFunc func() (State, error), want ...State) (State, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, WaitTimeout)
+		defer cancel()
+	}
+	if runner.DryRun() {
+		// Nothing was changed, so the state would never be reached
+		deadline, _ := ctx.Deadline()
+		runner.Record("wait up to %s for %s to reach %s", time.Until(deadline).Round(time.Second), name, joinStates(want))
+		return want[0], nil
+	}
+	for {
+		state, err := stateFunc()
+		if err == nil {
+			for _, w := range want {
+				if state == w {
+					return state, nil
+				}
+			}
+			if state == StateNotInstalled {
+				return state, fmt.Errorf("%s is not installed", name)
+			}
+			if state == StateFailed {
+				return state, fmt.Errorf("%s failed while waiting for it to reach %s", name, joinStates(want))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			msg := fmt.Sprintf("timed out waiting for %s to reach %s (last state: %s)", name, joinStates(want), state)
+			if err != nil {
+				msg += fmt.Sprintf(", last error: %v", err)
+			}
+			return state, fmt.Errorf("%s", msg)
+		case <-time.After(WaitPollInterval):
+		}
+	}
+}
+
+func joinStates(states []State) string {
+	names := make([]string, len(states))
+	for i, s := range states {
+		names[i] = s.String()
+	}
+	return strings.Join(names, " or ")
+}
@@ -0,0 +1,45 @@
+package servicectl
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitForState(t *testing.T) {
+	defer func(interval time.Duration) { WaitPollInterval = interval }(WaitPollInterval)
+	WaitPollInterval = 10 * time.Millisecond
+
+	tests := []struct {
+		name   string
+		states []State // reported in turn, the last one from then on
+		want   []State
+		err    string
+	}{
+		{"reached", []State{StateStarting, StateRunning}, []State{StateRunning}, ""},
+		{"failed", []State{StateStarting, StateFailed, StateRunning}, []State{StateRunning}, "failed while waiting"},
+		{"failed is wanted", []State{StateStopping, StateFailed}, []State{StateStopped, StateFailed}, ""},
+		{"not installed", []State{StateNotInstalled}, []State{StateRunning}, "is not installed"},
+		{"timeout", []State{StateStarting}, []State{StateRunning}, "timed out"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			stateFunc := func() (State, error) {
+				state := tt.states[min(calls, len(tt.states)-1)]
+				calls++
+				return state, nil
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			_, err := WaitForState(ctx, "test", stateFunc, tt.want...)
+			if tt.err == "" && err != nil {
+				t.Errorf("WaitForState: %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("WaitForState = %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
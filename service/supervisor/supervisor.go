@@ -0,0 +1,380 @@
+// service/supervisor/supervisor.go
+
+package supervisor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"ss-agent/config"
+	"ss-agent/service"
+	"ss-agent/service/servicectl"
+	"ss-agent/utils/crash"
+	"ss-agent/utils/guard"
+	"ss-agent/utils/logging"
+)
+
+var logger = logging.For("supervisor")
+
+// maxPendingTransitions bounds the transitions kept while heartbeats fail.
+// The oldest are dropped first.
+const maxPendingTransitions = 256
+
+// Transition events
+const (
+	EventState         = "state"          // the observed state changed
+	EventRestart       = "restart"        // the supervisor restarted the service
+	EventRestartFailed = "restart-failed" // the restart command returned an error
+	EventCrashLoop     = "crash-loop"     // too many restarts, supervisor gave up
+)
+
+// Transition records a state change of a supervised service or an action the
+// supervisor took on it. Transitions are reported in the heartbeat.
+type Transition struct {
+	Service string    `json:"service"`
+	Event   string    `json:"event"`
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Message string    `json:"message,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// ServiceStatus is the supervisor's view of a single service.
+type ServiceStatus struct {
+	Name        string     `json:"name"`
+	State       string     `json:"state"`
+	Policy      string     `json:"policy"`
+	Restarts    int        `json:"restarts"`
+	LastRestart *time.Time `json:"last_restart,omitempty"`
+	NextRestart *time.Time `json:"next_restart,omitempty"`
+	CrashLoop   bool       `json:"crash_loop"`
+	LastError   string     `json:"last_error,omitempty"`
+}
+
+type watched struct {
+	name          string
+	policy        config.SupervisePolicy
+	state         servicectl.State
+	restarts      []time.Time // restarts within the crash loop window
+	totalRestarts int
+	lastRestart   time.Time
+	nextRestart   time.Time
+	backoff       time.Duration
+	crashLoop     bool
+	lastError     string
+}
+
+// Supervisor polls managed services and restarts them according to their
+// policy, backing off exponentially and giving up on crash loops.
+type Supervisor struct {
+	mu       sync.Mutex
+	services map[string]*watched
+	order    []string
+
+	pending []Transition
+	sent    int // transitions included in the last collected heartbeat
+
+	slowdown int // poll interval multiplier while the agent sheds load
+
+	stateFunc  func(serviceName string) (servicectl.State, error)
+	actionFunc func(serviceName, action string) error
+}
+
+// New creates a supervisor for the given services using the policies in conf.
+func New(conf config.Config, services []string) *Supervisor {
+	s := &Supervisor{
+		services:   make(map[string]*watched),
+		slowdown:   1,
+		stateFunc:  service.ServiceState,
+		actionFunc: service.ManageService,
+	}
+	for _, name := range services {
+		policy := conf.SupervisePolicyFor(name)
+		s.services[name] = &watched{
+			name:    name,
+			policy:  policy,
+			backoff: time.Duration(policy.InitialBackoff) * time.Second,
+		}
+		s.order = append(s.order, name)
+	}
+	return s
+}
+
+// Run watches every service until ctx is cancelled.
+func (s *Supervisor) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, name := range s.order {
+		wg.Add(1)
+		go func(w *watched) {
+			defer wg.Done()
+			defer crash.Recover("supervisor " + w.name)
+			s.watch(ctx, w)
+		}(s.services[name])
+	}
+	wg.Wait()
+	logger.Info("Supervisor stopped")
+}
+
+func (s *Supervisor) watch(ctx context.Context, w *watched) {
+	s.mu.Lock()
+	policy := w.policy
+	s.mu.Unlock()
+	logger.Info("Supervising", "service", w.name, "restart", policy.Restart, "poll_interval", policy.PollInterval)
+	for {
+		s.check(w)
+
+		timer := time.NewTimer(s.nextCheck(w))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// nextCheck returns the time until the service should be polled again, which is
+// sooner than the poll interval when a restart is due.
+func (s *Supervisor) nextCheck(w *watched) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	wait := time.Duration(w.policy.PollInterval*s.slowdown) * time.Second
+	if until := time.Until(w.nextRestart); until > 0 && until < wait && s.wantsRestart(w) {
+		wait = until
+	}
+	return wait
+}
+
+// check polls the service once and restarts it if the policy calls for it.
+func (s *Supervisor) check(w *watched) {
+	state, err := s.stateFunc(w.name)
+	now := time.Now()
+
+	s.mu.Lock()
+	if err != nil {
+		// An unknown state never triggers a restart
+		w.lastError = err.Error()
+		s.mu.Unlock()
+		return
+	}
+	s.observe(w, state, now)
+	if !s.wantsRestart(w) || now.Before(w.nextRestart) {
+		s.mu.Unlock()
+		return
+	}
+
+	window := time.Duration(w.policy.CrashLoopWindow) * time.Second
+	w.restarts = pruneBefore(w.restarts, now.Add(-window))
+	if len(w.restarts) >= w.policy.MaxRestarts {
+		w.crashLoop = true
+		s.record(w.name, EventCrashLoop, state, state,
+			fmt.Sprintf("%d restarts within %s, giving up", len(w.restarts), window))
+		s.mu.Unlock()
+		return
+	}
+
+	action := "start"
+	if state == servicectl.StateFailed {
+		action = "restart"
+	}
+	w.restarts = append(w.restarts, now)
+	w.totalRestarts++
+	w.lastRestart = now
+	w.nextRestart = now.Add(w.backoff)
+	backoff := w.backoff
+	w.backoff *= 2
+	if max := time.Duration(w.policy.MaxBackoff) * time.Second; w.backoff > max {
+		w.backoff = max
+	}
+	s.mu.Unlock()
+
+	logger.Warn("Service needs recovery", "service", w.name, "state", state.String(), "action", action, "backoff", backoff.String())
+	actionErr := s.actionFunc(w.name, action)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if actionErr != nil {
+		w.lastError = actionErr.Error()
+		s.record(w.name, EventRestartFailed, state, state, fmt.Sprintf("%s failed: %v", action, actionErr))
+		return
+	}
+	w.lastError = ""
+	s.record(w.name, EventRestart, state, state, fmt.Sprintf("%s succeeded", action))
+}
+
+// observe updates the recorded state and resets the backoff once the service
+// has stayed up for a full crash loop window. Must be called with s.mu held.
+func (s *Supervisor) observe(w *watched, state servicectl.State, now time.Time) {
+	if state != w.state {
+		s.record(w.name, EventState, w.state, state, "")
+		w.state = state
+	}
+	if state != servicectl.StateRunning {
+		return
+	}
+	// A service brought back by hand leaves the crash loop
+	w.crashLoop = false
+	window := time.Duration(w.policy.CrashLoopWindow) * time.Second
+	if now.Sub(w.lastRestart) > window {
+		w.backoff = time.Duration(w.policy.InitialBackoff) * time.Second
+		w.nextRestart = time.Time{}
+	}
+}
+
+// wantsRestart reports whether the policy asks for the service to be
+// restarted in its current state. Must be called with s.mu held.
+func (s *Supervisor) wantsRestart(w *watched) bool {
+	if w.crashLoop {
+		return false
+	}
+	switch w.state {
+	case servicectl.StateFailed:
+		return w.policy.Restart == config.RestartAlways || w.policy.Restart == config.RestartOnFailure
+	case servicectl.StateStopped:
+		return w.policy.Restart == config.RestartAlways
+	default:
+		return false
+	}
+}
+
+// record queues a transition for the next heartbeat. Must be called with s.mu held.
+func (s *Supervisor) record(name, event string, from, to servicectl.State, message string) {
+	t := Transition{
+		Service: name,
+		Event:   event,
+		From:    from.String(),
+		To:      to.String(),
+		Message: message,
+		Time:    time.Now().UTC(),
+	}
+	switch event {
+	case EventState:
+		logger.Info("State changed", "service", name, "from", t.From, "to", t.To)
+	case EventRestart:
+		logger.Info(message, "service", name, "event", event)
+	default:
+		logger.Warn(message, "service", name, "event", event)
+	}
+
+	s.pending = append(s.pending, t)
+	if over := len(s.pending) - maxPendingTransitions; over > 0 {
+		s.pending = s.pending[over:]
+		s.sent -= over
+		if s.sent < 0 {
+			s.sent = 0
+		}
+	}
+}
+
+// Shed implements guard.Shedder by polling services less often while the
+// agent is short of resources. Restarts that are due still happen on time.
+func (s *Supervisor) Shed(level guard.Level) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch level {
+	case guard.Critical:
+		s.slowdown = 4
+	case guard.Elevated:
+		s.slowdown = 2
+	default:
+		s.slowdown = 1
+	}
+}
+
+// SetPolicies switches the services to their policies in conf, e.g. after a
+// reload. A new poll interval applies from the next poll. The backoff starts
+// over from the new initial backoff unless the service was restarted within
+// its crash loop window, then it is only capped at the new maximum.
+func (s *Supervisor) SetPolicies(conf config.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range s.order {
+		w := s.services[name]
+		policy := conf.SupervisePolicyFor(name)
+		if policy == w.policy {
+			continue
+		}
+		w.policy = policy
+		w.restarts = pruneBefore(w.restarts, time.Now().Add(-time.Duration(policy.CrashLoopWindow)*time.Second))
+		if len(w.restarts) == 0 {
+			w.backoff = time.Duration(policy.InitialBackoff) * time.Second
+		} else if max := time.Duration(policy.MaxBackoff) * time.Second; w.backoff > max {
+			w.backoff = max
+		}
+		logger.Info("Supervise policy changed", "service", name, "restart", policy.Restart, "poll_interval", policy.PollInterval)
+	}
+}
+
+// Statuses returns the supervisor's view of all services in a stable order.
+func (s *Supervisor) Statuses() []ServiceStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]ServiceStatus, 0, len(s.order))
+	for _, name := range s.order {
+		w := s.services[name]
+		st := ServiceStatus{
+			Name:      w.name,
+			State:     w.state.String(),
+			Policy:    w.policy.Restart,
+			Restarts:  w.totalRestarts,
+			CrashLoop: w.crashLoop,
+			LastError: w.lastError,
+		}
+		if !w.lastRestart.IsZero() {
+			lastRestart := w.lastRestart
+			st.LastRestart = &lastRestart
+		}
+		if s.wantsRestart(w) && !w.nextRestart.IsZero() {
+			nextRestart := w.nextRestart
+			st.NextRestart = &nextRestart
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
+
+// Pending returns the number of transitions waiting to be delivered with the
+// next heartbeat.
+func (s *Supervisor) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.pending)
+}
+
+type heartbeatSection struct {
+	Services    []ServiceStatus `json:"services"`
+	Transitions []Transition    `json:"transitions"`
+}
+
+// HeartbeatSection implements api.HeartbeatSource.
+func (s *Supervisor) HeartbeatSection() interface{} {
+	statuses := s.Statuses()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = len(s.pending)
+	transitions := make([]Transition, len(s.pending))
+	copy(transitions, s.pending)
+	return heartbeatSection{Services: statuses, Transitions: transitions}
+}
+
+// HeartbeatDelivered implements api.HeartbeatSource by dropping the
+// transitions the server has received.
+func (s *Supervisor) HeartbeatDelivered() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = s.pending[s.sent:]
+	s.sent = 0
+}
+
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	kept := times[:0]
+	for _, t := range times {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
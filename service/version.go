@@ -0,0 +1,131 @@
+// service/version.go
+
+package service
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"ss-agent/config"
+	"ss-agent/service/fluentbit"
+	"ss-agent/service/osquery"
+	"ss-agent/service/zeek"
+	"ss-agent/utils/guard"
+	"ss-agent/utils/version"
+)
+
+// versionRefreshInterval is how often the heartbeat re-detects installed
+// versions. Detection runs the binaries, so it is not done on every heartbeat.
+const versionRefreshInterval = 15 * time.Minute
+
+// VersionStatus is the installed version of a managed service, checked
+// against the minimum version from the configuration.
+type VersionStatus struct {
+	Service      string `json:"service"`
+	Binary       string `json:"binary,omitempty"`
+	Version      string `json:"version,omitempty"`
+	Source       string `json:"source,omitempty"`
+	MinVersion   string `json:"min_version,omitempty"`
+	BelowMinimum bool   `json:"below_minimum"`
+	Error        string `json:"error,omitempty"`
+}
+
+// String returns the version for status output, e.g.
+// "version 5.9.1 (below minimum 5.10.0)".
+func (v VersionStatus) String() string {
+	if v.Version == "" {
+		return ""
+	}
+	s := "version " + v.Version
+	if v.BelowMinimum {
+		s += fmt.Sprintf(" (below minimum %s)", v.MinVersion)
+	}
+	return s
+}
+
+// ServiceVersion detects the installed version of a managed service.
+func ServiceVersion(serviceName string) (version.Info, error) {
+	switch strings.ToLower(serviceName) {
+	case "zeek":
+		return zeek.ZeekVersion()
+	case "fluent-bit":
+		return fluentbit.FluentBitVersion()
+	case "osqueryd":
+		return osquery.OsqueryVersion()
+	default:
+		return version.Info{}, fmt.Errorf("unknown service: %s", serviceName)
+	}
+}
+
+// CheckVersion detects the installed version of a service and compares it
+// with the configured min_version.
+func CheckVersion(serviceName string) VersionStatus {
+	vs := VersionStatus{
+		Service:    serviceName,
+		MinVersion: config.GetConfig().Services[serviceName].MinVersion,
+	}
+	info, err := ServiceVersion(serviceName)
+	vs.Binary, vs.Version, vs.Source = info.Binary, info.Version, info.Source
+	if err != nil {
+		vs.Error = err.Error()
+		return vs
+	}
+	if vs.MinVersion != "" {
+		cmp, err := version.Compare(vs.Version, vs.MinVersion)
+		if err != nil {
+			vs.Error = fmt.Sprintf("cannot compare with min_version: %v", err)
+		} else {
+			vs.BelowMinimum = cmp < 0
+		}
+	}
+	return vs
+}
+
+// VersionReporter reports the installed versions of all managed services in
+// the heartbeat.
+type VersionReporter struct {
+	mu       sync.Mutex
+	checked  time.Time
+	versions []VersionStatus
+	paused   bool // while the agent sheds load
+}
+
+// NewVersionReporter creates a heartbeat source for installed versions.
+func NewVersionReporter() *VersionReporter {
+	return &VersionReporter{}
+}
+
+// Versions returns the installed versions, detecting them again when the
+// cached result is older than versionRefreshInterval. While detection is
+// paused the cached result is returned, nil if there is none yet.
+func (r *VersionReporter) Versions() []VersionStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.paused && (r.versions == nil || time.Since(r.checked) > versionRefreshInterval) {
+		versions := make([]VersionStatus, 0, len(AllServices))
+		for _, svc := range AllServices {
+			versions = append(versions, CheckVersion(svc))
+		}
+		r.versions = versions
+		r.checked = time.Now()
+	}
+	return r.versions
+}
+
+// Shed implements guard.Shedder by pausing version detection, which runs the
+// service binaries, under any pressure.
+func (r *VersionReporter) Shed(level guard.Level) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paused = level > guard.Normal
+}
+
+// HeartbeatSection implements api.HeartbeatSource.
+func (r *VersionReporter) HeartbeatSection() interface{} {
+	return r.Versions()
+}
+
+// HeartbeatDelivered implements api.HeartbeatSource.
+func (r *VersionReporter) HeartbeatDelivered() {}
@@ -0,0 +1,61 @@
+// service/wait.go
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"ss-agent/service/servicectl"
+)
+
+// ExpectedStates returns the states a service should settle in after the
+// given action. A service that failed while stopping is not running either,
+// so it counts as stopped.
+func ExpectedStates(action string) []servicectl.State {
+	switch action {
+	case "stop":
+		return []servicectl.State{servicectl.StateStopped, servicectl.StateFailed}
+	case "start", "restart":
+		return []servicectl.State{servicectl.StateRunning}
+	default:
+		return nil
+	}
+}
+
+// WaitForState polls a managed service until it reaches one of the wanted
+// states or the timeout expires.
+func WaitForState(serviceName string, timeout time.Duration, want ...servicectl.State) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return waitForState(ctx, serviceName, want...)
+}
+
+func waitForState(ctx context.Context, serviceName string, want ...servicectl.State) error {
+	_, err := servicectl.WaitForState(ctx, serviceName, func() (servicectl.State, error) {
+		return ServiceState(serviceName)
+	}, want...)
+	return err
+}
+
+// ManageServiceAndWait runs the action and then confirms the service reached
+// the state the action implies. The timeout covers both: an action still
+// running when it expires is given up on.
+func ManageServiceAndWait(serviceName, action string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := ManageServiceContext(ctx, serviceName, action); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s of %s did not finish within %s: %v", action, serviceName, timeout, err)
+		}
+		return err
+	}
+
+	want := ExpectedStates(action)
+	if len(want) == 0 {
+		return nil
+	}
+	logger.Info("Waiting for state", "service", serviceName, "state", want[0].String())
+	return waitForState(ctx, serviceName, want...)
+}
@@ -1,123 +1,210 @@
 package zeek
 
 import (
+	"context"
 	"fmt"
-	"os/exec"
 	"runtime"
+	"ss-agent/config"
+	"ss-agent/service/servicectl"
+	"ss-agent/utils/logging"
+	"ss-agent/utils/runner"
+	"ss-agent/utils/version"
 	"ss-agent/utils/zeek"
 	"strings"
 )
 
+var logger = logging.For("zeek")
+
+// Slice is the systemd slice zeekctl starts Zeek in, which carries Zeek's
+// resource limits when there is no zeek.service unit
+const Slice = "ss-agent-zeek.slice"
+
 // ZeekStatus checks the status of Zeek using `zeekctl status`
 func ZeekStatus() (string, error) {
-	fmt.Println("Checking Zeek status...")
+	logger.Debug("Checking Zeek status")
+
+	state, err := ZeekState()
+	return state.Label(), err
+}
 
+// ZeekState returns the normalized state of Zeek
+func ZeekState() (servicectl.State, error) {
 	switch runtime.GOOS {
 	case "windows":
-		cmd := exec.Command("sc", "query", "ss-network-analyzer")
-		output, err := cmd.CombinedOutput()
+		output, err := runner.Query("sc", "query", "ss-network-analyzer")
 		if err != nil {
-			return "[FAILED]", fmt.Errorf("sc query failed: %v\nOutput: %s", err, string(output))
+			return servicectl.StateFailed, fmt.Errorf("sc query failed: %v\nOutput: %s", err, string(output))
 		}
 
 		if strings.Contains(string(output), "RUNNING") {
-			return "[RUNNING]", nil
+			return servicectl.StateRunning, nil
 		}
-		return "[STOPPED]", nil
+		return servicectl.StateStopped, nil
 
 	case "darwin", "linux":
 		zeekctlPath, err := zeek.FindZeekctl()
 		if err != nil {
-			return "[NOT INSTALLED]", fmt.Errorf("failed to locate zeekctl: %v", err)
+			return servicectl.StateNotInstalled, nil
 		}
 
-		cmd := exec.Command(zeekctlPath, "status")
-		output, err := cmd.CombinedOutput()
+		output, err := runner.Query(zeekctlPath, "status")
+
+		// zeekctl reports a node that died unexpectedly as "crashed"
+		if strings.Contains(string(output), "crashed") {
+			return servicectl.StateFailed, nil
+		}
 
 		if err != nil {
 			// Handle the "stopped" case even if there is an error
 			if strings.Contains(string(output), "stopped") {
-				return "[STOPPED]", nil
+				return servicectl.StateStopped, nil
 			}
-			return "[FAILED]", fmt.Errorf("zeekctl status failed: %v\nOutput: %s", err, string(output))
+			return servicectl.StateFailed, fmt.Errorf("zeekctl status failed: %v\nOutput: %s", err, string(output))
 		}
 
 		if strings.Contains(string(output), "running") {
-			return "[RUNNING]", nil
+			return servicectl.StateRunning, nil
 		} else if strings.Contains(string(output), "stopped") {
-			return "[STOPPED]", nil
+			return servicectl.StateStopped, nil
 		}
 	default:
-		return "[UNKNOWN]", fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+		return servicectl.StateUnknown, fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
 	}
 
-	return "[UNKNOWN]", nil
+	return servicectl.StateUnknown, nil
+}
+
+// zeekBinaryPaths are the known install locations of the zeek binary
+var zeekBinaryPaths = []string{
+	"/opt/zeek/bin/zeek",
+	"/usr/local/zeek/bin/zeek",
+	"/usr/bin/zeek",
+	"/usr/local/bin/zeek",
+	"/usr/local/opt/zeek/bin/zeek",
 }
 
-// ZeekStart starts Zeek using `zeekctl deploy`
-func ZeekStart() error {
+// ZeekVersion detects the installed Zeek version using `zeek --version`,
+// falling back to package metadata
+func ZeekVersion() (version.Info, error) {
+	binary, _ := version.FindBinary("zeek", zeekBinaryPaths...)
+	return version.Detect(binary, []string{"--version"}, "zeek", "zeek-lts")
+}
+
+// LimitsUnit returns the systemd unit Zeek's resource limits are applied to:
+// zeek.service if one is installed, otherwise the slice zeekctl runs it in.
+func LimitsUnit() string {
+	if hasUnit() {
+		return servicectl.UnitName("zeek")
+	}
+	return Slice
+}
+
+// hasUnit reports whether a zeek.service unit is installed. Zeek is then
+// started and stopped through it rather than by zeekctl directly.
+func hasUnit() bool {
+	if _, ok := servicectl.Configurator(); !ok {
+		return false
+	}
+	status, err := servicectl.Default().Status("zeek")
+	return err == nil && status.LoadState == "loaded"
+}
+
+// inSlice returns the command running zeekctl in Zeek's slice on systemd
+// hosts, so the nodes it starts are held to the slice's limits. A slice has
+// no nice level, so the configured one is given to zeekctl instead.
+func inSlice(zeekctlPath string, args ...string) (string, []string) {
+	if _, ok := servicectl.Configurator(); !ok {
+		return zeekctlPath, args
+	}
+	cmd := []string{"--scope", "--quiet", "--collect", "--slice=" + Slice}
+	if nice := config.GetConfig().Services["zeek"].Resources.Nice; nice != nil {
+		cmd = append(cmd, fmt.Sprintf("--nice=%d", *nice))
+	}
+	return "systemd-run", append(append(cmd, zeekctlPath), args...)
+}
+
+// ZeekStart starts Zeek using `zeekctl deploy`, or zeek.service if installed
+func ZeekStart(ctx context.Context) error {
 	switch runtime.GOOS {
 	case "windows":
-		cmd := exec.Command("sc", "start", "ss-network-analyzer")
-		output, err := cmd.CombinedOutput()
+		output, err := runner.RunContext(ctx, "sc", "start", "ss-network-analyzer")
 		if err != nil {
 			return fmt.Errorf("sc start failed: %v\nOutput: %s", err, string(output))
 		}
-		fmt.Println("Zeek started successfully.")
+		runner.LogUnlessDryRun(logger, "Zeek started")
 		return nil
 
 	case "darwin", "linux":
+		if hasUnit() {
+			if err := servicectl.Default().Start(ctx, "zeek"); err != nil {
+				return err
+			}
+			runner.LogUnlessDryRun(logger, "Zeek started")
+			return nil
+		}
+
 		zeekctlPath, err := zeek.FindZeekctl()
 		if err != nil {
 			return fmt.Errorf("failed to locate zeekctl: %v", err)
 		}
 
-		cmd := exec.Command(zeekctlPath, "deploy")
-		output, err := cmd.CombinedOutput()
+		name, args := inSlice(zeekctlPath, "deploy")
+		output, err := runner.RunContext(ctx, name, args...)
 		if err != nil {
 			return fmt.Errorf("zeekctl deploy failed: %v\nOutput: %s", err, string(output))
 		}
-		fmt.Println("Zeek started successfully.")
+		runner.LogUnlessDryRun(logger, "Zeek started")
 		return nil
 	default:
 		return fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
 	}
 }
 
-// ZeekStop stops Zeek using `zeekctl stop`
-func ZeekStop() error {
+// ZeekStop stops Zeek using `zeekctl stop`, or zeek.service if installed
+func ZeekStop(ctx context.Context) error {
 	switch runtime.GOOS {
 	case "windows":
-		cmd := exec.Command("sc", "stop", "ss-network-analyzer")
-		output, err := cmd.CombinedOutput()
+		output, err := runner.RunContext(ctx, "sc", "stop", "ss-network-analyzer")
 		if err != nil {
 			return fmt.Errorf("sc stop failed: %v\nOutput: %s", err, string(output))
 		}
-		fmt.Println("Zeek stopped successfully.")
+		runner.LogUnlessDryRun(logger, "Zeek stopped")
 		return nil
 
 	case "darwin", "linux":
+		if hasUnit() {
+			if err := servicectl.Default().Stop(ctx, "zeek"); err != nil {
+				return err
+			}
+			runner.LogUnlessDryRun(logger, "Zeek stopped")
+			return nil
+		}
+
 		zeekctlPath, err := zeek.FindZeekctl()
 		if err != nil {
 			return fmt.Errorf("failed to locate zeekctl: %v", err)
 		}
 
-		cmd := exec.Command(zeekctlPath, "stop")
-		output, err := cmd.CombinedOutput()
+		output, err := runner.RunContext(ctx, zeekctlPath, "stop")
 		if err != nil {
 			return fmt.Errorf("zeekctl stop failed: %v\nOutput: %s", err, string(output))
 		}
-		fmt.Println("Zeek stopped successfully.")
+		runner.LogUnlessDryRun(logger, "Zeek stopped")
 		return nil
 	default:
 		return fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
 	}
 }
 
-func ZeekRestart() error {
-	err := ZeekStop()
+// ZeekRestart stops Zeek, waits for it to stop and starts it again
+func ZeekRestart(ctx context.Context) error {
+	err := ZeekStop(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = servicectl.WaitForState(ctx, "Zeek", ZeekState, servicectl.StateStopped, servicectl.StateFailed)
 	if err != nil {
 		return err
 	}
-	return ZeekStart()
+	return ZeekStart(ctx)
 }
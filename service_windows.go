@@ -9,6 +9,8 @@ import (
 	"context"
 	"log"
 	"ss-agent/cmd"
+	"ss-agent/config"
+	"time"
 
 	"golang.org/x/sys/windows/svc"
 )
@@ -24,12 +26,23 @@ func (m *myService) Execute(args []string, req <-chan svc.ChangeRequest, statusC
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Run the agent's main functionality in a goroutine
+	// Run the agent's main functionality in a goroutine. It returns once the
+	// agent has drained, sent its offline heartbeat and removed the PID file.
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		cmd.Execute(version, ctx, cancel)
 	}()
 
+	// The service control manager gives up on a service that stays in
+	// StopPending longer than the wait hint without an update
+	stopPending := func() svc.Status {
+		timeout := time.Duration(config.GetConfig().ShutdownTimeout)*time.Second + 15*time.Second
+		return svc.Status{State: svc.StopPending, WaitHint: uint32(timeout / time.Millisecond)}
+	}
+
 	// Handle service lifecycle events
+	stopping := ctx.Done()
 	for {
 		select {
 		case c := <-req:
@@ -37,14 +50,17 @@ func (m *myService) Execute(args []string, req <-chan svc.ChangeRequest, statusC
 			case svc.Interrogate:
 				statusChan <- c.CurrentStatus
 			case svc.Stop, svc.Shutdown:
-				statusChan <- svc.Status{State: svc.StopPending}
+				statusChan <- stopPending()
+				stopping = nil
 				cancel()
-				return false, 0
 			default:
 				log.Printf("Unexpected control request: %v", c.Cmd)
 			}
-		case <-ctx.Done():
-			// Service is stopping
+		case <-stopping:
+			// The agent is stopping on its own, e.g. 'ss-agent stop'
+			statusChan <- stopPending()
+			stopping = nil
+		case <-done:
 			statusChan <- svc.Status{State: svc.Stopped}
 			return false, 0
 		}
@@ -0,0 +1,244 @@
+// updater/updater.go
+
+package updater
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"ss-agent/api"
+	"ss-agent/utils/logging"
+)
+
+var logger = logging.For("updater")
+
+// PublicKey is the base64 ed25519 key release signatures are verified
+// against. It is pinned at build time:
+//
+//	go build -ldflags "-X ss-agent/updater.PublicKey=<base64 key>"
+//
+// Without it the agent refuses to update itself.
+var PublicKey string
+
+// ErrNoPublicKey is returned when the binary was built without a signing key
+var ErrNoPublicKey = errors.New("no update signing key was built into this agent")
+
+// maxBinarySize bounds the download
+const maxBinarySize = 256 << 20
+
+// SignedMessage is what the release signature covers. Binding the version and
+// platform keeps a validly signed binary from being offered as another
+// version, e.g. to downgrade the agent.
+func SignedMessage(rel api.Release) []byte {
+	return []byte(fmt.Sprintf("ss-agent %s %s/%s %s", rel.Version, runtime.GOOS, runtime.GOARCH, strings.ToLower(rel.SHA256)))
+}
+
+// Verify checks the release signature against PublicKey
+func Verify(rel api.Release) error {
+	if PublicKey == "" {
+		return ErrNoPublicKey
+	}
+	key, err := base64.StdEncoding.DecodeString(PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid update signing key built into this agent")
+	}
+	sig, err := base64.StdEncoding.DecodeString(rel.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %v", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), SignedMessage(rel), sig) {
+		return fmt.Errorf("signature of version %s does not verify", rel.Version)
+	}
+	return nil
+}
+
+// Download fetches the release binary next to exe and checks it against the
+// signed SHA-256. It returns the path of the downloaded file, which Install
+// moves into place.
+func Download(ctx context.Context, client *http.Client, rel api.Release, exe string) (string, error) {
+	path := exe + ".new"
+	req, err := http.NewRequestWithContext(ctx, "GET", rel.URL, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("download failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("download failed: server returned %s", resp.Status)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(resp.Body, maxBinarySize+1))
+	if err == nil && n > maxBinarySize {
+		err = fmt.Errorf("binary is larger than %d bytes", maxBinarySize)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		if sum := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(sum, rel.SHA256) {
+			err = fmt.Errorf("SHA-256 of the download is %s, expected %s", sum, rel.SHA256)
+		}
+	}
+	if err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	logger.Debug("Downloaded update", "version", rel.Version, "path", path, "bytes", n)
+	return path, nil
+}
+
+// Install replaces exe with the downloaded binary and keeps the current one
+// as exe.prev for Rollback. The running process keeps its binary open, so
+// this is safe while the agent runs.
+func Install(exe, downloaded string) error {
+	prev := exe + ".prev"
+	os.Remove(prev)
+
+	if runtime.GOOS == "windows" {
+		// A running executable cannot be replaced or linked, only renamed
+		if err := os.Rename(exe, prev); err != nil {
+			return fmt.Errorf("failed to keep the current binary: %v", err)
+		}
+		if err := os.Rename(downloaded, exe); err != nil {
+			os.Rename(prev, exe)
+			return fmt.Errorf("failed to install the new binary: %v", err)
+		}
+		return nil
+	}
+
+	if err := os.Link(exe, prev); err != nil {
+		if err := copyFile(exe, prev); err != nil {
+			return fmt.Errorf("failed to keep the current binary: %v", err)
+		}
+	}
+	// rename(2) replaces exe atomically, there is no moment without a binary
+	if err := os.Rename(downloaded, exe); err != nil {
+		return fmt.Errorf("failed to install the new binary: %v", err)
+	}
+	return nil
+}
+
+// Rollback puts back the binary Install replaced
+func Rollback(exe string) error {
+	prev := exe + ".prev"
+	if _, err := os.Stat(prev); err != nil {
+		return fmt.Errorf("no previous binary to roll back to: %v", err)
+	}
+	if runtime.GOOS == "windows" {
+		failed := exe + ".failed"
+		os.Remove(failed)
+		if err := os.Rename(exe, failed); err != nil {
+			return err
+		}
+		if err := os.Rename(prev, exe); err != nil {
+			os.Rename(failed, exe)
+			return err
+		}
+		return nil
+	}
+	return os.Rename(prev, exe)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// State tracks an installed update until it has proven itself. It is kept
+// next to the binary, so it survives the restart into the new version.
+type State struct {
+	Version     string    `json:"version,omitempty"` // installed and waiting for a heartbeat, empty when none
+	Previous    string    `json:"previous,omitempty"`
+	InstalledAt time.Time `json:"installed_at,omitempty"`
+	Starts      int       `json:"starts"`           // of the new version so far
+	Failed      string    `json:"failed,omitempty"` // rolled back, not installed again
+}
+
+// Pending reports whether an installed update waits for confirmation
+func (s State) Pending() bool {
+	return s.Version != ""
+}
+
+func statePath(exe string) string {
+	return exe + ".update.json"
+}
+
+// LoadState reads the update state kept next to exe. A missing file is an
+// empty state.
+func LoadState(exe string) (State, error) {
+	var st State
+	data, err := os.ReadFile(statePath(exe))
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	err = json.Unmarshal(data, &st)
+	return st, err
+}
+
+// SaveState writes the update state, replacing the file atomically
+func SaveState(exe string, st State) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".ss-agent-update-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0600)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), statePath(exe))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package updater
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ss-agent/api"
+)
+
+// useKey builds a fresh signing key into the agent and returns its private
+// half
+func useKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(key string) { t.Cleanup(func() { PublicKey = key }) }(PublicKey)
+	PublicKey = base64.StdEncoding.EncodeToString(public)
+	return private
+}
+
+func sign(key ed25519.PrivateKey, rel api.Release) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, SignedMessage(rel)))
+}
+
+func TestVerify(t *testing.T) {
+	key := useKey(t)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	rel := api.Release{Version: "1.2.0", SHA256: strings.Repeat("ab", 32)}
+	valid := sign(key, rel)
+	sig, _ := base64.StdEncoding.DecodeString(valid)
+	flipped := append([]byte(nil), sig...)
+	flipped[10] ^= 1
+	older := rel
+	older.Version = "1.1.0"
+
+	tests := []struct {
+		name      string
+		rel       api.Release
+		signature string
+		err       string // part of the expected error, empty for none
+	}{
+		{"valid", rel, valid, ""},
+		{"bad signature", rel, base64.StdEncoding.EncodeToString(flipped), "does not verify"},
+		{"wrong key", rel, sign(otherKey, rel), "does not verify"},
+		{"truncated signature", rel, base64.StdEncoding.EncodeToString(sig[:len(sig)-8]), "does not verify"},
+		{"not base64", rel, "not a signature!", "invalid signature encoding"},
+		{"other version", older, valid, "does not verify"},
+		{"upper case hash", api.Release{Version: rel.Version, SHA256: strings.ToUpper(rel.SHA256)}, valid, ""},
+	}
+	for _, tt := range tests {
+		tt.rel.Signature = tt.signature
+		err := Verify(tt.rel)
+		if tt.err == "" && err != nil {
+			t.Errorf("%s: Verify: %v", tt.name, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: Verify = %v, want an error containing %q", tt.name, err, tt.err)
+		}
+	}
+
+	PublicKey = ""
+	if err := Verify(rel); err != ErrNoPublicKey {
+		t.Errorf("Verify without a key = %v, want ErrNoPublicKey", err)
+	}
+	PublicKey = "c2hvcnQ="
+	if err := Verify(rel); err == nil {
+		t.Error("Verify with a malformed key succeeded")
+	}
+}
+
+func TestDownload(t *testing.T) {
+	binary := []byte("#!/bin/sh\necho new agent\n")
+	sum := sha256.Sum256(binary)
+	rel := api.Release{Version: "1.2.0", SHA256: hex.EncodeToString(sum[:])}
+	served := binary
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(served)
+	}))
+	defer ts.Close()
+	rel.URL = ts.URL + "/ss-agent"
+	exe := filepath.Join(t.TempDir(), "ss-agent")
+
+	path, err := Download(context.Background(), ts.Client(), rel, exe)
+	if err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != string(binary) {
+		t.Errorf("downloaded %q, want %q", got, binary)
+	}
+
+	// A download cut short does not match the signed hash
+	served = binary[:len(binary)-5]
+	if _, err := Download(context.Background(), ts.Client(), rel, exe); err == nil || !strings.Contains(err.Error(), "SHA-256") {
+		t.Errorf("Download of a truncated binary = %v, want a hash mismatch", err)
+	}
+	if _, err := os.Stat(exe + ".new"); !os.IsNotExist(err) {
+		t.Errorf("truncated download was left behind: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+// updater/window.go
+
+package updater
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Window is a recurring time range in local time during which updates may be
+// applied, e.g. "Sat 02:00-04:00", "Mon-Fri 22:00-02:00" or "03:00-05:00"
+// for every day. A range ending before it starts runs past midnight and
+// belongs to the day it starts on.
+type Window struct {
+	days       [7]bool
+	start, end int // minutes since midnight
+}
+
+// ParseWindow parses a maintenance window
+func ParseWindow(spec string) (Window, error) {
+	var w Window
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 1:
+		for i := range w.days {
+			w.days[i] = true
+		}
+	case 2:
+		if err := w.parseDays(fields[0]); err != nil {
+			return w, fmt.Errorf("invalid maintenance window %q: %v", spec, err)
+		}
+		fields = fields[1:]
+	default:
+		return w, fmt.Errorf("invalid maintenance window %q: expected [days] HH:MM-HH:MM", spec)
+	}
+
+	from, to, ok := strings.Cut(fields[0], "-")
+	if !ok {
+		return w, fmt.Errorf("invalid maintenance window %q: expected HH:MM-HH:MM", spec)
+	}
+	var err error
+	if w.start, err = parseClock(from); err == nil {
+		w.end, err = parseClock(to)
+	}
+	if err != nil {
+		return w, fmt.Errorf("invalid maintenance window %q: %v", spec, err)
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("invalid maintenance window %q: empty time range", spec)
+	}
+	return w, nil
+}
+
+// parseDays parses "Sat", "Sat,Sun" or "Mon-Fri"
+func (w *Window) parseDays(spec string) error {
+	for _, part := range strings.Split(strings.ToLower(spec), ",") {
+		from, to, isRange := strings.Cut(part, "-")
+		first, ok := weekdays[from]
+		if !ok {
+			return fmt.Errorf("unknown day %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = weekdays[to]; !ok {
+				return fmt.Errorf("unknown day %q", to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			w.days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains reports whether t falls in the window
+func (w Window) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.days[t.Weekday()] && minute >= w.start && minute < w.end
+	}
+	// Past midnight: the evening of a listed day or the morning after it
+	yesterday := (t.Weekday() + 6) % 7
+	return (w.days[t.Weekday()] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+// InWindow reports whether t falls in any of the maintenance windows. No
+// windows means any time.
+func InWindow(specs []string, t time.Time) (bool, error) {
+	if len(specs) == 0 {
+		return true, nil
+	}
+	for _, spec := range specs {
+		w, err := ParseWindow(spec)
+		if err != nil {
+			return false, err
+		}
+		if w.Contains(t) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,93 @@
+package updater
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowContains(t *testing.T) {
+	// 2024-05-06 is a Monday
+	day := func(weekday time.Weekday, clock string) time.Time {
+		t.Helper()
+		c, err := time.Parse("15:04", clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offset := (int(weekday) + 6) % 7
+		return time.Date(2024, 5, 6+offset, c.Hour(), c.Minute(), 0, 0, time.Local)
+	}
+	tests := []struct {
+		spec    string
+		weekday time.Weekday
+		clock   string
+		want    bool
+	}{
+		{"Sat 02:00-04:00", time.Saturday, "02:00", true},
+		{"Sat 02:00-04:00", time.Saturday, "03:59", true},
+		{"Sat 02:00-04:00", time.Saturday, "04:00", false},
+		{"Sat 02:00-04:00", time.Sunday, "03:00", false},
+
+		// Past midnight the window belongs to the day it starts on
+		{"Mon-Fri 22:00-02:00", time.Monday, "22:00", true},
+		{"Mon-Fri 22:00-02:00", time.Tuesday, "01:59", true},
+		{"Mon-Fri 22:00-02:00", time.Tuesday, "02:00", false},
+		{"Mon-Fri 22:00-02:00", time.Saturday, "01:00", true},
+		{"Mon-Fri 22:00-02:00", time.Saturday, "22:30", false},
+		{"Mon-Fri 22:00-02:00", time.Monday, "01:00", false},
+		{"Mon-Fri 22:00-02:00", time.Wednesday, "12:00", false},
+
+		// Day ranges and lists
+		{"Fri-Mon 03:00-05:00", time.Sunday, "04:00", true},
+		{"Fri-Mon 03:00-05:00", time.Monday, "04:00", true},
+		{"Fri-Mon 03:00-05:00", time.Wednesday, "04:00", false},
+		{"sat,SUN 00:00-06:00", time.Sunday, "05:00", true},
+		{"sat,SUN 00:00-06:00", time.Friday, "05:00", false},
+
+		// Without days, every day
+		{"03:00-05:00", time.Wednesday, "03:00", true},
+		{"03:00-05:00", time.Wednesday, "05:00", false},
+		{"23:00-01:00", time.Sunday, "00:30", true},
+	}
+	for _, tt := range tests {
+		w, err := ParseWindow(tt.spec)
+		if err != nil {
+			t.Errorf("ParseWindow(%q): %v", tt.spec, err)
+			continue
+		}
+		at := day(tt.weekday, tt.clock)
+		if got := w.Contains(at); got != tt.want {
+			t.Errorf("%q contains %s %s = %v, want %v", tt.spec, tt.weekday, tt.clock, got, tt.want)
+		}
+	}
+}
+
+func TestParseWindowInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"Mon",
+		"Mon-Fri 22:00",
+		"Mon Tue 02:00-03:00",
+		"Funday 02:00-03:00",
+		"Mon-Someday 02:00-03:00",
+		"25:00-02:00",
+		"02:00-02:60",
+		"02:00-02:00",
+	} {
+		if _, err := ParseWindow(spec); err == nil {
+			t.Errorf("ParseWindow(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestInWindow(t *testing.T) {
+	monday := time.Date(2024, 5, 6, 3, 0, 0, 0, time.Local)
+	if ok, err := InWindow(nil, monday); err != nil || !ok {
+		t.Errorf("InWindow without windows = %v, %v, want any time", ok, err)
+	}
+	if ok, err := InWindow([]string{"Sat 02:00-04:00", "Mon 02:30-03:30"}, monday); err != nil || !ok {
+		t.Errorf("InWindow = %v, %v, want in the second window", ok, err)
+	}
+	if _, err := InWindow([]string{"Mon 02:30-03:30", "bogus"}, monday.Add(time.Hour)); err == nil {
+		t.Error("InWindow with an invalid window succeeded")
+	}
+}
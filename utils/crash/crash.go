@@ -0,0 +1,184 @@
+package crash
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ss-agent/utils/logging"
+)
+
+// Report is what is known about a panic of the agent
+type Report struct {
+	Time      time.Time       `json:"time"`
+	Version   string          `json:"version"`
+	PID       int             `json:"pid"`
+	OS        string          `json:"os"`
+	Goroutine string          `json:"goroutine"` // where the panic was caught
+	Panic     string          `json:"panic"`
+	Stack     string          `json:"stack"`
+	Logs      []logging.Entry `json:"logs"` // the last lines logged before the panic
+}
+
+const (
+	reportPrefix = "crash-"
+	historyFile  = "history.json"
+	// logLines is how many recent log lines go into a report
+	logLines = 200
+	// maxHistory bounds the crash times kept for crash loop detection
+	maxHistory = 50
+)
+
+var (
+	mu      sync.Mutex
+	dir     string
+	version string
+)
+
+// Setup sets where Recover writes crash reports and the version it records
+func Setup(crashDir, agentVersion string) {
+	mu.Lock()
+	defer mu.Unlock()
+	dir = crashDir
+	version = agentVersion
+}
+
+// Recover writes a crash report when the goroutine is panicking and then
+// panics again, so the agent still dies with the usual trace. It must be
+// deferred directly:
+//
+//	defer crash.Recover("supervisor")
+func Recover(goroutine string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	report := Report{
+		Time:      time.Now().UTC(),
+		PID:       os.Getpid(),
+		OS:        runtime.GOOS + "/" + runtime.GOARCH,
+		Goroutine: goroutine,
+		Panic:     fmt.Sprint(r),
+		Stack:     string(debug.Stack()),
+		Logs:      logging.Recent(logLines),
+	}
+	if path, err := write(report); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write crash report: %v\n", err)
+	} else {
+		fmt.Fprintf(os.Stderr, "Crash report written to %s\n", path)
+	}
+	panic(r)
+}
+
+// write stores the report and records the crash in the history
+func write(report Report) (string, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	if dir == "" {
+		return "", fmt.Errorf("no crash directory set up")
+	}
+	report.Version = version
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%s%s-%d.json", reportPrefix, report.Time.Format("20060102T150405.000Z"), report.PID)
+	path := filepath.Join(dir, name)
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := writeFile(path, data); err != nil {
+		return "", err
+	}
+
+	history := append(loadHistory(dir), report.Time)
+	if len(history) > maxHistory {
+		history = history[len(history)-maxHistory:]
+	}
+	if data, err := json.Marshal(history); err == nil {
+		writeFile(filepath.Join(dir, historyFile), data)
+	}
+	return path, nil
+}
+
+// writeFile writes through a temporary file, so a reader never sees half a
+// report
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func loadHistory(dir string) []time.Time {
+	var history []time.Time
+	if data, err := os.ReadFile(filepath.Join(dir, historyFile)); err == nil {
+		json.Unmarshal(data, &history)
+	}
+	return history
+}
+
+// Pending returns the paths of the crash reports in dir that were not sent
+// yet, oldest first
+func Pending(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), reportPrefix) && strings.HasSuffix(e.Name(), ".json") {
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	// The names start with the time
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Prune removes the oldest pending reports beyond keep, so an agent that
+// crashes while the server is unreachable does not fill the disk
+func Prune(dir string, keep int) error {
+	paths, err := Pending(dir)
+	if err != nil {
+		return err
+	}
+	for len(paths) > keep {
+		if err := os.Remove(paths[0]); err != nil {
+			return err
+		}
+		paths = paths[1:]
+	}
+	return nil
+}
+
+// Recent returns how many crashes happened within window and when the last
+// one was. Crashes are remembered after their reports were sent.
+func Recent(dir string, window time.Duration) (count int, last time.Time) {
+	since := time.Now().Add(-window)
+	for _, t := range loadHistory(dir) {
+		if t.After(since) {
+			count++
+		}
+		if t.After(last) {
+			last = t
+		}
+	}
+	return count, last
+}
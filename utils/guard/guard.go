@@ -0,0 +1,394 @@
+package guard
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	rtmetrics "runtime/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ss-agent/utils/logging"
+	"ss-agent/utils/metrics"
+)
+
+var logger = logging.For("guard")
+
+var (
+	shedTotal = metrics.NewCounter("ss_agent_load_shedding_total",
+		"Times the agent started shedding load, by pressure level.", "level")
+	diskFreedTotal = metrics.NewCounter("ss_agent_disk_freed_bytes_total",
+		"Bytes of old logs and crash reports deleted to stay under the disk limit.")
+)
+
+// Level is how close the agent is to its own resource limits
+type Level int
+
+const (
+	Normal   Level = iota
+	Elevated       // 80% of a limit, low-priority work is paused
+	Critical       // 95% of a limit, only essential work goes on
+)
+
+func (l Level) String() string {
+	switch l {
+	case Elevated:
+		return "elevated"
+	case Critical:
+		return "critical"
+	default:
+		return "normal"
+	}
+}
+
+// Thresholds as a fraction of a limit
+const (
+	elevatedAt = 0.80
+	criticalAt = 0.95
+)
+
+// calmChecks is how many checks in a row must find less pressure before the
+// level goes down, so the agent does not flap around a threshold
+const calmChecks = 2
+
+// Shedder is a part of the agent that does less while the agent is short of
+// resources. Shed is called whenever the level changes, with Normal once the
+// pressure is gone. It must not block.
+type Shedder interface {
+	Shed(level Level)
+}
+
+// ShedderFunc adapts a function to a Shedder
+type ShedderFunc func(level Level)
+
+// Shed calls f
+func (f ShedderFunc) Shed(level Level) {
+	f(level)
+}
+
+// Limits are the caps the guard enforces. Zero values are no limit.
+type Limits struct {
+	Memory        int64 // bytes, usually the limit set with ApplyRuntimeLimits
+	MaxGoroutines int
+	Disk          int64 // bytes of the files matching DiskFiles
+	// DiskFiles are glob patterns for the agent's own files that count
+	// against Disk. The oldest are deleted when it is exceeded, except the
+	// ones listed in Keep.
+	DiskFiles []string
+	Keep      []string
+	Interval  time.Duration // between checks, default 15s
+}
+
+// Status is the guard's last check, reported in the heartbeat and by
+// 'ss-agent status'
+type Status struct {
+	Level         string    `json:"level"`
+	Since         time.Time `json:"since"`
+	Reasons       []string  `json:"reasons,omitempty"`
+	Shedding      []string  `json:"shedding,omitempty"` // parts of the agent doing less
+	Memory        uint64    `json:"memory_bytes"`
+	MemoryLimit   int64     `json:"memory_limit_bytes,omitempty"`
+	Goroutines    int       `json:"goroutines"`
+	MaxGoroutines int       `json:"max_goroutines,omitempty"`
+	CPUs          int       `json:"cpus"`
+	Disk          int64     `json:"disk_bytes"`
+	DiskLimit     int64     `json:"disk_limit_bytes,omitempty"`
+	DiskFreed     int64     `json:"disk_freed_bytes,omitempty"` // since the agent started
+}
+
+// Guard watches the agent's own memory, goroutines and disk usage and sheds
+// load before a limit is reached, instead of letting the agent grow without
+// bound until the OS kills it
+type Guard struct {
+	limits Limits
+
+	mu       sync.Mutex
+	shedders []namedShedder
+	level    Level
+	since    time.Time
+	calm     int // checks in a row that found a lower level
+	status   Status
+}
+
+type namedShedder struct {
+	name string
+	s    Shedder
+}
+
+// New creates a guard with the defaults filled in for unset limits
+func New(limits Limits) *Guard {
+	if limits.Interval <= 0 {
+		limits.Interval = 15 * time.Second
+	}
+	g := &Guard{limits: limits, since: time.Now().UTC()}
+	g.status = Status{Level: Normal.String(), Since: g.since}
+	return g
+}
+
+// Register adds a part of the agent that sheds load under pressure
+func (g *Guard) Register(name string, s Shedder) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.shedders = append(g.shedders, namedShedder{name, s})
+}
+
+// Run checks the agent's resources every interval until ctx is done
+func (g *Guard) Run(ctx context.Context) {
+	ticker := time.NewTicker(g.limits.Interval)
+	defer ticker.Stop()
+	for {
+		g.Check()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check samples the agent's resources once, frees disk space if needed and
+// tells the shedders when the level changes. It returns the level in effect.
+func (g *Guard) Check() Level {
+	st := Status{
+		Memory:        memoryInUse(),
+		MemoryLimit:   g.limits.Memory,
+		Goroutines:    runtime.NumGoroutine(),
+		MaxGoroutines: g.limits.MaxGoroutines,
+		CPUs:          runtime.GOMAXPROCS(0),
+		DiskLimit:     g.limits.Disk,
+	}
+	level := Normal
+	measure := func(what string, used, limit float64, format func(float64) string) {
+		if limit <= 0 {
+			return
+		}
+		ratio := used / limit
+		l := Normal
+		switch {
+		case ratio >= criticalAt:
+			l = Critical
+		case ratio >= elevatedAt:
+			l = Elevated
+		}
+		if l > Normal {
+			st.Reasons = append(st.Reasons, fmt.Sprintf("%s %s is %.0f%% of %s", what, format(used), 100*ratio, format(limit)))
+		}
+		if l > level {
+			level = l
+		}
+	}
+
+	measure("memory", float64(st.Memory), float64(st.MemoryLimit), formatBytes)
+	measure("goroutines", float64(st.Goroutines), float64(st.MaxGoroutines), func(v float64) string {
+		return fmt.Sprintf("%.0f", v)
+	})
+	var freed int64
+	st.Disk, freed = g.enforceDisk()
+	measure("disk", float64(st.Disk), float64(st.DiskLimit), formatBytes)
+
+	if level == Critical && st.MemoryLimit > 0 && float64(st.Memory) >= criticalAt*float64(st.MemoryLimit) {
+		// Give the memory the garbage collector has already freed back to
+		// the OS right away
+		debug.FreeOSMemory()
+	}
+
+	g.mu.Lock()
+	previous := g.level
+	switch {
+	case level > g.level:
+		g.level = level
+		g.calm = 0
+	case level < g.level:
+		g.calm++
+		if g.calm >= calmChecks {
+			g.level = level
+			g.calm = 0
+		}
+	default:
+		g.calm = 0
+	}
+	if g.level != previous {
+		g.since = time.Now().UTC()
+	}
+	current := g.level
+	st.Level = current.String()
+	st.Since = g.since
+	st.DiskFreed = g.status.DiskFreed + freed
+	if current > Normal {
+		for _, s := range g.shedders {
+			st.Shedding = append(st.Shedding, s.name)
+		}
+	}
+	g.status = st
+	shedders := append([]namedShedder(nil), g.shedders...)
+	g.mu.Unlock()
+
+	if current == previous {
+		return current
+	}
+	// Logged before the shedders run, so the warning is still shipped to
+	// the server
+	switch {
+	case current == Critical:
+		logger.Error("Agent is running out of resources, shedding load", "level", current.String(), "reasons", strings.Join(st.Reasons, "; "))
+	case current > previous:
+		logger.Warn("Agent resources under pressure, shedding load", "level", current.String(), "reasons", strings.Join(st.Reasons, "; "))
+	case current == Normal:
+		logger.Info("Agent resources back to normal, resuming all work", "previous", previous.String())
+	default:
+		logger.Info("Agent resource pressure eased", "level", current.String(), "previous", previous.String())
+	}
+	if current > previous {
+		shedTotal.Inc(current.String())
+	}
+	for _, s := range shedders {
+		s.s.Shed(current)
+	}
+	return current
+}
+
+// Level returns the level in effect
+func (g *Guard) Level() Level {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.level
+}
+
+// Status returns the result of the last check
+func (g *Guard) Status() Status {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	st := g.status
+	st.Reasons = append([]string(nil), st.Reasons...)
+	st.Shedding = append([]string(nil), st.Shedding...)
+	return st
+}
+
+// HeartbeatSection implements api.HeartbeatSource.
+func (g *Guard) HeartbeatSection() interface{} {
+	return g.Status()
+}
+
+// HeartbeatDelivered implements api.HeartbeatSource.
+func (g *Guard) HeartbeatDelivered() {}
+
+// Collect implements metrics.Collector
+func (g *Guard) Collect() []metrics.Family {
+	st := g.Status()
+	gauge := func(name, help string, v float64) metrics.Family {
+		return metrics.Family{Name: name, Help: help, Type: metrics.TypeGauge, Samples: []metrics.Sample{{Value: v}}}
+	}
+	families := []metrics.Family{
+		gauge("ss_agent_resource_pressure", "Pressure on the agent's own resources, 0 normal, 1 elevated, 2 critical.", float64(g.Level())),
+		gauge("ss_agent_memory_bytes", "Memory the agent holds from the OS, as counted against its memory limit.", float64(st.Memory)),
+		gauge("ss_agent_disk_bytes", "Disk space used by the agent's logs and crash reports.", float64(st.Disk)),
+	}
+	if st.MemoryLimit > 0 {
+		families = append(families, gauge("ss_agent_memory_limit_bytes", "The agent's soft memory limit.", float64(st.MemoryLimit)))
+	}
+	if st.DiskLimit > 0 {
+		families = append(families, gauge("ss_agent_disk_limit_bytes", "Disk space the agent's logs and crash reports may use.", float64(st.DiskLimit)))
+	}
+	return families
+}
+
+// enforceDisk returns the size of the agent's files. From the elevated
+// threshold on the oldest ones are deleted until they are below it again, so
+// disk usage only raises the level when the files that are kept fill it.
+func (g *Guard) enforceDisk() (used, freed int64) {
+	if len(g.limits.DiskFiles) == 0 {
+		return 0, 0
+	}
+	keep := make(map[string]bool)
+	for _, path := range g.limits.Keep {
+		keep[filepath.Clean(path)] = true
+	}
+
+	type file struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var files []file
+	seen := make(map[string]bool)
+	for _, pattern := range g.limits.DiskFiles {
+		matches, _ := filepath.Glob(pattern)
+		for _, path := range matches {
+			path = filepath.Clean(path)
+			if seen[path] {
+				continue
+			}
+			seen[path] = true
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			used += info.Size()
+			if !keep[path] {
+				files = append(files, file{path, info.Size(), info.ModTime()})
+			}
+		}
+	}
+	target := int64(elevatedAt * float64(g.limits.Disk))
+	if g.limits.Disk <= 0 || used < target {
+		return used, 0
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, f := range files {
+		if used < target {
+			break
+		}
+		if err := os.Remove(f.path); err != nil {
+			logger.Debug("Failed to delete file over the disk limit", "path", f.path, "error", err)
+			continue
+		}
+		used -= f.size
+		freed += f.size
+		logger.Info("Deleted file to stay under the disk limit", "path", f.path, "bytes", f.size)
+	}
+	diskFreedTotal.Add(float64(freed))
+	return used, freed
+}
+
+// memoryInUse returns the memory the Go runtime holds from the OS, which is
+// what its memory limit applies to
+func memoryInUse() uint64 {
+	samples := []rtmetrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	rtmetrics.Read(samples)
+	if samples[0].Value.Kind() != rtmetrics.KindUint64 || samples[1].Value.Kind() != rtmetrics.KindUint64 {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		return ms.Sys - ms.HeapReleased
+	}
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
+
+// ApplyRuntimeLimits sets the Go runtime's soft memory limit and how many
+// CPUs it runs on. GOMEMLIMIT and GOMAXPROCS in the environment take
+// precedence, as they do for any Go program. It returns the memory limit in
+// effect, 0 when there is none.
+func ApplyRuntimeLimits(memory int64, cpus int) int64 {
+	if memory > 0 && os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(memory)
+	}
+	if cpus > 0 && os.Getenv("GOMAXPROCS") == "" {
+		runtime.GOMAXPROCS(cpus)
+	}
+	limit := debug.SetMemoryLimit(-1)
+	if limit == math.MaxInt64 {
+		return 0
+	}
+	return limit
+}
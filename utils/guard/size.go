@@ -0,0 +1,52 @@
+package guard
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// ParseSize parses a size in bytes with an optional binary unit, e.g. "512M",
+// "1G", "256MiB" or "1048576"
+func ParseSize(s string) (int64, error) {
+	trimmed := strings.TrimSpace(s)
+	upper := strings.ToUpper(trimmed)
+	upper = strings.TrimSuffix(strings.TrimSuffix(upper, "B"), "I")
+	i := strings.IndexFunc(upper, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(upper)
+	}
+	unit, ok := sizeUnits[upper[i:]]
+	n, err := strconv.ParseInt(upper[:i], 10, 64)
+	if !ok || err != nil || n <= 0 || n > (1<<62)/unit {
+		return 0, fmt.Errorf("%q is not a size (e.g. 512M or 1G)", s)
+	}
+	return n * unit, nil
+}
+
+// formatBytes formats a size for humans, e.g. "212.4MiB"
+func formatBytes(v float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for v >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f%s", v, units[i])
+	}
+	return fmt.Sprintf("%.1f%s", v, units[i])
+}
+
+// FormatBytes formats a size in bytes for humans, e.g. "212.4MiB"
+func FormatBytes(n int64) string {
+	return formatBytes(float64(n))
+}
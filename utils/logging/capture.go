@@ -0,0 +1,143 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Entry is a log record kept in the ring buffer and passed to subscribers
+type Entry struct {
+	Time      time.Time         `json:"time"`
+	Level     string            `json:"level"`
+	Subsystem string            `json:"subsystem,omitempty"`
+	Message   string            `json:"message"`
+	Attrs     map[string]string `json:"attrs,omitempty"`
+}
+
+type subscriber struct {
+	min slog.Level
+	fn  func(Entry)
+}
+
+var (
+	captureMu   sync.Mutex
+	ring        []Entry
+	ringNext    int // where the next entry goes once the ring is full
+	ringSize    = 1000
+	subscribers = map[int]subscriber{}
+	nextSubID   int
+)
+
+// Recent returns up to n of the most recent log entries, oldest first. n <= 0
+// returns all that are buffered.
+func Recent(n int) []Entry {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	ordered := append(append([]Entry(nil), ring[ringNext:]...), ring[:ringNext]...)
+	if n > 0 && n < len(ordered) {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered
+}
+
+// Subscribe calls fn for every record at or above min. fn runs on the logging
+// goroutine, so it must not block or log at or above min itself.
+func Subscribe(min slog.Level, fn func(Entry)) (unsubscribe func()) {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	id := nextSubID
+	nextSubID++
+	subscribers[id] = subscriber{min: min, fn: fn}
+	return func() {
+		captureMu.Lock()
+		defer captureMu.Unlock()
+		delete(subscribers, id)
+	}
+}
+
+// setBufferSize changes how many entries Recent can return, keeping the
+// newest ones
+func setBufferSize(n int) {
+	if n <= 0 {
+		n = 1000
+	}
+	kept := Recent(n)
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	ringSize = n
+	ring = kept
+	ringNext = 0
+}
+
+func capture(e Entry, level slog.Level) {
+	captureMu.Lock()
+	if len(ring) < ringSize {
+		ring = append(ring, e)
+	} else {
+		ring[ringNext] = e
+		ringNext = (ringNext + 1) % ringSize
+	}
+	var notify []func(Entry)
+	for _, s := range subscribers {
+		if level >= s.min {
+			notify = append(notify, s.fn)
+		}
+	}
+	captureMu.Unlock()
+
+	for _, fn := range notify {
+		fn(e)
+	}
+}
+
+// captureHandler passes records on to the output handler and keeps them for
+// Recent and the subscribers
+type captureHandler struct {
+	inner  slog.Handler
+	attrs  []slog.Attr
+	prefix string // group prefix for attributes added later
+}
+
+func (c *captureHandler) Enabled(ctx context.Context, lvl slog.Level) bool {
+	return c.inner.Enabled(ctx, lvl)
+}
+
+func (c *captureHandler) Handle(ctx context.Context, r slog.Record) error {
+	err := c.inner.Handle(ctx, r)
+
+	e := Entry{Time: r.Time, Level: r.Level.String(), Message: r.Message}
+	add := func(prefix string, a slog.Attr) {
+		if a.Key == "subsystem" && prefix == "" {
+			e.Subsystem = a.Value.String()
+			return
+		}
+		if e.Attrs == nil {
+			e.Attrs = map[string]string{}
+		}
+		e.Attrs[prefix+a.Key] = a.Value.Resolve().String()
+	}
+	for _, a := range c.attrs {
+		add("", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		add(c.prefix, a)
+		return true
+	})
+	capture(e, r.Level)
+	return err
+}
+
+func (c *captureHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	prefixed := make([]slog.Attr, 0, len(c.attrs)+len(attrs))
+	prefixed = append(prefixed, c.attrs...)
+	for _, a := range attrs {
+		prefixed = append(prefixed, slog.Attr{Key: c.prefix + a.Key, Value: a.Value})
+	}
+	return &captureHandler{inner: c.inner.WithAttrs(attrs), attrs: prefixed, prefix: c.prefix}
+}
+
+func (c *captureHandler) WithGroup(name string) slog.Handler {
+	return &captureHandler{inner: c.inner.WithGroup(name), attrs: c.attrs, prefix: c.prefix + name + "."}
+}
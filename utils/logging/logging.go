@@ -0,0 +1,185 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Output formats
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Options configure the agent's logging. Zero values use the defaults.
+type Options struct {
+	Level      string // debug, info, warn or error, default info
+	Format     string // text or json, default text
+	File       string // log file, empty logs to stderr
+	MaxSizeMB  int    // rotate the file when it reaches this size, default 50
+	MaxAgeDays int    // delete rotated files older than this, default 30
+	MaxBackups int    // rotated files to keep, default 5
+	Compress   bool   // gzip rotated files
+
+	BufferLines int // recent entries kept for Recent, default 1000
+}
+
+var (
+	mu    sync.Mutex
+	level = new(slog.LevelVar)
+	file  *rotatingFile
+
+	// current is the handler loggers from For write to; generation changes
+	// whenever Setup replaces it
+	current    atomic.Value
+	generation atomic.Uint64
+)
+
+func init() {
+	install(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+}
+
+// Setup replaces the handler of all loggers, including the default slog
+// logger and the standard log package, which logs at info level.
+func Setup(opts Options) error {
+	lvl, err := ParseLevel(opts.Level)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var out io.Writer = os.Stderr
+	var opened *rotatingFile
+	if opts.File != "" {
+		if opened, err = openRotatingFile(opts); err != nil {
+			return err
+		}
+		out = opened
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch strings.ToLower(opts.Format) {
+	case "", FormatText:
+		h = slog.NewTextHandler(out, handlerOpts)
+	case FormatJSON:
+		h = slog.NewJSONHandler(out, handlerOpts)
+	default:
+		if opened != nil {
+			opened.Close()
+		}
+		return fmt.Errorf("unknown log format %q, expected text or json", opts.Format)
+	}
+
+	level.Set(lvl)
+	setBufferSize(opts.BufferLines)
+	install(h)
+	if file != nil {
+		file.Close()
+	}
+	file = opened
+	return nil
+}
+
+// Close flushes and closes the log file, if logging to one. Later log
+// output goes to stderr.
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	install(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	if file != nil {
+		file.Close()
+		file = nil
+	}
+}
+
+// SetLevel changes the level of all loggers
+func SetLevel(name string) error {
+	lvl, err := ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	level.Set(lvl)
+	return nil
+}
+
+// ParseLevel parses debug, info, warn or error. An empty name is info.
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", name)
+}
+
+func install(h slog.Handler) {
+	h = &captureHandler{inner: h}
+	current.Store(&h)
+	generation.Add(1)
+	slog.SetDefault(slog.New(h))
+}
+
+// For returns the logger of a subsystem. Its records carry a subsystem
+// attribute and go to whatever handler Setup installed last, so loggers can
+// be created in package variables before logging is set up.
+func For(subsystem string) *slog.Logger {
+	return slog.New(&lazyHandler{wrap: func(h slog.Handler) slog.Handler {
+		return h.WithAttrs([]slog.Attr{slog.String("subsystem", subsystem)})
+	}})
+}
+
+// lazyHandler applies its attributes and groups to the current handler,
+// rebuilding them only when the handler was replaced
+type lazyHandler struct {
+	wrap   func(slog.Handler) slog.Handler
+	cached atomic.Pointer[cachedHandler]
+}
+
+type cachedHandler struct {
+	generation uint64
+	handler    slog.Handler
+}
+
+func (l *lazyHandler) handler() slog.Handler {
+	gen := generation.Load()
+	if c := l.cached.Load(); c != nil && c.generation == gen {
+		return c.handler
+	}
+	h := l.wrap(*current.Load().(*slog.Handler))
+	l.cached.Store(&cachedHandler{generation: gen, handler: h})
+	return h
+}
+
+func (l *lazyHandler) Enabled(ctx context.Context, lvl slog.Level) bool {
+	return l.handler().Enabled(ctx, lvl)
+}
+
+func (l *lazyHandler) Handle(ctx context.Context, r slog.Record) error {
+	return l.handler().Handle(ctx, r)
+}
+
+func (l *lazyHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &lazyHandler{wrap: func(h slog.Handler) slog.Handler {
+		return l.wrap(h).WithAttrs(attrs)
+	}}
+}
+
+func (l *lazyHandler) WithGroup(name string) slog.Handler {
+	return &lazyHandler{wrap: func(h slog.Handler) slog.Handler {
+		return l.wrap(h).WithGroup(name)
+	}}
+}
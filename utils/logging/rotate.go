@@ -0,0 +1,210 @@
+package logging
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is used in the names of rotated files, e.g.
+// ss-agent-2024-05-01T10-00-00.000.log.gz
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// StderrFile returns the file next to the log file that the output of a
+// daemonized agent outside the logger goes to, such as a panic. It is never
+// rotated, so the process never writes to a file that was renamed away.
+func StderrFile(logFile string) string {
+	return filepath.Join(filepath.Dir(logFile), "ss-agent.stderr")
+}
+
+// rotatingFile is a log file that is rotated when it reaches its maximum
+// size. Rotated files are compressed and pruned in the background.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	wg   sync.WaitGroup // background compression and pruning
+}
+
+func openRotatingFile(opts Options) (*rotatingFile, error) {
+	r := &rotatingFile{
+		path:       opts.File,
+		maxSize:    int64(opts.MaxSizeMB) << 20,
+		maxAge:     time.Duration(opts.MaxAgeDays) * 24 * time.Hour,
+		maxBackups: opts.MaxBackups,
+		compress:   opts.Compress,
+	}
+	if r.maxSize <= 0 {
+		r.maxSize = 50 << 20
+	}
+	if r.maxAge <= 0 {
+		r.maxAge = 30 * 24 * time.Hour
+	}
+	if r.maxBackups <= 0 {
+		r.maxBackups = 5
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %v", err)
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+	r.file = f
+	r.size = info.Size()
+	return nil
+}
+
+// Write appends to the file, rotating it first if p would take it past its
+// maximum size
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			// Keep logging to the current file rather than losing output
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file and starts a new one. Callers hold mu.
+func (r *rotatingFile) rotate() error {
+	ext := filepath.Ext(r.path)
+	backup := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(r.path, ext), time.Now().UTC().Format(backupTimeFormat), ext)
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+	r.file = nil
+	renameErr := os.Rename(r.path, backup)
+	if err := r.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		if r.compress {
+			if err := compressFile(backup); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to compress %s: %v\n", backup, err)
+			}
+		}
+		r.prune()
+	}()
+	return nil
+}
+
+// prune deletes rotated files beyond maxBackups or older than maxAge
+func (r *rotatingFile) prune() {
+	ext := filepath.Ext(r.path)
+	prefix := filepath.Base(strings.TrimSuffix(r.path, ext)) + "-"
+	entries, err := os.ReadDir(filepath.Dir(r.path))
+	if err != nil {
+		return
+	}
+
+	type backup struct {
+		path string
+		time time.Time
+	}
+	var backups []backup
+	for _, e := range entries {
+		name := e.Name()
+		stamp := strings.TrimSuffix(strings.TrimSuffix(name, ".gz"), ext)
+		if !strings.HasPrefix(stamp, prefix) || !strings.HasSuffix(strings.TrimSuffix(name, ".gz"), ext) {
+			continue
+		}
+		t, err := time.Parse(backupTimeFormat, strings.TrimPrefix(stamp, prefix))
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{filepath.Join(filepath.Dir(r.path), name), t})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].time.After(backups[j].time)
+	})
+	for i, b := range backups {
+		if i >= r.maxBackups || time.Since(b.time) > r.maxAge {
+			os.Remove(b.path)
+		}
+	}
+}
+
+// Close closes the file once background compression has finished
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.wg.Wait()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
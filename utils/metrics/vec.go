@@ -0,0 +1,194 @@
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// vec holds the series of a metric, keyed by their label values
+type vec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string][]string // key to label values
+}
+
+func newVec(name, help string, labels []string) vec {
+	return vec{name: name, help: help, labels: labels, series: map[string][]string{}}
+}
+
+// key returns the series key for the label values, which must match the
+// label names given when the metric was created. Callers hold mu.
+func (v *vec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic("metrics: " + v.name + " needs label values for " + strings.Join(v.labels, ", "))
+	}
+	key := strings.Join(values, "\xff")
+	if _, ok := v.series[key]; !ok {
+		v.series[key] = append([]string(nil), values...)
+	}
+	return key
+}
+
+// sortedKeys returns the series keys in a stable order. Callers hold mu.
+func (v *vec) sortedKeys() []string {
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *vec) labelPairs(key string, extra ...Label) []Label {
+	values := v.series[key]
+	pairs := make([]Label, 0, len(values)+len(extra))
+	for i, name := range v.labels {
+		pairs = append(pairs, Label{name, values[i]})
+	}
+	return append(pairs, extra...)
+}
+
+// Counter is a value that only goes up, optionally split by labels
+type Counter struct {
+	vec
+	values map[string]float64
+}
+
+// NewCounter creates and registers a counter
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{vec: newVec(name, help, labels), values: map[string]float64{}}
+	Register(c)
+	return c
+}
+
+// Inc adds one to the series with the given label values
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v, which must not be negative, to the series with the given label values
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[c.key(labelValues)] += v
+}
+
+// Collect implements Collector
+func (c *Counter) Collect() []Family {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f := Family{Name: c.name, Help: c.help, Type: TypeCounter}
+	for _, k := range c.sortedKeys() {
+		f.Samples = append(f.Samples, Sample{Labels: c.labelPairs(k), Value: c.values[k]})
+	}
+	return []Family{f}
+}
+
+// Gauge is a value that can go up and down, optionally split by labels
+type Gauge struct {
+	vec
+	values map[string]float64
+}
+
+// NewGauge creates and registers a gauge
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{vec: newVec(name, help, labels), values: map[string]float64{}}
+	Register(g)
+	return g
+}
+
+// Set sets the series with the given label values
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[g.key(labelValues)] = v
+}
+
+// Add adds v to the series with the given label values
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[g.key(labelValues)] += v
+}
+
+// Collect implements Collector
+func (g *Gauge) Collect() []Family {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	f := Family{Name: g.name, Help: g.help, Type: TypeGauge}
+	for _, k := range g.sortedKeys() {
+		f.Samples = append(f.Samples, Sample{Labels: g.labelPairs(k), Value: g.values[k]})
+	}
+	return []Family{f}
+}
+
+// DefaultBuckets suit request latencies in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Histogram counts observations in buckets, optionally split by labels
+type Histogram struct {
+	vec
+	buckets []float64
+	counts  map[string][]uint64 // per bucket, not cumulative
+	sums    map[string]float64
+	totals  map[string]uint64
+}
+
+// NewHistogram creates and registers a histogram with the given upper
+// bounds, which must be sorted. nil uses DefaultBuckets.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &Histogram{
+		vec:     newVec(name, help, labels),
+		buckets: buckets,
+		counts:  map[string][]uint64{},
+		sums:    map[string]float64{},
+		totals:  map[string]uint64{},
+	}
+	Register(h)
+	return h
+}
+
+// Observe records v in the series with the given label values
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	k := h.key(labelValues)
+	counts := h.counts[k]
+	if counts == nil {
+		counts = make([]uint64, len(h.buckets))
+		h.counts[k] = counts
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(counts) {
+		counts[i]++
+	}
+	h.sums[k] += v
+	h.totals[k]++
+}
+
+// Collect implements Collector
+func (h *Histogram) Collect() []Family {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f := Family{Name: h.name, Help: h.help, Type: TypeHistogram}
+	for _, k := range h.sortedKeys() {
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += h.counts[k][i]
+			f.Samples = append(f.Samples, Sample{Suffix: "_bucket", Labels: h.labelPairs(k, Label{"le", formatValue(bound)}), Value: float64(cumulative)})
+		}
+		f.Samples = append(f.Samples,
+			Sample{Suffix: "_bucket", Labels: h.labelPairs(k, Label{"le", "+Inf"}), Value: float64(h.totals[k])},
+			Sample{Suffix: "_sum", Labels: h.labelPairs(k), Value: h.sums[k]},
+			Sample{Suffix: "_count", Labels: h.labelPairs(k), Value: float64(h.totals[k])},
+		)
+	}
+	return []Family{f}
+}
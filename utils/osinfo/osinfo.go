@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"runtime"
 	"strings"
@@ -58,7 +59,7 @@ func DetectOS() {
 		log.Fatalf("Unsupported operating system: %s", runtime.GOOS)
 	}
 
-	log.Printf("Detected operating system: %s %s", osType, osDist)
+	slog.Debug("Detected operating system", "type", osType, "dist", osDist)
 }
 
 func normalizeLinuxDist(dist string) string {
@@ -67,6 +68,8 @@ func normalizeLinuxDist(dist string) string {
 		return dist
 	case "fedora", "rhel", "centos":
 		return dist
+	case "alpine", "gentoo":
+		return dist
 	default:
 		return "unsupported"
 	}
@@ -0,0 +1,29 @@
+//go:build !windows
+// +build !windows
+
+package pidfile
+
+import (
+	"os"
+	"syscall"
+)
+
+func tryLock(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlock(file *os.File) {
+	syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
+
+// release removes the file while still holding the lock, so a starting agent
+// never sees the file unlocked with our PID in it, and then drops the lock
+func release(p *PidFile) (removeErr, closeErr error) {
+	removeErr = os.Remove(p.path)
+	unlock(p.file)
+	return removeErr, p.file.Close()
+}
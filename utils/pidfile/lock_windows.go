@@ -0,0 +1,36 @@
+//go:build windows
+// +build windows
+
+package pidfile
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockOffset places the locked byte range far past the PID, because Windows
+// locks are mandatory and would otherwise stop other processes reading it
+const lockOffset = 0x7fffffff
+
+func tryLock(file *os.File) (bool, error) {
+	ol := &windows.Overlapped{Offset: lockOffset}
+	err := windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, ol)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlock(file *os.File) {
+	ol := &windows.Overlapped{Offset: lockOffset}
+	windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, ol)
+}
+
+// release drops the lock and closes the file before removing it, because
+// Windows cannot delete an open file
+func release(p *PidFile) (removeErr, closeErr error) {
+	unlock(p.file)
+	closeErr = p.file.Close()
+	return os.Remove(p.path), closeErr
+}
@@ -0,0 +1,182 @@
+package pidfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrLocked is returned by Acquire when another process holds the PID file.
+var ErrLocked = errors.New("PID file is locked by another process")
+
+// PidFile is a PID file held with an exclusive lock for the lifetime of the
+// process. The operating system drops the lock when the process dies, so a
+// file left behind by a crash is never mistaken for a running agent, even if
+// its PID has been reused.
+type PidFile struct {
+	path string
+	file *os.File
+}
+
+// LockedError reports the process holding the PID file.
+type LockedError struct {
+	Path string
+	PID  int
+}
+
+func (e *LockedError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("%s is locked by another process", e.Path)
+	}
+	return fmt.Sprintf("%s is locked by the process with PID %d", e.Path, e.PID)
+}
+
+func (e *LockedError) Unwrap() error {
+	return ErrLocked
+}
+
+// Acquire creates or opens the PID file, locks it and writes the current PID.
+// It returns a *LockedError if another process holds the lock.
+func Acquire(path string) (*PidFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory for PID file: %v", err)
+	}
+	// An agent releasing the file removes it while holding the lock, so the
+	// lock may have been taken on a file that is no longer at path. Nobody
+	// else could find that lock, so start over with the file now there.
+	var file *os.File
+	for attempt := 0; ; attempt++ {
+		var err error
+		if file, err = openLocked(path); err != nil {
+			return nil, err
+		}
+		same, err := isCurrent(file, path)
+		if err != nil {
+			unlock(file)
+			file.Close()
+			return nil, fmt.Errorf("failed to check PID file: %v", err)
+		}
+		if same {
+			break
+		}
+		unlock(file)
+		file.Close()
+		if attempt == 4 {
+			return nil, fmt.Errorf("failed to lock PID file: %s keeps being replaced", path)
+		}
+	}
+
+	if err := file.Truncate(0); err != nil {
+		unlock(file)
+		file.Close()
+		return nil, fmt.Errorf("failed to truncate PID file: %v", err)
+	}
+	if _, err := file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		unlock(file)
+		file.Close()
+		return nil, fmt.Errorf("failed to write PID file: %v", err)
+	}
+	file.Sync()
+	return &PidFile{path: path, file: file}, nil
+}
+
+// openLocked creates or opens the PID file and locks it
+func openLocked(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open PID file: %v", err)
+	}
+	// Check holds the lock for an instant while probing it, so retry briefly
+	// before giving up
+	var locked bool
+	for attempt := 0; attempt < 5; attempt++ {
+		if locked, err = tryLock(file); err != nil || locked {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock PID file: %v", err)
+	}
+	if !locked {
+		pid, _ := readPID(file)
+		file.Close()
+		return nil, &LockedError{Path: path, PID: pid}
+	}
+	return file, nil
+}
+
+// isCurrent reports whether the open file is still the one at path
+func isCurrent(file *os.File, path string) (bool, error) {
+	opened, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	current, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(opened, current), nil
+}
+
+// Release removes the PID file and drops the lock.
+func (p *PidFile) Release() error {
+	removeErr, closeErr := release(p)
+	if removeErr != nil && !os.IsNotExist(removeErr) {
+		return removeErr
+	}
+	return closeErr
+}
+
+// Check reports the PID of the process holding the PID file. running is false
+// if the file does not exist or nobody holds its lock, i.e. it is stale. The
+// file is only opened for reading, so any user who can read it can check.
+func Check(path string) (pid int, running bool, err error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	defer file.Close()
+
+	pid, _ = readPID(file)
+	locked, err := tryLock(file)
+	if err != nil {
+		return pid, false, err
+	}
+	if locked {
+		unlock(file)
+		return pid, false, nil
+	}
+	return pid, true, nil
+}
+
+// Read returns the PID stored in the PID file without checking whether that
+// process is still running
+func Read(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return readPID(file)
+}
+
+func readPID(file *os.File) (int, error) {
+	data, err := io.ReadAll(io.NewSectionReader(file, 0, 64))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
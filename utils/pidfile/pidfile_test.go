@@ -0,0 +1,102 @@
+package pidfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestAcquireRelease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "ss-agent.pid")
+	p, err := Acquire(path)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if pid, running, err := Check(path); err != nil || !running || pid != os.Getpid() {
+		t.Errorf("Check = %d, %v, %v, want our PID running", pid, running, err)
+	}
+	_, err = Acquire(path)
+	var locked *LockedError
+	if !errors.As(err, &locked) || locked.PID != os.Getpid() || !errors.Is(err, ErrLocked) {
+		t.Errorf("second Acquire = %v, want locked by our PID", err)
+	}
+
+	if err := p.Release(); err != nil {
+		t.Errorf("Release: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("PID file still exists after Release: %v", err)
+	}
+	if _, running, err := Check(path); err != nil || running {
+		t.Errorf("Check after Release = %v, %v, want not running", running, err)
+	}
+}
+
+func TestAcquireStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ss-agent.pid")
+	if err := os.WriteFile(path, []byte("999999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if pid, running, err := Check(path); err != nil || running || pid != 999999 {
+		t.Errorf("Check of a stale file = %d, %v, %v, want 999999 not running", pid, running, err)
+	}
+	p, err := Acquire(path)
+	if err != nil {
+		t.Fatalf("Acquire of a stale file: %v", err)
+	}
+	defer p.Release()
+	if pid, err := Read(path); err != nil || pid != os.Getpid() {
+		t.Errorf("Read = %d, %v, want our PID", pid, err)
+	}
+}
+
+func TestIsCurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ss-agent.pid")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if same, err := isCurrent(file, path); err != nil || !same {
+		t.Errorf("isCurrent of the file at path = %v, %v, want true", same, err)
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows cannot delete an open file")
+	}
+
+	// A releasing agent removes the file after it was opened, and the next
+	// agent creates a new one
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if same, err := isCurrent(file, path); err != nil || same {
+		t.Errorf("isCurrent of a removed file = %v, %v, want false", same, err)
+	}
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if same, err := isCurrent(file, path); err != nil || same {
+		t.Errorf("isCurrent of a replaced file = %v, %v, want false", same, err)
+	}
+}
+
+func TestCheckReadOnly(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("needs file permissions that apply to the test")
+	}
+	path := filepath.Join(t.TempDir(), "ss-agent.pid")
+	p, err := Acquire(path)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer p.Release()
+	// The agent runs as root and other users can only read its PID file
+	if err := os.Chmod(path, 0444); err != nil {
+		t.Fatal(err)
+	}
+	if pid, running, err := Check(path); err != nil || !running || pid != os.Getpid() {
+		t.Errorf("Check of a read-only file = %d, %v, %v, want our PID running", pid, running, err)
+	}
+}
@@ -0,0 +1,140 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	mu     sync.Mutex
+	dryRun bool
+	plan   []string
+)
+
+// SetDryRun enables or disables dry-run mode. In dry-run mode commands that
+// change the system are recorded instead of executed.
+func SetDryRun(enabled bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	dryRun = enabled
+}
+
+// DryRun reports whether dry-run mode is enabled.
+func DryRun() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return dryRun
+}
+
+// LogUnlessDryRun logs an action that was carried out. In dry-run mode it
+// was only planned, and the plan lists it instead.
+func LogUnlessDryRun(logger *slog.Logger, msg string) {
+	if !DryRun() {
+		logger.Info(msg)
+	}
+}
+
+// Run executes a command that changes the system and returns its combined
+// output. In dry-run mode the command is only recorded and no output is returned.
+func Run(name string, args ...string) ([]byte, error) {
+	return RunContext(context.Background(), name, args...)
+}
+
+// RunContext is Run with a context that kills the command when it is done.
+func RunContext(ctx context.Context, name string, args ...string) ([]byte, error) {
+	mu.Lock()
+	if dryRun {
+		plan = append(plan, FormatCommand(name, args...))
+		mu.Unlock()
+		return nil, nil
+	}
+	mu.Unlock()
+	return exec.CommandContext(ctx, name, args...).CombinedOutput()
+}
+
+// Query executes a read-only command and returns its combined output. Queries
+// run in dry-run mode as well, so the plan reflects the current state.
+func Query(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// WriteFile writes a file that changes the system configuration. In dry-run
+// mode the write is only recorded.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	mu.Lock()
+	if dryRun {
+		plan = append(plan, fmt.Sprintf("write %s (%d bytes, mode %04o)", path, len(data), perm))
+		mu.Unlock()
+		return nil
+	}
+	mu.Unlock()
+	return os.WriteFile(path, data, perm)
+}
+
+// MkdirAll creates a directory and any missing parents. In dry-run mode the
+// creation is only recorded, and only if the directory does not exist yet.
+func MkdirAll(path string, perm os.FileMode) error {
+	mu.Lock()
+	if dryRun {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			plan = append(plan, fmt.Sprintf("mkdir -p %s", path))
+		}
+		mu.Unlock()
+		return nil
+	}
+	mu.Unlock()
+	return os.MkdirAll(path, perm)
+}
+
+// Remove deletes a file, ignoring files that do not exist. In dry-run mode the
+// removal is only recorded.
+func Remove(path string) error {
+	mu.Lock()
+	if dryRun {
+		plan = append(plan, fmt.Sprintf("remove %s", path))
+		mu.Unlock()
+		return nil
+	}
+	mu.Unlock()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Record adds a step to the plan in dry-run mode, for actions that are not
+// commands such as D-Bus calls. It does nothing otherwise.
+func Record(format string, args ...interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	if dryRun {
+		plan = append(plan, fmt.Sprintf(format, args...))
+	}
+}
+
+// TakePlan returns the steps recorded so far and clears them.
+func TakePlan() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	steps := plan
+	plan = nil
+	return steps
+}
+
+// FormatCommand renders a command line, quoting arguments where needed.
+func FormatCommand(name string, args ...string) string {
+	parts := make([]string, 0, len(args)+1)
+	for _, arg := range append([]string{name}, args...) {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'") {
+			arg = strconv.Quote(arg)
+		}
+		parts = append(parts, arg)
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,110 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse("2006-01-02 15:04:05", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		spec, from, want string // want is empty for never
+	}{
+		{"*/15 * * * *", "2024-05-01 10:07:30", "2024-05-01 10:15:00"},
+		{"*/15 * * * *", "2024-05-01 10:15:00", "2024-05-01 10:30:00"},
+		{"5-20/5 * * * *", "2024-05-01 10:20:00", "2024-05-01 11:05:00"},
+		{"0 9-17/4 * * *", "2024-05-01 14:00:00", "2024-05-01 17:00:00"},
+		{"0,30 8 * * *", "2024-05-01 08:10:00", "2024-05-01 08:30:00"},
+		{"30 2 * * Mon-Fri", "2024-05-03 03:00:00", "2024-05-06 02:30:00"},
+		{"0 12 * * 7", "2024-05-06 00:00:00", "2024-05-12 12:00:00"}, // 7 is Sunday
+		{"0 0 1 feb,aug *", "2024-03-01 00:00:00", "2024-08-01 00:00:00"},
+
+		// With both restricted, either the day of month or of week matches
+		{"0 0 13 * Fri", "2024-05-01 00:00:00", "2024-05-03 00:00:00"},
+		{"0 0 13 * Fri", "2024-05-10 00:00:00", "2024-05-13 00:00:00"},
+		// With one of them "*", only the other one counts
+		{"0 0 13 * *", "2024-05-01 00:00:00", "2024-05-13 00:00:00"},
+		{"0 0 * * Fri", "2024-05-10 00:00:00", "2024-05-17 00:00:00"},
+		// A stepped "*" counts as "*" as in cron, so both have to match
+		{"0 0 */10 * Fri", "2024-05-02 00:00:00", "2024-05-31 00:00:00"},
+
+		// Month and year rollover
+		{"0 0 31 * *", "2024-04-01 00:00:00", "2024-05-31 00:00:00"},
+		{"0 0 29 2 *", "2024-03-01 00:00:00", "2028-02-29 00:00:00"},
+		{"59 23 31 12 *", "2024-12-31 23:59:00", "2025-12-31 23:59:00"},
+		{"@yearly", "2024-06-15 12:00:00", "2025-01-01 00:00:00"},
+		{"@monthly", "2024-12-15 12:00:00", "2025-01-01 00:00:00"},
+		{"@hourly", "2024-12-31 23:30:00", "2025-01-01 00:00:00"},
+		{"0 0 30 2 *", "2024-01-01 00:00:00", ""},
+
+		{"@every 90s", "2024-05-01 10:00:15", "2024-05-01 10:01:45"},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.spec, err)
+			continue
+		}
+		got := s.Next(at(tt.from))
+		if tt.want == "" {
+			if !got.IsZero() {
+				t.Errorf("%q: Next(%s) = %s, want never", tt.spec, tt.from, got)
+			}
+			continue
+		}
+		if want := at(tt.want); !got.Equal(want) {
+			t.Errorf("%q: Next(%s) = %s, want %s", tt.spec, tt.from, got, want)
+		}
+	}
+}
+
+func TestParseString(t *testing.T) {
+	tests := []struct{ spec, want string }{
+		{"@every 90s", "@every 1m30s"},
+		{" @daily ", "@daily"},
+		{"*/5 * * * *", "*/5 * * * *"},
+	}
+	for _, tt := range tests {
+		s, err := Parse(tt.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := s.String(); got != tt.want {
+			t.Errorf("Parse(%q).String() = %q, want %q", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"* * * foo *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"1-x * * * *",
+		"@every 500ms",
+		"@every soon",
+		"@fortnightly",
+	} {
+		if s, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) = %v, want an error", spec, s)
+		}
+	}
+}
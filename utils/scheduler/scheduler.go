@@ -0,0 +1,390 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"ss-agent/utils/crash"
+	"ss-agent/utils/logging"
+	"ss-agent/utils/metrics"
+)
+
+var logger = logging.For("scheduler")
+
+var jobRuns = metrics.NewCounter("ss_agent_job_runs_total",
+	"Runs of the agent's scheduled jobs, by job and result.", "job", "result")
+
+// Results of a run
+const (
+	ResultOK      = "ok"
+	ResultFailed  = "failed"
+	ResultTimeout = "timeout"
+	ResultSkipped = "skipped" // due while the previous run was still going
+)
+
+var (
+	// ErrRunning is returned by RunNow when the job is already running
+	ErrRunning = errors.New("job is already running")
+	// ErrStopped is returned by Add and RunNow once the scheduler is
+	// shutting down
+	ErrStopped = errors.New("scheduler is stopping")
+)
+
+// Job is a periodic task of the agent. A job never runs twice at the same
+// time: a run that is due while the previous one still goes is skipped.
+type Job struct {
+	Name     string
+	Schedule Schedule
+	// Jitter delays each run by a random duration up to it, so many agents
+	// do not call the server at the same moment
+	Jitter time.Duration
+	// Timeout cancels the context of a run that takes longer, 0 for none
+	Timeout time.Duration
+	// Immediate runs the job right away on start, then on its schedule
+	Immediate bool
+	Run       func(ctx context.Context) error
+}
+
+// Status is what is known about a job, for 'ss-agent jobs list'
+type Status struct {
+	Name         string     `json:"name"`
+	Schedule     string     `json:"schedule"`
+	Running      bool       `json:"running"`
+	LastRun      *time.Time `json:"last_run,omitempty"`
+	LastDuration string     `json:"last_duration,omitempty"`
+	LastResult   string     `json:"last_result,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	NextRun      *time.Time `json:"next_run,omitempty"`
+	Runs         int        `json:"runs"`
+	Failures     int        `json:"failures"` // failed or timed out
+	Skipped      int        `json:"skipped"`
+}
+
+type job struct {
+	Job
+	running      bool
+	started      time.Time     // of the current run
+	done         chan struct{} // closed when the current run ends
+	rescheduled  chan struct{} // wakes the loop to plan on a new schedule
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastResult   string
+	lastError    string
+	nextRun      time.Time
+	runs         int
+	failures     int
+	skipped      int
+}
+
+// Scheduler runs jobs on their schedules and keeps track of their results
+type Scheduler struct {
+	mu    sync.Mutex
+	jobs  map[string]*job
+	order []string
+
+	// Set by Run
+	ctx    context.Context
+	reqCtx context.Context
+	loops  sync.WaitGroup
+	runs   sync.WaitGroup
+}
+
+// New creates a scheduler without jobs
+func New() *Scheduler {
+	return &Scheduler{jobs: make(map[string]*job)}
+}
+
+// Add adds a job. Jobs added while the scheduler runs are started right away.
+func (s *Scheduler) Add(j Job) error {
+	if j.Name == "" || j.Schedule == nil || j.Run == nil {
+		return fmt.Errorf("job %q needs a name, a schedule and a function", j.Name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[j.Name]; ok {
+		return fmt.Errorf("job %q already exists", j.Name)
+	}
+	if s.ctx != nil && s.ctx.Err() != nil {
+		return ErrStopped
+	}
+	added := &job{Job: j, rescheduled: make(chan struct{}, 1)}
+	s.jobs[j.Name] = added
+	s.order = append(s.order, j.Name)
+	if s.ctx != nil {
+		s.loops.Add(1)
+		go s.loop(s.ctx, added)
+	}
+	return nil
+}
+
+// Run starts the jobs on their schedules until ctx is done, then waits for
+// runs in progress. Runs use reqCtx, so they can finish during shutdown.
+func (s *Scheduler) Run(ctx, reqCtx context.Context) {
+	s.mu.Lock()
+	s.ctx, s.reqCtx = ctx, reqCtx
+	for _, name := range s.order {
+		s.loops.Add(1)
+		go s.loop(ctx, s.jobs[name])
+	}
+	s.mu.Unlock()
+
+	<-ctx.Done()
+	s.loops.Wait()
+	s.runs.Wait()
+	logger.Info("Scheduler stopped")
+}
+
+// loop starts the runs of a job when they are due until ctx is done
+func (s *Scheduler) loop(ctx context.Context, j *job) {
+	defer s.loops.Done()
+	defer crash.Recover("scheduler " + j.Name)
+
+	schedule, jitter := s.timing(j)
+	planned := time.Now()
+	if !j.Immediate {
+		planned = schedule.Next(planned)
+	}
+	for !planned.IsZero() {
+		at := planned
+		if jitter > 0 {
+			at = at.Add(time.Duration(rand.Int63n(int64(jitter))))
+		}
+		s.mu.Lock()
+		j.nextRun = at
+		s.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(at))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			s.mu.Lock()
+			j.nextRun = time.Time{}
+			s.mu.Unlock()
+			return
+		case <-j.rescheduled:
+			timer.Stop()
+			schedule, jitter = s.timing(j)
+			planned = schedule.Next(time.Now())
+			continue
+		case <-timer.C:
+		}
+
+		if _, err := s.start(j); err == ErrRunning {
+			s.mu.Lock()
+			j.skipped++
+			s.mu.Unlock()
+			jobRuns.Inc(j.Name, ResultSkipped)
+			logger.Debug("Job still running, skipping this run", "job", j.Name)
+		}
+
+		// Runs missed while the machine slept or the clock jumped are not
+		// made up for
+		schedule, jitter = s.timing(j)
+		now := time.Now()
+		planned = schedule.Next(planned)
+		if !planned.IsZero() && planned.Before(now) {
+			planned = schedule.Next(now)
+		}
+	}
+	s.mu.Lock()
+	j.nextRun = time.Time{}
+	s.mu.Unlock()
+	logger.Debug("Job has no more runs scheduled", "job", j.Name)
+}
+
+// timing returns the current schedule and jitter of j, which Reschedule may
+// change while the loop runs
+func (s *Scheduler) timing(j *job) (Schedule, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return j.Schedule, j.Jitter
+}
+
+// start begins a run of j unless one is already going, and returns a channel
+// that is closed when it ends
+func (s *Scheduler) start(j *job) (<-chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx != nil && s.ctx.Err() != nil {
+		return nil, ErrStopped
+	}
+	if j.running {
+		return nil, ErrRunning
+	}
+	j.running = true
+	j.started = time.Now()
+	j.done = make(chan struct{})
+	done := j.done
+	ctx := s.reqCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	s.runs.Add(1)
+	go s.execute(ctx, j, j.Timeout)
+	return done, nil
+}
+
+func (s *Scheduler) execute(ctx context.Context, j *job, timeout time.Duration) {
+	defer s.runs.Done()
+	defer crash.Recover("job " + j.Name)
+
+	cancel := func() {}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	started := time.Now()
+	err := j.Run(ctx)
+	duration := time.Since(started)
+	result := ResultOK
+	switch {
+	case err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded):
+		result = ResultTimeout
+		logger.Warn("Job timed out", "job", j.Name, "timeout", timeout.String(), "error", err)
+	case err != nil:
+		result = ResultFailed
+		logger.Debug("Job failed", "job", j.Name, "duration", duration.String(), "error", err)
+	default:
+		logger.Debug("Job finished", "job", j.Name, "duration", duration.String())
+	}
+	cancel()
+	jobRuns.Inc(j.Name, result)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j.running = false
+	j.lastRun = started
+	j.lastDuration = duration
+	j.lastResult = result
+	j.lastError = ""
+	if err != nil {
+		j.lastError = err.Error()
+		j.failures++
+	}
+	j.runs++
+	close(j.done)
+}
+
+// Reschedule changes the schedule, jitter and timeout of a job to those of
+// j, whose Run is ignored. A new schedule or jitter plans the next run from
+// now, a run in progress keeps its timeout.
+func (s *Scheduler) Reschedule(j Job) error {
+	if j.Schedule == nil {
+		return fmt.Errorf("job %q needs a schedule", j.Name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.jobs[j.Name]
+	if !ok {
+		return fmt.Errorf("unknown job %q", j.Name)
+	}
+	existing.Timeout = j.Timeout
+	if j.Schedule.String() == existing.Schedule.String() && j.Jitter == existing.Jitter {
+		return nil
+	}
+	existing.Schedule, existing.Jitter = j.Schedule, j.Jitter
+	select {
+	case existing.rescheduled <- struct{}{}:
+	default:
+	}
+	logger.Info("Job rescheduled", "job", j.Name, "schedule", j.Schedule.String())
+	return nil
+}
+
+// RunNow runs a job right away, outside its schedule, and returns its status
+// once the run has ended
+func (s *Scheduler) RunNow(name string) (Status, error) {
+	s.mu.Lock()
+	j, ok := s.jobs[name]
+	s.mu.Unlock()
+	if !ok {
+		return Status{}, fmt.Errorf("unknown job %q", name)
+	}
+	logger.Info("Running job on request", "job", name)
+	done, err := s.start(j)
+	if err != nil {
+		return Status{}, fmt.Errorf("%s: %v", name, err)
+	}
+	<-done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return j.status(), nil
+}
+
+// Stalled returns the jobs that are stuck: a run that was due more than grace
+// ago and has not started, which means the job's loop hangs, or a run that
+// goes on more than grace past its timeout
+func (s *Scheduler) Stalled(grace time.Duration) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var stalled []string
+	for _, name := range s.order {
+		j := s.jobs[name]
+		switch {
+		case j.running && j.Timeout > 0 && now.Sub(j.started) > j.Timeout+grace:
+			stalled = append(stalled, name)
+		case !j.nextRun.IsZero() && now.Sub(j.nextRun) > grace:
+			stalled = append(stalled, name)
+		}
+	}
+	return stalled
+}
+
+// Deadline returns when the n-th scheduled run of a job after t ends at the
+// latest, allowing for its jitter and timeout. It is zero for an unknown job
+// or a schedule with fewer runs.
+func (s *Scheduler) Deadline(name string, t time.Time, n int) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[name]
+	if !ok {
+		return time.Time{}
+	}
+	for i := 0; i < n && !t.IsZero(); i++ {
+		t = j.Schedule.Next(t)
+	}
+	if t.IsZero() {
+		return t
+	}
+	return t.Add(j.Jitter + j.Timeout)
+}
+
+// Jobs returns the status of every job, in the order they were added
+func (s *Scheduler) Jobs() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]Status, 0, len(s.order))
+	for _, name := range s.order {
+		statuses = append(statuses, s.jobs[name].status())
+	}
+	return statuses
+}
+
+// status must be called with the scheduler's mu held
+func (j *job) status() Status {
+	st := Status{
+		Name:       j.Name,
+		Schedule:   j.Schedule.String(),
+		Running:    j.running,
+		LastResult: j.lastResult,
+		LastError:  j.lastError,
+		Runs:       j.runs,
+		Failures:   j.failures,
+		Skipped:    j.skipped,
+	}
+	if !j.lastRun.IsZero() {
+		lastRun := j.lastRun
+		st.LastRun = &lastRun
+		st.LastDuration = j.lastDuration.Round(time.Millisecond).String()
+	}
+	if !j.nextRun.IsZero() {
+		nextRun := j.nextRun
+		st.NextRun = &nextRun
+	}
+	return st
+}
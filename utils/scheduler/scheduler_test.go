@@ -0,0 +1,41 @@
+package scheduler
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDeadline(t *testing.T) {
+	s := New()
+	run := func(context.Context) error { return nil }
+	every, _ := Parse("@every 1m")
+	hourly, _ := Parse("0 * * * *")
+	never, _ := Parse("0 0 30 2 *")
+	s.Add(Job{Name: "every", Schedule: every, Jitter: 5 * time.Second, Timeout: 30 * time.Second, Run: run})
+	s.Add(Job{Name: "hourly", Schedule: hourly, Run: run})
+	s.Add(Job{Name: "never", Schedule: never, Run: run})
+
+	from := time.Date(2024, 5, 1, 10, 20, 0, 0, time.Local)
+	tests := []struct {
+		name string
+		n    int
+		want time.Time // zero for none
+	}{
+		{"every", 3, from.Add(3*time.Minute + 35*time.Second)},
+		{"hourly", 2, time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)},
+		{"never", 1, time.Time{}},
+		{"missing", 1, time.Time{}},
+	}
+	for _, tt := range tests {
+		if got := s.Deadline(tt.name, from, tt.n); !got.Equal(tt.want) {
+			t.Errorf("Deadline(%s, %d) = %s, want %s", tt.name, tt.n, got, tt.want)
+		}
+	}
+
+	// A reschedule, e.g. after a reload, moves the deadline
+	s.Reschedule(Job{Name: "hourly", Schedule: every})
+	if got, want := s.Deadline("hourly", from, 2), from.Add(2*time.Minute); !got.Equal(want) {
+		t.Errorf("Deadline after Reschedule = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,123 @@
+//go:build !windows
+// +build !windows
+
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeSocket binds a unixgram socket like systemd's and points NOTIFY_SOCKET
+// at it
+func fakeSocket(t *testing.T, name string) *net.UnixConn {
+	t.Helper()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("failed to bind %s: %v", name, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if name[0] == 0 {
+		name = "@" + name[1:]
+	}
+	t.Setenv("NOTIFY_SOCKET", name)
+	return conn
+}
+
+// receive returns the next datagram sent to conn
+func receive(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no notification received: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	conn := fakeSocket(t, filepath.Join(t.TempDir(), "notify"))
+	if !Enabled() {
+		t.Fatal("Enabled() = false with NOTIFY_SOCKET set")
+	}
+
+	tests := []struct {
+		states []string
+		want   string
+	}{
+		{[]string{Ready}, "READY=1"},
+		{[]string{Watchdog}, "WATCHDOG=1"},
+		{[]string{Stopping, Status("Shutting down")}, "STOPPING=1\nSTATUS=Shutting down"},
+		{[]string{Ready, Status("Last heartbeat failed: %s", "dial tcp:\nrefused")}, "READY=1\nSTATUS=Last heartbeat failed: dial tcp: refused"},
+	}
+	for _, tt := range tests {
+		sent, err := Notify(tt.states...)
+		if err != nil || !sent {
+			t.Fatalf("Notify(%q) = %v, %v, want true, nil", tt.states, sent, err)
+		}
+		if got := receive(t, conn); got != tt.want {
+			t.Errorf("Notify(%q) sent %q, want %q", tt.states, got, tt.want)
+		}
+	}
+}
+
+func TestNotifyAbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are Linux only")
+	}
+	conn := fakeSocket(t, "\x00ss-agent-test-"+strconv.Itoa(os.Getpid()))
+	if _, err := Notify(Ready); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if got := receive(t, conn); got != Ready {
+		t.Errorf("sent %q, want %q", got, Ready)
+	}
+}
+
+func TestNotifyWithoutSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if Enabled() {
+		t.Error("Enabled() = true without NOTIFY_SOCKET")
+	}
+	sent, err := Notify(Ready)
+	if sent || err != nil {
+		t.Errorf("Notify = %v, %v, want false, nil", sent, err)
+	}
+}
+
+func TestNotifySocketGone(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing"))
+	if sent, err := Notify(Ready); sent || err == nil {
+		t.Errorf("Notify = %v, %v, want false and an error", sent, err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	self := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+		ok        bool
+	}{
+		{"", "", 0, false},
+		{"garbage", "", 0, false},
+		{"0", "", 0, false},
+		{"60000000", "", 30 * time.Second, true},
+		{"60000000", self, 30 * time.Second, true},
+		{"60000000", "1", 0, false}, // meant for another process
+	}
+	for _, tt := range tests {
+		t.Setenv("WATCHDOG_USEC", tt.usec)
+		t.Setenv("WATCHDOG_PID", tt.pid)
+		got, ok := WatchdogInterval()
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: got %v, %v, want %v, %v", tt.usec, tt.pid, got, ok, tt.want, tt.ok)
+		}
+	}
+}
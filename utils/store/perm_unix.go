@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package store
+
+import (
+	"fmt"
+	"os"
+)
+
+// lockDown restricts path to its owner, and to root when the agent runs as
+// root, since the state holds the agent's identity
+func lockDown(path string, perm os.FileMode) error {
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(path, 0, 0); err != nil {
+			return fmt.Errorf("failed to set the owner of %s: %v", path, err)
+		}
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		return fmt.Errorf("failed to set the permissions of %s: %v", path, err)
+	}
+	return nil
+}
+
+// syncDir flushes a directory so a rename in it survives a power loss
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
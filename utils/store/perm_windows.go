@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package store
+
+import "os"
+
+// lockDown is a no-op, files under ProgramData inherit their ACLs from the
+// parent directory
+func lockDown(path string, perm os.FileMode) error {
+	return nil
+}
+
+// syncDir is a no-op on Windows, where directories cannot be synced
+func syncDir(dir string) {}
@@ -0,0 +1,229 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ss-agent/utils/logging"
+)
+
+var logger = logging.For("store")
+
+const (
+	// FileName is the state file in the data directory
+	FileName = "state.json"
+	// SchemaVersion is the layout of the state file. Bump it and add a
+	// migration when stored keys are renamed or change their meaning.
+	SchemaVersion = 1
+)
+
+// migrations upgrade the data of a schema version to the next one, keyed by
+// the version they upgrade from
+var migrations = map[int]func(data map[string]json.RawMessage) error{}
+
+// File is the content of the state file
+type File struct {
+	Schema    int                        `json:"schema"`
+	UpdatedAt time.Time                  `json:"updated_at"`
+	Data      map[string]json.RawMessage `json:"data"`
+}
+
+// Store is a small key-value store for the state the agent keeps between
+// runs. Values are JSON. Every change rewrites the whole file through a
+// temporary file that is synced and renamed over the old one, so after a
+// crash or power loss the file holds either the old or the new state.
+type Store struct {
+	path string
+
+	mu   sync.Mutex
+	data map[string]json.RawMessage
+}
+
+// Open opens the store in dir, creating the directory if needed and
+// restricting it and the file to their owner. A state file that cannot be
+// parsed is moved aside and the store starts empty; a file written by a newer
+// agent is refused rather than overwritten.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := lockDown(dir, 0700); err != nil {
+		return nil, err
+	}
+	s := &Store{path: filepath.Join(dir, FileName), data: make(map[string]json.RawMessage)}
+
+	f, err := readFile(s.path)
+	switch {
+	case os.IsNotExist(err):
+		return s, nil
+	case err == errCorrupt:
+		aside := fmt.Sprintf("%s.corrupt-%s", s.path, time.Now().UTC().Format("20060102T150405Z"))
+		if err := os.Rename(s.path, aside); err != nil {
+			return nil, fmt.Errorf("%s is corrupt and cannot be moved aside: %v", s.path, err)
+		}
+		logger.Error("State file is corrupt, starting with an empty state", "path", s.path, "moved_to", aside)
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+	if f.Schema > SchemaVersion {
+		return nil, fmt.Errorf("%s has schema version %d, this agent only knows up to %d; it was written by a newer agent",
+			s.path, f.Schema, SchemaVersion)
+	}
+	if f.Data != nil {
+		s.data = f.Data
+	}
+	if err := lockDown(s.path, 0600); err != nil {
+		return nil, err
+	}
+
+	if f.Schema < SchemaVersion {
+		for v := f.Schema; v < SchemaVersion; v++ {
+			if migrate := migrations[v]; migrate != nil {
+				if err := migrate(s.data); err != nil {
+					return nil, fmt.Errorf("failed to migrate %s from schema version %d: %v", s.path, v, err)
+				}
+			}
+		}
+		logger.Info("Migrated state file", "path", s.path, "from", f.Schema, "to", SchemaVersion)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err := s.save(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Path returns the state file
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Get decodes the value of key into v and reports whether the key exists
+func (s *Store) Get(key string, v interface{}) (bool, error) {
+	s.mu.Lock()
+	raw, ok := s.data[key]
+	s.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return true, fmt.Errorf("invalid value of %s: %v", key, err)
+	}
+	return true, nil
+}
+
+// Put stores v under key and writes the state file
+func (s *Store) Put(key string, v interface{}) error {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("cannot encode %s: %v", key, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, existed := s.data[key]
+	s.data[key] = raw
+	if err := s.save(); err != nil {
+		// Keep memory and disk in step
+		if existed {
+			s.data[key] = previous
+		} else {
+			delete(s.data, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete removes key and writes the state file
+func (s *Store) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous, ok := s.data[key]
+	if !ok {
+		return nil
+	}
+	delete(s.data, key)
+	if err := s.save(); err != nil {
+		s.data[key] = previous
+		return err
+	}
+	return nil
+}
+
+// Keys returns the keys starting with prefix, sorted
+func (s *Store) Keys(prefix string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.data {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// save writes the state file atomically. Callers hold mu.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(File{Schema: SchemaVersion, UpdatedAt: time.Now().UTC(), Data: s.data}, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(s.path)
+	tmp, err := os.CreateTemp(dir, ".state-*")
+	if err != nil {
+		return err
+	}
+	// CreateTemp makes the file 0600, so no one else can read it meanwhile
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write %s: %v", s.path, err)
+	}
+	// Make the rename itself durable
+	syncDir(dir)
+	return nil
+}
+
+var errCorrupt = fmt.Errorf("state file is corrupt")
+
+func readFile(path string) (File, error) {
+	var f File
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return f, err
+	}
+	if err := json.Unmarshal(data, &f); err != nil || f.Schema <= 0 {
+		return f, errCorrupt
+	}
+	return f, nil
+}
+
+// Read returns the content of the state file in dir without opening the
+// store, for inspecting it while the agent runs
+func Read(dir string) (File, error) {
+	path := filepath.Join(dir, FileName)
+	f, err := readFile(path)
+	if err == errCorrupt {
+		return f, fmt.Errorf("%s is corrupt", path)
+	}
+	return f, err
+}
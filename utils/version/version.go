@@ -0,0 +1,145 @@
+package version
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"ss-agent/utils/runner"
+)
+
+// versionPattern matches the first dotted version number in tool output,
+// e.g. "6.0.3" in "zeek version 6.0.3".
+var versionPattern = regexp.MustCompile(`\d+(\.\d+)+`)
+
+// Info describes an installed binary and its version.
+type Info struct {
+	Binary  string `json:"binary,omitempty"`
+	Version string `json:"version"`
+	Source  string `json:"source"` // "binary" or the package manager that reported it
+}
+
+// Extract returns the first version number found in s, or "" if none.
+func Extract(s string) string {
+	return versionPattern.FindString(s)
+}
+
+// Compare compares two dotted version numbers numerically and returns -1, 0
+// or 1. Missing segments count as zero and anything after the numeric part
+// (e.g. "-rc1") is ignored.
+func Compare(a, b string) (int, error) {
+	pa, err := parse(a)
+	if err != nil {
+		return 0, err
+	}
+	pb, err := parse(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x < y {
+			return -1, nil
+		}
+		if x > y {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+func parse(v string) ([]int, error) {
+	numeric := Extract(v)
+	if numeric == "" {
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			return []int{n}, nil
+		}
+		return nil, fmt.Errorf("invalid version %q", v)
+	}
+	var parts []int
+	for _, s := range strings.Split(numeric, ".") {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", v)
+		}
+		parts = append(parts, n)
+	}
+	return parts, nil
+}
+
+// FindBinary returns the first candidate path that exists, falling back to
+// looking up name in PATH.
+func FindBinary(name string, candidates ...string) (string, error) {
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("%s executable not found in known paths or system PATH", name)
+	}
+	return path, nil
+}
+
+// FromBinary runs the binary with the given arguments (usually --version) and
+// extracts the version from its output.
+func FromBinary(binary string, args ...string) (Info, error) {
+	output, err := runner.Query(binary, args...)
+	v := Extract(string(output))
+	if v == "" {
+		if err != nil {
+			return Info{Binary: binary}, fmt.Errorf("%s failed: %v\nOutput: %s", runner.FormatCommand(binary, args...), err, string(output))
+		}
+		return Info{Binary: binary}, fmt.Errorf("no version found in output of %s", runner.FormatCommand(binary, args...))
+	}
+	return Info{Binary: binary, Version: v, Source: "binary"}, nil
+}
+
+// FromPackage asks dpkg or rpm for the installed version of a package.
+func FromPackage(pkg string) (Info, error) {
+	if _, err := exec.LookPath("dpkg-query"); err == nil {
+		output, err := runner.Query("dpkg-query", "-W", "-f=${Version}", pkg)
+		if v := Extract(string(output)); err == nil && v != "" {
+			return Info{Version: v, Source: "dpkg"}, nil
+		}
+	}
+	if _, err := exec.LookPath("rpm"); err == nil {
+		output, err := runner.Query("rpm", "-q", "--qf", "%{VERSION}", pkg)
+		if v := Extract(string(output)); err == nil && v != "" {
+			return Info{Version: v, Source: "rpm"}, nil
+		}
+	}
+	return Info{}, fmt.Errorf("package %s not found by dpkg or rpm", pkg)
+}
+
+// Detect tries the binary first and falls back to package metadata.
+func Detect(binary string, args []string, packages ...string) (Info, error) {
+	var binErr error
+	if binary != "" {
+		info, err := FromBinary(binary, args...)
+		if err == nil {
+			return info, nil
+		}
+		binErr = err
+	}
+	for _, pkg := range packages {
+		if info, err := FromPackage(pkg); err == nil {
+			info.Binary = binary
+			return info, nil
+		}
+	}
+	if binErr != nil {
+		return Info{Binary: binary}, binErr
+	}
+	return Info{}, fmt.Errorf("no installed binary or package found")
+}
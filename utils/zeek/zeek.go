@@ -4,11 +4,13 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+
+	"ss-agent/utils/logging"
 )
 
+var logger = logging.For("zeek")
+
 func FindZeekctl() (string, error) {
-	// Log information
-	fmt.Println("Searching for zeekctl...")
 
 	// List of possible paths where zeekctl might be located
 	possiblePaths := []string{
@@ -20,10 +22,9 @@ func FindZeekctl() (string, error) {
 
 	// Try each of the possible paths
 	for _, path := range possiblePaths {
-		fmt.Printf("Checking path: %s\n", path)
 		if _, err := os.Stat(path); err == nil {
 			// File exists, zeekctl found
-			fmt.Printf("Found zeekctl at: %s\n", path)
+			logger.Debug("Found zeekctl", "path", path)
 			return path, nil
 		}
 	}
@@ -31,7 +32,7 @@ func FindZeekctl() (string, error) {
 	// If not found, try to find it in the system PATH using LookPath
 	zeekctlPath, err := exec.LookPath("zeekctl")
 	if err == nil {
-		fmt.Printf("Found zeekctl in PATH: %s\n", zeekctlPath)
+		logger.Debug("Found zeekctl in PATH", "path", zeekctlPath)
 		return zeekctlPath, nil
 	}
 